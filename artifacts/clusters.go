@@ -0,0 +1,350 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// orchestratorCluster is one of the clusters of a ClustersOrchestrator.
+type orchestratorCluster struct {
+	name         string
+	orchestrator Orchestrator
+	// how often the workloads of the cluster are fetched
+	interval time.Duration
+	// translates the paths mounted in the cluster to those of the artifact manager
+	translatePath func(string) string
+	// the workloads last fetched, tagged with the name of the cluster
+	workloads []Workload
+	// set once the workloads have been fetched, or failed to be, for the first time
+	fetched bool
+	// the deployments last listed, tagged with the name of the cluster
+	deployments []Deployment
+	// when the deployments were last listed
+	listed time.Time
+}
+
+// ClustersOrchestrator is an Orchestrator for the workloads of several named
+// clusters, each of them run by its own Orchestrator, such as the Marathon
+// clusters whose agents mount the same NFS export.
+//
+// The workloads of the clusters are merged, their ids are tagged with the
+// name of their cluster as "<cluster>:<id>" and they are restarted by the
+// cluster they came from. Each cluster is queried on its own by Run, a
+// cluster that fails keeps the workloads last fetched from it and doesn't
+// hold back the others.
+type ClustersOrchestrator struct {
+	debug  *log.Logger
+	logger *core.Logger
+	// how long the deployments last listed from a cluster that fails are
+	// still reported
+	deploymentExpiry time.Duration
+	// returns the current time, replaced in tests
+	now   func() time.Time
+	mutex *sync.Mutex
+	// the clusters in the order they were added
+	clusters []*orchestratorCluster
+	byName   map[string]*orchestratorCluster
+}
+
+// NewClustersOrchestrator creates a ClustersOrchestrator without any clusters.
+//
+// The debug argument allows debug messages to be written to the provided logger.
+func NewClustersOrchestrator(debug *log.Logger) *ClustersOrchestrator {
+	return &ClustersOrchestrator{
+		debug:            debug,
+		logger:           core.DefaultLogger(),
+		deploymentExpiry: 10 * time.Minute,
+		now:              time.Now,
+		mutex:            &sync.Mutex{},
+		byName:           make(map[string]*orchestratorCluster),
+	}
+}
+
+// SetLogger sets the logger the problems the orchestrator works around are logged
+// with, core.DefaultLogger by default.
+func (c *ClustersOrchestrator) SetLogger(logger *core.Logger) {
+	c.logger = logger
+}
+
+// SetDeploymentExpiry sets how long the deployments last listed from a
+// cluster that fails to list them are still reported, after which its
+// restarts in progress are no longer waited for, by default 10 minutes.
+func (c *ClustersOrchestrator) SetDeploymentExpiry(expiry time.Duration) {
+	c.mutex.Lock()
+	c.deploymentExpiry = expiry
+	c.mutex.Unlock()
+}
+
+// AddCluster adds the cluster called name, whose workloads are run by
+// orchestrator and fetched every interval. The paths mounted by the workloads
+// are passed through translatePath, which may be nil to keep them as they are.
+//
+// Clusters have to be added before Run is called.
+func (c *ClustersOrchestrator) AddCluster(name string, orchestrator Orchestrator, interval time.Duration, translatePath func(string) string) error {
+	if name == "" || strings.Contains(name, ":") {
+		return fmt.Errorf("the name of a cluster can't be empty or contain a colon, got %q", name)
+	}
+	if translatePath == nil {
+		translatePath = func(path string) string { return path }
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if _, ok := c.byName[name]; ok {
+		return fmt.Errorf("cluster %s was already added", name)
+	}
+	cluster := &orchestratorCluster{
+		name:          name,
+		orchestrator:  orchestrator,
+		interval:      interval,
+		translatePath: translatePath,
+	}
+	c.clusters = append(c.clusters, cluster)
+	c.byName[name] = cluster
+	return nil
+}
+
+// Run fetches the workloads of every cluster at its interval until ctx is done.
+func (c *ClustersOrchestrator) Run(ctx context.Context) {
+	c.mutex.Lock()
+	clusters := append([]*orchestratorCluster{}, c.clusters...)
+	c.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, cluster := range clusters {
+		wg.Add(1)
+		go func(cluster *orchestratorCluster) {
+			defer wg.Done()
+			c.fetchWorkloads(ctx, cluster)
+		}(cluster)
+	}
+	wg.Wait()
+}
+
+// fetchWorkloads fetches the workloads of cluster right away and after each
+// of its intervals until ctx is done.
+func (c *ClustersOrchestrator) fetchWorkloads(ctx context.Context, cluster *orchestratorCluster) {
+	ticker := time.NewTicker(cluster.interval)
+	defer ticker.Stop()
+	for {
+		workloads, err := cluster.orchestrator.Workloads()
+		if err != nil {
+			c.logger.Warnf("problem fetching the workloads of cluster %s, keeping those last fetched: %v", cluster.name, err)
+		} else {
+			c.debug.Printf("Found %d workloads in cluster %s\n", len(workloads), cluster.name)
+		}
+
+		c.mutex.Lock()
+		if err == nil {
+			cluster.workloads = make([]Workload, 0, len(workloads))
+			for _, workload := range workloads {
+				cluster.workloads = append(cluster.workloads, c.tagWorkload(cluster, workload))
+			}
+		}
+		cluster.fetched = true
+		c.mutex.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tagWorkload returns workload with its id and dependencies tagged with the
+// name of cluster and its paths translated.
+func (c *ClustersOrchestrator) tagWorkload(cluster *orchestratorCluster, workload Workload) Workload {
+	tagged := Workload{
+		ID:           tagID(cluster.name, workload.ID),
+		Kind:         workload.Kind,
+		Paths:        make([]string, 0, len(workload.Paths)),
+		Dependencies: make([]string, 0, len(workload.Dependencies)),
+	}
+	for _, path := range workload.Paths {
+		tagged.Paths = append(tagged.Paths, cluster.translatePath(path))
+	}
+	for _, dependency := range workload.Dependencies {
+		tagged.Dependencies = append(tagged.Dependencies, tagID(cluster.name, dependency))
+	}
+	return tagged
+}
+
+// Workloads returns the workloads last fetched from every cluster.
+//
+// An error is returned until every cluster has been queried once, a cluster
+// that failed then is left out until it answers.
+func (c *ClustersOrchestrator) Workloads() ([]Workload, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	workloads := make([]Workload, 0)
+	for _, cluster := range c.clusters {
+		if !cluster.fetched {
+			return nil, fmt.Errorf("the workloads of cluster %s have not been fetched yet", cluster.name)
+		}
+		workloads = append(workloads, cluster.workloads...)
+	}
+	return workloads, nil
+}
+
+// Restart restarts the workload identified by id in the cluster it came from,
+// the id of the deployment returned is tagged with the name of the cluster.
+func (c *ClustersOrchestrator) Restart(id string) (string, error) {
+	cluster, workloadID, err := c.cluster(id)
+	if err != nil {
+		return "", err
+	}
+	deploymentID, err := cluster.orchestrator.Restart(workloadID)
+	if err != nil {
+		return "", fmt.Errorf("cluster %s: %v", cluster.name, err)
+	}
+	if deploymentID == "" {
+		return "", nil
+	}
+	return tagID(cluster.name, deploymentID), nil
+}
+
+// Deployments returns the deployments in progress in every cluster that can
+// report them. The clusters are queried at the same time, if one of them
+// fails its deployments last listed are used, so its restarts in progress
+// are still waited for, until they are older than the deployment expiry and
+// a cluster that stays down stops holding back the restarts of the others.
+func (c *ClustersOrchestrator) Deployments() ([]Deployment, error) {
+	c.mutex.Lock()
+	clusters := append([]*orchestratorCluster{}, c.clusters...)
+	c.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, cluster := range clusters {
+		tracker, ok := cluster.orchestrator.(DeploymentTracker)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(cluster *orchestratorCluster, tracker DeploymentTracker) {
+			defer wg.Done()
+			deployments, err := tracker.Deployments()
+			if err != nil {
+				c.mutex.Lock()
+				defer c.mutex.Unlock()
+				if age := c.now().Sub(cluster.listed); len(cluster.deployments) > 0 && age >= c.deploymentExpiry {
+					c.logger.Warnf("problem listing the deployments of cluster %s, the %d last listed %s ago have expired: %v", cluster.name, len(cluster.deployments), age, err)
+					cluster.deployments = nil
+					return
+				}
+				c.logger.Warnf("problem listing the deployments of cluster %s, using those last listed: %v", cluster.name, err)
+				return
+			}
+			tagged := make([]Deployment, 0, len(deployments))
+			for _, deployment := range deployments {
+				workloads := make([]string, 0, len(deployment.Workloads))
+				for _, workloadID := range deployment.Workloads {
+					workloads = append(workloads, tagID(cluster.name, workloadID))
+				}
+				tagged = append(tagged, Deployment{ID: tagID(cluster.name, deployment.ID), Workloads: workloads})
+			}
+			c.mutex.Lock()
+			cluster.deployments = tagged
+			cluster.listed = c.now()
+			c.mutex.Unlock()
+		}(cluster, tracker)
+	}
+	wg.Wait()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	deployments := make([]Deployment, 0)
+	for _, cluster := range clusters {
+		deployments = append(deployments, cluster.deployments...)
+	}
+	return deployments, nil
+}
+
+// Healthy returns whether the workload identified by id is healthy according
+// to its cluster, a workload of a cluster that can't report its health is
+// considered healthy.
+func (c *ClustersOrchestrator) Healthy(id string) (bool, error) {
+	cluster, workloadID, err := c.cluster(id)
+	if err != nil {
+		return false, err
+	}
+	checker, ok := cluster.orchestrator.(HealthChecker)
+	if !ok {
+		return true, nil
+	}
+	return checker.Healthy(workloadID)
+}
+
+// Ping checks which of the clusters that can be pinged are reachable, it
+// returns the description of each cluster, or the error of those that aren't.
+// As a cluster that is down doesn't hold back the others, an error is only
+// returned if none of them are reachable.
+func (c *ClustersOrchestrator) Ping() (string, error) {
+	c.mutex.Lock()
+	clusters := append([]*orchestratorCluster{}, c.clusters...)
+	c.mutex.Unlock()
+
+	results := make([]string, len(clusters))
+	errs := make([]string, len(clusters))
+	var wg sync.WaitGroup
+	for i, cluster := range clusters {
+		pinger, ok := cluster.orchestrator.(Pinger)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, cluster *orchestratorCluster, pinger Pinger) {
+			defer wg.Done()
+			result, err := pinger.Ping()
+			if err != nil {
+				errs[i] = fmt.Sprintf("%s: %v", cluster.name, err)
+				results[i] = fmt.Sprintf("%s: unreachable, %v", cluster.name, err)
+				return
+			}
+			results[i] = fmt.Sprintf("%s: %s", cluster.name, result)
+		}(i, cluster, pinger)
+	}
+	wg.Wait()
+
+	if failed := nonEmpty(errs); len(failed) > 0 && len(failed) == len(nonEmpty(results)) {
+		return "", fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+	return strings.Join(nonEmpty(results), "; "), nil
+}
+
+// nonEmpty returns the values that aren't empty.
+func nonEmpty(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// cluster returns the cluster a tagged id belongs to, along with the id
+// within that cluster.
+func (c *ClustersOrchestrator) cluster(id string) (*orchestratorCluster, string, error) {
+	parts := strings.SplitN(id, ":", 2)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("%s is not tagged with a cluster", id)
+	}
+	c.mutex.Lock()
+	cluster, ok := c.byName[parts[0]]
+	c.mutex.Unlock()
+	if !ok {
+		return nil, "", fmt.Errorf("%s belongs to an unknown cluster %s", id, parts[0])
+	}
+	return cluster, parts[1], nil
+}
+
+// tagID tags id with the name of its cluster.
+func tagID(name, id string) string {
+	return name + ":" + id
+}
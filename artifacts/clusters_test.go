@@ -0,0 +1,217 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// brokenOrchestrator is an Orchestrator whose cluster can't be reached.
+type brokenOrchestrator struct{}
+
+func (brokenOrchestrator) Workloads() ([]Workload, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+func (brokenOrchestrator) Restart(id string) (string, error) {
+	return "", fmt.Errorf("connection refused")
+}
+
+func (brokenOrchestrator) Deployments() ([]Deployment, error) {
+	return nil, fmt.Errorf("connection refused")
+}
+
+func (brokenOrchestrator) Ping() (string, error) {
+	return "", fmt.Errorf("connection refused")
+}
+
+// trackingOrchestrator is a fakeOrchestrator that reports a deployment for
+// every restart.
+type trackingOrchestrator struct {
+	*fakeOrchestrator
+	deployments []Deployment
+}
+
+func (t *trackingOrchestrator) Restart(id string) (string, error) {
+	if _, err := t.fakeOrchestrator.Restart(id); err != nil {
+		return "", err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	deploymentID := fmt.Sprintf("d%d", len(t.deployments)+1)
+	t.deployments = append(t.deployments, Deployment{ID: deploymentID, Workloads: []string{id}})
+	return deploymentID, nil
+}
+
+func (t *trackingOrchestrator) Deployments() ([]Deployment, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]Deployment{}, t.deployments...), nil
+}
+
+// flakyOrchestrator is a trackingOrchestrator whose cluster can go down.
+type flakyOrchestrator struct {
+	*trackingOrchestrator
+	down bool
+}
+
+func (f *flakyOrchestrator) Deployments() ([]Deployment, error) {
+	f.mutex.Lock()
+	down := f.down
+	f.mutex.Unlock()
+	if down {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return f.trackingOrchestrator.Deployments()
+}
+
+// runClusters runs clusters until the returned function is called, once the
+// workloads of every cluster have been fetched.
+func runClusters(t *testing.T, clusters *ClustersOrchestrator) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		clusters.Run(ctx)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := clusters.Workloads(); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for the workloads of the clusters")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// TestClustersOrchestrator_Workloads tests that the workloads of the clusters
+// are merged and tagged with their cluster, with their paths translated, and
+// that a cluster that can't be reached doesn't hold back the others.
+func TestClustersOrchestrator_Workloads(t *testing.T) {
+	east := newFakeOrchestrator(
+		Workload{ID: "/web", Kind: "app", Paths: []string{"/data/a-latest"}, Dependencies: []string{"/api"}},
+		Workload{ID: "/api", Kind: "app", Paths: []string{"/data/a-latest"}},
+	)
+	west := newFakeOrchestrator(
+		Workload{ID: "/web", Kind: "pod", Paths: []string{"/mnt/artifacts/a-latest", "/etc/hosts"}},
+	)
+	clusters := NewClustersOrchestrator(log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	clusters.AddCluster("east", east, time.Hour, nil)
+	clusters.AddCluster("west", west, time.Hour, func(path string) string {
+		return strings.Replace(path, "/mnt/artifacts/", "/data/", 1)
+	})
+	clusters.AddCluster("north", brokenOrchestrator{}, time.Hour, nil)
+	if err := clusters.AddCluster("east", east, time.Hour, nil); err == nil {
+		t.Errorf("expected an error adding the east cluster twice")
+	}
+	stop := runClusters(t, clusters)
+	defer stop()
+
+	svc := newFakeService(t, clusters)
+	byKind := svc.GetAppIdsByKind("/data/a-latest")
+	expected := map[string][]string{"app": {"east:/web", "east:/api"}, "pod": {"west:/web"}}
+	if !reflect.DeepEqual(byKind, expected) {
+		t.Errorf("expected %v to depend on /data/a-latest, got %v", expected, byKind)
+	}
+
+	waves, err := svc.dependencies.Waves([]string{"east:/web", "east:/api", "west:/web"})
+	if err != nil || len(waves) != 2 || !reflect.DeepEqual(waves[0], []string{"east:/api", "west:/web"}) {
+		t.Errorf("expected the dependencies to be tagged, got %v, %v", waves, err)
+	}
+}
+
+// TestClustersOrchestrator_Restart tests that restarts are sent to the cluster
+// of the workload and that the deployments of the clusters are tagged.
+func TestClustersOrchestrator_Restart(t *testing.T) {
+	east := &trackingOrchestrator{fakeOrchestrator: newFakeOrchestrator(Workload{ID: "/web"})}
+	west := newFakeOrchestrator(Workload{ID: "/web"})
+	clusters := NewClustersOrchestrator(log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	clusters.AddCluster("east", east, time.Hour, nil)
+	clusters.AddCluster("west", west, time.Hour, nil)
+	clusters.AddCluster("north", brokenOrchestrator{}, time.Hour, nil)
+	stop := runClusters(t, clusters)
+	defer stop()
+
+	deploymentID, err := clusters.Restart("east:/web")
+	if err != nil || deploymentID != "east:d1" {
+		t.Errorf("expected deployment east:d1, got %s, %v", deploymentID, err)
+	}
+	if _, err = clusters.Restart("west:/web"); err != nil {
+		t.Errorf("failed to restart west:/web: %v", err)
+	}
+	if restarts := east.restarted(); !reflect.DeepEqual(restarts, []string{"/web"}) {
+		t.Errorf("expected /web to be restarted once in east, got %v", restarts)
+	}
+	if restarts := west.restarted(); !reflect.DeepEqual(restarts, []string{"/web"}) {
+		t.Errorf("expected /web to be restarted once in west, got %v", restarts)
+	}
+	if _, err = clusters.Restart("south:/web"); err == nil {
+		t.Errorf("expected an error restarting a workload of an unknown cluster")
+	}
+	if _, err = clusters.Restart("north:/web"); err == nil || !strings.Contains(err.Error(), "north") {
+		t.Errorf("expected the error of the north cluster, got %v", err)
+	}
+
+	deployments, err := clusters.Deployments()
+	expected := []Deployment{{ID: "east:d1", Workloads: []string{"east:/web"}}}
+	if err != nil || !reflect.DeepEqual(deployments, expected) {
+		t.Errorf("expected deployments %+v, got %+v, %v", expected, deployments, err)
+	}
+
+	healthy, err := clusters.Healthy("west:/web")
+	if err != nil || !healthy {
+		t.Errorf("expected a workload without health checks to be healthy, got %v, %v", healthy, err)
+	}
+}
+
+// TestClustersOrchestrator_StaleDeployments tests that a cluster that stays
+// down with a restart in progress only holds back the restarts of the other
+// clusters until its deployments last listed expire.
+func TestClustersOrchestrator_StaleDeployments(t *testing.T) {
+	north := &flakyOrchestrator{trackingOrchestrator: &trackingOrchestrator{fakeOrchestrator: newFakeOrchestrator(Workload{ID: "/web"})}}
+	south := &trackingOrchestrator{fakeOrchestrator: newFakeOrchestrator(Workload{ID: "/web"})}
+	debug := log.New(ioutil.Discard, log.Prefix(), log.Flags())
+	clusters := NewClustersOrchestrator(debug)
+	clusters.AddCluster("north", north, time.Hour, nil)
+	clusters.AddCluster("south", south, time.Hour, nil)
+	clusters.SetDeploymentExpiry(5 * time.Minute)
+
+	now := time.Now()
+	clusters.now = func() time.Time { return now }
+	rs := newRestartScheduler(clusters, debug)
+	rs.now = clusters.now
+	rs.setLimits(RestartLimits{MaxInFlight: 1})
+
+	rs.schedule([][]string{{"north:/web", "south:/web"}}, false)
+	rs.dispatch()
+	// the deployment of the restart is listed before north goes down
+	rs.dispatch()
+	north.mutex.Lock()
+	north.down = true
+	north.mutex.Unlock()
+
+	now = now.Add(time.Minute)
+	rs.dispatch()
+	if restarts := south.restarted(); len(restarts) != 0 {
+		t.Fatalf("expected south to wait for the restart in progress in north, got %v", restarts)
+	}
+
+	now = now.Add(5 * time.Minute)
+	rs.dispatch()
+	if restarts := south.restarted(); !reflect.DeepEqual(restarts, []string{"/web"}) {
+		t.Errorf("expected south to keep restarting once the deployments of north expired, got %v", restarts)
+	}
+}
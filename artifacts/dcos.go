@@ -0,0 +1,200 @@
+package artifacts
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dcosServiceAccount holds the fields used of the credentials of a DC/OS
+// service account, as stored in a secret by the DC/OS CLI.
+type dcosServiceAccount struct {
+	UID           string `json:"uid"`
+	PrivateKey    string `json:"private_key"`
+	LoginEndpoint string `json:"login_endpoint"`
+}
+
+// dcosTokenSource logs in to DC/OS as a service account and returns the
+// authentication token, which is refreshed before it expires or once it is
+// refused.
+type dcosTokenSource struct {
+	httpClient *http.Client
+	uid        string
+	privateKey *rsa.PrivateKey
+	// the url of the DC/OS login endpoint, such as "https://master.mesos/acs/api/v1/auth/login"
+	loginURL string
+	// how long before it expires a token is refreshed
+	refreshBefore time.Duration
+	// returns the current time, replaced in tests
+	now func() time.Time
+
+	mutex   *sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// newDCOSTokenSource creates a dcosTokenSource for the service account whose
+// credentials are in credentialsFile, logging in with httpClient. If the
+// credentials have no login endpoint, defaultLoginURL is used.
+func newDCOSTokenSource(credentialsFile, defaultLoginURL string, httpClient *http.Client) (*dcosTokenSource, error) {
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read dc/os credentials: %v", err)
+	}
+	var account dcosServiceAccount
+	if err = json.Unmarshal(data, &account); err != nil {
+		return nil, fmt.Errorf("unable to parse dc/os credentials in %s: %v", credentialsFile, err)
+	}
+	if account.UID == "" {
+		return nil, fmt.Errorf("no uid in the dc/os credentials in %s", credentialsFile)
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("no private key in the dc/os credentials in %s", credentialsFile)
+	}
+	var privateKey *rsa.PrivateKey
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("the private key in %s is not an rsa key", credentialsFile)
+		}
+		privateKey = rsaKey
+	} else {
+		privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the private key in %s: %v", credentialsFile, err)
+		}
+	}
+
+	loginURL := account.LoginEndpoint
+	if loginURL == "" {
+		loginURL = defaultLoginURL
+	}
+	return &dcosTokenSource{
+		httpClient:    httpClient,
+		uid:           account.UID,
+		privateKey:    privateKey,
+		loginURL:      loginURL,
+		refreshBefore: 5 * time.Minute,
+		now:           time.Now,
+		mutex:         &sync.Mutex{},
+	}, nil
+}
+
+// currentToken returns the token, logging in first if there is none or it
+// is about to expire.
+func (s *dcosTokenSource) currentToken() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token != "" && s.now().Add(s.refreshBefore).Before(s.expires) {
+		return s.token, nil
+	}
+	token, expires, err := s.login()
+	if err != nil {
+		return "", err
+	}
+	s.token, s.expires = token, expires
+	return token, nil
+}
+
+// refused forgets token once it was refused, so the next call to
+// currentToken logs in again.
+func (s *dcosTokenSource) refused(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.token == token {
+		s.token = ""
+	}
+}
+
+// login logs in with a login token signed by the private key of the service
+// account and returns the authentication token along with when it expires.
+func (s *dcosTokenSource) login() (string, time.Time, error) {
+	now := s.now()
+	loginToken, err := signJWT(s.privateKey, map[string]interface{}{
+		"uid": s.uid,
+		"exp": now.Add(5 * time.Minute).Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	body, err := json.Marshal(map[string]string{"uid": s.uid, "token": loginToken})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	res, err := s.httpClient.Post(s.loginURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("unable to log in to dc/os as %s: %v", s.uid, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return "", time.Time{}, fmt.Errorf("unable to log in to dc/os as %s, %s returned %d: %s", s.uid, s.loginURL, res.StatusCode, strings.TrimSpace(string(message)))
+	}
+	var login struct {
+		Token string `json:"token"`
+	}
+	if err = json.NewDecoder(res.Body).Decode(&login); err != nil || login.Token == "" {
+		return "", time.Time{}, fmt.Errorf("unable to read the dc/os authentication token: %v", err)
+	}
+
+	// the token is a JWT whose expiry can be read without verifying it, a
+	// token that can't be read is refreshed once it is refused
+	expires := now.Add(24 * time.Hour)
+	if exp, ok := jwtExpiry(login.Token); ok {
+		expires = exp
+	}
+	return login.Token, expires, nil
+}
+
+// signJWT returns a JWT with claims signed by key using RS256.
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("unable to sign the dc/os login token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// jwtExpiry returns the exp claim of token, without verifying its signature.
+func jwtExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
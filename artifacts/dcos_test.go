@@ -0,0 +1,197 @@
+package artifacts
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	gohttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// fakeDCOS is a "mock" DC/OS master serving Marathon behind its login
+// endpoint, which only accepts login tokens signed by the key of the service
+// account.
+type fakeDCOS struct {
+	t         *testing.T
+	publicKey *rsa.PublicKey
+	mutex     *sync.Mutex
+	// the number of times the service account logged in
+	logins int
+	// the authentication token currently accepted
+	token string
+}
+
+func (d *fakeDCOS) ServeHTTP(w gohttp.ResponseWriter, r *gohttp.Request) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/acs/api/v1/auth/login" {
+		var login struct {
+			UID   string `json:"uid"`
+			Token string `json:"token"`
+		}
+		json.NewDecoder(r.Body).Decode(&login)
+		parts := strings.Split(login.Token, ".")
+		if len(parts) != 3 || login.UID != "artifact-manager" {
+			w.WriteHeader(gohttp.StatusUnauthorized)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(d.publicKey, crypto.SHA256, digest[:], signature); err != nil {
+			d.t.Errorf("the login token isn't signed by the service account: %v", err)
+			w.WriteHeader(gohttp.StatusUnauthorized)
+			return
+		}
+		d.logins++
+		claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"uid": "artifact-manager", "exp": %d}`, time.Now().Add(time.Hour).Unix())))
+		d.token = fmt.Sprintf("header.%s.%d", claims, d.logins)
+		fmt.Fprintf(w, `{"token": "%s"}`, d.token)
+		return
+	}
+
+	if d.token == "" || r.Header.Get("Authorization") != "token="+d.token {
+		w.WriteHeader(gohttp.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/service/marathon/v2/groups":
+		fmt.Fprint(w, `{"id": "/"}`)
+	case "/service/marathon/v2/pods":
+		fmt.Fprint(w, `[]`)
+	default:
+		fmt.Fprint(w, sharedVolumesApps)
+	}
+}
+
+// revoke makes the token currently accepted invalid.
+func (d *fakeDCOS) revoke() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.token = "revoked"
+}
+
+func (d *fakeDCOS) loginCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.logins
+}
+
+// TestNewMarathonClusterOrchestrator_DCOS tests that a DC/OS service account
+// logs in once, with a login token signed by its key, and logs in again
+// once its token is refused.
+func TestNewMarathonClusterOrchestrator_DCOS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcos")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate a key: %v", err)
+	}
+	dcos := &fakeDCOS{t: t, publicKey: &key.PublicKey, mutex: &sync.Mutex{}}
+	s := httptest.NewTLSServer(dcos)
+	defer s.Close()
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("unable to parse mock server url %s: %v", s.URL, err)
+	}
+
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal the key: %v", err)
+	}
+	credentials, err := json.Marshal(map[string]string{
+		"uid":         "artifact-manager",
+		"private_key": string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data})),
+	})
+	if err != nil {
+		t.Fatalf("unable to marshal the credentials: %v", err)
+	}
+	credentialsFile := path.Join(dir, "credentials.json")
+	if err = ioutil.WriteFile(credentialsFile, credentials, 0600); err != nil {
+		t.Fatalf("unable to write %s: %v", credentialsFile, err)
+	}
+	caFile, _ := writeCertificate(t, dir, "ca", s.Certificate().Raw, nil)
+
+	cluster := core.MarathonCluster{
+		Hosts:               u.Host + "/service/marathon",
+		Scheme:              "https",
+		CAFile:              caFile,
+		DCOSCredentialsFile: credentialsFile,
+	}
+	m, err := NewMarathonClusterOrchestrator(cluster, nil, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	if err != nil {
+		t.Fatalf("unable to create the orchestrator: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if workloads, err := m.Workloads(); err != nil || len(workloads) != 2 {
+			t.Fatalf("expected 2 applications, got %+v, %v", workloads, err)
+		}
+	}
+	if logins := dcos.loginCount(); logins != 1 {
+		t.Errorf("expected the token to be reused, logged in %d times", logins)
+	}
+
+	dcos.revoke()
+	if workloads, err := m.Workloads(); err != nil || len(workloads) != 2 {
+		t.Fatalf("expected 2 applications once logged in again, got %+v, %v", workloads, err)
+	}
+	if logins := dcos.loginCount(); logins != 2 {
+		t.Errorf("expected to log in again once the token was refused, logged in %d times", logins)
+	}
+}
+
+// TestDCOSTokenSource_Expiry tests that a token is refreshed before it expires.
+func TestDCOSTokenSource_Expiry(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate a key: %v", err)
+	}
+	dcos := &fakeDCOS{t: t, publicKey: &key.PublicKey, mutex: &sync.Mutex{}}
+	s := httptest.NewServer(dcos)
+	defer s.Close()
+
+	now := time.Now()
+	source := &dcosTokenSource{
+		httpClient:    s.Client(),
+		uid:           "artifact-manager",
+		privateKey:    key,
+		loginURL:      s.URL + "/acs/api/v1/auth/login",
+		refreshBefore: 5 * time.Minute,
+		now:           func() time.Time { return now },
+		mutex:         &sync.Mutex{},
+	}
+	if _, err = source.currentToken(); err != nil {
+		t.Fatalf("failed to log in: %v", err)
+	}
+	if _, err = source.currentToken(); err != nil || dcos.loginCount() != 1 {
+		t.Errorf("expected the token to be reused, logged in %d times: %v", dcos.loginCount(), err)
+	}
+
+	// the tokens expire after an hour
+	now = now.Add(56 * time.Minute)
+	if _, err = source.currentToken(); err != nil || dcos.loginCount() != 2 {
+		t.Errorf("expected the token to be refreshed, logged in %d times: %v", dcos.loginCount(), err)
+	}
+}
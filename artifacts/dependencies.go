@@ -0,0 +1,244 @@
+package artifacts
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	marathon "github.com/gambol99/go-marathon"
+)
+
+// Dependencies keeps a mapping of Marathon application ID's to the
+// ID's of the applications they depend on.
+//
+// A dependency on a group is stored as a dependency on each application
+// within that group.
+type Dependencies map[string][]string
+
+// CycleError is returned when applications depend on each other in a cycle.
+type CycleError struct {
+	// the application ids making up the cycle, the first id is repeated at the end
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("dependency cycle between applications: %s", strings.Join(e.Cycle, " -> "))
+}
+
+// NewDependencies builds the Dependencies of every application found
+// within the given root group and its sub groups.
+func NewDependencies(root *marathon.Groups) Dependencies {
+	group := &marathon.Group{
+		ID:           root.ID,
+		Apps:         root.Apps,
+		Dependencies: root.Dependencies,
+		Groups:       root.Groups,
+	}
+	if group.ID == "" {
+		group.ID = "/"
+	}
+
+	// a dependency may be on a group, so the applications in each group
+	// have to be known before the dependencies can be resolved
+	groupApps := make(map[string][]string)
+	collectGroupApps(group, groupApps)
+
+	d := Dependencies{}
+	d.addGroup(group, nil, groupApps)
+	return d
+}
+
+// collectGroupApps stores the ids of the applications within group, including
+// those of its sub groups, keyed by the group id.
+func collectGroupApps(group *marathon.Group, groupApps map[string][]string) []string {
+	appIds := make([]string, 0)
+	for _, application := range group.Apps {
+		appIds = append(appIds, application.ID)
+	}
+	for _, subGroup := range group.Groups {
+		appIds = append(appIds, collectGroupApps(subGroup, groupApps)...)
+	}
+	groupApps[group.ID] = appIds
+	return appIds
+}
+
+// addGroup adds the dependencies of each application within group, inherited
+// holds the dependencies of the groups containing group.
+func (d Dependencies) addGroup(group *marathon.Group, inherited []string, groupApps map[string][]string) {
+	// dependencies of a group are relative to the group containing it
+	deps := append([]string{}, inherited...)
+	for _, dep := range group.Dependencies {
+		deps = append(deps, resolveDependency(path.Dir(group.ID), dep, groupApps)...)
+	}
+
+	for _, application := range group.Apps {
+		d.add(application.ID, deps...)
+		for _, dep := range application.Dependencies {
+			d.add(application.ID, resolveDependency(group.ID, dep, groupApps)...)
+		}
+	}
+	for _, subGroup := range group.Groups {
+		d.addGroup(subGroup, deps, groupApps)
+	}
+}
+
+// resolveDependency returns the application ids identified by dep, which is
+// either an application or group id that may be relative to parent.
+func resolveDependency(parent, dep string, groupApps map[string][]string) []string {
+	id := dep
+	if !path.IsAbs(id) {
+		id = path.Join(parent, id)
+	}
+	id = path.Clean(id)
+	if appIds, ok := groupApps[id]; ok {
+		return appIds
+	}
+	return []string{id}
+}
+
+// add stores the dependencies of appID, ignoring a dependency on itself.
+func (d Dependencies) add(appID string, deps ...string) {
+	if _, ok := d[appID]; !ok {
+		d[appID] = make([]string, 0)
+	}
+	for _, dep := range deps {
+		if dep == appID || contains(d[appID], dep) {
+			continue
+		}
+		d[appID] = append(d[appID], dep)
+	}
+}
+
+// Get returns the ids of the applications that the application identified
+// by appID directly depends on.
+func (d Dependencies) Get(appID string) []string {
+	deps, ok := d[appID]
+	if !ok {
+		return make([]string, 0)
+	}
+	return deps
+}
+
+// Waves orders the given application ids into waves, each application only
+// depends on applications of earlier waves.
+//
+// An application depending on another through applications that are not
+// given is still placed after it. If the applications depend on each other
+// in a cycle, a *CycleError is returned along with the waves, the
+// applications that could not be ordered are placed in the last wave.
+func (d Dependencies) Waves(appIds []string) ([][]string, error) {
+	// the dependencies between the given applications, following the
+	// dependencies of applications that were not given
+	wanted := make(map[string]bool)
+	for _, appID := range appIds {
+		wanted[appID] = true
+	}
+	deps := make(map[string][]string)
+	for _, appID := range appIds {
+		deps[appID] = d.reachable(appID, wanted)
+	}
+
+	waves := make([][]string, 0)
+	done := make(map[string]bool)
+	remaining := unique(appIds)
+	for len(remaining) > 0 {
+		wave := make([]string, 0)
+		blocked := make([]string, 0)
+		for _, appID := range remaining {
+			ready := true
+			for _, dep := range deps[appID] {
+				if !done[dep] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				wave = append(wave, appID)
+			} else {
+				blocked = append(blocked, appID)
+			}
+		}
+		if len(wave) == 0 {
+			waves = append(waves, blocked)
+			return waves, &CycleError{Cycle: findCycle(blocked, deps)}
+		}
+		for _, appID := range wave {
+			done[appID] = true
+		}
+		waves = append(waves, wave)
+		remaining = blocked
+	}
+	return waves, nil
+}
+
+// reachable returns the wanted applications that appID depends on directly,
+// or through applications that are not wanted.
+func (d Dependencies) reachable(appID string, wanted map[string]bool) []string {
+	result := make([]string, 0)
+	visited := map[string]bool{appID: true}
+	stack := append([]string{}, d.Get(appID)...)
+	for len(stack) > 0 {
+		dep := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if wanted[dep] {
+			if !contains(result, dep) {
+				result = append(result, dep)
+			}
+			continue
+		}
+		if visited[dep] {
+			continue
+		}
+		visited[dep] = true
+		stack = append(stack, d.Get(dep)...)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// findCycle returns a cycle amongst the given applications, each of which is
+// known to depend on at least one of the others.
+func findCycle(appIds []string, deps map[string][]string) []string {
+	blocked := make(map[string]bool)
+	for _, appID := range appIds {
+		blocked[appID] = true
+	}
+
+	// walk the dependencies until an application is seen twice
+	position := make(map[string]int)
+	walk := make([]string, 0)
+	current := appIds[0]
+	for {
+		if i, ok := position[current]; ok {
+			return append(walk[i:], current)
+		}
+		position[current] = len(walk)
+		walk = append(walk, current)
+		for _, dep := range deps[current] {
+			if blocked[dep] {
+				current = dep
+				break
+			}
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, val := range values {
+		if val == value {
+			return true
+		}
+	}
+	return false
+}
+
+func unique(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, val := range values {
+		if !contains(result, val) {
+			result = append(result, val)
+		}
+	}
+	return result
+}
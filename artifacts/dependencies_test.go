@@ -0,0 +1,118 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	marathon "github.com/gambol99/go-marathon"
+)
+
+// dependentGroups is a Marathon group tree where "/web" depends on the "/backend"
+// group, "/backend/api" depends on "/backend/db" using a relative id and
+// "/backend/db" depends on "/storage/cache" through the "/backend" group.
+const dependentGroups = `{
+	"id": "/",
+	"apps": [
+		{"id": "/web", "dependencies": ["/backend"]},
+		{"id": "/standalone", "dependencies": []}
+	],
+	"groups": [
+		{
+			"id": "/backend",
+			"dependencies": ["/storage"],
+			"apps": [
+				{"id": "/backend/api", "dependencies": ["db"]},
+				{"id": "/backend/db", "dependencies": []}
+			],
+			"groups": []
+		},
+		{
+			"id": "/storage",
+			"dependencies": [],
+			"apps": [{"id": "/storage/cache", "dependencies": []}],
+			"groups": []
+		}
+	]
+}`
+
+func loadGroups(t *testing.T, data string) *marathon.Groups {
+	groups := new(marathon.Groups)
+	if err := json.Unmarshal([]byte(data), groups); err != nil {
+		t.Fatalf("unable to parse groups: %v", err)
+	}
+	return groups
+}
+
+func TestNewDependencies(t *testing.T) {
+	d := NewDependencies(loadGroups(t, dependentGroups))
+
+	expected := map[string][]string{
+		"/web":           {"/backend/api", "/backend/db"},
+		"/standalone":    {},
+		"/backend/api":   {"/storage/cache", "/backend/db"},
+		"/backend/db":    {"/storage/cache"},
+		"/storage/cache": {},
+	}
+	for appID, deps := range expected {
+		if got := d.Get(appID); !reflect.DeepEqual(got, deps) {
+			t.Errorf("expected %s to depend on %v, got %v", appID, deps, got)
+		}
+	}
+}
+
+func TestDependencies_Waves(t *testing.T) {
+	d := NewDependencies(loadGroups(t, dependentGroups))
+
+	waves, err := d.Waves([]string{"/web", "/backend/api", "/backend/db", "/storage/cache", "/standalone"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := [][]string{
+		{"/storage/cache", "/standalone"},
+		{"/backend/db"},
+		{"/backend/api"},
+		{"/web"},
+	}
+	if !reflect.DeepEqual(waves, expected) {
+		t.Errorf("expected waves %v, got %v", expected, waves)
+	}
+}
+
+// TestDependencies_WavesThroughOtherApps tests that applications are ordered
+// by dependencies on applications that are not being restarted.
+func TestDependencies_WavesThroughOtherApps(t *testing.T) {
+	d := NewDependencies(loadGroups(t, dependentGroups))
+
+	waves, err := d.Waves([]string{"/web", "/storage/cache"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := [][]string{{"/storage/cache"}, {"/web"}}
+	if !reflect.DeepEqual(waves, expected) {
+		t.Errorf("expected waves %v, got %v", expected, waves)
+	}
+}
+
+func TestDependencies_WavesWithCycle(t *testing.T) {
+	d := Dependencies{
+		"/a": {"/b"},
+		"/b": {"/c"},
+		"/c": {"/a"},
+		"/d": {},
+	}
+
+	waves, err := d.Waves([]string{"/a", "/b", "/c", "/d"})
+	cycleErr, ok := err.(*CycleError)
+	if !ok {
+		t.Fatalf("expected a *CycleError, got %v", err)
+	}
+	if len(cycleErr.Cycle) != 4 || cycleErr.Cycle[0] != cycleErr.Cycle[3] {
+		t.Errorf("expected a cycle of 3 applications, got %v", cycleErr.Cycle)
+	}
+
+	expected := [][]string{{"/d"}, {"/a", "/b", "/c"}}
+	if !reflect.DeepEqual(waves, expected) {
+		t.Errorf("expected waves %v, got %v", expected, waves)
+	}
+}
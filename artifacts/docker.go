@@ -0,0 +1,186 @@
+package artifacts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// dockerContainer holds the fields used of a container listed by /containers/json.
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	Labels map[string]string `json:"Labels"`
+	Mounts []struct {
+		Type   string `json:"Type"`
+		Source string `json:"Source"`
+	} `json:"Mounts"`
+}
+
+// name returns the name of the container without its leading slash, or its
+// id if it has no name.
+func (c *dockerContainer) name() string {
+	if len(c.Names) == 0 {
+		return c.ID
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+// DockerOrchestrator is an Orchestrator for the containers run by the local
+// Docker Engine, which is reached through its unix socket.
+//
+// The workloads are the running containers, identified by their name, and
+// their paths are the sources of their bind mounts. If a label is set, only
+// the containers that have the label set to "true" are workloads.
+type DockerOrchestrator struct {
+	httpClient *http.Client
+	debug      *log.Logger
+	// the label a container has to have set to "true" to be restarted, may be empty
+	label string
+	// the seconds a container is given to stop before it is killed when restarting it
+	stopTimeout int
+}
+
+// NewDockerOrchestrator creates a DockerOrchestrator using the Docker Engine
+// API listening on the unix socket at socketPath, such as "/var/run/docker.sock".
+//
+// The debug argument allows debug messages to be written to the provided logger.
+func NewDockerOrchestrator(socketPath string, debug *log.Logger) *DockerOrchestrator {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	return &DockerOrchestrator{
+		httpClient: &http.Client{
+			// a restart waits for the container to stop
+			Timeout: time.Minute,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+		debug:       debug,
+		stopTimeout: 10,
+	}
+}
+
+// SetLabel limits the workloads to the containers that have label set to "true",
+// an empty label includes every container.
+func (d *DockerOrchestrator) SetLabel(label string) {
+	d.label = label
+}
+
+// Workloads returns the running containers along with the sources of their
+// bind mounts.
+func (d *DockerOrchestrator) Workloads() ([]Workload, error) {
+	query := url.Values{}
+	if d.label != "" {
+		filters, err := json.Marshal(map[string][]string{"label": {d.label + "=true"}})
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", string(filters))
+	}
+	var containers []dockerContainer
+	err := d.get("/containers/json", query, &containers)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+
+	d.debug.Printf("Found %d containers running\n", len(containers))
+	workloads := make([]Workload, 0, len(containers))
+	for _, container := range containers {
+		// the filter is checked again in case it was ignored
+		if d.label != "" && container.Labels[d.label] != "true" {
+			continue
+		}
+		workload := Workload{ID: container.name(), Kind: "container", Paths: make([]string, 0)}
+		for _, mount := range container.Mounts {
+			if mount.Type == "bind" && mount.Source != "" {
+				d.debug.Printf("Adding %s path for %s\n", mount.Source, workload.ID)
+				workload.Paths = append(workload.Paths, mount.Source)
+			}
+		}
+		workloads = append(workloads, workload)
+	}
+	return workloads, nil
+}
+
+// Restart restarts the container named id.
+func (d *DockerOrchestrator) Restart(id string) (string, error) {
+	query := url.Values{}
+	query.Set("t", fmt.Sprintf("%d", d.stopTimeout))
+	res, err := d.do(http.MethodPost, "/containers/"+url.PathEscape(id)+"/restart", query)
+	if err != nil {
+		return "", fmt.Errorf("failed to restart %s: %v", id, err)
+	}
+	res.Body.Close()
+	return "", nil
+}
+
+// Healthy returns true if the container named id is running and, if it has
+// a health check, the check passes.
+func (d *DockerOrchestrator) Healthy(id string) (bool, error) {
+	var container struct {
+		State struct {
+			Running bool `json:"Running"`
+			Health  *struct {
+				Status string `json:"Status"`
+			} `json:"Health"`
+		} `json:"State"`
+	}
+	err := d.get("/containers/"+url.PathEscape(id)+"/json", nil, &container)
+	if err != nil {
+		return false, err
+	}
+	if container.State.Health != nil {
+		return container.State.Running && container.State.Health.Status == "healthy", nil
+	}
+	return container.State.Running, nil
+}
+
+// get reads apiPath and decodes the JSON response into v.
+func (d *DockerOrchestrator) get(apiPath string, query url.Values, v interface{}) error {
+	res, err := d.do(http.MethodGet, apiPath, query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// do sends a request to the Docker Engine and returns the response if it
+// succeeded, otherwise an error including the message returned.
+func (d *DockerOrchestrator) do(method, apiPath string, query url.Values) (*http.Response, error) {
+	// the host is ignored since every connection is made to the socket
+	u := "http://docker" + apiPath
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		var body struct {
+			Message string `json:"message"`
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+		if json.Unmarshal(data, &body) == nil && body.Message != "" {
+			return nil, fmt.Errorf("%s %s returned %d: %s", method, apiPath, res.StatusCode, body.Message)
+		}
+		return nil, fmt.Errorf("%s %s returned %d", method, apiPath, res.StatusCode)
+	}
+	return res, nil
+}
@@ -0,0 +1,132 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const dockerContainers = `[
+	{"Id": "1", "Names": ["/web"], "Labels": {"artifact-manager.restart": "true"}, "Mounts": [
+		{"Type": "bind", "Source": "/data/a-latest", "Destination": "/a"},
+		{"Type": "volume", "Source": "/var/lib/docker/volumes/cache/_data", "Destination": "/cache"}
+	]},
+	{"Id": "2", "Names": ["/worker"], "Labels": {}, "Mounts": [
+		{"Type": "bind", "Source": "/data/a-latest", "Destination": "/a"}
+	]}
+]`
+
+// newFakeDocker creates a "mock" Docker Engine listening on a unix socket,
+// every restart request is recorded in restarts.
+func newFakeDocker(t *testing.T) (*httptest.Server, *DockerOrchestrator, func() []string, func()) {
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	socketPath := path.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unable to listen on %s: %v", socketPath, err)
+	}
+
+	var mutex sync.Mutex
+	restarts := make([]string, 0)
+	s := httptest.NewUnstartedServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == gohttp.MethodPost && strings.HasSuffix(r.URL.Path, "/restart"):
+			mutex.Lock()
+			restarts = append(restarts, r.URL.Path+"?"+r.URL.RawQuery)
+			mutex.Unlock()
+			w.WriteHeader(gohttp.StatusNoContent)
+		case r.URL.Path == "/containers/json":
+			var filters map[string][]string
+			json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+			if len(filters["label"]) > 0 && filters["label"][0] != "artifact-manager.restart=true" {
+				t.Errorf("unexpected label filter %v", filters)
+			}
+			fmt.Fprint(w, dockerContainers)
+		case r.URL.Path == "/containers/web/json":
+			fmt.Fprint(w, `{"State": {"Running": true, "Health": {"Status": "starting"}}}`)
+		default:
+			w.WriteHeader(gohttp.StatusNotFound)
+			fmt.Fprint(w, `{"message": "No such container"}`)
+		}
+	}))
+	s.Listener.Close()
+	s.Listener = listener
+	s.Start()
+
+	d := NewDockerOrchestrator(socketPath, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	restarted := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, restarts...)
+	}
+	return s, d, restarted, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// TestDockerOrchestrator_Workloads tests that the bind mounts of the running
+// containers are found, and that only labelled containers are included once a
+// label is set.
+func TestDockerOrchestrator_Workloads(t *testing.T) {
+	_, d, _, stop := newFakeDocker(t)
+	defer stop()
+
+	workloads, err := d.Workloads()
+	if err != nil {
+		t.Fatalf("failed to list workloads: %v", err)
+	}
+	expected := []Workload{
+		{ID: "web", Kind: "container", Paths: []string{"/data/a-latest"}},
+		{ID: "worker", Kind: "container", Paths: []string{"/data/a-latest"}},
+	}
+	if !reflect.DeepEqual(workloads, expected) {
+		t.Errorf("expected workloads %+v, got %+v", expected, workloads)
+	}
+
+	d.SetLabel("artifact-manager.restart")
+	workloads, err = d.Workloads()
+	if err != nil {
+		t.Fatalf("failed to list workloads: %v", err)
+	}
+	if !reflect.DeepEqual(workloads, expected[:1]) {
+		t.Errorf("expected workloads %+v, got %+v", expected[:1], workloads)
+	}
+}
+
+// TestDockerOrchestrator_Restart tests that containers are restarted through
+// the socket and that errors of the Docker Engine are returned.
+func TestDockerOrchestrator_Restart(t *testing.T) {
+	_, d, restarted, stop := newFakeDocker(t)
+	defer stop()
+
+	if _, err := d.Restart("web"); err != nil {
+		t.Fatalf("failed to restart: %v", err)
+	}
+	if restarts := restarted(); !reflect.DeepEqual(restarts, []string{"/containers/web/restart?t=10"}) {
+		t.Errorf("expected web to be restarted, got %v", restarts)
+	}
+
+	healthy, err := d.Healthy("web")
+	if err != nil || healthy {
+		t.Errorf("expected a starting container to be unhealthy, got %v, %v", healthy, err)
+	}
+	if _, err = d.Healthy("missing"); err == nil || !strings.Contains(err.Error(), "No such container") {
+		t.Errorf("expected the error of the docker engine, got %v", err)
+	}
+}
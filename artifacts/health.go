@@ -0,0 +1,23 @@
+package artifacts
+
+import "time"
+
+// FetchStatus returns when the volumes were last fetched successfully, zero
+// if they haven't been yet, and the error the last fetch failed with, nil if
+// it succeeded.
+func (as *ArtifactsService) FetchStatus() (time.Time, error) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	return as.lastFetch, as.fetchErr
+}
+
+// PingOrchestrator checks that the orchestrator is reachable, returning a
+// description of it, such as its leader. An orchestrator that isn't a Pinger
+// is considered reachable.
+func (as *ArtifactsService) PingOrchestrator() (string, error) {
+	pinger, ok := as.orchestrator.(Pinger)
+	if !ok {
+		return "the orchestrator can't be pinged", nil
+	}
+	return pinger.Ping()
+}
@@ -0,0 +1,92 @@
+package artifacts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	gohttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newPingedMarathon creates a "mock" marathon server answering pings with
+// leader as its leader, and an orchestrator using it.
+func newPingedMarathon(t *testing.T, leader string) (*httptest.Server, *MarathonOrchestrator) {
+	s := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		switch r.URL.Path {
+		case "/ping":
+			fmt.Fprint(w, "pong")
+		case "/v2/leader":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"leader": "%s"}`, leader)
+		default:
+			w.WriteHeader(gohttp.StatusNotFound)
+		}
+	}))
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to parse mock server url %s: %v", s.URL, err)
+	}
+	marathonClient, err := NewMarathonClient(nil, nil, u.Host)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to create marathon client: %v", err)
+	}
+	return s, NewMarathonOrchestrator(marathonClient, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+}
+
+// TestArtifactsService_FetchStatus tests that a failed fetch of the volumes
+// is reported along with the time of the last successful one.
+func TestArtifactsService_FetchStatus(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	lastFetch, err := svc.FetchStatus()
+	if lastFetch.IsZero() || err != nil {
+		t.Fatalf("expected the volumes to have been fetched; got %s, %v", lastFetch, err)
+	}
+
+	s.Close()
+	if _, err = svc.FetchVolumes(); err == nil {
+		t.Fatalf("expected fetching the volumes from a stopped server to fail")
+	}
+	failedFetch, err := svc.FetchStatus()
+	if !failedFetch.Equal(lastFetch) || err == nil {
+		t.Errorf("expected the failure and the last successful fetch; got %s, %v", failedFetch, err)
+	}
+}
+
+// TestArtifactsService_PingOrchestrator tests that marathon, and each of the
+// clusters of a ClustersOrchestrator, are pinged and that the clusters are
+// only unreachable once none of them can be reached.
+func TestArtifactsService_PingOrchestrator(t *testing.T) {
+	s, marathon := newPingedMarathon(t, "master-1:8080")
+	defer s.Close()
+	debug := log.New(ioutil.Discard, log.Prefix(), log.Flags())
+
+	result, err := NewArtifactsService(marathon, debug).PingOrchestrator()
+	if err != nil || result != "leader master-1:8080" {
+		t.Errorf("expected the leader of marathon; got %s, %v", result, err)
+	}
+
+	clusters := NewClustersOrchestrator(debug)
+	clusters.AddCluster("east", marathon, time.Hour, nil)
+	result, err = NewArtifactsService(clusters, debug).PingOrchestrator()
+	if err != nil || result != "east: leader master-1:8080" {
+		t.Errorf("expected the leader of the east cluster; got %s, %v", result, err)
+	}
+	clusters.AddCluster("north", brokenOrchestrator{}, time.Hour, nil)
+	result, err = NewArtifactsService(clusters, debug).PingOrchestrator()
+	if err != nil || result != "east: leader master-1:8080; north: unreachable, connection refused" {
+		t.Errorf("expected the north cluster to be reported unreachable; got %s, %v", result, err)
+	}
+
+	down := NewClustersOrchestrator(debug)
+	down.AddCluster("north", brokenOrchestrator{}, time.Hour, nil)
+	down.AddCluster("south", brokenOrchestrator{}, time.Hour, nil)
+	if _, err = NewArtifactsService(down, debug).PingOrchestrator(); err == nil || err.Error() != "north: connection refused; south: connection refused" {
+		t.Errorf("expected every cluster to be unreachable; got %v", err)
+	}
+}
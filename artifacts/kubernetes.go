@@ -0,0 +1,657 @@
+package artifacts
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// kubeResource is a type of Kubernetes object that is watched.
+type kubeResource struct {
+	// the kind used in workload ids
+	kind string
+	// the api the resource belongs to
+	api string
+	// the plural name of the resource used in api paths
+	name string
+}
+
+var (
+	kubePods         = kubeResource{kind: "pod", api: "/api/v1", name: "pods"}
+	kubeReplicaSets  = kubeResource{kind: "replicaset", api: "/apis/apps/v1", name: "replicasets"}
+	kubeDeployments  = kubeResource{kind: "deployment", api: "/apis/apps/v1", name: "deployments"}
+	kubeStatefulSets = kubeResource{kind: "statefulset", api: "/apis/apps/v1", name: "statefulsets"}
+	kubeDaemonSets   = kubeResource{kind: "daemonset", api: "/apis/apps/v1", name: "daemonsets"}
+
+	// the resources whose pod template can be restarted, they are the workloads
+	kubeControllers = []kubeResource{kubeDeployments, kubeStatefulSets, kubeDaemonSets}
+	// every resource that is watched
+	kubeResources = []kubeResource{kubePods, kubeReplicaSets, kubeDeployments, kubeStatefulSets, kubeDaemonSets}
+)
+
+// kubeRestartedAtAnnotation is the pod template annotation changed to restart
+// a workload, the same one `kubectl rollout restart` uses.
+const kubeRestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// kubeObject holds the fields used of the Kubernetes objects that are watched.
+type kubeObject struct {
+	Metadata struct {
+		Name            string `json:"name"`
+		Namespace       string `json:"namespace"`
+		ResourceVersion string `json:"resourceVersion"`
+		Generation      int64  `json:"generation"`
+		OwnerReferences []struct {
+			Kind       string `json:"kind"`
+			Name       string `json:"name"`
+			Controller bool   `json:"controller"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+	Spec struct {
+		// set for pods
+		kubePodSpec
+		// set for controllers
+		Replicas *int32 `json:"replicas"`
+		Template struct {
+			Spec kubePodSpec `json:"spec"`
+		} `json:"template"`
+	} `json:"spec"`
+	Status struct {
+		ObservedGeneration     int64 `json:"observedGeneration"`
+		Replicas               int32 `json:"replicas"`
+		UpdatedReplicas        int32 `json:"updatedReplicas"`
+		ReadyReplicas          int32 `json:"readyReplicas"`
+		AvailableReplicas      int32 `json:"availableReplicas"`
+		DesiredNumberScheduled int32 `json:"desiredNumberScheduled"`
+		UpdatedNumberScheduled int32 `json:"updatedNumberScheduled"`
+		NumberAvailable        int32 `json:"numberAvailable"`
+	} `json:"status"`
+}
+
+type kubePodSpec struct {
+	Volumes []struct {
+		Name     string `json:"name"`
+		HostPath *struct {
+			Path string `json:"path"`
+		} `json:"hostPath"`
+		NFS *struct {
+			Server string `json:"server"`
+			Path   string `json:"path"`
+		} `json:"nfs"`
+	} `json:"volumes"`
+	Containers     []kubeContainer `json:"containers"`
+	InitContainers []kubeContainer `json:"initContainers"`
+}
+
+type kubeContainer struct {
+	VolumeMounts []struct {
+		Name    string `json:"name"`
+		SubPath string `json:"subPath"`
+	} `json:"volumeMounts"`
+}
+
+// paths returns the paths of the hostPath and NFS volumes of the pod spec.
+//
+// A volume mounted with a subPath is reported as the path within the volume,
+// the path of an NFS volume is the path of the export on the server.
+func (s *kubePodSpec) paths() []string {
+	volumePaths := make(map[string]string)
+	for _, volume := range s.Volumes {
+		switch {
+		case volume.HostPath != nil:
+			volumePaths[volume.Name] = volume.HostPath.Path
+		case volume.NFS != nil:
+			volumePaths[volume.Name] = volume.NFS.Path
+		}
+	}
+
+	paths := make([]string, 0)
+	mounted := make(map[string]bool)
+	for _, container := range append(append([]kubeContainer{}, s.InitContainers...), s.Containers...) {
+		for _, mount := range container.VolumeMounts {
+			volumePath, ok := volumePaths[mount.Name]
+			if !ok {
+				continue
+			}
+			mounted[mount.Name] = true
+			if mount.SubPath != "" {
+				volumePath = path.Join(volumePath, mount.SubPath)
+			}
+			if volumePath != "" && !contains(paths, volumePath) {
+				paths = append(paths, volumePath)
+			}
+		}
+	}
+	for _, volume := range s.Volumes {
+		volumePath := volumePaths[volume.Name]
+		if !mounted[volume.Name] && volumePath != "" && !contains(paths, volumePath) {
+			paths = append(paths, volumePath)
+		}
+	}
+	return paths
+}
+
+// key returns the namespace and name identifying the object within its resource.
+func (o *kubeObject) key() string {
+	return o.Metadata.Namespace + "/" + o.Metadata.Name
+}
+
+// controller returns the kind and name of the object controlling o, if any.
+func (o *kubeObject) controller() (string, string) {
+	for _, owner := range o.Metadata.OwnerReferences {
+		if owner.Controller {
+			return strings.ToLower(owner.Kind), owner.Name
+		}
+	}
+	return "", ""
+}
+
+// rolledOut returns true if the latest pod template of the controller has
+// been rolled out to all of its replicas.
+func (o *kubeObject) rolledOut(kind string) bool {
+	if o.Status.ObservedGeneration < o.Metadata.Generation {
+		return false
+	}
+	replicas := int32(1)
+	if o.Spec.Replicas != nil {
+		replicas = *o.Spec.Replicas
+	}
+	switch kind {
+	case kubeDaemonSets.kind:
+		desired := o.Status.DesiredNumberScheduled
+		return o.Status.UpdatedNumberScheduled >= desired && o.Status.NumberAvailable >= desired
+	case kubeStatefulSets.kind:
+		return o.Status.UpdatedReplicas >= replicas && o.Status.ReadyReplicas >= replicas
+	default:
+		return o.Status.UpdatedReplicas >= replicas && o.Status.AvailableReplicas >= replicas && o.Status.Replicas <= replicas
+	}
+}
+
+// kubeEvent is an event received from the watch API.
+type kubeEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubeStatus is the object of an ERROR event.
+type kubeStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// errKubeExpired is returned when a watch can't continue from the resource
+// version it was given, the resources have to be listed again.
+var errKubeExpired = fmt.Errorf("the resource version is too old")
+
+// NewKubernetesHTTPClient returns an http client for the Kubernetes API server
+// trusting the certificate authorities in caFile, pass an empty caFile to use
+// the system's certificate authorities.
+//
+// The client has no overall timeout since watches are long running requests.
+func NewKubernetesHTTPClient(caFile string) (*http.Client, error) {
+	transport := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	}
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read kubernetes certificate authorities: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// KubernetesOrchestrator is an Orchestrator for the Deployments, StatefulSets
+// and DaemonSets run by Kubernetes.
+//
+// The workloads are identified by "<kind>/<namespace>/<name>", for example
+// "deployment/default/web". The paths of a workload are those of the hostPath
+// and NFS volumes of its pod template and of the pods it controls, a pod is
+// controlled by a Deployment through a ReplicaSet. Pods that are not
+// controlled by a workload are ignored.
+//
+// The objects are kept up to date using the watch API once Run has been
+// called. A workload is restarted by changing an annotation of its pod
+// template, like `kubectl rollout restart` does.
+type KubernetesOrchestrator struct {
+	baseURL    string
+	httpClient *http.Client
+	debug      *log.Logger
+	logger     *core.Logger
+	// the file the bearer token is read from, may be empty
+	tokenFile string
+	// the namespace that is watched, every namespace if empty
+	namespace string
+	// how long to wait before listing the resources again after a failure
+	retryInterval time.Duration
+	// how long the API server keeps a watch open
+	watchTimeout time.Duration
+	// returns the current time, replaced in tests
+	now func() time.Time
+
+	mutex *sync.Mutex
+	// resource to the objects of that resource keyed by namespace and name
+	objects map[kubeResource]map[string]*kubeObject
+	// the resources that have been listed
+	listed map[kubeResource]bool
+}
+
+// NewKubernetesOrchestrator creates a KubernetesOrchestrator using the API
+// server at baseURL, such as "https://kubernetes.default.svc".
+//
+// The debug argument allows debug messages to be written to the provided logger.
+func NewKubernetesOrchestrator(baseURL string, httpClient *http.Client, debug *log.Logger) *KubernetesOrchestrator {
+	objects := make(map[kubeResource]map[string]*kubeObject)
+	for _, resource := range kubeResources {
+		objects[resource] = make(map[string]*kubeObject)
+	}
+	return &KubernetesOrchestrator{
+		baseURL:       strings.TrimSuffix(baseURL, "/"),
+		httpClient:    httpClient,
+		debug:         debug,
+		logger:        core.DefaultLogger(),
+		retryInterval: 5 * time.Second,
+		watchTimeout:  5 * time.Minute,
+		now:           time.Now,
+		mutex:         &sync.Mutex{},
+		objects:       objects,
+		listed:        make(map[kubeResource]bool),
+	}
+}
+
+// SetTokenFile sets the file the bearer token used to authenticate with the
+// API server is read from. The file is read for every request, so a token
+// that is rotated is picked up.
+func (k *KubernetesOrchestrator) SetTokenFile(name string) {
+	k.tokenFile = name
+}
+
+// SetNamespace limits the workloads to those of namespace, an empty namespace
+// watches every namespace.
+func (k *KubernetesOrchestrator) SetNamespace(namespace string) {
+	k.namespace = namespace
+}
+
+// SetLogger sets the logger the problems the orchestrator works around are logged
+// with, core.DefaultLogger by default.
+func (k *KubernetesOrchestrator) SetLogger(logger *core.Logger) {
+	k.logger = logger
+}
+
+// Run lists and watches the resources until ctx is done.
+func (k *KubernetesOrchestrator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, resource := range kubeResources {
+		wg.Add(1)
+		go func(resource kubeResource) {
+			defer wg.Done()
+			k.watchResource(ctx, resource)
+		}(resource)
+	}
+	wg.Wait()
+}
+
+// Workloads returns the Deployments, StatefulSets and DaemonSets along with
+// the paths of their volumes. An error is returned until every resource has
+// been listed.
+func (k *KubernetesOrchestrator) Workloads() ([]Workload, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	for _, resource := range kubeResources {
+		if !k.listed[resource] {
+			return nil, fmt.Errorf("the kubernetes %s have not been listed yet", resource.name)
+		}
+	}
+
+	workloads := make(map[string]*Workload)
+	for _, resource := range kubeControllers {
+		for _, object := range k.objects[resource] {
+			id := kubeWorkloadID(resource.kind, object.Metadata.Namespace, object.Metadata.Name)
+			workloads[id] = &Workload{ID: id, Kind: resource.kind, Paths: object.Spec.Template.Spec.paths()}
+		}
+	}
+	for _, pod := range k.objects[kubePods] {
+		id := k.podWorkloadID(pod)
+		workload, ok := workloads[id]
+		if !ok {
+			k.debug.Printf("ignoring pod %s, it is not controlled by a workload\n", pod.key())
+			continue
+		}
+		for _, podPath := range pod.Spec.paths() {
+			if !contains(workload.Paths, podPath) {
+				workload.Paths = append(workload.Paths, podPath)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(workloads))
+	for id := range workloads {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	result := make([]Workload, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, *workloads[id])
+	}
+	k.debug.Printf("Found %d kubernetes workloads\n", len(result))
+	return result, nil
+}
+
+// podWorkloadID returns the id of the workload controlling pod, or an empty
+// string if there is none.
+func (k *KubernetesOrchestrator) podWorkloadID(pod *kubeObject) string {
+	kind, name := pod.controller()
+	if kind == kubeReplicaSets.kind {
+		replicaSet, ok := k.objects[kubeReplicaSets][pod.Metadata.Namespace+"/"+name]
+		if !ok {
+			return ""
+		}
+		kind, name = replicaSet.controller()
+	}
+	for _, resource := range kubeControllers {
+		if kind == resource.kind {
+			return kubeWorkloadID(kind, pod.Metadata.Namespace, name)
+		}
+	}
+	return ""
+}
+
+// Restart restarts the workload identified by id by changing the restartedAt
+// annotation of its pod template. The deployment id returned identifies the
+// generation of the workload the restart created.
+func (k *KubernetesOrchestrator) Restart(id string) (string, error) {
+	resource, namespace, name, err := parseKubeWorkloadID(id)
+	if err != nil {
+		return "", err
+	}
+
+	patch := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						kubeRestartedAtAnnotation: k.now().UTC().Format(time.RFC3339),
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(patch)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	objectPath := fmt.Sprintf("%s/namespaces/%s/%s/%s", resource.api, namespace, resource.name, name)
+	res, err := k.do(ctx, http.MethodPatch, objectPath, nil, bytes.NewReader(body), "application/strategic-merge-patch+json")
+	if err != nil {
+		return "", fmt.Errorf("failed to restart %s: %v", id, err)
+	}
+	defer res.Body.Close()
+
+	object := new(kubeObject)
+	err = json.NewDecoder(res.Body).Decode(object)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the %s of %s after restarting it: %v", resource.kind, id, err)
+	}
+	// the object is stored right away, so the deployment is known to be in
+	// progress before the watch catches up
+	k.mutex.Lock()
+	k.objects[resource][object.key()] = object
+	k.mutex.Unlock()
+
+	return kubeDeploymentID(id, object.Metadata.Generation), nil
+}
+
+// Deployments returns a deployment for every workload whose latest pod
+// template has not been rolled out to all of its replicas.
+func (k *KubernetesOrchestrator) Deployments() ([]Deployment, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	deployments := make([]Deployment, 0)
+	for _, resource := range kubeControllers {
+		for _, object := range k.objects[resource] {
+			if object.rolledOut(resource.kind) {
+				continue
+			}
+			id := kubeWorkloadID(resource.kind, object.Metadata.Namespace, object.Metadata.Name)
+			deployments = append(deployments, Deployment{
+				ID:        kubeDeploymentID(id, object.Metadata.Generation),
+				Workloads: []string{id},
+			})
+		}
+	}
+	return deployments, nil
+}
+
+// Healthy returns true if the latest pod template of the workload identified
+// by id has been rolled out and all of its replicas are available.
+func (k *KubernetesOrchestrator) Healthy(id string) (bool, error) {
+	resource, namespace, name, err := parseKubeWorkloadID(id)
+	if err != nil {
+		return false, err
+	}
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	object, ok := k.objects[resource][namespace+"/"+name]
+	if !ok {
+		return false, fmt.Errorf("%s does not exist", id)
+	}
+	return object.rolledOut(resource.kind), nil
+}
+
+// watchResource keeps the objects of resource up to date until ctx is done.
+//
+// The objects are listed and then watched from the resource version of the
+// list. A watch that ends is started again from the last version seen, the
+// objects are listed again if the watch fails.
+func (k *KubernetesOrchestrator) watchResource(ctx context.Context, resource kubeResource) {
+	for ctx.Err() == nil {
+		version, err := k.list(ctx, resource)
+		for err == nil && ctx.Err() == nil {
+			version, err = k.watch(ctx, resource, version)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errKubeExpired {
+			k.debug.Printf("watch of kubernetes %s expired, listing them again\n", resource.name)
+			continue
+		}
+		k.logger.Warnf("problem watching kubernetes %s, retrying in %s: %v", resource.name, k.retryInterval, err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(k.retryInterval):
+		}
+	}
+}
+
+// list replaces the objects of resource with those listed by the API server
+// and returns the resource version of the list.
+func (k *KubernetesOrchestrator) list(ctx context.Context, resource kubeResource) (string, error) {
+	listCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	res, err := k.do(listCtx, http.MethodGet, k.resourcePath(resource), nil, nil, "")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var list struct {
+		Metadata struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"metadata"`
+		Items []*kubeObject `json:"items"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&list)
+	if err != nil {
+		return "", fmt.Errorf("unable to read the list of %s: %v", resource.name, err)
+	}
+
+	objects := make(map[string]*kubeObject, len(list.Items))
+	for _, object := range list.Items {
+		objects[object.key()] = object
+	}
+	k.mutex.Lock()
+	k.objects[resource] = objects
+	k.listed[resource] = true
+	k.mutex.Unlock()
+	k.debug.Printf("listed %d kubernetes %s at version %s\n", len(objects), resource.name, list.Metadata.ResourceVersion)
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies the events of resource from version on until the watch ends
+// and returns the last resource version seen.
+func (k *KubernetesOrchestrator) watch(ctx context.Context, resource kubeResource, version string) (string, error) {
+	query := url.Values{}
+	query.Set("watch", "1")
+	query.Set("resourceVersion", version)
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("timeoutSeconds", fmt.Sprintf("%d", int(k.watchTimeout.Seconds())))
+	res, err := k.do(ctx, http.MethodGet, k.resourcePath(resource), query, nil, "")
+	if err != nil {
+		return version, err
+	}
+	defer res.Body.Close()
+
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var event kubeEvent
+		err = decoder.Decode(&event)
+		if err == io.EOF {
+			return version, nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return version, nil
+			}
+			return version, fmt.Errorf("unable to read watch event: %v", err)
+		}
+
+		if event.Type == "ERROR" {
+			var status kubeStatus
+			json.Unmarshal(event.Object, &status)
+			if status.Code == http.StatusGone {
+				return version, errKubeExpired
+			}
+			return version, fmt.Errorf("watch failed with %d: %s", status.Code, status.Message)
+		}
+
+		object := new(kubeObject)
+		err = json.Unmarshal(event.Object, object)
+		if err != nil {
+			return version, fmt.Errorf("unable to read the object of a %s event: %v", event.Type, err)
+		}
+		version = object.Metadata.ResourceVersion
+
+		k.mutex.Lock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			k.objects[resource][object.key()] = object
+		case "DELETED":
+			delete(k.objects[resource], object.key())
+		}
+		k.mutex.Unlock()
+	}
+}
+
+// resourcePath returns the api path listing the objects of resource.
+func (k *KubernetesOrchestrator) resourcePath(resource kubeResource) string {
+	if k.namespace == "" {
+		return fmt.Sprintf("%s/%s", resource.api, resource.name)
+	}
+	return fmt.Sprintf("%s/namespaces/%s/%s", resource.api, k.namespace, resource.name)
+}
+
+// do sends a request to the API server and returns the response if it
+// succeeded, otherwise an error including the status returned.
+func (k *KubernetesOrchestrator) do(ctx context.Context, method, apiPath string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	u := k.baseURL + apiPath
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if k.tokenFile != "" {
+		token, err := ioutil.ReadFile(k.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the kubernetes token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	res, err := k.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		var status kubeStatus
+		data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 64*1024))
+		if json.Unmarshal(data, &status) == nil && status.Message != "" {
+			return nil, fmt.Errorf("%s %s returned %d: %s", method, apiPath, res.StatusCode, status.Message)
+		}
+		return nil, fmt.Errorf("%s %s returned %d", method, apiPath, res.StatusCode)
+	}
+	return res, nil
+}
+
+// kubeWorkloadID returns the id of the workload of the given kind.
+func kubeWorkloadID(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// parseKubeWorkloadID returns the resource, namespace and name of the
+// workload identified by id.
+func parseKubeWorkloadID(id string) (kubeResource, string, string, error) {
+	parts := strings.Split(id, "/")
+	if len(parts) == 3 {
+		for _, resource := range kubeControllers {
+			if parts[0] == resource.kind {
+				return resource, parts[1], parts[2], nil
+			}
+		}
+	}
+	return kubeResource{}, "", "", fmt.Errorf("%s is not the id of a kubernetes workload", id)
+}
+
+// kubeDeploymentID returns the id of the deployment of the given generation
+// of the workload identified by id.
+func kubeDeploymentID(id string, generation int64) string {
+	return fmt.Sprintf("%s@%d", id, generation)
+}
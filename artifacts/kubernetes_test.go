@@ -0,0 +1,268 @@
+package artifacts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	gohttp "net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKubernetes is a "mock" Kubernetes API server. It lists the objects it
+// was given and streams the events sent to a resource to its watchers.
+type fakeKubernetes struct {
+	mutex *sync.Mutex
+	// api path of a resource to its objects
+	objects map[string][]string
+	// api path of a resource to the events sent to its watchers
+	events map[string]chan string
+	// the number of times each resource was listed
+	lists   map[string]int
+	patches []string
+}
+
+func newFakeKubernetes() *fakeKubernetes {
+	f := &fakeKubernetes{
+		mutex:   &sync.Mutex{},
+		objects: make(map[string][]string),
+		events:  make(map[string]chan string),
+		lists:   make(map[string]int),
+		patches: make([]string, 0),
+	}
+	for _, resource := range kubeResources {
+		resourcePath := resource.api + "/" + resource.name
+		f.objects[resourcePath] = make([]string, 0)
+		f.events[resourcePath] = make(chan string, 10)
+	}
+	return f
+}
+
+func (f *fakeKubernetes) ServeHTTP(w gohttp.ResponseWriter, r *gohttp.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == gohttp.MethodPatch {
+		data, _ := ioutil.ReadAll(r.Body)
+		f.mutex.Lock()
+		f.patches = append(f.patches, r.URL.Path+" "+string(data))
+		f.mutex.Unlock()
+		parts := strings.Split(r.URL.Path, "/")
+		fmt.Fprintf(w, `{"metadata": {"name": "%s", "namespace": "%s", "generation": 2}, "status": {"observedGeneration": 1}}`, parts[len(parts)-1], parts[5])
+		return
+	}
+
+	f.mutex.Lock()
+	events, ok := f.events[r.URL.Path]
+	objects := f.objects[r.URL.Path]
+	if ok && r.URL.Query().Get("watch") == "" {
+		f.lists[r.URL.Path]++
+	}
+	f.mutex.Unlock()
+	if !ok {
+		w.WriteHeader(gohttp.StatusNotFound)
+		fmt.Fprint(w, `{"kind": "Status", "code": 404, "message": "not found"}`)
+		return
+	}
+
+	if r.URL.Query().Get("watch") == "" {
+		fmt.Fprintf(w, `{"metadata": {"resourceVersion": "1"}, "items": [%s]}`, strings.Join(objects, ","))
+		return
+	}
+	w.(gohttp.Flusher).Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			fmt.Fprintln(w, event)
+			w.(gohttp.Flusher).Flush()
+		}
+	}
+}
+
+func (f *fakeKubernetes) listCount(resource kubeResource) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.lists[resource.api+"/"+resource.name]
+}
+
+func (f *fakeKubernetes) send(resource kubeResource, eventType, object string) {
+	f.events[resource.api+"/"+resource.name] <- fmt.Sprintf(`{"type": "%s", "object": %s}`, eventType, object)
+}
+
+const (
+	kubeWebDeployment = `{"metadata": {"name": "web", "namespace": "default", "generation": 1},
+		"spec": {"replicas": 1, "template": {"spec": {
+			"volumes": [{"name": "models", "hostPath": {"path": "/data/a-latest"}}],
+			"containers": [{"volumeMounts": [{"name": "models", "mountPath": "/models"}]}]}}},
+		"status": {"observedGeneration": 1, "replicas": 1, "updatedReplicas": 1, "availableReplicas": 1}}`
+	kubeWebReplicaSet = `{"metadata": {"name": "web-abc", "namespace": "default",
+		"ownerReferences": [{"kind": "Deployment", "name": "web", "controller": true}]}}`
+	kubeWebPod = `{"metadata": {"name": "web-abc-1", "namespace": "default",
+		"ownerReferences": [{"kind": "ReplicaSet", "name": "web-abc", "controller": true}]},
+		"spec": {"volumes": [{"name": "shared", "nfs": {"server": "nfs", "path": "/exports/b-latest"}}],
+			"containers": [{"volumeMounts": [{"name": "shared", "mountPath": "/shared"}]}]}}`
+	kubeDBStatefulSet = `{"metadata": {"name": "db", "namespace": "data"},
+		"spec": {"template": {"spec": {
+			"volumes": [{"name": "data", "hostPath": {"path": "/data"}}, {"name": "tmp", "emptyDir": {}}],
+			"containers": [{"volumeMounts": [{"name": "data", "subPath": "c-latest"}, {"name": "tmp"}]}]}}},
+		"status": {"updatedReplicas": 1, "readyReplicas": 1}}`
+	kubeBarePod = `{"metadata": {"name": "debug", "namespace": "default"},
+		"spec": {"volumes": [{"name": "models", "hostPath": {"path": "/data/a-latest"}}]}}`
+	kubeAgentDaemonSet = `{"metadata": {"name": "agent", "namespace": "kube-system", "resourceVersion": "2"},
+		"spec": {"template": {"spec": {"volumes": [{"name": "d", "hostPath": {"path": "/data/d-latest"}}]}}}}`
+)
+
+func newTestKubernetes(t *testing.T) (*httptest.Server, *fakeKubernetes, *KubernetesOrchestrator, context.CancelFunc) {
+	f := newFakeKubernetes()
+	f.objects["/apis/apps/v1/deployments"] = []string{kubeWebDeployment}
+	f.objects["/apis/apps/v1/replicasets"] = []string{kubeWebReplicaSet}
+	f.objects["/apis/apps/v1/statefulsets"] = []string{kubeDBStatefulSet}
+	f.objects["/api/v1/pods"] = []string{kubeWebPod, kubeBarePod}
+	s := httptest.NewServer(f)
+
+	k := NewKubernetesOrchestrator(s.URL, s.Client(), log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	k.retryInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		k.Run(ctx)
+		close(done)
+	}()
+	stop := func() {
+		cancel()
+		<-done
+		s.Close()
+	}
+	return s, f, k, stop
+}
+
+// waitForWorkloads returns the workloads once check returns true for them.
+func waitForWorkloads(t *testing.T, k *KubernetesOrchestrator, check func([]Workload) bool) []Workload {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		workloads, err := k.Workloads()
+		if err == nil && check(workloads) {
+			return workloads
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for the workloads, last got %+v, %v", workloads, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestKubernetesOrchestrator_Workloads tests that the volumes of the workloads
+// and of the pods they control are found and kept up to date by the watches.
+func TestKubernetesOrchestrator_Workloads(t *testing.T) {
+	_, f, k, stop := newTestKubernetes(t)
+	defer stop()
+
+	workloads := waitForWorkloads(t, k, func([]Workload) bool { return true })
+	expected := []Workload{
+		{ID: "deployment/default/web", Kind: "deployment", Paths: []string{"/data/a-latest", "/exports/b-latest"}},
+		{ID: "statefulset/data/db", Kind: "statefulset", Paths: []string{"/data/c-latest"}},
+	}
+	if !reflect.DeepEqual(workloads, expected) {
+		t.Errorf("expected workloads %+v, got %+v", expected, workloads)
+	}
+
+	f.send(kubeDaemonSets, "ADDED", kubeAgentDaemonSet)
+	f.send(kubeStatefulSets, "DELETED", kubeDBStatefulSet)
+	expected = []Workload{
+		{ID: "daemonset/kube-system/agent", Kind: "daemonset", Paths: []string{"/data/d-latest"}},
+		{ID: "deployment/default/web", Kind: "deployment", Paths: []string{"/data/a-latest", "/exports/b-latest"}},
+	}
+	waitForWorkloads(t, k, func(workloads []Workload) bool {
+		return reflect.DeepEqual(workloads, expected)
+	})
+}
+
+// TestKubernetesOrchestrator_Expired tests that the resources are listed again
+// when a watch can't continue from the version it was given.
+func TestKubernetesOrchestrator_Expired(t *testing.T) {
+	_, f, k, stop := newTestKubernetes(t)
+	defer stop()
+
+	waitForWorkloads(t, k, func([]Workload) bool { return true })
+	f.mutex.Lock()
+	f.objects["/apis/apps/v1/daemonsets"] = []string{kubeAgentDaemonSet}
+	f.mutex.Unlock()
+	f.send(kubeDaemonSets, "ERROR", `{"kind": "Status", "code": 410, "message": "too old resource version"}`)
+
+	waitForWorkloads(t, k, func(workloads []Workload) bool {
+		return len(workloads) == 3 && workloads[0].ID == "daemonset/kube-system/agent"
+	})
+	if count := f.listCount(kubeDaemonSets); count != 2 {
+		t.Errorf("expected the daemonsets to be listed twice, got %d", count)
+	}
+}
+
+// TestKubernetesOrchestrator_Restart tests that a restart patches the
+// restartedAt annotation and is reported as a deployment until it has been
+// rolled out.
+func TestKubernetesOrchestrator_Restart(t *testing.T) {
+	_, f, k, stop := newTestKubernetes(t)
+	defer stop()
+	waitForWorkloads(t, k, func([]Workload) bool { return true })
+	k.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+
+	deploymentID, err := k.Restart("deployment/default/web")
+	if err != nil {
+		t.Fatalf("failed to restart: %v", err)
+	}
+	if deploymentID != "deployment/default/web@2" {
+		t.Errorf("expected deployment deployment/default/web@2, got %s", deploymentID)
+	}
+
+	f.mutex.Lock()
+	patches := f.patches
+	f.mutex.Unlock()
+	if len(patches) != 1 || !strings.HasPrefix(patches[0], "/apis/apps/v1/namespaces/default/deployments/web ") {
+		t.Fatalf("expected a patch of the web deployment, got %v", patches)
+	}
+	var patch struct {
+		Spec struct {
+			Template struct {
+				Metadata struct {
+					Annotations map[string]string `json:"annotations"`
+				} `json:"metadata"`
+			} `json:"template"`
+		} `json:"spec"`
+	}
+	err = json.Unmarshal([]byte(strings.SplitN(patches[0], " ", 2)[1]), &patch)
+	if err != nil {
+		t.Fatalf("unable to read patch: %v", err)
+	}
+	if at := patch.Spec.Template.Metadata.Annotations[kubeRestartedAtAnnotation]; at != "2020-01-02T03:04:05Z" {
+		t.Errorf("expected the restartedAt annotation to be set, got %q", at)
+	}
+
+	deployments, _ := k.Deployments()
+	expected := []Deployment{{ID: deploymentID, Workloads: []string{"deployment/default/web"}}}
+	if !reflect.DeepEqual(deployments, expected) {
+		t.Errorf("expected deployments %+v, got %+v", expected, deployments)
+	}
+
+	f.send(kubeDeployments, "MODIFIED", strings.Replace(strings.Replace(kubeWebDeployment,
+		`"generation": 1`, `"generation": 2`, 1), `"observedGeneration": 1`, `"observedGeneration": 2`, 1))
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deployments, _ = k.Deployments()
+		if len(deployments) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the deployment to finish, got %+v", deployments)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if healthy, err := k.Healthy("deployment/default/web"); !healthy || err != nil {
+		t.Errorf("expected the deployment to be healthy, got %v, %v", healthy, err)
+	}
+}
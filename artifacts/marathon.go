@@ -0,0 +1,371 @@
+package artifacts
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"apex/artifact-manager/core"
+
+	marathon "github.com/gambol99/go-marathon"
+)
+
+// NewMarathonClient configures and returns a Marathon client.
+//
+// httpClient    - a custom http client may be provided, otherwise pass nil
+// debug         - The third-party marathon library being used allows debug
+// output to be written to a writer, pass nil if you want debug
+// for that library to be disabled.
+// marathonAddrs - one or more "host:port" addresses used to connect to Marathon,
+// the first may start with "https://" to use https for all of them.
+func NewMarathonClient(httpClient *http.Client, debug io.Writer, marathonAddrs ...string) (marathon.Marathon, error) {
+	config := marathon.NewDefaultConfig()
+	config.URL = strings.Join(marathonAddrs, ",")
+	if !strings.Contains(config.URL, "://") {
+		config.URL = fmt.Sprintf("http://%s", config.URL)
+	}
+	if debug != nil {
+		config.LogOutput = debug
+	}
+	config.HTTPClient = httpClient
+	if httpClient == nil {
+		config.HTTPClient = &http.Client{
+			Timeout: (time.Duration(10) * time.Second),
+			Transport: &http.Transport{
+				Dial: (&net.Dialer{
+					Timeout:   10 * time.Second,
+					KeepAlive: 10 * time.Second,
+				}).Dial,
+			},
+		}
+	}
+
+	client, err := marathon.NewClient(config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create a client for marathon, error: %v", err)
+	}
+	return client, nil
+}
+
+// NewMarathonHTTPClient returns an http client for cluster, which trusts its
+// certificate authorities, presents its client certificate and authenticates
+// every request with its basic auth credentials or DC/OS service account.
+//
+// A DC/OS service account logs in when the first request is sent, and again
+// before its token expires or once the token is refused.
+func NewMarathonHTTPClient(cluster core.MarathonCluster) (*http.Client, error) {
+	transport := &http.Transport{
+		Dial: (&net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 10 * time.Second,
+		}).Dial,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	if cluster.CAFile != "" || cluster.CertFile != "" {
+		tlsConfig := &tls.Config{}
+		if cluster.CAFile != "" {
+			data, err := ioutil.ReadFile(cluster.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read marathon certificate authorities: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in %s", cluster.CAFile)
+			}
+		}
+		if cluster.CertFile != "" {
+			certificate, err := tls.LoadX509KeyPair(cluster.CertFile, cluster.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read marathon client certificate: %v", err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{certificate}
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	auth := &marathonAuthTransport{
+		base:     transport,
+		username: cluster.Username,
+		password: cluster.Password,
+	}
+	if cluster.DCOSCredentialsFile != "" {
+		// the login endpoint is served by the master Marathon runs behind
+		host := strings.SplitN(strings.Split(cluster.Hosts, ",")[0], "/", 2)[0]
+		loginURL := fmt.Sprintf("%s://%s/acs/api/v1/auth/login", cluster.Scheme, host)
+		var err error
+		auth.dcos, err = newDCOSTokenSource(cluster.DCOSCredentialsFile, loginURL, &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: transport,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &http.Client{Timeout: 10 * time.Second, Transport: auth}, nil
+}
+
+// NewMarathonClusterOrchestrator creates a MarathonOrchestrator, with pods
+// enabled, for the applications and pods of cluster.
+//
+// goMarathonDebug is the writer the debug output of the go-marathon library
+// is written to, pass nil to disable it. The debug argument allows debug
+// messages to be written to the provided logger.
+func NewMarathonClusterOrchestrator(cluster core.MarathonCluster, goMarathonDebug io.Writer, debug *log.Logger) (*MarathonOrchestrator, error) {
+	httpClient, err := NewMarathonHTTPClient(cluster)
+	if err != nil {
+		return nil, err
+	}
+	client, err := NewMarathonClient(httpClient, goMarathonDebug, cluster.URL())
+	if err != nil {
+		return nil, err
+	}
+
+	orchestrator := NewMarathonOrchestrator(client, debug)
+	orchestrator.EnablePods(httpClient, cluster.URL())
+	return orchestrator, nil
+}
+
+// marathonAuthTransport authenticates every request sent to Marathon.
+type marathonAuthTransport struct {
+	base http.RoundTripper
+	// the credentials used with http basic auth, none are sent if username is empty
+	username string
+	password string
+	// logs in to DC/OS, nil unless a DC/OS service account is used
+	dcos *dcosTokenSource
+}
+
+func (t *marathonAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.dcos == nil {
+		if t.username == "" {
+			return t.base.RoundTrip(req)
+		}
+		// a RoundTripper must not modify the request it was given
+		authenticated := req.Clone(req.Context())
+		authenticated.SetBasicAuth(t.username, t.password)
+		return t.base.RoundTrip(authenticated)
+	}
+
+	token, err := t.dcos.currentToken()
+	if err != nil {
+		return nil, err
+	}
+	authenticated := req.Clone(req.Context())
+	authenticated.Header.Set("Authorization", "token="+token)
+	res, err := t.base.RoundTrip(authenticated)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	// the token was refused, such as when it was revoked, so log in again
+	// and send the request once more if its body can be read again
+	if req.Body != nil && req.GetBody == nil {
+		return res, nil
+	}
+	res.Body.Close()
+	t.dcos.refused(token)
+	token, err = t.dcos.currentToken()
+	if err != nil {
+		return nil, err
+	}
+	authenticated = req.Clone(req.Context())
+	if req.GetBody != nil {
+		authenticated.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	authenticated.Header.Set("Authorization", "token="+token)
+	return t.base.RoundTrip(authenticated)
+}
+
+// MarathonOrchestrator is an Orchestrator for the applications, and
+// optionally the pods, run by Marathon.
+//
+// The workloads are the applications and pods, identified by their Marathon
+// id, and the dependencies of the applications are those of the
+// applications and groups defined in Marathon, see NewDependencies.
+type MarathonOrchestrator struct {
+	client marathon.Marathon
+	debug  *log.Logger
+	logger *core.Logger
+	// the client used for pods, nil unless pods are enabled
+	pods *marathonPodsClient
+
+	mutex *sync.Mutex
+	// the ids of the pods last listed
+	podIds map[string]bool
+}
+
+// NewMarathonOrchestrator creates a MarathonOrchestrator using client.
+//
+// The debug argument allows debug messages to be written to the provided logger.
+func NewMarathonOrchestrator(client marathon.Marathon, debug *log.Logger) *MarathonOrchestrator {
+	return &MarathonOrchestrator{
+		client: client,
+		debug:  debug,
+		logger: core.DefaultLogger(),
+		mutex:  &sync.Mutex{},
+		podIds: make(map[string]bool),
+	}
+}
+
+// SetLogger sets the logger the problems the orchestrator works around are logged
+// with, core.DefaultLogger by default.
+func (m *MarathonOrchestrator) SetLogger(logger *core.Logger) {
+	m.logger = logger
+}
+
+// EnablePods makes the pods of Marathon workloads too, pods are read and
+// restarted through the Marathon REST API at the given "host:port" addresses,
+// the first of which may start with "https://", using httpClient. Pass a nil
+// httpClient to use a default one.
+//
+// A pod is restarted by creating a new version of it, which replaces its
+// instances. Marathon versions without pods are treated as having none.
+func (m *MarathonOrchestrator) EnablePods(httpClient *http.Client, marathonAddrs ...string) {
+	m.pods = newMarathonPodsClient(httpClient, marathonAddrs...)
+}
+
+// Workloads returns the Marathon applications, and pods if they are enabled,
+// along with the host paths of their volumes.
+//
+// If the groups can't be listed, the applications are returned without their
+// dependencies.
+func (m *MarathonOrchestrator) Workloads() ([]Workload, error) {
+	applications, err := m.client.Applications(url.Values{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list applications: %v", err)
+	}
+
+	var dependencies Dependencies
+	groups, err := m.client.Groups()
+	if err != nil {
+		m.logger.Warnf("failed to list groups, applications are restarted without being ordered by their dependencies: %v", err)
+	} else {
+		dependencies = NewDependencies(groups)
+	}
+
+	m.debug.Printf("Found %d applications running\n", len(applications.Apps))
+	workloads := make([]Workload, 0, len(applications.Apps))
+	for _, application := range applications.Apps {
+		workload := Workload{
+			ID:           application.ID,
+			Kind:         "app",
+			Paths:        make([]string, 0),
+			Dependencies: dependencies.Get(application.ID),
+		}
+		if application.Container != nil {
+			volumes := application.Container.Volumes
+			if volumes != nil && len(*volumes) > 0 {
+				m.debug.Printf("%s depends on %d volumes\n", application.ID, len(*volumes))
+				for _, volume := range *volumes {
+					if volume.HostPath != "" {
+						m.debug.Printf("Adding %s path for %s\n", volume.HostPath, application.ID)
+						workload.Paths = append(workload.Paths, volume.HostPath)
+					}
+				}
+			}
+		}
+		workloads = append(workloads, workload)
+	}
+
+	if m.pods == nil {
+		return workloads, nil
+	}
+	pods, err := m.pods.pods()
+	if err == errPodsNotSupported {
+		m.debug.Printf("%v, only applications are restarted\n", err)
+		pods = nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	m.debug.Printf("Found %d pods running\n", len(pods))
+	podIds := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		podIds[pod.ID] = true
+		paths := pod.hostPaths()
+		for _, hostPath := range paths {
+			m.debug.Printf("Adding %s path for pod %s\n", hostPath, pod.ID)
+		}
+		workloads = append(workloads, Workload{ID: pod.ID, Kind: "pod", Paths: paths})
+	}
+	m.mutex.Lock()
+	m.podIds = podIds
+	m.mutex.Unlock()
+	return workloads, nil
+}
+
+// isPod returns true if id is the id of a pod that was last listed.
+func (m *MarathonOrchestrator) isPod(id string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.pods != nil && m.podIds[id]
+}
+
+// Restart restarts the Marathon application or pod identified by id.
+func (m *MarathonOrchestrator) Restart(id string) (string, error) {
+	if m.isPod(id) {
+		deploymentID, err := m.pods.restart(id)
+		if err != nil {
+			return "", err
+		}
+		m.debug.Printf("restarted pod %s deploymentID=%s\n", id, deploymentID)
+		return deploymentID, nil
+	}
+	deploymentID, err := m.client.RestartApplication(id, true)
+	if err != nil {
+		return "", err
+	}
+	m.debug.Printf("restarted %s deploymentID=%s version=%s\n", id, deploymentID.DeploymentID, deploymentID.Version)
+	return deploymentID.DeploymentID, nil
+}
+
+// Deployments returns the Marathon deployments in progress.
+func (m *MarathonOrchestrator) Deployments() ([]Deployment, error) {
+	if m.pods != nil {
+		// go-marathon doesn't read the pods affected by a deployment
+		return m.pods.deployments()
+	}
+	deployments, err := m.client.Deployments()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Deployment, 0, len(deployments))
+	for _, deployment := range deployments {
+		result = append(result, Deployment{
+			ID:        deployment.ID,
+			Workloads: deployment.AffectedApps,
+		})
+	}
+	return result, nil
+}
+
+// Healthy returns true if the Marathon application identified by id is
+// running and passing its health checks, or if the pod identified by id is stable.
+func (m *MarathonOrchestrator) Healthy(id string) (bool, error) {
+	if m.isPod(id) {
+		return m.pods.stable(id)
+	}
+	return m.client.ApplicationOK(id)
+}
+
+// Ping checks that Marathon is reachable and has a leader, which it returns.
+func (m *MarathonOrchestrator) Ping() (string, error) {
+	if _, err := m.client.Ping(); err != nil {
+		return "", err
+	}
+	leader, err := m.client.Leader()
+	if err != nil {
+		return "", err
+	}
+	return "leader " + leader, nil
+}
@@ -0,0 +1,218 @@
+package artifacts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// marathonRestartedAtLabel is the label of a pod changed to restart it, which
+// creates a new version of the pod.
+const marathonRestartedAtLabel = "artifact-manager/restarted-at"
+
+// errPodsNotSupported is returned when Marathon has no /v2/pods endpoint,
+// which was added in Marathon 1.4.
+var errPodsNotSupported = fmt.Errorf("marathon does not support pods")
+
+// marathonPod holds the fields used of a pod listed by /v2/pods.
+type marathonPod struct {
+	ID      string `json:"id"`
+	Volumes []struct {
+		Name string `json:"name"`
+		Host string `json:"host"`
+	} `json:"volumes"`
+	Containers []struct {
+		VolumeMounts []struct {
+			Name string `json:"name"`
+		} `json:"volumeMounts"`
+	} `json:"containers"`
+}
+
+// hostPaths returns the host paths of the volumes mounted by the containers of the pod.
+func (p *marathonPod) hostPaths() []string {
+	mounted := make(map[string]bool)
+	for _, container := range p.Containers {
+		for _, mount := range container.VolumeMounts {
+			mounted[mount.Name] = true
+		}
+	}
+	paths := make([]string, 0)
+	for _, volume := range p.Volumes {
+		if volume.Host != "" && mounted[volume.Name] && !contains(paths, volume.Host) {
+			paths = append(paths, volume.Host)
+		}
+	}
+	return paths
+}
+
+// marathonPodsClient reads and updates pods with the Marathon REST API, since
+// the go-marathon library doesn't support them.
+type marathonPodsClient struct {
+	httpClient *http.Client
+	// the Marathon hosts, each is tried in turn until one of them answers
+	hosts []string
+	// returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// newMarathonPodsClient creates a client for the pods of Marathon. Like
+// NewMarathonClient, it takes one or more "host:port" addresses, which may
+// be separated by commas, and the scheme of the first address is used for
+// the addresses without one.
+func newMarathonPodsClient(httpClient *http.Client, marathonAddrs ...string) *marathonPodsClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	scheme := ""
+	hosts := make([]string, 0)
+	for _, addrs := range marathonAddrs {
+		for _, addr := range strings.Split(addrs, ",") {
+			addr = strings.TrimSpace(addr)
+			if addr == "" {
+				continue
+			}
+			if i := strings.Index(addr, "://"); i >= 0 {
+				if scheme == "" {
+					scheme = addr[:i]
+				}
+			} else {
+				if scheme == "" {
+					scheme = "http"
+				}
+				addr = scheme + "://" + addr
+			}
+			hosts = append(hosts, addr)
+		}
+	}
+	return &marathonPodsClient{
+		httpClient: httpClient,
+		hosts:      hosts,
+		now:        time.Now,
+	}
+}
+
+// pods returns every pod, errPodsNotSupported is returned if Marathon has no pods endpoint.
+func (c *marathonPodsClient) pods() ([]marathonPod, error) {
+	var pods []marathonPod
+	_, err := c.call(http.MethodGet, "/v2/pods", nil, &pods)
+	if err != nil {
+		return nil, err
+	}
+	return pods, nil
+}
+
+// restart creates a new version of the pod identified by id, by changing
+// its restarted-at label, and returns the id of the deployment started.
+func (c *marathonPodsClient) restart(id string) (string, error) {
+	// the definition is updated as it is, so fields this client doesn't
+	// know about are kept
+	var pod map[string]interface{}
+	_, err := c.call(http.MethodGet, "/v2/pods"+id, nil, &pod)
+	if err != nil {
+		return "", err
+	}
+	delete(pod, "version")
+	labels, ok := pod["labels"].(map[string]interface{})
+	if !ok {
+		labels = make(map[string]interface{})
+	}
+	labels[marathonRestartedAtLabel] = c.now().UTC().Format(time.RFC3339Nano)
+	pod["labels"] = labels
+
+	res, err := c.call(http.MethodPut, "/v2/pods"+id+"?force=true", pod, nil)
+	if err != nil {
+		return "", err
+	}
+	return res.Header.Get("Marathon-Deployment-Id"), nil
+}
+
+// stable returns true if every instance of the pod identified by id runs its
+// latest version and is healthy.
+func (c *marathonPodsClient) stable(id string) (bool, error) {
+	var status struct {
+		Status string `json:"status"`
+	}
+	_, err := c.call(http.MethodGet, "/v2/pods"+id+"::status", nil, &status)
+	if err != nil {
+		return false, err
+	}
+	return status.Status == "STABLE", nil
+}
+
+// deployments returns the deployments in progress, including the pods they affect.
+func (c *marathonPodsClient) deployments() ([]Deployment, error) {
+	var deployments []struct {
+		ID           string   `json:"id"`
+		AffectedApps []string `json:"affectedApps"`
+		AffectedPods []string `json:"affectedPods"`
+	}
+	_, err := c.call(http.MethodGet, "/v2/deployments", nil, &deployments)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Deployment, 0, len(deployments))
+	for _, deployment := range deployments {
+		result = append(result, Deployment{
+			ID:        deployment.ID,
+			Workloads: append(append([]string{}, deployment.AffectedApps...), deployment.AffectedPods...),
+		})
+	}
+	return result, nil
+}
+
+// call sends a request to the first Marathon host that answers it and
+// decodes the JSON response into result, unless result is nil.
+func (c *marathonPodsClient) call(method, uri string, body, result interface{}) (*http.Response, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		data, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var lastErr error
+	for _, host := range c.hosts {
+		u := strings.TrimSuffix(host, "/") + uri
+		req, err := http.NewRequest(method, u, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		res, err := c.httpClient.Do(req)
+		if err != nil {
+			// try the next host
+			lastErr = err
+			continue
+		}
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusNotFound && uri == "/v2/pods" {
+			return nil, errPodsNotSupported
+		}
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+			return nil, fmt.Errorf("%s %s returned %d: %s", method, uri, res.StatusCode, strings.TrimSpace(string(message)))
+		}
+		if result != nil {
+			err = json.NewDecoder(res.Body).Decode(result)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read the response of %s %s: %v", method, uri, err)
+			}
+		}
+		return res, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no marathon hosts")
+	}
+	return nil, lastErr
+}
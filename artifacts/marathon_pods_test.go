@@ -0,0 +1,187 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	gohttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const marathonPods = `[
+	{"id": "/mypod", "labels": {"team": "search"}, "version": "2017-01-01T00:00:00.000Z",
+		"volumes": [
+			{"name": "a", "host": "/data/a-latest"},
+			{"name": "unused", "host": "/data/c-latest"},
+			{"name": "scratch"}
+		],
+		"containers": [
+			{"name": "web", "volumeMounts": [{"name": "a", "mountPath": "/a"}, {"name": "scratch", "mountPath": "/tmp"}]},
+			{"name": "sidecar", "volumeMounts": [{"name": "a", "mountPath": "/a"}]}
+		]}
+]`
+
+// newTestMarathonPods creates a "mock" marathon server serving the given pods
+// next to the shared volumes applications, every pod definition PUT is
+// recorded in updates. A pods value of "" makes /v2/pods answer 404.
+func newTestMarathonPods(t *testing.T, pods string) (*httptest.Server, *MarathonOrchestrator, func() []map[string]interface{}) {
+	var mutex sync.Mutex
+	updates := make([]map[string]interface{}, 0)
+	s := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v2/groups":
+			fmt.Fprint(w, `{"id": "/"}`)
+		case r.URL.Path == "/v2/pods" && pods == "":
+			w.WriteHeader(gohttp.StatusNotFound)
+		case r.URL.Path == "/v2/pods":
+			fmt.Fprint(w, pods)
+		case r.URL.Path == "/v2/pods/mypod::status":
+			fmt.Fprint(w, `{"id": "/mypod", "status": "DEGRADED"}`)
+		case r.URL.Path == "/v2/pods/mypod" && r.Method == gohttp.MethodGet:
+			var all []json.RawMessage
+			json.Unmarshal([]byte(pods), &all)
+			w.Write(all[0])
+		case r.URL.Path == "/v2/pods/mypod" && r.Method == gohttp.MethodPut:
+			if r.URL.Query().Get("force") != "true" {
+				t.Errorf("expected the pod to be updated with force, got %s", r.URL.RawQuery)
+			}
+			var pod map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&pod)
+			mutex.Lock()
+			updates = append(updates, pod)
+			mutex.Unlock()
+			w.Header().Set("Marathon-Deployment-Id", "d3")
+			fmt.Fprint(w, "{}")
+		case r.URL.Path == "/v2/deployments":
+			fmt.Fprint(w, `[{"id": "d3", "affectedApps": [], "affectedPods": ["/mypod"], "steps": []}]`)
+		default:
+			fmt.Fprint(w, sharedVolumesApps)
+		}
+	}))
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to parse mock server url %s: %v", s.URL, err)
+	}
+	marathonClient, err := NewMarathonClient(nil, nil, u.Host)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to create marathon client: %v", err)
+	}
+	m := NewMarathonOrchestrator(marathonClient, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	m.EnablePods(s.Client(), "127.0.0.1:1,"+u.Host)
+	m.pods.now = func() time.Time {
+		return time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+	updated := func() []map[string]interface{} {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]map[string]interface{}{}, updates...)
+	}
+	return s, m, updated
+}
+
+// TestMarathonOrchestrator_PodWorkloads tests that pods are listed after the
+// applications with the host paths of the volumes their containers mount.
+func TestMarathonOrchestrator_PodWorkloads(t *testing.T) {
+	s, m, _ := newTestMarathonPods(t, marathonPods)
+	defer s.Close()
+
+	workloads, err := m.Workloads()
+	if err != nil {
+		t.Fatalf("failed to list workloads: %v", err)
+	}
+	if len(workloads) != 3 {
+		t.Fatalf("expected 2 applications and 1 pod, got %+v", workloads)
+	}
+	expected := Workload{ID: "/mypod", Kind: "pod", Paths: []string{"/data/a-latest"}}
+	if !reflect.DeepEqual(workloads[2], expected) {
+		t.Errorf("expected pod %+v, got %+v", expected, workloads[2])
+	}
+
+	service := NewArtifactsService(m, m.debug)
+	if _, err = service.FetchVolumes(); err != nil {
+		t.Fatalf("failed to fetch volumes: %v", err)
+	}
+	byKind := service.GetAppIdsByKind("/data/a-latest")
+	expectedByKind := map[string][]string{"app": {"/myapp"}, "pod": {"/mypod"}}
+	if !reflect.DeepEqual(byKind, expectedByKind) {
+		t.Errorf("expected %v to depend on /data/a-latest, got %v", expectedByKind, byKind)
+	}
+}
+
+// TestMarathonOrchestrator_PodsNotSupported tests that a Marathon without
+// pods is treated as having none.
+func TestMarathonOrchestrator_PodsNotSupported(t *testing.T) {
+	s, m, _ := newTestMarathonPods(t, "")
+	defer s.Close()
+
+	workloads, err := m.Workloads()
+	if err != nil {
+		t.Fatalf("failed to list workloads: %v", err)
+	}
+	for _, workload := range workloads {
+		if workload.Kind != "app" {
+			t.Errorf("expected only applications, got %+v", workload)
+		}
+	}
+}
+
+// TestMarathonOrchestrator_RestartPod tests that a pod is restarted by
+// putting a new version of it, that its deployment is tracked and that its
+// status decides whether it is healthy.
+func TestMarathonOrchestrator_RestartPod(t *testing.T) {
+	s, m, updated := newTestMarathonPods(t, marathonPods)
+	defer s.Close()
+
+	if _, err := m.Workloads(); err != nil {
+		t.Fatalf("failed to list workloads: %v", err)
+	}
+	deploymentID, err := m.Restart("/mypod")
+	if err != nil {
+		t.Fatalf("failed to restart /mypod: %v", err)
+	}
+	if deploymentID != "d3" {
+		t.Errorf("expected deployment d3, got %s", deploymentID)
+	}
+
+	updates := updated()
+	if len(updates) != 1 {
+		t.Fatalf("expected the pod to be updated once, got %v", updates)
+	}
+	if _, ok := updates[0]["version"]; ok {
+		t.Errorf("expected the version to be removed, got %v", updates[0])
+	}
+	expectedLabels := map[string]interface{}{
+		"team":                   "search",
+		marathonRestartedAtLabel: "2017-01-02T03:04:05Z",
+	}
+	if !reflect.DeepEqual(updates[0]["labels"], expectedLabels) {
+		t.Errorf("expected labels %v, got %v", expectedLabels, updates[0]["labels"])
+	}
+	if _, ok := updates[0]["containers"]; !ok {
+		t.Errorf("expected the rest of the pod definition to be kept, got %v", updates[0])
+	}
+
+	deployments, err := m.Deployments()
+	if err != nil {
+		t.Fatalf("failed to list deployments: %v", err)
+	}
+	expectedDeployments := []Deployment{{ID: "d3", Workloads: []string{"/mypod"}}}
+	if !reflect.DeepEqual(deployments, expectedDeployments) {
+		t.Errorf("expected deployments %+v, got %+v", expectedDeployments, deployments)
+	}
+
+	healthy, err := m.Healthy("/mypod")
+	if err != nil || healthy {
+		t.Errorf("expected a degraded pod to be unhealthy, got %v, %v", healthy, err)
+	}
+}
@@ -0,0 +1,274 @@
+package artifacts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	gohttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// newTestMarathonOrchestrator creates a "mock" marathon server which serves
+// the given applications and groups.
+func newTestMarathonOrchestrator(t *testing.T, apps, groups string) (*httptest.Server, *MarathonOrchestrator) {
+	s := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v2/groups":
+			fmt.Fprint(w, groups)
+		case r.URL.Path == "/v2/deployments":
+			fmt.Fprint(w, `[{"id": "d1", "affectedApps": ["/myapp"], "steps": []}]`)
+		case r.Method == gohttp.MethodPost && r.URL.Path == "/v2/apps/myapp/restart":
+			fmt.Fprint(w, `{"deploymentId": "d2", "version": "1"}`)
+		default:
+			fmt.Fprint(w, apps)
+		}
+	}))
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to parse mock server url %s: %v", s.URL, err)
+	}
+	marathonClient, err := NewMarathonClient(nil, nil, u.Host)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to create marathon client: %v", err)
+	}
+	return s, NewMarathonOrchestrator(marathonClient, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+}
+
+// TestMarathonOrchestrator_Workloads tests that the host paths of the volumes
+// and the dependencies of each application are returned.
+func TestMarathonOrchestrator_Workloads(t *testing.T) {
+	groups := `{"id": "/", "apps": [
+		{"id": "/myapp", "dependencies": ["/otherapp"]},
+		{"id": "/otherapp", "dependencies": []}
+	], "groups": []}`
+	s, m := newTestMarathonOrchestrator(t, sharedVolumesApps, groups)
+	defer s.Close()
+
+	workloads, err := m.Workloads()
+	if err != nil {
+		t.Fatalf("failed to list workloads: %v", err)
+	}
+	expected := []Workload{
+		{ID: "/myapp", Kind: "app", Paths: []string{"/data/a-latest", "/data/b-latest"}, Dependencies: []string{"/otherapp"}},
+		{ID: "/otherapp", Kind: "app", Paths: []string{"/data/b-latest"}, Dependencies: []string{}},
+	}
+	if !reflect.DeepEqual(workloads, expected) {
+		t.Errorf("expected workloads %+v, got %+v", expected, workloads)
+	}
+}
+
+// TestMarathonOrchestrator_Restart tests that a restart returns the id of the
+// deployment it started and that deployments are reported.
+func TestMarathonOrchestrator_Restart(t *testing.T) {
+	s, m := newTestMarathonOrchestrator(t, sharedVolumesApps, `{"id": "/"}`)
+	defer s.Close()
+
+	deploymentID, err := m.Restart("/myapp")
+	if err != nil {
+		t.Fatalf("failed to restart /myapp: %v", err)
+	}
+	if deploymentID != "d2" {
+		t.Errorf("expected deployment d2, got %s", deploymentID)
+	}
+
+	deployments, err := m.Deployments()
+	if err != nil {
+		t.Fatalf("failed to list deployments: %v", err)
+	}
+	expected := []Deployment{{ID: "d1", Workloads: []string{"/myapp"}}}
+	if !reflect.DeepEqual(deployments, expected) {
+		t.Errorf("expected deployments %+v, got %+v", expected, deployments)
+	}
+}
+
+// TestNewMarathonClusterOrchestrator tests that the applications and pods of
+// a cluster are queried with its credentials.
+func TestNewMarathonClusterOrchestrator(t *testing.T) {
+	s := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		username, password, ok := r.BasicAuth()
+		if !ok || username != "am" || password != "secret" {
+			w.WriteHeader(gohttp.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v2/groups":
+			fmt.Fprint(w, `{"id": "/"}`)
+		case "/v2/pods":
+			fmt.Fprint(w, `[{"id": "/mypod"}]`)
+		default:
+			fmt.Fprint(w, sharedVolumesApps)
+		}
+	}))
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("unable to parse mock server url %s: %v", s.URL, err)
+	}
+	debug := log.New(ioutil.Discard, log.Prefix(), log.Flags())
+	cluster := core.MarathonCluster{Name: "east", Hosts: u.Host, Username: "am", Password: "secret"}
+	m, err := NewMarathonClusterOrchestrator(cluster, nil, debug)
+	if err != nil {
+		t.Fatalf("unable to create the orchestrator: %v", err)
+	}
+	workloads, err := m.Workloads()
+	if err != nil {
+		t.Fatalf("failed to list workloads: %v", err)
+	}
+	if len(workloads) != 3 || workloads[2].ID != "/mypod" {
+		t.Errorf("expected 2 applications and /mypod, got %+v", workloads)
+	}
+
+	cluster.Password = "wrong"
+	m, err = NewMarathonClusterOrchestrator(cluster, nil, debug)
+	if err != nil {
+		t.Fatalf("unable to create the orchestrator: %v", err)
+	}
+	if _, err = m.Workloads(); err == nil {
+		t.Errorf("expected an error listing workloads with the wrong password")
+	}
+}
+
+// writeCertificate writes certificate, and key unless it is nil, as PEM files
+// in dir and returns their paths.
+func writeCertificate(t *testing.T, dir, name string, certificate []byte, key interface{}) (string, string) {
+	certFile := path.Join(dir, name+".crt")
+	err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0600)
+	if err != nil {
+		t.Fatalf("unable to write %s: %v", certFile, err)
+	}
+	if key == nil {
+		return certFile, ""
+	}
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal the key of %s: %v", name, err)
+	}
+	keyFile := path.Join(dir, name+".key")
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data}), 0600)
+	if err != nil {
+		t.Fatalf("unable to write %s: %v", keyFile, err)
+	}
+	return certFile, keyFile
+}
+
+// newClientCertificate creates a self-signed client certificate.
+func newClientCertificate(t *testing.T) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate a key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "artifact-manager"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	data, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create a certificate: %v", err)
+	}
+	certificate, err := x509.ParseCertificate(data)
+	if err != nil {
+		t.Fatalf("unable to parse the certificate: %v", err)
+	}
+	return certificate, key
+}
+
+// TestNewMarathonClusterOrchestrator_TLS tests that Marathon is reached with
+// https, trusting the given certificate authorities and presenting the given
+// client certificate.
+func TestNewMarathonClusterOrchestrator_TLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "marathon-tls")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clientCertificate, clientKey := newClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCertificate)
+	s := httptest.NewUnstartedServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/v2/groups":
+			fmt.Fprint(w, `{"id": "/"}`)
+		case "/v2/pods":
+			fmt.Fprint(w, `[]`)
+		default:
+			fmt.Fprint(w, sharedVolumesApps)
+		}
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	s.StartTLS()
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		t.Fatalf("unable to parse mock server url %s: %v", s.URL, err)
+	}
+	caFile, _ := writeCertificate(t, dir, "ca", s.Certificate().Raw, nil)
+	certFile, keyFile := writeCertificate(t, dir, "client", clientCertificate.Raw, clientKey)
+	debug := log.New(ioutil.Discard, log.Prefix(), log.Flags())
+
+	cluster := core.MarathonCluster{Hosts: u.Host, Scheme: "https", CAFile: caFile, CertFile: certFile, KeyFile: keyFile}
+	m, err := NewMarathonClusterOrchestrator(cluster, nil, debug)
+	if err != nil {
+		t.Fatalf("unable to create the orchestrator: %v", err)
+	}
+	if workloads, err := m.Workloads(); err != nil || len(workloads) != 2 {
+		t.Errorf("expected 2 applications, got %+v, %v", workloads, err)
+	}
+
+	// without the client certificate the handshake fails
+	cluster.CertFile, cluster.KeyFile = "", ""
+	m, err = NewMarathonClusterOrchestrator(cluster, nil, debug)
+	if err != nil {
+		t.Fatalf("unable to create the orchestrator: %v", err)
+	}
+	if _, err = m.Workloads(); err == nil {
+		t.Errorf("expected an error listing workloads without a client certificate")
+	}
+}
+
+// TestNewMarathonClient_HTTPClient tests that the http client given is used.
+func TestNewMarathonClient_HTTPClient(t *testing.T) {
+	s := httptest.NewTLSServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, sharedVolumesApps)
+	}))
+	defer s.Close()
+
+	// only the client of the test server trusts its certificate
+	client, err := NewMarathonClient(s.Client(), nil, s.URL)
+	if err != nil {
+		t.Fatalf("unable to create marathon client: %v", err)
+	}
+	applications, err := client.Applications(url.Values{})
+	if err != nil || len(applications.Apps) != 2 {
+		t.Errorf("expected 2 applications, got %+v, %v", applications, err)
+	}
+}
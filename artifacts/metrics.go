@@ -0,0 +1,97 @@
+package artifacts
+
+import (
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// batchBuckets are the buckets of the number of updates in a batch.
+var batchBuckets = []float64{1, 2, 5, 10, 20, 50, 100}
+
+// fetchBuckets are the buckets, in seconds, of the time taken to fetch the volumes.
+var fetchBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// serviceMetrics are the metrics of an ArtifactsService, a nil
+// *serviceMetrics records nothing.
+type serviceMetrics struct {
+	batchSize     *core.Histogram
+	fetchDuration *core.Histogram
+	fetchErrors   *core.Counter
+}
+
+// SetMetrics adds the metrics of the batches of updates, the restarts and the
+// fetching of the volumes to registry.
+func (as *ArtifactsService) SetMetrics(registry *core.Registry) {
+	metrics := &serviceMetrics{
+		batchSize: registry.NewHistogram("artifact_manager_restart_batch_size",
+			"Number of updated paths in each batch the applications are restarted for.", batchBuckets),
+		fetchDuration: registry.NewHistogram("artifact_manager_fetch_volumes_duration_seconds",
+			"Time taken to fetch the volumes from the orchestrator.", fetchBuckets),
+		fetchErrors: registry.NewCounter("artifact_manager_fetch_volumes_errors_total",
+			"Number of times fetching the volumes from the orchestrator failed."),
+	}
+	registry.NewGaugeFunc("artifact_manager_fetch_volumes_since_success_seconds",
+		"Time since the volumes were last fetched, -1 until they have been fetched once.",
+		func() float64 {
+			as.mutex.Lock()
+			defer as.mutex.Unlock()
+			if as.lastFetch.IsZero() {
+				return -1
+			}
+			return time.Since(as.lastFetch).Seconds()
+		})
+	registry.NewGaugeFunc("artifact_manager_volumes",
+		"Number of host paths mounted by the workloads last fetched.",
+		func() float64 { return float64(len(as.currentVolumes())) })
+	registry.NewGaugeFunc("artifact_manager_apps",
+		"Number of workloads last fetched.",
+		func() float64 {
+			as.mutex.Lock()
+			defer as.mutex.Unlock()
+			return float64(len(as.kinds))
+		})
+	registry.NewCounterFunc("artifact_manager_restart_attempts_total",
+		"Number of restarts attempted by application.", "app",
+		func() map[string]float64 {
+			return restartCounts(as.RestartStats(), func(stats RestartStats) int { return stats.Restarted + stats.Failed })
+		})
+	registry.NewCounterFunc("artifact_manager_restart_failures_total",
+		"Number of restarts that failed to start by application.", "app",
+		func() map[string]float64 {
+			return restartCounts(as.RestartStats(), func(stats RestartStats) int { return stats.Failed })
+		})
+
+	as.mutex.Lock()
+	as.metrics = metrics
+	as.mutex.Unlock()
+}
+
+// restartCounts returns the count selected by count of each application.
+func restartCounts(stats map[string]RestartStats, count func(RestartStats) int) map[string]float64 {
+	counts := make(map[string]float64, len(stats))
+	for appID, appStats := range stats {
+		counts[appID] = float64(count(appStats))
+	}
+	return counts
+}
+
+// observeFetch records a fetch of the volumes that took duration and failed
+// if err is not nil.
+func (m *serviceMetrics) observeFetch(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.fetchDuration.Observe(duration.Seconds())
+	if err != nil {
+		m.fetchErrors.Inc()
+	}
+}
+
+// observeBatch records a batch of updates the applications are restarted for.
+func (m *serviceMetrics) observeBatch(size int) {
+	if m == nil {
+		return
+	}
+	m.batchSize.Observe(float64(size))
+}
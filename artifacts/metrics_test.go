@@ -0,0 +1,49 @@
+package artifacts
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// TestArtifactsService_Metrics tests that the fetches of the volumes, the
+// batches and the restarts of each application are reported.
+func TestArtifactsService_Metrics(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+	registry := core.NewRegistry()
+	svc.SetMetrics(registry)
+
+	requestQueue := make(chan core.Update, 10)
+	go svc.Run(context.Background(), requestQueue, time.Hour, BatchPolicy{Size: 10, QuietPeriod: 50 * time.Millisecond, MaxWait: 5 * time.Second})
+	defer svc.Stop(context.Background())
+	requestQueue <- core.Update{Path: "/data/a-latest"}
+	requestQueue <- core.Update{Path: "/data/b-latest"}
+	collectRestarts(restarts, 500*time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := registry.Write(&buf); err != nil {
+		t.Fatalf("unable to write the metrics: %v", err)
+	}
+	for _, line := range []string{
+		`artifact_manager_restart_batch_size_bucket{le="2"} 1`,
+		`artifact_manager_fetch_volumes_duration_seconds_count 1`,
+		`artifact_manager_volumes 2`,
+		`artifact_manager_apps 2`,
+		`artifact_manager_restart_attempts_total{app="/myapp"} 1`,
+		`artifact_manager_restart_attempts_total{app="/otherapp"} 1`,
+		`artifact_manager_restart_failures_total{app="/myapp"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("expected the metrics to contain %s, got\n%s", line, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "artifact_manager_fetch_volumes_since_success_seconds -1\n") {
+		t.Errorf("expected the time since the volumes were fetched to be reported")
+	}
+}
@@ -0,0 +1,495 @@
+package artifacts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// nomadJobStub is a job as listed by /v1/jobs.
+type nomadJobStub struct {
+	ID             string `json:"ID"`
+	Namespace      string `json:"Namespace"`
+	JobModifyIndex uint64 `json:"JobModifyIndex"`
+}
+
+// nomadJob holds the fields used of a job read from /v1/job/<id>.
+type nomadJob struct {
+	ID             string `json:"ID"`
+	Namespace      string `json:"Namespace"`
+	JobModifyIndex uint64 `json:"JobModifyIndex"`
+	TaskGroups     []struct {
+		Name    string `json:"Name"`
+		Volumes map[string]struct {
+			Type   string `json:"Type"`
+			Source string `json:"Source"`
+		} `json:"Volumes"`
+		Tasks []struct {
+			Driver string `json:"Driver"`
+			Config struct {
+				// docker "host:container[:mode]" volumes
+				Volumes []string `json:"volumes"`
+				// docker mounts, "mount" with HCL2 and "mounts" before it
+				Mount  []nomadMount `json:"mount"`
+				Mounts []nomadMount `json:"mounts"`
+			} `json:"Config"`
+		} `json:"Tasks"`
+	} `json:"TaskGroups"`
+}
+
+type nomadMount struct {
+	Type   string `json:"type"`
+	Source string `json:"source"`
+}
+
+// nomadAllocation is an allocation as listed by /v1/allocations.
+type nomadAllocation struct {
+	ID           string `json:"ID"`
+	JobID        string `json:"JobID"`
+	Namespace    string `json:"Namespace"`
+	TaskGroup    string `json:"TaskGroup"`
+	NodeID       string `json:"NodeID"`
+	ClientStatus string `json:"ClientStatus"`
+}
+
+// nomadNodeStub is a node as listed by /v1/nodes.
+type nomadNodeStub struct {
+	ID          string `json:"ID"`
+	ModifyIndex uint64 `json:"ModifyIndex"`
+}
+
+// nomadNode holds the fields used of a node read from /v1/node/<id>.
+type nomadNode struct {
+	ID          string `json:"ID"`
+	ModifyIndex uint64 `json:"ModifyIndex"`
+	HostVolumes map[string]struct {
+		Path string `json:"Path"`
+	} `json:"HostVolumes"`
+}
+
+// NomadOrchestrator is an Orchestrator for the task groups of the jobs run by
+// HashiCorp Nomad.
+//
+// The workloads are identified by "<namespace>/<job>/<task group>". The paths
+// of a task group are the host paths of its docker volumes and bind mounts,
+// and the paths of the host volumes it uses on the nodes its allocations run
+// on. If a path prefix is set, only the paths within it are reported.
+//
+// The jobs and allocations are kept up to date using blocking queries once
+// Run has been called, the nodes the allocations run on are read again
+// whenever the allocations change and the node was modified. A workload is
+// restarted by restarting each of its running allocations.
+type NomadOrchestrator struct {
+	baseURL    string
+	httpClient *http.Client
+	debug      *log.Logger
+	logger     *core.Logger
+	// the ACL token sent with every request, may be empty
+	token string
+	// the namespace of the jobs, "*" for every namespace, the default namespace if empty
+	namespace string
+	// the directory the reported paths have to be within, may be empty
+	pathPrefix string
+	// how long to wait before retrying a query that failed
+	retryInterval time.Duration
+	// how long a blocking query waits for a change
+	waitTime time.Duration
+
+	mutex *sync.Mutex
+	// namespace and job id to the job
+	jobs map[string]*nomadJob
+	// the allocations last listed
+	allocations []nomadAllocation
+	// node id to the nodes the allocations run on
+	nodes       map[string]*nomadNode
+	jobsListed  bool
+	allocListed bool
+}
+
+// NewNomadOrchestrator creates a NomadOrchestrator using the Nomad HTTP API at
+// baseURL, such as "http://localhost:4646".
+//
+// The debug argument allows debug messages to be written to the provided logger.
+func NewNomadOrchestrator(baseURL string, httpClient *http.Client, debug *log.Logger) *NomadOrchestrator {
+	return &NomadOrchestrator{
+		baseURL:       strings.TrimSuffix(baseURL, "/"),
+		httpClient:    httpClient,
+		debug:         debug,
+		logger:        core.DefaultLogger(),
+		retryInterval: 5 * time.Second,
+		waitTime:      5 * time.Minute,
+		mutex:         &sync.Mutex{},
+		jobs:          make(map[string]*nomadJob),
+		allocations:   make([]nomadAllocation, 0),
+		nodes:         make(map[string]*nomadNode),
+	}
+}
+
+// SetToken sets the ACL token sent with every request.
+func (n *NomadOrchestrator) SetToken(token string) {
+	n.token = token
+}
+
+// SetNamespace sets the namespace of the jobs, "*" watches every namespace.
+func (n *NomadOrchestrator) SetNamespace(namespace string) {
+	n.namespace = namespace
+}
+
+// SetPathPrefix limits the paths reported to those within prefix, such as
+// the ExternalDir of the configuration.
+func (n *NomadOrchestrator) SetPathPrefix(prefix string) {
+	n.pathPrefix = prefix
+}
+
+// SetLogger sets the logger the problems the orchestrator works around are logged
+// with, core.DefaultLogger by default.
+func (n *NomadOrchestrator) SetLogger(logger *core.Logger) {
+	n.logger = logger
+}
+
+// Run watches the jobs and allocations until ctx is done.
+func (n *NomadOrchestrator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n.watch(ctx, "/v1/jobs", n.updateJobs)
+	}()
+	go func() {
+		defer wg.Done()
+		n.watch(ctx, "/v1/allocations", n.updateAllocations)
+	}()
+	wg.Wait()
+}
+
+// Workloads returns the task groups along with the paths they mount. An error
+// is returned until the jobs and allocations have been listed.
+func (n *NomadOrchestrator) Workloads() ([]Workload, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if !n.jobsListed || !n.allocListed {
+		return nil, fmt.Errorf("the nomad jobs and allocations have not been listed yet")
+	}
+
+	// task group to the nodes its allocations are running on
+	groupNodes := make(map[string][]string)
+	for _, allocation := range n.allocations {
+		if allocation.ClientStatus != "running" {
+			continue
+		}
+		id := nomadWorkloadID(allocation.Namespace, allocation.JobID, allocation.TaskGroup)
+		groupNodes[id] = append(groupNodes[id], allocation.NodeID)
+	}
+
+	workloads := make([]Workload, 0)
+	for _, job := range n.jobs {
+		for _, group := range job.TaskGroups {
+			id := nomadWorkloadID(job.Namespace, job.ID, group.Name)
+			paths := make([]string, 0)
+			add := func(hostPath string) {
+				if path.IsAbs(hostPath) && n.withinPrefix(hostPath) && !contains(paths, hostPath) {
+					paths = append(paths, hostPath)
+				}
+			}
+			for _, task := range group.Tasks {
+				for _, volume := range task.Config.Volumes {
+					add(strings.SplitN(volume, ":", 2)[0])
+				}
+				for _, mount := range append(task.Config.Mount, task.Config.Mounts...) {
+					if mount.Type == "" || mount.Type == "bind" {
+						add(mount.Source)
+					}
+				}
+			}
+			for _, volume := range group.Volumes {
+				if volume.Type != "host" {
+					continue
+				}
+				for _, nodeID := range groupNodes[id] {
+					if node, ok := n.nodes[nodeID]; ok {
+						if hostVolume, ok := node.HostVolumes[volume.Source]; ok {
+							add(hostVolume.Path)
+						}
+					}
+				}
+			}
+			workloads = append(workloads, Workload{ID: id, Kind: "group", Paths: paths})
+		}
+	}
+	sort.Slice(workloads, func(i, j int) bool {
+		return workloads[i].ID < workloads[j].ID
+	})
+	n.debug.Printf("Found %d nomad task groups\n", len(workloads))
+	return workloads, nil
+}
+
+// nomadRestartAttempts is the number of times the restart of an allocation
+// is attempted before the restart of its task group fails.
+const nomadRestartAttempts = 3
+
+// Restart restarts the running allocations of the task group identified by id.
+//
+// An allocation that fails to restart is attempted again after the retry
+// interval, without restarting the allocations already restarted. An error
+// naming the allocations that couldn't be restarted is returned once they
+// have been attempted nomadRestartAttempts times.
+func (n *NomadOrchestrator) Restart(id string) (string, error) {
+	n.mutex.Lock()
+	allocationIds := make([]string, 0)
+	for _, allocation := range n.allocations {
+		if allocation.ClientStatus == "running" && nomadWorkloadID(allocation.Namespace, allocation.JobID, allocation.TaskGroup) == id {
+			allocationIds = append(allocationIds, allocation.ID)
+		}
+	}
+	n.mutex.Unlock()
+	if len(allocationIds) == 0 {
+		return "", fmt.Errorf("%s has no running allocations", id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	errs := make(map[string]error)
+	for attempt := 1; ; attempt++ {
+		failed := make([]string, 0)
+		for _, allocationID := range allocationIds {
+			res, err := n.do(ctx, http.MethodPost, "/v1/client/allocation/"+allocationID+"/restart", nil, strings.NewReader("{}"))
+			if err != nil {
+				errs[allocationID] = err
+				failed = append(failed, allocationID)
+				continue
+			}
+			res.Body.Close()
+			n.debug.Printf("restarted allocation %s of %s\n", allocationID, id)
+		}
+		if len(failed) == 0 {
+			return "", nil
+		}
+		if attempt == nomadRestartAttempts || ctx.Err() != nil {
+			problems := make([]string, 0, len(failed))
+			for _, allocationID := range failed {
+				problems = append(problems, fmt.Sprintf("allocation %s: %v", allocationID, errs[allocationID]))
+			}
+			return "", fmt.Errorf("failed to restart %d allocations of %s: %s", len(failed), id, strings.Join(problems, "; "))
+		}
+		n.logger.Warnf("failed to restart %d allocations of %s, retrying in %s: %v", len(failed), id, n.retryInterval, errs[failed[0]])
+		allocationIds = failed
+		select {
+		case <-ctx.Done():
+		case <-time.After(n.retryInterval):
+		}
+	}
+}
+
+// watch reads apiPath with blocking queries until ctx is done, handing the
+// body of every response to update. A failed query is retried after the
+// retry interval.
+func (n *NomadOrchestrator) watch(ctx context.Context, apiPath string, update func(context.Context, []byte) error) {
+	var index uint64
+	for ctx.Err() == nil {
+		query := url.Values{}
+		if index > 0 {
+			query.Set("index", strconv.FormatUint(index, 10))
+			query.Set("wait", fmt.Sprintf("%ds", int(n.waitTime.Seconds())))
+		}
+		body, newIndex, err := n.get(ctx, apiPath, query)
+		if err == nil && newIndex != index {
+			err = update(ctx, body)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			n.logger.Warnf("problem querying nomad %s, retrying in %s: %v", apiPath, n.retryInterval, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(n.retryInterval):
+			}
+			continue
+		}
+		// the index may go backwards, for example after a leader election,
+		// in which case the query starts over
+		if newIndex < index {
+			newIndex = 0
+		}
+		index = newIndex
+	}
+}
+
+// updateJobs reads the jobs of a /v1/jobs response whose definition changed.
+func (n *NomadOrchestrator) updateJobs(ctx context.Context, body []byte) error {
+	var stubs []nomadJobStub
+	err := json.Unmarshal(body, &stubs)
+	if err != nil {
+		return fmt.Errorf("unable to read the list of jobs: %v", err)
+	}
+
+	n.mutex.Lock()
+	known := n.jobs
+	n.mutex.Unlock()
+
+	jobs := make(map[string]*nomadJob, len(stubs))
+	for _, stub := range stubs {
+		key := stub.Namespace + "/" + stub.ID
+		if job, ok := known[key]; ok && job.JobModifyIndex == stub.JobModifyIndex {
+			jobs[key] = job
+			continue
+		}
+		query := url.Values{}
+		query.Set("namespace", stub.Namespace)
+		data, _, err := n.get(ctx, "/v1/job/"+url.PathEscape(stub.ID), query)
+		if err != nil {
+			return err
+		}
+		job := new(nomadJob)
+		err = json.Unmarshal(data, job)
+		if err != nil {
+			return fmt.Errorf("unable to read job %s: %v", stub.ID, err)
+		}
+		n.debug.Printf("read nomad job %s\n", key)
+		jobs[key] = job
+	}
+
+	n.mutex.Lock()
+	n.jobs = jobs
+	n.jobsListed = true
+	n.mutex.Unlock()
+	return nil
+}
+
+// updateAllocations stores the allocations of a /v1/allocations response and
+// reads the nodes they run on that are not known yet or were modified since
+// they were read, such as to add a host volume.
+func (n *NomadOrchestrator) updateAllocations(ctx context.Context, body []byte) error {
+	var allocations []nomadAllocation
+	err := json.Unmarshal(body, &allocations)
+	if err != nil {
+		return fmt.Errorf("unable to read the list of allocations: %v", err)
+	}
+	data, _, err := n.get(ctx, "/v1/nodes", nil)
+	if err != nil {
+		return err
+	}
+	var stubs []nomadNodeStub
+	err = json.Unmarshal(data, &stubs)
+	if err != nil {
+		return fmt.Errorf("unable to read the list of nodes: %v", err)
+	}
+	modifyIndexes := make(map[string]uint64, len(stubs))
+	for _, stub := range stubs {
+		modifyIndexes[stub.ID] = stub.ModifyIndex
+	}
+
+	n.mutex.Lock()
+	known := n.nodes
+	n.mutex.Unlock()
+
+	nodes := make(map[string]*nomadNode)
+	for _, allocation := range allocations {
+		if _, ok := nodes[allocation.NodeID]; ok || allocation.NodeID == "" {
+			continue
+		}
+		// a node missing from the list, for example because it registered
+		// since, is read rather than kept as it was
+		modifyIndex, listed := modifyIndexes[allocation.NodeID]
+		if node, ok := known[allocation.NodeID]; ok && listed && node.ModifyIndex == modifyIndex {
+			nodes[allocation.NodeID] = node
+			continue
+		}
+		data, _, err := n.get(ctx, "/v1/node/"+url.PathEscape(allocation.NodeID), nil)
+		if err != nil {
+			return err
+		}
+		node := new(nomadNode)
+		err = json.Unmarshal(data, node)
+		if err != nil {
+			return fmt.Errorf("unable to read node %s: %v", allocation.NodeID, err)
+		}
+		n.debug.Printf("read nomad node %s\n", allocation.NodeID)
+		nodes[allocation.NodeID] = node
+	}
+
+	n.mutex.Lock()
+	n.allocations = allocations
+	n.nodes = nodes
+	n.allocListed = true
+	n.mutex.Unlock()
+	return nil
+}
+
+// withinPrefix returns true if hostPath is within the path prefix, or there
+// is no path prefix.
+func (n *NomadOrchestrator) withinPrefix(hostPath string) bool {
+	if n.pathPrefix == "" {
+		return true
+	}
+	prefix := path.Clean(n.pathPrefix)
+	return hostPath == prefix || strings.HasPrefix(hostPath, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// get reads apiPath and returns the body along with the X-Nomad-Index of the response.
+func (n *NomadOrchestrator) get(ctx context.Context, apiPath string, query url.Values) ([]byte, uint64, error) {
+	if n.namespace != "" && query.Get("namespace") == "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("namespace", n.namespace)
+	}
+	res, err := n.do(ctx, http.MethodGet, apiPath, query, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	index, _ := strconv.ParseUint(res.Header.Get("X-Nomad-Index"), 10, 64)
+	return data, index, nil
+}
+
+// do sends a request to Nomad and returns the response if it succeeded,
+// otherwise an error including the status returned.
+func (n *NomadOrchestrator) do(ctx context.Context, method, apiPath string, query url.Values, body io.Reader) (*http.Response, error) {
+	u := n.baseURL + apiPath
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if n.token != "" {
+		req.Header.Set("X-Nomad-Token", n.token)
+	}
+
+	res, err := n.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, fmt.Errorf("%s %s returned %d: %s", method, apiPath, res.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return res, nil
+}
+
+// nomadWorkloadID returns the id of a task group.
+func nomadWorkloadID(namespace, jobID, group string) string {
+	return namespace + "/" + jobID + "/" + group
+}
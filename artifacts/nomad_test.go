@@ -0,0 +1,309 @@
+package artifacts
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	gohttp "net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubNomad is a "mock" Nomad HTTP API answering blocking queries for the
+// jobs and allocations.
+type stubNomad struct {
+	mutex       *sync.Mutex
+	index       uint64
+	changed     chan struct{}
+	jobs        map[string]string
+	allocations string
+	nodes       map[string]string
+	// node id to the index the node was last modified at
+	nodesModified map[string]uint64
+	// the number of blocking queries received, and of nodes read
+	blocking  int
+	nodeReads int
+	restarts  []string
+	// allocation id to the number of times restarting it fails
+	failRestarts map[string]int
+}
+
+func newStubNomad() *stubNomad {
+	return &stubNomad{
+		mutex:         &sync.Mutex{},
+		index:         1,
+		changed:       make(chan struct{}),
+		jobs:          make(map[string]string),
+		nodes:         make(map[string]string),
+		nodesModified: make(map[string]uint64),
+		restarts:      make([]string, 0),
+		failRestarts:  make(map[string]int),
+	}
+}
+
+// update changes the jobs or allocations and wakes up the blocking queries.
+func (s *stubNomad) update(change func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	change()
+	s.index++
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *stubNomad) ServeHTTP(w gohttp.ResponseWriter, r *gohttp.Request) {
+	if r.Method == gohttp.MethodPost && strings.HasSuffix(r.URL.Path, "/restart") {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		allocationID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/client/allocation/"), "/restart")
+		if s.failRestarts[allocationID] > 0 {
+			s.failRestarts[allocationID]--
+			w.WriteHeader(gohttp.StatusInternalServerError)
+			fmt.Fprint(w, "Unknown allocation")
+			return
+		}
+		s.restarts = append(s.restarts, allocationID)
+		fmt.Fprint(w, "{}")
+		return
+	}
+
+	s.mutex.Lock()
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if index > 0 {
+		s.blocking++
+	}
+	for index >= s.index {
+		changed := s.changed
+		s.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+		s.mutex.Lock()
+	}
+	defer s.mutex.Unlock()
+
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(s.index, 10))
+	switch {
+	case r.URL.Path == "/v1/jobs":
+		stubs := make([]string, 0)
+		for id := range s.jobs {
+			stubs = append(stubs, fmt.Sprintf(`{"ID": "%s", "Namespace": "default", "JobModifyIndex": %d}`, id, s.index))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(stubs, ","))
+	case strings.HasPrefix(r.URL.Path, "/v1/job/"):
+		fmt.Fprint(w, s.jobs[strings.TrimPrefix(r.URL.Path, "/v1/job/")])
+	case r.URL.Path == "/v1/allocations":
+		fmt.Fprint(w, s.allocations)
+	case r.URL.Path == "/v1/nodes":
+		stubs := make([]string, 0)
+		for id := range s.nodes {
+			stubs = append(stubs, fmt.Sprintf(`{"ID": "%s", "ModifyIndex": %d}`, id, s.nodesModified[id]))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(stubs, ","))
+	case strings.HasPrefix(r.URL.Path, "/v1/node/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/node/")
+		var node map[string]interface{}
+		json.Unmarshal([]byte(s.nodes[id]), &node)
+		node["ModifyIndex"] = s.nodesModified[id]
+		json.NewEncoder(w).Encode(node)
+		s.nodeReads++
+	default:
+		w.WriteHeader(gohttp.StatusNotFound)
+	}
+}
+
+const (
+	nomadWebJob = `{"ID": "web", "Namespace": "default", "TaskGroups": [{
+		"Name": "app",
+		"Volumes": {"models": {"Type": "host", "Source": "models"}, "certs": {"Type": "csi", "Source": "certs"}},
+		"Tasks": [{"Driver": "docker", "Config": {
+			"volumes": ["/srv/artifacts/a-latest:/a:ro", "local/config:/config", "/etc/hosts:/etc/hosts"],
+			"mount": [{"type": "bind", "source": "/srv/artifacts/b-latest", "target": "/b"}, {"type": "volume", "source": "cache"}]
+		}}]
+	}]}`
+	nomadBatchJob = `{"ID": "batch", "Namespace": "default", "TaskGroups": [{
+		"Name": "worker",
+		"Tasks": [{"Driver": "docker", "Config": {"volumes": ["/srv/artifacts/c-latest:/c"]}}]
+	}]}`
+	nomadAllocations = `[
+		{"ID": "a1", "JobID": "web", "Namespace": "default", "TaskGroup": "app", "NodeID": "n1", "ClientStatus": "running"},
+		{"ID": "a2", "JobID": "web", "Namespace": "default", "TaskGroup": "app", "NodeID": "n1", "ClientStatus": "complete"}
+	]`
+	nomadNode1 = `{"ID": "n1", "HostVolumes": {"models": {"Path": "/srv/artifacts/models-latest"}}}`
+)
+
+func newTestNomad(t *testing.T) (*stubNomad, *NomadOrchestrator, func()) {
+	stub := newStubNomad()
+	stub.jobs["web"] = nomadWebJob
+	stub.allocations = nomadAllocations
+	stub.nodes["n1"] = nomadNode1
+	stub.nodesModified["n1"] = 1
+	s := httptest.NewServer(stub)
+
+	n := NewNomadOrchestrator(s.URL, s.Client(), log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	n.SetPathPrefix("/srv/artifacts/")
+	n.retryInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		n.Run(ctx)
+		close(done)
+	}()
+	return stub, n, func() {
+		cancel()
+		<-done
+		s.Close()
+	}
+}
+
+// waitForNomadWorkloads returns the workloads once check returns true for them.
+func waitForNomadWorkloads(t *testing.T, n *NomadOrchestrator, check func([]Workload) bool) []Workload {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		workloads, err := n.Workloads()
+		if err == nil && check(workloads) {
+			return workloads
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("gave up waiting for the workloads, last got %+v, %v", workloads, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// TestNomadOrchestrator_Workloads tests that the docker volumes, bind mounts and
+// host volumes within the path prefix are found, and that changes are picked
+// up by the blocking queries.
+func TestNomadOrchestrator_Workloads(t *testing.T) {
+	stub, n, stop := newTestNomad(t)
+	defer stop()
+
+	workloads := waitForNomadWorkloads(t, n, func([]Workload) bool { return true })
+	expected := []Workload{
+		{ID: "default/web/app", Kind: "group", Paths: []string{"/srv/artifacts/a-latest", "/srv/artifacts/b-latest", "/srv/artifacts/models-latest"}},
+	}
+	if !reflect.DeepEqual(workloads, expected) {
+		t.Errorf("expected workloads %+v, got %+v", expected, workloads)
+	}
+
+	stub.update(func() {
+		stub.jobs["batch"] = nomadBatchJob
+	})
+	waitForNomadWorkloads(t, n, func(workloads []Workload) bool {
+		return len(workloads) == 2 && workloads[0].ID == "default/batch/worker"
+	})
+
+	stub.mutex.Lock()
+	blocking := stub.blocking
+	stub.mutex.Unlock()
+	if blocking == 0 {
+		t.Errorf("expected blocking queries to be used")
+	}
+}
+
+// TestNomadOrchestrator_NodeChanges tests that a node is only read again once
+// it was modified, such as to change the path of a host volume.
+func TestNomadOrchestrator_NodeChanges(t *testing.T) {
+	stub, n, stop := newTestNomad(t)
+	defer stop()
+	waitForNomadWorkloads(t, n, func([]Workload) bool { return true })
+
+	stub.update(func() {
+		stub.allocations = strings.Replace(nomadAllocations, `"complete"`, `"failed"`, 1)
+	})
+	waitForNomadWorkloads(t, n, func([]Workload) bool {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		return n.allocations[1].ClientStatus == "failed"
+	})
+	stub.mutex.Lock()
+	nodeReads := stub.nodeReads
+	stub.mutex.Unlock()
+	if nodeReads != 1 {
+		t.Errorf("expected the unmodified node to be read once, it was read %d times", nodeReads)
+	}
+
+	stub.update(func() {
+		stub.nodes["n1"] = strings.Replace(nomadNode1, "models-latest", "models-v2", 1)
+		stub.nodesModified["n1"] = stub.index + 1
+		stub.allocations = nomadAllocations
+	})
+	waitForNomadWorkloads(t, n, func(workloads []Workload) bool {
+		return len(workloads) == 1 && contains(workloads[0].Paths, "/srv/artifacts/models-v2")
+	})
+}
+
+// TestNomadOrchestrator_Restart tests that only the running allocations of a
+// task group are restarted.
+func TestNomadOrchestrator_Restart(t *testing.T) {
+	stub, n, stop := newTestNomad(t)
+	defer stop()
+	waitForNomadWorkloads(t, n, func([]Workload) bool { return true })
+
+	if _, err := n.Restart("default/web/app"); err != nil {
+		t.Fatalf("failed to restart: %v", err)
+	}
+	stub.mutex.Lock()
+	restarts := stub.restarts
+	stub.mutex.Unlock()
+	if !reflect.DeepEqual(restarts, []string{"a1"}) {
+		t.Errorf("expected allocation a1 to be restarted, got %v", restarts)
+	}
+
+	if _, err := n.Restart("default/batch/worker"); err == nil {
+		t.Errorf("expected an error restarting a task group without allocations")
+	}
+}
+
+// TestNomadOrchestrator_RestartFails tests that only the allocations that
+// failed to restart are attempted again.
+func TestNomadOrchestrator_RestartFails(t *testing.T) {
+	stub, n, stop := newTestNomad(t)
+	defer stop()
+	stub.update(func() {
+		stub.allocations = `[
+			{"ID": "a1", "JobID": "web", "Namespace": "default", "TaskGroup": "app", "NodeID": "n1", "ClientStatus": "running"},
+			{"ID": "a3", "JobID": "web", "Namespace": "default", "TaskGroup": "app", "NodeID": "n1", "ClientStatus": "running"}
+		]`
+	})
+	waitForNomadWorkloads(t, n, func([]Workload) bool {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+		return len(n.allocations) == 2 && n.allocations[1].ID == "a3"
+	})
+
+	stub.mutex.Lock()
+	stub.failRestarts["a3"] = 1
+	stub.mutex.Unlock()
+	if _, err := n.Restart("default/web/app"); err != nil {
+		t.Fatalf("expected the failed allocation to be restarted again, got: %v", err)
+	}
+	stub.mutex.Lock()
+	restarts := stub.restarts
+	stub.restarts = make([]string, 0)
+	stub.failRestarts["a3"] = nomadRestartAttempts
+	stub.mutex.Unlock()
+	if !reflect.DeepEqual(restarts, []string{"a1", "a3"}) {
+		t.Errorf("expected allocations a1 and a3 to be restarted once, got %v", restarts)
+	}
+
+	_, err := n.Restart("default/web/app")
+	if err == nil || !strings.Contains(err.Error(), "allocation a3") || strings.Contains(err.Error(), "allocation a1") {
+		t.Errorf("expected an error for allocation a3 only, got: %v", err)
+	}
+	stub.mutex.Lock()
+	restarts = stub.restarts
+	stub.mutex.Unlock()
+	if !reflect.DeepEqual(restarts, []string{"a1"}) {
+		t.Errorf("expected allocation a1 to be restarted once, got %v", restarts)
+	}
+}
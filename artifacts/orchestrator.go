@@ -0,0 +1,62 @@
+package artifacts
+
+// Workload is something run by an Orchestrator that may mount the paths
+// managed by the artifact manager, such as a Marathon application.
+type Workload struct {
+	// identifies the workload to the Orchestrator
+	ID string
+	// the kind of workload, such as "app" or "pod" for Marathon, may be empty
+	Kind string
+	// the host paths mounted by the workload
+	Paths []string
+	// the ids of the workloads that have to be restarted before this one,
+	// may be empty
+	Dependencies []string
+}
+
+// Orchestrator is a system that runs workloads.
+type Orchestrator interface {
+	// Workloads returns the workloads that are running along with the host
+	// paths they mount.
+	Workloads() ([]Workload, error)
+	// Restart restarts the workload identified by id, returning the id of the
+	// deployment started by the restart. The id may be empty if the
+	// Orchestrator does not track deployments.
+	Restart(id string) (string, error)
+}
+
+// Deployment is a change to one or more workloads that is in progress.
+type Deployment struct {
+	ID string
+	// the ids of the workloads affected by the deployment
+	Workloads []string
+}
+
+// DeploymentTracker is implemented by an Orchestrator that can report the
+// deployments in progress.
+//
+// Restarts of a workload are held back while one of its deployments is in
+// progress, and the restarts of a wave wait for the deployments started by
+// the previous wave. Without a DeploymentTracker, a restart is considered to
+// be deployed as soon as it was started.
+type DeploymentTracker interface {
+	Deployments() ([]Deployment, error)
+}
+
+// HealthChecker is implemented by an Orchestrator that can report whether a
+// workload is healthy.
+//
+// It is used to gate the restarts of the next wave on the health of the
+// previous one, see RolloutPolicy. Without a HealthChecker, workloads are
+// considered healthy.
+type HealthChecker interface {
+	Healthy(id string) (bool, error)
+}
+
+// Pinger is implemented by an Orchestrator that can check that it is
+// reachable, it is used to report whether the application is ready.
+type Pinger interface {
+	// Ping returns a description of the orchestrator reached, such as its
+	// leader, or an error if it can't be reached.
+	Ping() (string, error)
+}
@@ -0,0 +1,104 @@
+package artifacts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"reflect"
+	"sync"
+	"testing"
+
+	"apex/artifact-manager/core"
+)
+
+// fakeOrchestrator is an Orchestrator running the given workloads that
+// records every restart. It neither tracks deployments nor health.
+type fakeOrchestrator struct {
+	mutex     *sync.Mutex
+	workloads []Workload
+	// workload ids whose restart fails
+	failing  map[string]bool
+	restarts []string
+}
+
+func newFakeOrchestrator(workloads ...Workload) *fakeOrchestrator {
+	return &fakeOrchestrator{
+		mutex:     &sync.Mutex{},
+		workloads: workloads,
+		failing:   make(map[string]bool),
+		restarts:  make([]string, 0),
+	}
+}
+
+func (f *fakeOrchestrator) Workloads() ([]Workload, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]Workload{}, f.workloads...), nil
+}
+
+func (f *fakeOrchestrator) Restart(id string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failing[id] {
+		return "", fmt.Errorf("unable to restart %s", id)
+	}
+	f.restarts = append(f.restarts, id)
+	return "", nil
+}
+
+func (f *fakeOrchestrator) restarted() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.restarts...)
+}
+
+func newFakeService(t *testing.T, orchestrator Orchestrator) *ArtifactsService {
+	debug := log.New(ioutil.Discard, log.Prefix(), log.Flags())
+	svc := NewArtifactsService(orchestrator, debug)
+	if _, err := svc.FetchVolumes(); err != nil {
+		t.Fatalf("failed to fetch volumes: %v", err)
+	}
+	return svc
+}
+
+// TestArtifactsService_FakeOrchestrator tests that the workloads mounting an
+// updated path are restarted in the order of their dependencies.
+func TestArtifactsService_FakeOrchestrator(t *testing.T) {
+	orchestrator := newFakeOrchestrator(
+		Workload{ID: "web", Paths: []string{"/data/a-latest"}, Dependencies: []string{"api"}},
+		Workload{ID: "api", Paths: []string{"/data/a-latest", "/data/b-latest"}},
+		Workload{ID: "batch", Paths: []string{"/data/c-latest"}},
+	)
+	svc := newFakeService(t, orchestrator)
+
+	if !svc.HasArtifact("/data/b-latest") {
+		t.Errorf("expected to have workloads associated with /data/b-latest")
+	}
+
+	// without deployment tracking every wave is restarted right away
+	svc.restartApps([]core.Update{{Path: "/data/a-latest"}})
+	expected := []string{"api", "web"}
+	if restarts := orchestrator.restarted(); !reflect.DeepEqual(restarts, expected) {
+		t.Errorf("expected restarts %v, got %v", expected, restarts)
+	}
+	if svc.scheduler.pendingCount() != 0 {
+		t.Errorf("expected no pending restarts, got %d", svc.scheduler.pendingCount())
+	}
+}
+
+// TestArtifactsService_FakeOrchestratorFailure tests that a workload the
+// Orchestrator fails to restart is counted as failed.
+func TestArtifactsService_FakeOrchestratorFailure(t *testing.T) {
+	orchestrator := newFakeOrchestrator(
+		Workload{ID: "api", Paths: []string{"/data/a-latest"}},
+		Workload{ID: "worker", Paths: []string{"/data/a-latest"}},
+	)
+	orchestrator.failing["worker"] = true
+	svc := newFakeService(t, orchestrator)
+
+	svc.restartApps([]core.Update{{Path: "/data/a-latest"}})
+	stats := svc.RestartStats()
+	if stats["api"].Restarted != 1 || stats["worker"].Failed != 1 {
+		t.Errorf("expected api to be restarted and worker to fail, got %+v", stats)
+	}
+}
@@ -0,0 +1,542 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// RestartLimits controls how quickly applications are restarted.
+//
+// A value that is not greater than zero disables that limit.
+type RestartLimits struct {
+	// the maximum number of deployments started by a restart that may be in progress at once
+	MaxInFlight int
+	// the maximum number of restarts started in any one minute
+	MaxPerMinute int
+	// the minimum time between two restarts of the same application, a restart
+	// requested before the cooldown has passed waits for it
+	Cooldown time.Duration
+}
+
+// RolloutPolicy controls how the health of restarted applications gates the
+// remaining restarts.
+type RolloutPolicy struct {
+	// the number of applications of each batch that are restarted, and have to
+	// pass the soak time, before the rest of the batch, 0 disables canaries
+	CanarySize int
+	// how long restarted applications have to stay healthy before the next
+	// wave is restarted, 0 disables health gating
+	SoakTime time.Duration
+	// how long restarted applications may take to become healthy, once their
+	// deployments finished, before the remaining restarts are halted, 0 waits forever
+	HealthTimeout time.Duration
+	// re-point the symlinks of the updated paths an unhealthy application
+	// depends on to their previous target when the restarts are halted
+	Rollback bool
+}
+
+// RestartStats counts what happened to the restarts requested for an application.
+type RestartStats struct {
+	// the number of restarts that were started
+	Restarted int
+	// the number of restarts that the Orchestrator refused
+	Failed int
+	// the number of restarts that had to wait for a limit, the cooldown or an
+	// unfinished deployment
+	Queued int
+	// the number of restarts that were dropped because a restart of the
+	// application was already pending or because the restarts were halted
+	Dropped int
+}
+
+// restartScheduler restarts applications while staying within its limits.
+//
+// Applications are restarted in waves, the applications of a wave are only
+// restarted once the deployments of the previous wave have finished and, if
+// the RolloutPolicy has a soak time, the applications have been healthy for it.
+// Applications that can't be restarted right away are kept pending until
+// a later call to dispatch finds room for them.
+type restartScheduler struct {
+	orchestrator Orchestrator
+	debug        *log.Logger
+	limits       RestartLimits
+	policy       RolloutPolicy
+	// returns the current time, replaced in tests
+	now func() time.Time
+	// called with the id of each application that was restarted and the id of
+	// the deployment its restart started, may be nil
+	restarted func(appID, deploymentID string)
+	// called with the id of each application whose requested restart won't be
+	// done, because it was dropped or failed, and the reason why, may be nil
+	abandoned func(appID, reason string)
+	// called with the ids of the restarted applications of each wave once it
+	// passed the health gating, may be nil
+	rolledOut func(appIDs []string)
+	// returns the logger the restarts of an application are logged with, may be nil
+	appLogger func(appID string) *core.Logger
+	// returns the spans the restart of an application is linked to, may be nil
+	appLinks func(appID string) []core.SpanContext
+
+	// held by dispatch, so only one runs at a time while mutex is released
+	// for the calls to the Orchestrator
+	dispatching *sync.Mutex
+	mutex       *sync.Mutex
+	// waves of application ids waiting to be restarted, in the order they were requested
+	pending [][]string
+	// application ids of the first pending wave that have been restarted
+	started []string
+	// the time the deployments of the first pending wave were seen to be finished
+	waveDeployed time.Time
+	// application id to the time it has been healthy since, for the first pending wave
+	healthySince map[string]time.Time
+	// application ids that have been counted as queued while pending
+	queued map[string]bool
+	// application ids whose pending restart skips the cooldown
+	forced map[string]bool
+	// application id to the id of the deployment its restart started
+	inFlight map[string]string
+	// application id to the time it was last restarted
+	lastRestart map[string]time.Time
+	// the times restarts were started within the last minute
+	recent []time.Time
+	stats  map[string]RestartStats
+	// the tracer each restart is traced with, may be nil
+	tracer *core.Tracer
+}
+
+func newRestartScheduler(orchestrator Orchestrator, debug *log.Logger) *restartScheduler {
+	rs := restartScheduler{
+		orchestrator: orchestrator,
+		debug:        debug,
+		now:          time.Now,
+		dispatching:  &sync.Mutex{},
+		mutex:        &sync.Mutex{},
+		pending:      make([][]string, 0),
+		started:      make([]string, 0),
+		healthySince: make(map[string]time.Time),
+		queued:       make(map[string]bool),
+		forced:       make(map[string]bool),
+		inFlight:     make(map[string]string),
+		lastRestart:  make(map[string]time.Time),
+		recent:       make([]time.Time, 0),
+		stats:        make(map[string]RestartStats),
+	}
+	return &rs
+}
+
+// schedule adds the given waves of applications to the pending restarts.
+//
+// Applications restarted within the cooldown wait for it to pass, unless
+// force is set, and applications already pending are only restarted once,
+// the restart requested again is dropped. If the RolloutPolicy has canaries,
+// they are split from the first wave into a wave of their own.
+func (rs *restartScheduler) schedule(waves [][]string, force bool) {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	if size := rs.policy.CanarySize; size > 0 && len(waves) > 0 && len(waves[0]) > size {
+		canaries := append([]string{}, waves[0][:size]...)
+		waves = append([][]string{canaries, waves[0][size:]}, waves[1:]...)
+	}
+
+	for _, appIds := range waves {
+		wave := make([]string, 0, len(appIds))
+		for _, appID := range appIds {
+			if contains(wave, appID) {
+				continue
+			}
+			if force {
+				rs.forced[appID] = true
+			}
+			if rs.isPending(appID) {
+				rs.debug.Printf("a restart of %s is already pending, dropping the one requested again\n", appID)
+				stats := rs.stats[appID]
+				stats.Dropped++
+				rs.stats[appID] = stats
+				continue
+			}
+			wave = append(wave, appID)
+		}
+		if len(wave) > 0 {
+			rs.pending = append(rs.pending, wave)
+		}
+	}
+}
+
+// cooldown returns how much longer appID has to wait before it is restarted
+// again, 0 if it doesn't.
+func (rs *restartScheduler) cooldown(appID string, now time.Time) time.Duration {
+	last, ok := rs.lastRestart[appID]
+	if !ok || rs.limits.Cooldown <= 0 || rs.forced[appID] || now.Sub(last) >= rs.limits.Cooldown {
+		return 0
+	}
+	return rs.limits.Cooldown - now.Sub(last)
+}
+
+// dispatch restarts as many of the pending applications as the limits allow.
+//
+// The Orchestrator is called without holding the mutex, so restarts can be
+// scheduled, and the stats read, while it answers.
+//
+// If the remaining restarts were halted, the id of the application that did
+// not become healthy is returned, along with the restarted applications of
+// the halted wave, otherwise an empty string.
+func (rs *restartScheduler) dispatch() (string, []string) {
+	rs.dispatching.Lock()
+	defer rs.dispatching.Unlock()
+
+	if rs.idle() {
+		return "", nil
+	}
+
+	activeDeployments, busyApps, err := rs.deployments()
+	if err != nil {
+		rs.logger("").Warnf("failed to list deployments, %d restarts remain pending: %v", rs.pendingCount(), err)
+		return "", nil
+	}
+
+	rs.mutex.Lock()
+	for appID, deploymentID := range rs.inFlight {
+		if !activeDeployments[deploymentID] {
+			rs.debug.Printf("deployment %s of %s has finished\n", deploymentID, appID)
+			delete(rs.inFlight, appID)
+		}
+	}
+
+	now := rs.now()
+	recent := make([]time.Time, 0, len(rs.recent))
+	for _, t := range rs.recent {
+		if now.Sub(t) < time.Minute {
+			recent = append(recent, t)
+		}
+	}
+	rs.recent = recent
+	rs.mutex.Unlock()
+
+	for rs.dispatchWave(busyApps, now) {
+		// the next wave waits until every deployment of this wave has finished
+		rs.mutex.Lock()
+		started := append([]string{}, rs.started...)
+		policy := rs.policy
+		for _, appID := range started {
+			if _, ok := rs.inFlight[appID]; ok {
+				rs.mutex.Unlock()
+				return "", nil
+			}
+		}
+		rs.mutex.Unlock()
+
+		health := rs.health(started, policy)
+		rs.mutex.Lock()
+		healthy, unhealthyAppID := rs.waveHealthy(now, health)
+		if unhealthyAppID != "" {
+			dropped := rs.halt(unhealthyAppID)
+			rs.mutex.Unlock()
+			for _, appID := range dropped {
+				rs.abandon(appID, fmt.Sprintf("the restarts were halted because %s is unhealthy", unhealthyAppID))
+			}
+			return unhealthyAppID, started
+		}
+		if !healthy {
+			rs.mutex.Unlock()
+			return "", nil
+		}
+		rs.nextWave()
+		rs.mutex.Unlock()
+		if len(started) > 0 && rs.rolledOut != nil {
+			rs.rolledOut(started)
+		}
+	}
+	return "", nil
+}
+
+// deployments returns the ids of the deployments in progress and the ids of
+// the applications they affect. If that isn't known then nothing is
+// restarted until the next attempt, an Orchestrator that doesn't track
+// deployments has none in progress.
+func (rs *restartScheduler) deployments() (map[string]bool, map[string]bool, error) {
+	activeDeployments := make(map[string]bool)
+	busyApps := make(map[string]bool)
+	tracker, ok := rs.orchestrator.(DeploymentTracker)
+	if !ok {
+		return activeDeployments, busyApps, nil
+	}
+	deployments, err := tracker.Deployments()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, deployment := range deployments {
+		activeDeployments[deployment.ID] = true
+		for _, appID := range deployment.Workloads {
+			busyApps[appID] = true
+		}
+	}
+	return activeDeployments, busyApps, nil
+}
+
+// health returns whether each of the given applications is healthy, or nil
+// if the policy doesn't gate the next wave on it.
+func (rs *restartScheduler) health(appIds []string, policy RolloutPolicy) map[string]bool {
+	checker, ok := rs.orchestrator.(HealthChecker)
+	if !ok || policy.SoakTime <= 0 || len(appIds) == 0 {
+		return nil
+	}
+	healthy := make(map[string]bool, len(appIds))
+	for _, appID := range appIds {
+		ok, err := checker.Healthy(appID)
+		if err != nil {
+			rs.logger(appID).Warnf("failed to check the health of %s: %v", appID, err)
+		}
+		healthy[appID] = ok
+	}
+	return healthy
+}
+
+// waveHealthy returns true once every restarted application of the first
+// pending wave has been healthy, according to health, for the soak time.
+//
+// If an application is not healthy once the health timeout has passed, its
+// id is returned.
+func (rs *restartScheduler) waveHealthy(now time.Time, health map[string]bool) (bool, string) {
+	if health == nil {
+		return true, ""
+	}
+	if rs.waveDeployed.IsZero() {
+		rs.waveDeployed = now
+	}
+
+	healthy := true
+	for _, appID := range rs.started {
+		if !health[appID] {
+			delete(rs.healthySince, appID)
+			healthy = false
+			if rs.policy.HealthTimeout > 0 && now.Sub(rs.waveDeployed) >= rs.policy.HealthTimeout {
+				return false, appID
+			}
+			continue
+		}
+		since, ok := rs.healthySince[appID]
+		if !ok {
+			rs.debug.Printf("%s is healthy, waiting %s before continuing\n", appID, rs.policy.SoakTime)
+			since = now
+			rs.healthySince[appID] = since
+		}
+		if now.Sub(since) < rs.policy.SoakTime {
+			healthy = false
+		}
+	}
+	return healthy, ""
+}
+
+// halt drops every pending restart because appID did not become healthy and
+// returns the applications whose restarts were dropped.
+func (rs *restartScheduler) halt(appID string) []string {
+	dropped := make([]string, 0)
+	for _, wave := range rs.pending {
+		for _, pendingAppID := range wave {
+			delete(rs.queued, pendingAppID)
+			delete(rs.forced, pendingAppID)
+			stats := rs.stats[pendingAppID]
+			stats.Dropped++
+			rs.stats[pendingAppID] = stats
+			dropped = append(dropped, pendingAppID)
+		}
+	}
+	rs.logger(appID).Warnf("halting restarts, %s did not become healthy within %s, dropped %d pending restarts", appID, rs.policy.HealthTimeout, len(dropped))
+	rs.pending = make([][]string, 0)
+	rs.nextWave()
+	return dropped
+}
+
+// nextWave forgets the first pending wave.
+func (rs *restartScheduler) nextWave() {
+	if len(rs.pending) > 0 {
+		rs.pending = rs.pending[1:]
+	}
+	rs.started = make([]string, 0)
+	rs.waveDeployed = time.Time{}
+	rs.healthySince = make(map[string]time.Time)
+}
+
+// dispatchWave restarts as many applications of the first pending wave as
+// the limits allow, it returns true if none of them remain pending. The
+// mutex is released while the Orchestrator restarts them.
+func (rs *restartScheduler) dispatchWave(busyApps map[string]bool, now time.Time) bool {
+	rs.mutex.Lock()
+	if len(rs.pending) == 0 {
+		rs.mutex.Unlock()
+		return false
+	}
+	_, tracksDeployments := rs.orchestrator.(DeploymentTracker)
+	inFlight, recent := len(rs.inFlight), len(rs.recent)
+	pending := make([]string, 0)
+	restarts := make([]string, 0)
+	for _, appID := range rs.pending[0] {
+		reason := ""
+		switch wait := rs.cooldown(appID, now); {
+		case wait > 0:
+			reason = fmt.Sprintf("it is within the cooldown of %s for another %s", rs.limits.Cooldown, wait)
+		case busyApps[appID]:
+			reason = "its last deployment has not finished"
+		case rs.limits.MaxInFlight > 0 && inFlight >= rs.limits.MaxInFlight:
+			reason = "the maximum number of deployments are in progress"
+		case rs.limits.MaxPerMinute > 0 && recent >= rs.limits.MaxPerMinute:
+			reason = "the maximum number of restarts per minute has been reached"
+		}
+		if reason != "" {
+			if !rs.queued[appID] {
+				rs.logger(appID).Infof("queueing restart of %s, %s", appID, reason)
+				rs.queued[appID] = true
+				stats := rs.stats[appID]
+				stats.Queued++
+				rs.stats[appID] = stats
+			}
+			pending = append(pending, appID)
+			continue
+		}
+
+		delete(rs.queued, appID)
+		delete(rs.forced, appID)
+		restarts = append(restarts, appID)
+		if tracksDeployments {
+			inFlight++
+		}
+		recent++
+	}
+	rs.pending[0] = pending
+	tracer := rs.tracer
+	rs.mutex.Unlock()
+
+	for _, appID := range restarts {
+		logger := rs.logger(appID)
+		logger.Infof("restarting %s", appID)
+		_, span := tracer.Start(context.Background(), "restart", rs.links(appID)...)
+		span.SetAttribute("app", appID)
+		deploymentID, err := rs.orchestrator.Restart(appID)
+		span.SetAttribute("deployment", deploymentID)
+		span.SetError(err)
+		span.End()
+
+		rs.mutex.Lock()
+		stats := rs.stats[appID]
+		if err != nil {
+			stats.Failed++
+			rs.stats[appID] = stats
+			rs.mutex.Unlock()
+			logger.Warnf("failed to restart %s: %v", appID, err)
+			rs.abandon(appID, fmt.Sprintf("the restart failed: %v", err))
+			continue
+		}
+		stats.Restarted++
+		rs.stats[appID] = stats
+		if tracksDeployments {
+			rs.inFlight[appID] = deploymentID
+		}
+		rs.lastRestart[appID] = now
+		rs.recent = append(rs.recent, now)
+		rs.started = append(rs.started, appID)
+		rs.mutex.Unlock()
+		if rs.restarted != nil {
+			rs.restarted(appID, deploymentID)
+		}
+	}
+
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return len(rs.pending) > 0 && len(rs.pending[0]) == 0
+}
+
+// abandon reports that the requested restart of appID won't be done.
+func (rs *restartScheduler) abandon(appID, reason string) {
+	if rs.abandoned != nil {
+		rs.abandoned(appID, reason)
+	}
+}
+
+// logger returns the logger the restarts of appID are logged with, or what
+// concerns no application in particular if appID is empty.
+func (rs *restartScheduler) logger(appID string) *core.Logger {
+	if rs.appLogger == nil {
+		return core.DefaultLogger()
+	}
+	return rs.appLogger(appID)
+}
+
+// links returns the spans the restart of appID is linked to.
+func (rs *restartScheduler) links(appID string) []core.SpanContext {
+	if rs.appLinks == nil {
+		return nil
+	}
+	return rs.appLinks(appID)
+}
+
+// pendingCount returns the number of applications waiting to be restarted.
+func (rs *restartScheduler) pendingCount() int {
+	return len(rs.pendingApps())
+}
+
+// pendingApps returns the ids of the applications waiting to be restarted,
+// in the order they are restarted in.
+func (rs *restartScheduler) pendingApps() []string {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	appIds := make([]string, 0)
+	for _, wave := range rs.pending {
+		appIds = append(appIds, wave...)
+	}
+	return appIds
+}
+
+// idle returns true if there are no waves of applications left to restart,
+// or to wait for.
+func (rs *restartScheduler) idle() bool {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return len(rs.pending) == 0
+}
+
+// setTracer sets the tracer each restart is traced with.
+func (rs *restartScheduler) setTracer(tracer *core.Tracer) {
+	rs.mutex.Lock()
+	rs.tracer = tracer
+	rs.mutex.Unlock()
+}
+
+// setLimits replaces the limits used by the scheduler.
+func (rs *restartScheduler) setLimits(limits RestartLimits) {
+	rs.mutex.Lock()
+	rs.limits = limits
+	rs.mutex.Unlock()
+}
+
+// setPolicy replaces the rollout policy used by the scheduler.
+func (rs *restartScheduler) setPolicy(policy RolloutPolicy) {
+	rs.mutex.Lock()
+	rs.policy = policy
+	rs.mutex.Unlock()
+}
+
+// snapshot returns a copy of the restart statistics for each application.
+func (rs *restartScheduler) snapshot() map[string]RestartStats {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	stats := make(map[string]RestartStats, len(rs.stats))
+	for appID, s := range rs.stats {
+		stats[appID] = s
+	}
+	return stats
+}
+
+func (rs *restartScheduler) isPending(appID string) bool {
+	for _, wave := range rs.pending {
+		if contains(wave, appID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,408 @@
+package artifacts
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	gohttp "net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deployingMarathon is a "mock" marathon server that starts a deployment for
+// every restart and keeps it in progress until it is finished by the test.
+type deployingMarathon struct {
+	mutex       sync.Mutex
+	restarted   []string
+	deployments map[string]string
+	// applications whose tasks are not running
+	unhealthy map[string]bool
+}
+
+func (m *deployingMarathon) ServeHTTP(w gohttp.ResponseWriter, r *gohttp.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == gohttp.MethodPost && strings.HasSuffix(r.URL.Path, "/restart") {
+		appID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v2/apps"), "/restart")
+		deploymentID := fmt.Sprintf("deployment-%d", len(m.restarted))
+		m.restarted = append(m.restarted, appID)
+		m.deployments[deploymentID] = appID
+		fmt.Fprintf(w, `{"deploymentId": "%s", "version": "1"}`, deploymentID)
+		return
+	}
+	if r.URL.Path == "/v2/deployments" {
+		deployments := make([]map[string]interface{}, 0)
+		for id, appID := range m.deployments {
+			deployments = append(deployments, map[string]interface{}{
+				"id":           id,
+				"affectedApps": []string{appID},
+				"steps":        []interface{}{},
+			})
+		}
+		json.NewEncoder(w).Encode(deployments)
+		return
+	}
+	if r.Method == gohttp.MethodGet && strings.HasPrefix(r.URL.Path, "/v2/apps/") {
+		appID := strings.TrimPrefix(r.URL.Path, "/v2/apps")
+		tasksRunning := 1
+		if m.unhealthy[appID] {
+			tasksRunning = 0
+		}
+		fmt.Fprintf(w, `{"app": {"id": "%s", "instances": 1, "tasksRunning": %d, "tasks": []}}`, appID, tasksRunning)
+		return
+	}
+	w.WriteHeader(gohttp.StatusNotFound)
+}
+
+// finish completes every deployment in progress.
+func (m *deployingMarathon) finish() {
+	m.mutex.Lock()
+	m.deployments = make(map[string]string)
+	m.mutex.Unlock()
+}
+
+// deploy starts a deployment of appID that was not caused by a restart.
+func (m *deployingMarathon) deploy(appID string) {
+	m.mutex.Lock()
+	m.deployments["external-"+appID] = appID
+	m.mutex.Unlock()
+}
+
+// setHealthy changes whether the tasks of appID are running.
+func (m *deployingMarathon) setHealthy(appID string, healthy bool) {
+	m.mutex.Lock()
+	m.unhealthy[appID] = !healthy
+	m.mutex.Unlock()
+}
+
+func (m *deployingMarathon) restarts() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string{}, m.restarted...)
+}
+
+func newTestScheduler(t *testing.T, limits RestartLimits) (*httptest.Server, *deployingMarathon, *restartScheduler) {
+	m := &deployingMarathon{deployments: make(map[string]string), unhealthy: make(map[string]bool)}
+	s := httptest.NewServer(m)
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to parse mock server url %s: %v", s.URL, err)
+	}
+	marathonClient, err := NewMarathonClient(nil, nil, u.Host)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to create marathon client: %v", err)
+	}
+	debug := log.New(ioutil.Discard, log.Prefix(), log.Flags())
+	rs := newRestartScheduler(NewMarathonOrchestrator(marathonClient, debug), debug)
+	rs.setLimits(limits)
+	return s, m, rs
+}
+
+// TestRestartScheduler_MaxInFlight tests that no more restarts are started
+// while the maximum number of deployments are in progress.
+func TestRestartScheduler_MaxInFlight(t *testing.T) {
+	s, m, rs := newTestScheduler(t, RestartLimits{MaxInFlight: 1})
+	defer s.Close()
+
+	rs.schedule([][]string{{"/a", "/b"}}, false)
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 1 || restarts[0] != "/a" {
+		t.Fatalf("expected only /a to be restarted, got %v", restarts)
+	}
+	if rs.pendingCount() != 1 {
+		t.Errorf("expected 1 pending restart, got %d", rs.pendingCount())
+	}
+
+	// nothing changes while the deployment is in progress
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 1 {
+		t.Fatalf("expected 1 restart while the deployment is in progress, got %v", restarts)
+	}
+
+	m.finish()
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 2 || restarts[1] != "/b" {
+		t.Fatalf("expected /b to be restarted once the deployment finished, got %v", restarts)
+	}
+
+	stats := rs.snapshot()
+	if stats["/a"].Queued != 0 || stats["/a"].Restarted != 1 {
+		t.Errorf("expected /a to be restarted without being queued, got %+v", stats["/a"])
+	}
+	if stats["/b"].Queued != 1 || stats["/b"].Restarted != 1 {
+		t.Errorf("expected /b to be queued once and restarted, got %+v", stats["/b"])
+	}
+}
+
+// TestRestartScheduler_MaxPerMinute tests that restarts beyond the rate limit
+// wait until a minute has passed.
+func TestRestartScheduler_MaxPerMinute(t *testing.T) {
+	s, m, rs := newTestScheduler(t, RestartLimits{MaxPerMinute: 2})
+	defer s.Close()
+
+	now := time.Now()
+	rs.now = func() time.Time { return now }
+
+	rs.schedule([][]string{{"/a", "/b", "/c"}}, false)
+	rs.dispatch()
+	m.finish()
+	if restarts := m.restarts(); len(restarts) != 2 {
+		t.Fatalf("expected 2 restarts, got %v", restarts)
+	}
+
+	now = now.Add(30 * time.Second)
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 2 {
+		t.Fatalf("expected 2 restarts within the minute, got %v", restarts)
+	}
+
+	now = now.Add(31 * time.Second)
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 3 || restarts[2] != "/c" {
+		t.Fatalf("expected /c to be restarted after a minute, got %v", restarts)
+	}
+}
+
+// TestRestartScheduler_Cooldown tests that a restart requested within the
+// cooldown waits for it to pass, and that one requested while another is
+// pending is dropped.
+func TestRestartScheduler_Cooldown(t *testing.T) {
+	s, m, rs := newTestScheduler(t, RestartLimits{Cooldown: time.Minute})
+	defer s.Close()
+
+	now := time.Now()
+	rs.now = func() time.Time { return now }
+	abandoned := make([]string, 0)
+	rs.abandoned = func(appID, reason string) {
+		abandoned = append(abandoned, appID)
+	}
+
+	rs.schedule([][]string{{"/a"}}, false)
+	rs.dispatch()
+	m.finish()
+
+	now = now.Add(30 * time.Second)
+	rs.schedule([][]string{{"/a"}}, false)
+	rs.schedule([][]string{{"/a"}}, false)
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 1 {
+		t.Fatalf("expected the second restart to wait for the cooldown, got %v", restarts)
+	}
+	if stats := rs.snapshot()["/a"]; stats.Queued != 1 || stats.Dropped != 1 {
+		t.Errorf("expected 1 queued and 1 dropped restart, got %+v", stats)
+	}
+	if len(abandoned) != 0 || rs.pendingCount() != 1 {
+		t.Errorf("expected the restart of /a to stay pending, got %d pending and %v abandoned", rs.pendingCount(), abandoned)
+	}
+
+	now = now.Add(31 * time.Second)
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 2 {
+		t.Fatalf("expected a restart once the cooldown passed, got %v", restarts)
+	}
+	m.finish()
+
+	// a forced restart, such as that of a rollback, skips the cooldown
+	now = now.Add(10 * time.Second)
+	rs.schedule([][]string{{"/a"}}, true)
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 3 {
+		t.Fatalf("expected a forced restart within the cooldown, got %v", restarts)
+	}
+}
+
+// TestRestartScheduler_UnfinishedDeployment tests that an application is not
+// restarted while it has a deployment in progress.
+func TestRestartScheduler_UnfinishedDeployment(t *testing.T) {
+	s, m, rs := newTestScheduler(t, RestartLimits{})
+	defer s.Close()
+
+	m.deploy("/a")
+	rs.schedule([][]string{{"/a", "/a"}}, false)
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 0 {
+		t.Fatalf("expected no restarts while /a is deploying, got %v", restarts)
+	}
+	if rs.pendingCount() != 1 {
+		t.Errorf("expected 1 pending restart, got %d", rs.pendingCount())
+	}
+
+	m.finish()
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 1 {
+		t.Fatalf("expected /a to be restarted once its deployment finished, got %v", restarts)
+	}
+}
+
+// TestRestartScheduler_Waves tests that a wave is only restarted once the
+// deployments of the previous wave have finished.
+func TestRestartScheduler_Waves(t *testing.T) {
+	s, m, rs := newTestScheduler(t, RestartLimits{})
+	defer s.Close()
+
+	rs.schedule([][]string{{"/db", "/cache"}, {"/api"}}, false)
+	rs.dispatch()
+	if restarts := m.restarts(); !reflect.DeepEqual(restarts, []string{"/db", "/cache"}) {
+		t.Fatalf("expected the first wave to be restarted, got %v", restarts)
+	}
+
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 2 {
+		t.Fatalf("expected the second wave to wait for the first, got %v", restarts)
+	}
+
+	m.finish()
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 3 || restarts[2] != "/api" {
+		t.Fatalf("expected the second wave to be restarted, got %v", restarts)
+	}
+	if rs.pendingCount() != 0 {
+		t.Errorf("expected no pending restarts, got %d", rs.pendingCount())
+	}
+}
+
+// TestRestartScheduler_SoakTime tests that the next wave is only restarted
+// once the previous wave has been healthy for the soak time.
+func TestRestartScheduler_SoakTime(t *testing.T) {
+	s, m, rs := newTestScheduler(t, RestartLimits{})
+	defer s.Close()
+	rs.setPolicy(RolloutPolicy{SoakTime: time.Minute, HealthTimeout: 10 * time.Minute})
+
+	now := time.Now()
+	rs.now = func() time.Time { return now }
+
+	m.setHealthy("/db", false)
+	rs.schedule([][]string{{"/db"}, {"/api"}}, false)
+	rs.dispatch()
+	m.finish()
+
+	// /db is not healthy yet
+	now = now.Add(2 * time.Minute)
+	rs.dispatch()
+	m.setHealthy("/db", true)
+	now = now.Add(time.Minute)
+	rs.dispatch()
+	now = now.Add(30 * time.Second)
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 1 {
+		t.Fatalf("expected /api to wait for /db to soak, got %v", restarts)
+	}
+
+	now = now.Add(30 * time.Second)
+	rs.dispatch()
+	if restarts := m.restarts(); len(restarts) != 2 || restarts[1] != "/api" {
+		t.Fatalf("expected /api to be restarted once /db soaked, got %v", restarts)
+	}
+}
+
+// TestRestartScheduler_Halt tests that the remaining restarts are dropped when
+// a restarted application doesn't become healthy within the health timeout.
+func TestRestartScheduler_Halt(t *testing.T) {
+	s, m, rs := newTestScheduler(t, RestartLimits{})
+	defer s.Close()
+	rs.setPolicy(RolloutPolicy{CanarySize: 1, SoakTime: time.Minute, HealthTimeout: 5 * time.Minute})
+
+	now := time.Now()
+	rs.now = func() time.Time { return now }
+
+	abandoned := make([]string, 0)
+	rs.abandoned = func(appID, reason string) {
+		abandoned = append(abandoned, appID)
+	}
+	m.setHealthy("/a", false)
+	rs.schedule([][]string{{"/a", "/b"}, {"/c"}}, false)
+	if unhealthy, _ := rs.dispatch(); unhealthy != "" {
+		t.Fatalf("expected no halt, got %s", unhealthy)
+	}
+	if restarts := m.restarts(); !reflect.DeepEqual(restarts, []string{"/a"}) {
+		t.Fatalf("expected only the canary /a to be restarted, got %v", restarts)
+	}
+	m.finish()
+	rs.dispatch()
+
+	now = now.Add(5 * time.Minute)
+	unhealthy, halted := rs.dispatch()
+	if unhealthy != "/a" {
+		t.Fatalf("expected the restarts to be halted by /a, got %q", unhealthy)
+	}
+	if !reflect.DeepEqual(halted, []string{"/a"}) {
+		t.Errorf("expected the halted wave to be the canary /a, got %v", halted)
+	}
+	if !reflect.DeepEqual(abandoned, []string{"/b", "/c"}) {
+		t.Errorf("expected the restarts of /b and /c to be abandoned, got %v", abandoned)
+	}
+	if rs.pendingCount() != 0 {
+		t.Errorf("expected no pending restarts after halting, got %d", rs.pendingCount())
+	}
+	stats := rs.snapshot()
+	if stats["/b"].Dropped != 1 || stats["/c"].Dropped != 1 {
+		t.Errorf("expected /b and /c to be dropped, got %+v", stats)
+	}
+	if restarts := m.restarts(); len(restarts) != 1 {
+		t.Errorf("expected no further restarts, got %v", restarts)
+	}
+}
+
+// blockingOrchestrator is a fakeOrchestrator whose restarts wait until they
+// are released.
+type blockingOrchestrator struct {
+	*fakeOrchestrator
+	restarting chan string
+	release    chan struct{}
+}
+
+func (b *blockingOrchestrator) Restart(id string) (string, error) {
+	b.restarting <- id
+	<-b.release
+	return b.fakeOrchestrator.Restart(id)
+}
+
+// TestRestartScheduler_DispatchUnlocked tests that restarts can be scheduled,
+// and the stats read, while dispatch waits for the Orchestrator.
+func TestRestartScheduler_DispatchUnlocked(t *testing.T) {
+	orchestrator := &blockingOrchestrator{
+		fakeOrchestrator: newFakeOrchestrator(),
+		restarting:       make(chan string, 10),
+		release:          make(chan struct{}),
+	}
+	rs := newRestartScheduler(orchestrator, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	rs.schedule([][]string{{"/a"}}, false)
+
+	dispatched := make(chan struct{})
+	go func() {
+		defer close(dispatched)
+		rs.dispatch()
+	}()
+	if id := <-orchestrator.restarting; id != "/a" {
+		t.Fatalf("expected /a to be restarted, got %s", id)
+	}
+
+	scheduled := make(chan struct{})
+	go func() {
+		defer close(scheduled)
+		rs.schedule([][]string{{"/b"}}, false)
+		rs.snapshot()
+	}()
+	select {
+	case <-scheduled:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the restarts to be scheduled while /a is restarting")
+	}
+	close(orchestrator.release)
+	<-dispatched
+
+	if restarts := orchestrator.restarted(); !reflect.DeepEqual(restarts, []string{"/a", "/b"}) {
+		t.Errorf("expected /a and then /b to be restarted, got %v", restarts)
+	}
+}
@@ -1,212 +1,876 @@
 package artifacts
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
-	"net"
-	"net/http"
-	"net/url"
 	"strings"
 	"sync"
 	"time"
 
-	marathon "github.com/gambol99/go-marathon"
+	"apex/artifact-manager/core"
 )
 
-// NewMarathonClient configures and returns a Marathon client.
-//
-// httpClient    - a custom http client may be provided, otherwise pass nil
-// debug         - The third-party marathon library being used allows debug
-// 				   output to be written to a writer, pass nil if you want debug
-//                 for that library to be disabled.
-// marathonAddrs - one or more "host:port" addresses used to connect to Marathon
-func NewMarathonClient(httpClient *http.Client, debug io.Writer, marathonAddrs ...string) (marathon.Marathon, error) {
-	config := marathon.NewDefaultConfig()
-	config.URL = fmt.Sprintf("http://%s", strings.Join(marathonAddrs, ","))
-	if debug != nil {
-		config.LogOutput = debug
-	}
-	if httpClient == nil {
-		config.HTTPClient = &http.Client{
-			Timeout: (time.Duration(10) * time.Second),
-			Transport: &http.Transport{
-				Dial: (&net.Dialer{
-					Timeout:   10 * time.Second,
-					KeepAlive: 10 * time.Second,
-				}).Dial,
-			},
-		}
-	}
-
-	client, err := marathon.NewClient(config)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create a client for marathon, error: %v", err)
-	}
-	return client, nil
-}
-
-// ArtifactsService represents a service for managing Marathon application
-// artifacts.
+// ArtifactsService represents a service for managing the artifacts of the
+// workloads run by an Orchestrator.
 type ArtifactsService struct {
-	volumes Volumes
-	client  marathon.Marathon
-	debug   *log.Logger
-	mutex   *sync.Mutex
-	stopCh  chan struct{}
+	volumes      Volumes
+	dependencies Dependencies
+	// workload id to its kind
+	kinds        map[string]string
+	orchestrator Orchestrator
+	debug        *log.Logger
+	mutex        *sync.Mutex
+	scheduler    *restartScheduler
+	// application id to the updates with a symlink that its restart rolls
+	// out, until the wave it is restarted in passed the health gating or
+	// halted, used to roll back
+	rollouts map[string][]core.Update
+	// application id to the rolled back paths its pending restart was
+	// requested for
+	rollbacks map[string][]string
+	// whether updates are rolled back when restarts are halted
+	rollback bool
+	// the journal updates are acknowledged in once their applications restarted, may be nil
+	journal *core.Journal
+	// application id to the ids of the journaled updates waiting for it to restart
+	waiting map[string][]uint64
+	// update id to the number of applications it is still waiting for
+	remaining map[uint64]int
+	// the audit log restarts and rollbacks are recorded in, may be nil
+	audit *core.AuditLog
+	// the logger the service is logged with, core.DefaultLogger if nil
+	logger *core.Logger
+	// application id to the updates its pending restart was requested for
+	causes map[string][]core.Update
+	// the metrics of the service, may be nil
+	metrics *serviceMetrics
+	// the tracer the batches of updates and the restarts are traced with, may be nil
+	tracer *core.Tracer
+	// when the volumes were last fetched successfully
+	lastFetch time.Time
+	// the error the volumes were last fetched with, nil if they were fetched
+	fetchErr error
+	// closed once the volumes have been fetched for the first time
+	fetched     chan struct{}
+	fetchedOnce *sync.Once
+	// the interval set by SetFetchInterval, until Run fetches with it
+	fetchInterval chan time.Duration
+	// how often pending restarts are retried
+	dispatchInterval time.Duration
+	// cancels the context Run is using, nil until Run is called
+	cancel context.CancelFunc
+	// set once Stop is called, a later call to Run returns right away
 	stopped bool
+	// the context Stop was called with, the pending restarts are dispatched
+	// until it is done
+	stopping context.Context
+	// closed once Run has returned
+	done chan struct{}
 }
 
 // NewArtifactsService configures, creates and returns a new ArtifactsService.
 //
 // The debug argument allows debug messages to be written to the provided logger.
-func NewArtifactsService(client marathon.Marathon, debug *log.Logger) *ArtifactsService {
+func NewArtifactsService(orchestrator Orchestrator, debug *log.Logger) *ArtifactsService {
 	as := ArtifactsService{
-		client: client,
-		debug:  debug,
-		mutex:  &sync.Mutex{},
-		stopCh: make(chan struct{}),
+		orchestrator:     orchestrator,
+		debug:            debug,
+		mutex:            &sync.Mutex{},
+		scheduler:        newRestartScheduler(orchestrator, debug),
+		rollouts:         make(map[string][]core.Update),
+		rollbacks:        make(map[string][]string),
+		waiting:          make(map[string][]uint64),
+		remaining:        make(map[uint64]int),
+		causes:           make(map[string][]core.Update),
+		fetched:          make(chan struct{}),
+		fetchedOnce:      &sync.Once{},
+		fetchInterval:    make(chan time.Duration, 1),
+		dispatchInterval: time.Second,
+		done:             make(chan struct{}),
 	}
+	as.scheduler.restarted = as.restarted
+	as.scheduler.abandoned = as.abandoned
+	as.scheduler.rolledOut = as.rolledOut
+	as.scheduler.appLogger = as.appLogger
+	as.scheduler.appLinks = as.appLinks
 	return &as
 }
 
-// FetchVolumes fetches volumes in use by Marathon applications
-// and stores them.
+// SetJournal sets the journal the updates received are acknowledged in, once
+// every application depending on them has been restarted. The updates in the
+// journal that are pending are replayed by Run.
+func (as *ArtifactsService) SetJournal(journal *core.Journal) {
+	as.mutex.Lock()
+	as.journal = journal
+	as.mutex.Unlock()
+}
+
+// SetAuditLog sets the audit log the restarts, along with the updated paths
+// they were requested for, and the rollbacks are recorded in.
+func (as *ArtifactsService) SetAuditLog(audit *core.AuditLog) {
+	as.mutex.Lock()
+	as.audit = audit
+	as.mutex.Unlock()
+}
+
+// SetLogger sets the logger the fetching of the volumes and the restarts are
+// logged with, core.DefaultLogger is used by default.
+func (as *ArtifactsService) SetLogger(logger *core.Logger) {
+	as.mutex.Lock()
+	as.logger = logger
+	as.mutex.Unlock()
+}
+
+// currentLogger returns the logger set by SetLogger, or core.DefaultLogger.
+func (as *ArtifactsService) currentLogger() *core.Logger {
+	as.mutex.Lock()
+	logger := as.logger
+	as.mutex.Unlock()
+	if logger == nil {
+		return core.DefaultLogger()
+	}
+	return logger
+}
+
+// SetRestartLimits sets the limits applied when restarting applications.
+func (as *ArtifactsService) SetRestartLimits(limits RestartLimits) {
+	as.scheduler.setLimits(limits)
+}
+
+// SetRolloutPolicy sets the policy controlling how the health of restarted
+// applications gates the remaining restarts.
+func (as *ArtifactsService) SetRolloutPolicy(policy RolloutPolicy) {
+	as.scheduler.setPolicy(policy)
+	as.mutex.Lock()
+	as.rollback = policy.Rollback
+	as.mutex.Unlock()
+}
+
+// SetFetchInterval changes how often Run fetches the volumes, the next fetch
+// happens interval after the change.
+func (as *ArtifactsService) SetFetchInterval(interval time.Duration) {
+	for {
+		select {
+		case as.fetchInterval <- interval:
+			return
+		default:
+			// replace the interval Run hasn't used yet
+			select {
+			case <-as.fetchInterval:
+			default:
+			}
+		}
+	}
+}
+
+// RestartStats returns, for each application that a restart was requested for,
+// how many restarts were started, failed, queued or dropped.
+func (as *ArtifactsService) RestartStats() map[string]RestartStats {
+	return as.scheduler.snapshot()
+}
+
+// FetchVolumes fetches the volumes mounted by the workloads of the
+// Orchestrator, along with their dependencies, and stores them.
 func (as *ArtifactsService) FetchVolumes() (int, error) {
-	applications, err := as.client.Applications(url.Values{})
+	start := time.Now()
+	workloads, err := as.orchestrator.Workloads()
+	as.mutex.Lock()
+	metrics := as.metrics
+	as.mutex.Unlock()
+	metrics.observeFetch(time.Since(start), err)
 	if err != nil {
-		return 0, fmt.Errorf("failed to list applications: %v", err)
+		as.mutex.Lock()
+		as.fetchErr = err
+		as.mutex.Unlock()
+		return 0, err
 	}
 
 	newVolumes := Volumes{}
-
-	as.debug.Printf("Found %d applications running\n", len(applications.Apps))
-	for _, application := range applications.Apps {
-		if application.Container != nil {
-			volumes := application.Container.Volumes
-			if volumes != nil && len(*volumes) > 0 {
-				as.debug.Printf("%s depends on %d volumes\n", application.ID, len(*volumes))
-				for _, volume := range *volumes {
-					if volume.HostPath != "" {
-						as.debug.Printf("Adding %s path for %s\n", volume.HostPath, application.ID)
-						newVolumes.Add(application.ID, volume.HostPath)
-					}
-				}
-			}
+	newDependencies := Dependencies{}
+	newKinds := make(map[string]string, len(workloads))
+	for _, workload := range workloads {
+		newKinds[workload.ID] = workload.Kind
+		for _, path := range workload.Paths {
+			newVolumes.Add(workload.ID, path)
 		}
+		newDependencies.add(workload.ID, workload.Dependencies...)
 	}
 
 	count := len(newVolumes)
 
 	as.mutex.Lock()
 	as.volumes = newVolumes
+	as.dependencies = newDependencies
+	as.kinds = newKinds
+	as.lastFetch = time.Now()
+	as.fetchErr = nil
 	as.mutex.Unlock()
+	as.fetchedOnce.Do(func() {
+		close(as.fetched)
+	})
 
 	return count, nil
 }
 
-// GetAppIds returns a list of Marathon application ids that
+// GetAppIds returns a list of workload ids that
 // rely on an artifact identified by `path`.
 func (as *ArtifactsService) GetAppIds(path string) []string {
+	return as.currentVolumes().Get(path)
+}
+
+// GetAppIdsByKind returns the ids of the workloads that rely on an artifact
+// identified by `path`, keyed by their kind, so Marathon applications and
+// pods are reported separately.
+func (as *ArtifactsService) GetAppIdsByKind(path string) map[string][]string {
 	as.mutex.Lock()
-	appIds := as.volumes.Get(path)
+	volumes, kinds := as.volumes, as.kinds
 	as.mutex.Unlock()
-	return appIds
+
+	byKind := make(map[string][]string)
+	for _, appID := range volumes.Get(path) {
+		kind := kinds[appID]
+		byKind[kind] = append(byKind[kind], appID)
+	}
+	return byKind
 }
 
 // HasArtifact returns true if it has the artifact
 func (as *ArtifactsService) HasArtifact(path string) bool {
+	return as.currentVolumes().Has(path)
+}
+
+// currentVolumes returns the volumes last fetched. They are replaced as a
+// whole by FetchVolumes and never modified, so they can be read without
+// holding the mutex.
+func (as *ArtifactsService) currentVolumes() Volumes {
 	as.mutex.Lock()
-	result := as.volumes.Has(path)
+	defer as.mutex.Unlock()
+	return as.volumes
+}
+
+// BatchPolicy controls how updates are batched before the applications
+// depending on them are restarted.
+//
+// A QuietPeriod or MaxWait that is not greater than zero disables that trigger.
+type BatchPolicy struct {
+	// the number of updates that triggers restarting applications
+	Size int
+	// the time without any new updates after which applications are restarted
+	QuietPeriod time.Duration
+	// the longest time the first update of a batch waits before applications are restarted
+	MaxWait time.Duration
+}
+
+// Run fetches the volumes every fetchInterval and processes the updates placed
+// onto requestQueue until ctx is done or Stop is called.
+//
+// The updates are batched and the workloads depending on them are
+// restarted once the batch has batch.Size updates, no new updates have arrived for
+// batch.QuietPeriod or the first update in the batch has waited batch.MaxWait,
+// whichever happens first. Restarts held back by the RestartLimits are retried
+// periodically.
+//
+// Updates are received and batched right away, but the workloads depending
+// on them are only restarted once the volumes have been fetched, at which
+// point the updates pending in the journal are replayed. When Run stops, the
+// batched updates and those still on the requestQueue are flushed before it
+// returns. Run can only be called once.
+func (as *ArtifactsService) Run(ctx context.Context, requestQueue <-chan core.Update, fetchInterval time.Duration, batch BatchPolicy) error {
+	as.mutex.Lock()
+	if as.cancel != nil {
+		as.mutex.Unlock()
+		return fmt.Errorf("the artifacts service is already running")
+	}
+	ctx, as.cancel = context.WithCancel(ctx)
+	if as.stopped {
+		as.cancel()
+	}
+	as.mutex.Unlock()
+	defer close(as.done)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		as.fetchVolumes(ctx, fetchInterval)
+	}()
+	as.processUpdates(ctx, requestQueue, batch)
+	wg.Wait()
+	return nil
+}
+
+// Stop stops the service started by Run.
+//
+// The batched updates, and those still on the request queue, are flushed
+// and the pending restarts are dispatched, until there are none left, before
+// Run returns. Stop waits for that to happen until ctx is done, in which case
+// the restarts left are logged and an error is returned. Nothing should be
+// placed onto the request queue once Stop has been called. Stop may be
+// called more than once.
+func (as *ArtifactsService) Stop(ctx context.Context) error {
+	as.currentLogger().Infof("STOPPING")
+	as.mutex.Lock()
+	as.stopped = true
+	if as.stopping == nil {
+		as.stopping = ctx
+	}
+	cancel := as.cancel
 	as.mutex.Unlock()
-	return result
+	if cancel == nil {
+		as.currentLogger().Infof("STOPPED")
+		return nil
+	}
+
+	cancel()
+	select {
+	case <-as.done:
+	case <-ctx.Done():
+		return fmt.Errorf("gave up waiting for the artifacts service to stop: %v", ctx.Err())
+	}
+	as.currentLogger().Infof("STOPPED")
+	return nil
 }
 
-// StartFetching starts polling for artifacts after each interval.
-func (as *ArtifactsService) StartFetching(interval time.Duration) {
-	log.Println("fetching volumes depended on by applications for the first time...")
+// fetchVolumes fetches the volumes right away and after each interval until ctx is done.
+func (as *ArtifactsService) fetchVolumes(ctx context.Context, interval time.Duration) {
+	as.currentLogger().Infof("fetching volumes depended on by applications for the first time...")
 	numVolumes, err := as.FetchVolumes()
-	log.Printf("DONE fetching volumes, found %d.\n", numVolumes)
+	as.currentLogger().Infof("DONE fetching volumes, found %d.", numVolumes)
 	if err != nil {
-		log.Printf("problem fetching volumes depended on by applications: %v", err)
+		as.currentLogger().Warnf("problem fetching volumes depended on by applications: %v", err)
 	}
 
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	for {
-		if as.stopped {
-			break
-		}
 		select {
-		case <-as.stopCh:
-			as.stopped = true
-		case <-time.After(interval):
-			log.Println("fetching volumes depended on by applications...")
+		case <-ctx.Done():
+			as.currentLogger().Infof("VOLUME FETCHING SERVICE HAS STOPPED")
+			return
+		case interval = <-as.fetchInterval:
+			as.currentLogger().Infof("fetching volumes every %s", interval)
+			ticker.Reset(interval)
+		case <-ticker.C:
+			as.currentLogger().Infof("fetching volumes depended on by applications...")
 			numVolumes, err = as.FetchVolumes()
-			log.Printf("DONE fetching volumes, found %d.\n", numVolumes)
+			as.currentLogger().Infof("DONE fetching volumes, found %d.", numVolumes)
 			if err != nil {
-				log.Printf("problem fetching marathon artifacts: %v", err)
+				as.currentLogger().Warnf("problem fetching volumes depended on by applications: %v", err)
 			}
 		}
 	}
-	log.Println("VOLUME FETCHING SERVICE HAS STOPPED")
 }
 
-// Stop stops the service, passing true to block until it stops.
-func (as *ArtifactsService) Stop(block bool) {
-	log.Println("STOPPING")
-	if block {
-		close(as.stopCh)
-		log.Println("STOPPED")
+// processUpdates batches the updates on requestQueue and restarts the
+// applications depending on them until ctx is done, see Run.
+func (as *ArtifactsService) processUpdates(ctx context.Context, requestQueue <-chan core.Update, batch BatchPolicy) {
+	// the applications depending on a path are only known once the volumes
+	// have been fetched, until then the updates are only batched, so the
+	// request queue doesn't fill up, and a batch that is due waits for them
+	fetched, due := false, false
+	fetchedCh := as.fetched
+
+	updates := make([]core.Update, 0)
+	// the spans of the time each batched update waits for its batch to be restarted
+	batched := make([]*core.Span, 0)
+	receive := func(update core.Update) {
+		updates = append(updates, update)
+		batched = append(batched, as.traceReceived(update))
+	}
+	flush := func(restart bool) {
+		for _, span := range batched {
+			span.End()
+		}
+		if restart {
+			as.restartApps(updates)
+		}
+		updates = make([]core.Update, 0)
+		batched = make([]*core.Span, 0)
+	}
+
+	// the timers are only armed while there are updates waiting to be processed,
+	// a nil channel blocks forever so the select ignores a disarmed timer
+	var quietTimer, waitTimer *time.Timer
+	var quietCh, waitCh <-chan time.Time
+	disarm := func() {
+		if quietTimer != nil {
+			quietTimer.Stop()
+			quietTimer, quietCh = nil, nil
+		}
+		if waitTimer != nil {
+			waitTimer.Stop()
+			waitTimer, waitCh = nil, nil
+		}
+	}
+
+	restart := func() {
+		disarm()
+		if !fetched {
+			due = true
+			return
+		}
+		flush(true)
+	}
+
+	dispatchTicker := time.NewTicker(as.dispatchInterval)
+	defer dispatchTicker.Stop()
+
+	for running := true; running; {
+		select {
+		case <-ctx.Done():
+			running = false
+		case <-fetchedCh:
+			fetched, fetchedCh = true, nil
+			as.replayJournal(updates)
+			if due {
+				due = false
+				as.currentLogger().Infof("The volumes have been fetched, have %d paths that have been updated", len(updates))
+				flush(true)
+			}
+		case <-dispatchTicker.C:
+			if !as.scheduler.idle() {
+				as.dispatch()
+			}
+		case update := <-requestQueue:
+			receive(update)
+			if len(updates) >= batch.Size {
+				as.currentLogger().Infof("Met or exceeded threshold (%d), there are %d paths that were updated", batch.Size, len(updates))
+				restart()
+				continue
+			}
+			// the quiet period starts over with every update, the max wait
+			// only starts with the first update of a batch
+			if batch.QuietPeriod > 0 {
+				if quietTimer != nil {
+					quietTimer.Stop()
+				}
+				quietTimer = time.NewTimer(batch.QuietPeriod)
+				quietCh = quietTimer.C
+			}
+			if batch.MaxWait > 0 && waitTimer == nil {
+				waitTimer = time.NewTimer(batch.MaxWait)
+				waitCh = waitTimer.C
+			}
+		case <-quietCh:
+			as.currentLogger().Infof("No updates for %s, have %d paths that have been updated", batch.QuietPeriod, len(updates))
+			restart()
+		case <-waitCh:
+			as.currentLogger().Infof("Waited %s since the first update, have %d paths that have been updated", batch.MaxWait, len(updates))
+			restart()
+		}
+	}
+	disarm()
+
+	// flush everything received so far, nothing is placed onto the queue
+	// once the service is stopping
+	for draining := true; draining; {
+		select {
+		case update := <-requestQueue:
+			receive(update)
+		default:
+			draining = false
+		}
+	}
+	if len(updates) > 0 {
+		if fetched {
+			as.currentLogger().Infof("Stopping, have %d paths that have been updated", len(updates))
+		} else {
+			as.currentLogger().Infof("Stopping before the volumes were fetched, %d paths that have been updated are not restarted", len(updates))
+		}
+		flush(fetched)
+	}
+	as.drain(dispatchTicker.C)
+	as.currentLogger().Infof("RESTART SERVICE HAS STOPPED")
+}
+
+// drain dispatches the pending restarts on every tick until there are none
+// left or the context Stop was called with is done, the restarts left then
+// are logged. Nothing is dispatched if Run stopped without Stop being called.
+func (as *ArtifactsService) drain(tick <-chan time.Time) {
+	as.mutex.Lock()
+	stopping := as.stopping
+	as.mutex.Unlock()
+	var done <-chan struct{}
+	if stopping == nil {
+		stopped := make(chan struct{})
+		close(stopped)
+		done = stopped
 	} else {
-		go func() {
-			close(as.stopCh)
-			log.Println("STOPPED")
-		}()
+		done = stopping.Done()
+	}
+
+	for as.scheduler.pendingCount() > 0 {
+		select {
+		case <-done:
+			appIds := as.scheduler.pendingApps()
+			as.currentLogger().Warnf("Stopping with %d restarts pending, they were not done: %v", len(appIds), appIds)
+			return
+		case <-tick:
+			as.dispatch()
+		}
 	}
-	log.Println("exiting stop routine")
 }
 
-// StartApplicationRestartProcessing begins waiting for requests on the requestQueue.
-// Once the queue has "count" items or "timeout" has occured, the marathon
-// applications will be restarted.
-func (as *ArtifactsService) StartApplicationRestartProcessing(requestQueue <-chan string, count int, timeout time.Duration) {
+// replayJournal restarts the applications depending on the updates pending
+// in the journal, other than those that are batched already.
+func (as *ArtifactsService) replayJournal(batched []core.Update) {
+	as.mutex.Lock()
+	journal := as.journal
+	as.mutex.Unlock()
+	if journal == nil {
+		return
+	}
+
+	pending := make([]core.Update, 0)
+	for _, update := range journal.Pending() {
+		isBatched := false
+		for _, b := range batched {
+			if b.ID == update.ID {
+				isBatched = true
+				break
+			}
+		}
+		if !isBatched {
+			pending = append(pending, update)
+		}
+	}
+	if len(pending) > 0 {
+		as.currentLogger().Infof("Replaying %d updates from the journal", len(pending))
+		as.restartApps(pending)
+	}
+}
+
+// restartApps schedules a restart of each application depending on one or
+// more of the updated paths, an application is only restarted once per call.
+//
+// Applications are restarted in waves ordered by their dependencies, see
+// Dependencies.Waves.
+func (as *ArtifactsService) restartApps(updates []core.Update) {
+	paths := make([]string, 0, len(updates))
+	for _, update := range updates {
+		paths = append(paths, update.Path)
+	}
+	appIds := as.appIdsForPaths(paths)
+	as.debug.Printf("found %d app ids depending on %d paths\n", len(appIds), len(paths))
+	_, span := as.currentTracer().Start(context.Background(), "restart_apps", traceLinks(updates)...)
+	span.SetAttribute("updates", len(updates))
+	span.SetAttribute("apps", len(appIds))
+	defer span.End()
+	as.mutex.Lock()
+	metrics := as.metrics
+	as.mutex.Unlock()
+	metrics.observeBatch(len(updates))
+	for _, path := range paths {
+		for kind, ids := range as.GetAppIdsByKind(path) {
+			if kind == "" {
+				kind = "workload"
+			}
+			as.debug.Printf("%s is mounted by %d %s(s): %v\n", path, len(ids), kind, ids)
+		}
+	}
+
+	as.track(updates)
+	as.addCauses(updates)
+
+	if len(appIds) == 0 {
+		return
+	}
+
+	as.scheduler.schedule(as.restartWaves(appIds), false)
+	as.dispatch()
+}
+
+// track remembers which applications each journaled update is waiting for,
+// an update that no application depends on is acknowledged right away.
+func (as *ArtifactsService) track(updates []core.Update) {
+	volumes := as.currentVolumes()
+	acked := make([]uint64, 0)
+	as.mutex.Lock()
+	if as.journal == nil {
+		as.mutex.Unlock()
+		return
+	}
+	for _, update := range updates {
+		if update.ID == 0 {
+			continue
+		}
+		appIds := unique(volumes.Get(update.Path))
+		if len(appIds) == 0 {
+			acked = append(acked, update.ID)
+			continue
+		}
+		as.remaining[update.ID] = len(appIds)
+		for _, appID := range appIds {
+			as.waiting[appID] = append(as.waiting[appID], update.ID)
+		}
+	}
+	journal := as.journal
+	as.mutex.Unlock()
+
+	if err := journal.Ack(acked...); err != nil {
+		as.currentLogger().Warnf("problem acknowledging updates in the journal: %v", err)
+	}
+}
+
+// addCauses remembers the updates each application depending on them is
+// restarted for, so its restart can be logged with the ids of the requests
+// that uploaded them and recorded along with their paths. The updates that
+// re-pointed a symlink are remembered as part of the rollout of the
+// application, so they can be rolled back.
+func (as *ArtifactsService) addCauses(updates []core.Update) {
+	volumes := as.currentVolumes()
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	for _, update := range updates {
+		for _, appID := range unique(volumes.Get(update.Path)) {
+			as.causes[appID] = append(as.causes[appID], update)
+			if update.Symlink != "" {
+				as.rollouts[appID] = append(as.rollouts[appID], update)
+			}
+		}
+	}
+}
+
+// appLogger returns a logger adding the ids of the requests appID is
+// restarted for to each entry.
+func (as *ArtifactsService) appLogger(appID string) *core.Logger {
+	as.mutex.Lock()
+	requestIDs := make([]string, 0)
+	for _, update := range as.causes[appID] {
+		if update.RequestID != "" && !contains(requestIDs, update.RequestID) {
+			requestIDs = append(requestIDs, update.RequestID)
+		}
+	}
+	as.mutex.Unlock()
+
+	if len(requestIDs) == 0 {
+		return as.currentLogger()
+	}
+	return as.currentLogger().With("request_ids", strings.Join(requestIDs, ","))
+}
+
+// restarted acknowledges the journaled updates that were only waiting for
+// appID to restart and records the restart in the audit log.
+func (as *ArtifactsService) restarted(appID, deploymentID string) {
+	logger := as.appLogger(appID)
+	as.mutex.Lock()
+	audit := as.audit
 	paths := make([]string, 0)
-	for {
-		if as.stopped {
-			break
+	for _, update := range as.causes[appID] {
+		if !contains(paths, update.Path) {
+			paths = append(paths, update.Path)
 		}
-		select {
-		case <-as.stopCh:
-			as.stopped = true
-		case path := <-requestQueue:
-			paths = append(paths, path)
-			if len(paths) >= count {
-				log.Printf("Met or exceeded threshold (%d), there are %d paths that were updated\n", count, len(paths))
-				as.restartApps(paths)
-				paths = make([]string, 0)
+	}
+	delete(as.causes, appID)
+	delete(as.rollbacks, appID)
+	as.mutex.Unlock()
+
+	logger.Infof("restarted %s for %v, deployment %s", appID, paths, deploymentID)
+	if audit != nil {
+		err := audit.Record(core.AuditEntry{
+			Operation: core.AuditRestart,
+			Paths:     paths,
+			Restarts:  []core.AuditRestartEntry{{App: appID, Deployment: deploymentID}},
+		})
+		if err != nil {
+			logger.Warnf("problem recording the restart of %s in the audit log: %v", appID, err)
+		}
+	}
+	as.release(appID)
+}
+
+// release acknowledges the journaled updates that were only waiting for
+// appID, once it was restarted.
+func (as *ArtifactsService) release(appID string) {
+	acked := make([]uint64, 0)
+	as.mutex.Lock()
+	for _, id := range as.waiting[appID] {
+		as.remaining[id]--
+		if as.remaining[id] <= 0 {
+			delete(as.remaining, id)
+			acked = append(acked, id)
+		}
+	}
+	delete(as.waiting, appID)
+	journal := as.journal
+	as.mutex.Unlock()
+
+	if journal == nil || len(acked) == 0 {
+		return
+	}
+	if err := journal.Ack(acked...); err != nil {
+		as.currentLogger().Warnf("problem acknowledging updates in the journal: %v", err)
+	}
+}
+
+// abandoned forgets what the restart of appID was requested for once it won't
+// be done. The journaled updates waiting for it are left pending, so they are
+// replayed on the next start unless a later restart of appID acknowledges
+// them. A rollback that wasn't restarted is logged and recorded in the audit
+// log.
+func (as *ArtifactsService) abandoned(appID, reason string) {
+	logger := as.appLogger(appID)
+	as.mutex.Lock()
+	audit := as.audit
+	delete(as.causes, appID)
+	delete(as.rollouts, appID)
+	rolledBack := as.rollbacks[appID]
+	delete(as.rollbacks, appID)
+	as.mutex.Unlock()
+
+	if len(rolledBack) == 0 {
+		return
+	}
+	logger.Errorf("%s was not restarted after rolling back %v, it may still use the release that was rolled back: %s", appID, rolledBack, reason)
+	if audit != nil {
+		err := audit.Record(core.AuditEntry{
+			Operation: core.AuditRollback,
+			Paths:     rolledBack,
+			Restarts:  []core.AuditRestartEntry{{App: appID}},
+			Reason:    fmt.Sprintf("%s was not restarted, %s", appID, reason),
+		})
+		if err != nil {
+			logger.Warnf("problem recording the rollback restart of %s in the audit log: %v", appID, err)
+		}
+	}
+}
+
+// rolledOut forgets the updates rolled out by restarting the given
+// applications, once their wave is over.
+func (as *ArtifactsService) rolledOut(appIds []string) {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	for _, appID := range appIds {
+		delete(as.rollouts, appID)
+	}
+}
+
+// dispatch restarts the pending applications the scheduler has room for. If
+// the restarts are halted, the updates whose rollout the unhealthy
+// application is part of are rolled back when the RolloutPolicy asks for it.
+func (as *ArtifactsService) dispatch() {
+	unhealthyAppID, halted := as.scheduler.dispatch()
+	if unhealthyAppID == "" {
+		return
+	}
+	as.mutex.Lock()
+	rollback := as.rollback
+	as.mutex.Unlock()
+	if rollback {
+		as.rollbackUpdates(unhealthyAppID)
+	}
+	as.rolledOut(halted)
+}
+
+// rollbackUpdates re-points the symlinks of the updated paths whose rollout
+// appID is part of to their targets from before the rollout and restarts the
+// applications depending on them, so they use the previous release again.
+// The restarts skip the cooldown, as the applications were just restarted.
+func (as *ArtifactsService) rollbackUpdates(appID string) {
+	logger := as.currentLogger()
+	as.mutex.Lock()
+	// the first update of a path within the rollout knows the target from
+	// before it
+	seen := make(map[string]bool)
+	claimed := make(map[string]bool)
+	rollbacks := make([]core.Update, 0)
+	for _, update := range as.rollouts[appID] {
+		if seen[update.Path] {
+			continue
+		}
+		seen[update.Path] = true
+		if update.PreviousTarget != "" {
+			claimed[update.Path] = true
+			rollbacks = append(rollbacks, update)
+		}
+	}
+	// a path is only rolled back once, even if other applications of the
+	// rollout become unhealthy too, so it is claimed before the symlinks
+	// are re-pointed outside the lock
+	for rolloutAppID, updates := range as.rollouts {
+		remaining := make([]core.Update, 0, len(updates))
+		for _, update := range updates {
+			if !claimed[update.Path] {
+				remaining = append(remaining, update)
 			}
-		case <-time.After(timeout):
-			log.Printf("Timeout after %s, have %d paths that have been updated\n", timeout, len(paths))
-			if len(paths) > 0 {
-				as.restartApps(paths)
-				paths = make([]string, 0)
+		}
+		as.rollouts[rolloutAppID] = remaining
+	}
+	audit := as.audit
+	as.mutex.Unlock()
+
+	paths := make([]string, 0)
+	entries := make([]core.AuditEntry, 0)
+	for _, update := range rollbacks {
+		logger.Warnf("rolling back %s to %s because %s is unhealthy", update.Symlink, update.PreviousTarget, appID)
+		target := core.SymlinkTarget(update.Symlink)
+		if err := core.Symlink(update.PreviousTarget, update.Symlink); err != nil {
+			logger.Warnf("failed to roll back %s to %s: %v", update.Symlink, update.PreviousTarget, err)
+			continue
+		}
+		paths = append(paths, update.Path)
+		entries = append(entries, core.AuditEntry{
+			Operation:      core.AuditRollback,
+			Paths:          []string{update.Path},
+			PreviousTarget: target,
+			Target:         update.PreviousTarget,
+			Reason:         fmt.Sprintf("%s is unhealthy", appID),
+		})
+	}
+	if audit != nil {
+		for _, entry := range entries {
+			if err := audit.Record(entry); err != nil {
+				logger.Warnf("problem recording the rollback of %s in the audit log: %v", entry.Paths[0], err)
 			}
 		}
 	}
-	log.Println("RESTART SERVICE HAS STOPPED")
+	if len(paths) > 0 {
+		rolledBack := make([]core.Update, 0, len(paths))
+		for _, path := range paths {
+			rolledBack = append(rolledBack, core.Update{Path: path})
+		}
+		volumes := as.currentVolumes()
+		as.mutex.Lock()
+		for _, path := range paths {
+			for _, rollbackAppID := range unique(volumes.Get(path)) {
+				as.rollbacks[rollbackAppID] = append(as.rollbacks[rollbackAppID], path)
+			}
+		}
+		as.mutex.Unlock()
+		as.addCauses(rolledBack)
+		as.scheduler.schedule(as.restartWaves(as.appIdsForPaths(paths)), true)
+	}
 }
 
-func (as *ArtifactsService) restartApps(paths []string) {
+// restartWaves orders the given workloads into waves using the dependencies
+// last fetched from the Orchestrator.
+func (as *ArtifactsService) restartWaves(appIds []string) [][]string {
+	as.mutex.Lock()
+	dependencies := as.dependencies
+	as.mutex.Unlock()
+
+	waves, err := dependencies.Waves(appIds)
+	if err != nil {
+		as.currentLogger().Warnf("%v, the applications that could not be ordered are restarted in the last wave", err)
+	}
+	as.debug.Printf("restarting %d applications in %d waves\n", len(appIds), len(waves))
+	return waves
+}
+
+// appIdsForPaths returns the unique application ids that depend on any
+// of the given paths, in the order they were first seen.
+func (as *ArtifactsService) appIdsForPaths(paths []string) []string {
+	seen := make(map[string]bool)
+	appIds := make([]string, 0)
 	for _, path := range paths {
-		appIds := as.volumes.Get(path)
-		as.debug.Printf("found %d app ids depending on %s\n", len(appIds), path)
-		for _, appID := range appIds {
-			log.Printf("restarting %s\n", appID)
-			deploymentID, err := as.client.RestartApplication(appID, true)
-			if err != nil {
-				log.Printf("failed to restart %s: %v\n", appID, err)
+		for _, appID := range as.GetAppIds(path) {
+			if seen[appID] {
 				continue
 			}
-			as.debug.Printf("restarted %s deploymentID=%s version=%s\n", appID, deploymentID.DeploymentID, deploymentID.Version)
+			seen[appID] = true
+			appIds = append(appIds, appID)
 		}
 	}
+	return appIds
 }
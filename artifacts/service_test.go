@@ -1,13 +1,22 @@
 package artifacts
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	gohttp "net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"apex/artifact-manager/core"
 )
 
 func TestArtifactsService_FetchArtifacts(t *testing.T) {
@@ -22,7 +31,7 @@ func TestArtifactsService_FetchArtifacts(t *testing.T) {
 		}
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(gohttp.StatusOK)
-		fmt.Fprintf(w, string(data))
+		w.Write(data)
 	}))
 	defer s.Close()
 
@@ -39,7 +48,8 @@ func TestArtifactsService_FetchArtifacts(t *testing.T) {
 	}
 
 	// create the artifacts service and fetch the volumes
-	svc := NewArtifactsService(marathonClient, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	debug := log.New(ioutil.Discard, log.Prefix(), log.Flags())
+	svc := NewArtifactsService(NewMarathonOrchestrator(marathonClient, debug), debug)
 	count, err := svc.FetchVolumes()
 	if err != nil {
 		t.Errorf("failed to fetch volumes: %v", err)
@@ -70,3 +80,550 @@ func TestArtifactsService_FetchArtifacts(t *testing.T) {
 		return
 	}
 }
+
+// sharedVolumesApps is a Marathon response where "/myapp" mounts two paths and
+// "/otherapp" mounts one of the same paths.
+const sharedVolumesApps = `{"apps": [
+	{"id": "/myapp", "container": {"type": "DOCKER", "volumes": [
+		{"containerPath": "/a", "hostPath": "/data/a-latest", "mode": "RO"},
+		{"containerPath": "/b", "hostPath": "/data/b-latest", "mode": "RO"}
+	]}},
+	{"id": "/otherapp", "container": {"type": "DOCKER", "volumes": [
+		{"containerPath": "/b", "hostPath": "/data/b-latest", "mode": "RO"}
+	]}}
+]}`
+
+// newRestartingMarathon creates a "mock" marathon server which lists the given
+// applications and sends the path of every restart request onto restarts.
+func newRestartingMarathon(t *testing.T, apps string, restarts chan<- string) (*httptest.Server, *ArtifactsService) {
+	s := httptest.NewServer(gohttp.HandlerFunc(func(w gohttp.ResponseWriter, r *gohttp.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == gohttp.MethodPost && strings.HasSuffix(r.URL.Path, "/restart") {
+			restarts <- r.URL.Path
+			fmt.Fprint(w, `{"deploymentId": "1", "version": "1"}`)
+			return
+		}
+		if r.URL.Path == "/v2/deployments" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+		fmt.Fprint(w, apps)
+	}))
+
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to parse mock server url %s: %v", s.URL, err)
+	}
+	marathonClient, err := NewMarathonClient(nil, nil, u.Host)
+	if err != nil {
+		s.Close()
+		t.Fatalf("unable to create marathon client: %v", err)
+	}
+	debug := log.New(ioutil.Discard, log.Prefix(), log.Flags())
+	svc := NewArtifactsService(NewMarathonOrchestrator(marathonClient, debug), debug)
+	if _, err = svc.FetchVolumes(); err != nil {
+		s.Close()
+		t.Fatalf("failed to fetch volumes: %v", err)
+	}
+	return s, svc
+}
+
+// collectRestarts returns the restart requests received until no request has
+// arrived for the given duration.
+func collectRestarts(restarts <-chan string, idle time.Duration) []string {
+	received := make([]string, 0)
+	for {
+		select {
+		case r := <-restarts:
+			received = append(received, r)
+		case <-time.After(idle):
+			return received
+		}
+	}
+}
+
+func TestArtifactsService_appIdsForPaths(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+
+	appIds := svc.appIdsForPaths([]string{"/data/a-latest", "/data/b-latest", "/data/a-latest", "/data/unknown"})
+	expected := []string{"/myapp", "/otherapp"}
+	if !reflect.DeepEqual(appIds, expected) {
+		t.Errorf("expected app ids %v, got %v", expected, appIds)
+	}
+}
+
+// TestArtifactsService_RestartDeduplicatesApps tests that an application is only
+// restarted once when several of the paths in a batch map to it.
+func TestArtifactsService_RestartDeduplicatesApps(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+
+	requestQueue := make(chan core.Update, 10)
+	go svc.Run(context.Background(), requestQueue, time.Hour, BatchPolicy{Size: 10, QuietPeriod: 50 * time.Millisecond, MaxWait: 5 * time.Second})
+	defer svc.Stop(context.Background())
+
+	requestQueue <- core.Update{Path: "/data/a-latest"}
+	requestQueue <- core.Update{Path: "/data/b-latest"}
+	requestQueue <- core.Update{Path: "/data/a-latest"}
+
+	received := collectRestarts(restarts, 500*time.Millisecond)
+	if len(received) != 2 {
+		t.Fatalf("expected 2 restarts, got %d: %v", len(received), received)
+	}
+	if received[0] == received[1] {
+		t.Errorf("expected each application to be restarted once, got %v", received)
+	}
+}
+
+// TestArtifactsService_RestartMaxWait tests that a steady trickle of updates,
+// which never lets the quiet period pass, is flushed once the max wait is reached.
+func TestArtifactsService_RestartMaxWait(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+
+	requestQueue := make(chan core.Update, 10)
+	go svc.Run(context.Background(), requestQueue, time.Hour, BatchPolicy{Size: 100, QuietPeriod: 200 * time.Millisecond, MaxWait: 300 * time.Millisecond})
+	defer svc.Stop(context.Background())
+
+	start := time.Now()
+	for time.Since(start) < time.Second {
+		requestQueue <- core.Update{Path: "/data/a-latest"}
+		select {
+		case r := <-restarts:
+			if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+				t.Errorf("expected %s to be restarted after the max wait, took %s", r, elapsed)
+			}
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Errorf("expected applications to be restarted while updates kept arriving")
+}
+
+// TestArtifactsService_rollbackUpdates tests that the symlinks of the paths
+// rolled out by an unhealthy application are re-pointed to the release from
+// before the rollout, and that a rollback that isn't restarted is audited.
+func TestArtifactsService_rollbackUpdates(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	audit, err := core.OpenAuditLog(path.Join(dir, "audit.log"), 0, 0, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to open the audit log: %v", err)
+	}
+	defer audit.Close()
+	svc.SetAuditLog(audit)
+	symlink := path.Join(dir, "a-latest")
+	previous := path.Join(dir, "a-1")
+	if err = core.Symlink(path.Join(dir, "a-3"), symlink); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+	otherSymlink := path.Join(dir, "b-latest")
+	if err = core.Symlink(path.Join(dir, "b-2"), otherSymlink); err != nil {
+		t.Fatalf("unable to create symlink: %v", err)
+	}
+
+	// /myapp rolls out two releases of a-latest, /otherapp the release of
+	// b-latest of another batch
+	svc.rollouts["/myapp"] = []core.Update{
+		{Path: "/data/a-latest", Symlink: symlink, PreviousTarget: previous},
+		{Path: "/data/a-latest", Symlink: symlink, PreviousTarget: path.Join(dir, "a-2")},
+	}
+	svc.rollouts["/otherapp"] = []core.Update{{Path: "/data/b-latest", Symlink: otherSymlink, PreviousTarget: path.Join(dir, "b-1")}}
+	svc.rollbackUpdates("/myapp")
+
+	if target := core.SymlinkTarget(symlink); target != previous {
+		t.Errorf("expected %s to point to %s, got %s", symlink, previous, target)
+	}
+	if target := core.SymlinkTarget(otherSymlink); target != path.Join(dir, "b-2") {
+		t.Errorf("expected %s, which is not part of the rollout, to be left alone, got %s", otherSymlink, target)
+	}
+	if len(svc.rollouts["/myapp"]) != 0 {
+		t.Errorf("expected the updates of /data/a-latest to be forgotten once rolled back, got %+v", svc.rollouts["/myapp"])
+	}
+	if svc.scheduler.pendingCount() != 1 {
+		t.Errorf("expected the application depending on the rolled back path to be restarted, got %d pending", svc.scheduler.pendingCount())
+	}
+
+	svc.abandoned("/myapp", "the restart failed")
+	entries, err := audit.Query(core.AuditFilter{App: "/myapp"})
+	if err != nil {
+		t.Fatalf("unable to query the audit log: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Operation != core.AuditRollback || !strings.Contains(entries[0].Reason, "the restart failed") {
+		t.Errorf("expected the rollback restart that wasn't done to be audited, got %+v", entries)
+	}
+}
+
+// TestArtifactsService_RolloutForgotten tests that the updates rolled out by
+// a wave are forgotten once it passed, so they are never rolled back later.
+func TestArtifactsService_RolloutForgotten(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+
+	svc.restartApps([]core.Update{{Path: "/data/a-latest", Symlink: "/managed/a-latest", PreviousTarget: "/data/a-1"}})
+	if len(svc.rollouts["/myapp"]) != 1 {
+		t.Fatalf("expected the update to be part of the rollout of /myapp, got %+v", svc.rollouts)
+	}
+	// the deployment of the restart is seen to be finished
+	svc.dispatch()
+	if len(svc.rollouts) != 0 {
+		t.Errorf("expected the rollout to be forgotten once the wave passed, got %+v", svc.rollouts)
+	}
+}
+
+// TestArtifactsService_ReplayJournal tests that the updates pending in the
+// journal are restarted and only acknowledged once their applications restarted.
+func TestArtifactsService_ReplayJournal(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal, err := core.OpenJournal(path.Join(dir, ".journal"), core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to open journal: %v", err)
+	}
+	defer journal.Close()
+	journal.Append(core.Update{Path: "/data/a-latest"})
+	journal.Append(core.Update{Path: "/data/unknown"})
+	journal.Append(core.Update{Path: "/data/a-latest"})
+
+	svc.SetJournal(journal)
+	go svc.Run(context.Background(), make(chan core.Update), time.Hour, BatchPolicy{Size: 10, QuietPeriod: time.Second, MaxWait: time.Second})
+	defer svc.Stop(context.Background())
+
+	received := collectRestarts(restarts, 500*time.Millisecond)
+	if len(received) != 1 {
+		t.Fatalf("expected /myapp to be restarted once, got %v", received)
+	}
+	if pending := journal.Pending(); len(pending) != 0 {
+		t.Errorf("expected every update to be acknowledged, got %+v", pending)
+	}
+}
+
+// TestArtifactsService_KeepFailed tests that a journaled update stays
+// pending while the restart it is waiting for fails, so it is replayed, and
+// is acknowledged once the application is restarted.
+func TestArtifactsService_KeepFailed(t *testing.T) {
+	orchestrator := newFakeOrchestrator(Workload{ID: "/web", Paths: []string{"/data/a-latest"}})
+	orchestrator.failing["/web"] = true
+	svc := newFakeService(t, orchestrator)
+
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	journal, err := core.OpenJournal(path.Join(dir, ".journal"), core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to open journal: %v", err)
+	}
+	defer journal.Close()
+	svc.SetJournal(journal)
+
+	update, err := journal.Append(core.Update{Path: "/data/a-latest"})
+	if err != nil {
+		t.Fatalf("unable to append: %v", err)
+	}
+	svc.restartApps([]core.Update{update})
+	if pending := journal.Pending(); len(pending) != 1 {
+		t.Fatalf("expected the update of the failed restart to stay pending, got %+v", pending)
+	}
+
+	orchestrator.failing["/web"] = false
+	svc.restartApps(journal.Pending())
+	if pending := journal.Pending(); len(pending) != 0 {
+		t.Errorf("expected the update to be acknowledged once /web restarted, got %+v", pending)
+	}
+}
+
+// gatedOrchestrator is a fakeOrchestrator whose workloads can only be fetched
+// once its gate is opened.
+type gatedOrchestrator struct {
+	*fakeOrchestrator
+	gate chan struct{}
+}
+
+func (g *gatedOrchestrator) Workloads() ([]Workload, error) {
+	<-g.gate
+	return g.fakeOrchestrator.Workloads()
+}
+
+// TestArtifactsService_BatchesBeforeFetch tests that updates are taken off
+// the request queue before the volumes are fetched for the first time, and
+// that their applications are restarted once they are.
+func TestArtifactsService_BatchesBeforeFetch(t *testing.T) {
+	orchestrator := &gatedOrchestrator{
+		fakeOrchestrator: newFakeOrchestrator(Workload{ID: "/web", Paths: []string{"/data/a-latest"}}),
+		gate:             make(chan struct{}),
+	}
+	svc := NewArtifactsService(orchestrator, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+
+	requestQueue := make(chan core.Update)
+	go svc.Run(context.Background(), requestQueue, time.Hour, BatchPolicy{Size: 2, QuietPeriod: time.Hour, MaxWait: time.Hour})
+	defer svc.Stop(context.Background())
+	for i := 0; i < 3; i++ {
+		select {
+		case requestQueue <- core.Update{Path: "/data/a-latest"}:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected update %d to be received before the volumes were fetched", i)
+		}
+	}
+	if restarts := orchestrator.restarted(); len(restarts) != 0 {
+		t.Fatalf("expected no restarts before the volumes were fetched, got %v", restarts)
+	}
+
+	close(orchestrator.gate)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(orchestrator.restarted()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected /web to be restarted once the volumes were fetched")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestArtifactsService_StopFlushesUpdates tests that stopping the service
+// restarts the applications of every update received, batched or still queued.
+func TestArtifactsService_StopFlushesUpdates(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+
+	requestQueue := make(chan core.Update, 10)
+	done := make(chan struct{})
+	go func() {
+		svc.Run(context.Background(), requestQueue, time.Hour, BatchPolicy{Size: 100, QuietPeriod: time.Hour, MaxWait: time.Hour})
+		close(done)
+	}()
+
+	// the first update is batched, the second may still be on the queue
+	requestQueue <- core.Update{Path: "/data/a-latest"}
+	time.Sleep(50 * time.Millisecond)
+	requestQueue <- core.Update{Path: "/data/b-latest"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.Stop(ctx); err != nil {
+		t.Fatalf("failed to stop: %v", err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Errorf("expected Run to have returned once Stop returned")
+	}
+
+	received := collectRestarts(restarts, 100*time.Millisecond)
+	if len(received) != 2 {
+		t.Errorf("expected /myapp and /otherapp to be restarted, got %v", received)
+	}
+	if len(requestQueue) != 0 {
+		t.Errorf("expected the queue to be drained, %d updates remain", len(requestQueue))
+	}
+
+	// stopping again is harmless
+	if err := svc.Stop(ctx); err != nil {
+		t.Errorf("failed to stop a second time: %v", err)
+	}
+}
+
+// finishingOrchestrator is a trackingOrchestrator whose deployments are
+// reported in progress once and are finished after that.
+type finishingOrchestrator struct {
+	*trackingOrchestrator
+}
+
+func (f *finishingOrchestrator) Deployments() ([]Deployment, error) {
+	deployments, err := f.trackingOrchestrator.Deployments()
+	f.mutex.Lock()
+	f.trackingOrchestrator.deployments = nil
+	f.mutex.Unlock()
+	return deployments, err
+}
+
+// TestArtifactsService_StopDrainsRestarts tests that the restarts held back by
+// the limits are dispatched while stopping, until the context of Stop is done.
+func TestArtifactsService_StopDrainsRestarts(t *testing.T) {
+	workloads := []Workload{{ID: "/a", Paths: []string{"/data/a-latest"}}, {ID: "/b", Paths: []string{"/data/a-latest"}}}
+	for _, test := range []struct {
+		name     string
+		finishes bool
+		restarts []string
+	}{
+		{name: "drained", finishes: true, restarts: []string{"/a", "/b"}},
+		{name: "timeout", finishes: false, restarts: []string{"/a"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tracking := &trackingOrchestrator{fakeOrchestrator: newFakeOrchestrator(workloads...)}
+			var orchestrator Orchestrator = tracking
+			if test.finishes {
+				orchestrator = &finishingOrchestrator{tracking}
+			}
+			svc := NewArtifactsService(orchestrator, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+			svc.SetRestartLimits(RestartLimits{MaxInFlight: 1})
+			svc.dispatchInterval = 10 * time.Millisecond
+
+			requestQueue := make(chan core.Update, 1)
+			go svc.Run(context.Background(), requestQueue, time.Hour, BatchPolicy{Size: 1})
+			requestQueue <- core.Update{Path: "/data/a-latest"}
+			deadline := time.Now().Add(5 * time.Second)
+			for len(tracking.restarted()) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected /a to be restarted")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err := svc.Stop(ctx)
+			if test.finishes && err != nil {
+				t.Errorf("failed to stop: %v", err)
+			}
+			if !test.finishes && err == nil {
+				t.Errorf("expected Stop to give up on the restart held back")
+			}
+			if restarts := tracking.restarted(); !reflect.DeepEqual(restarts, test.restarts) {
+				t.Errorf("expected %v to be restarted, got %v", test.restarts, restarts)
+			}
+		})
+	}
+}
+
+// TestArtifactsService_Concurrent tests that updates, fetches and stops can
+// happen at the same time, it is meant to be run with the race detector.
+func TestArtifactsService_Concurrent(t *testing.T) {
+	restarts := make(chan string, 1000)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+
+	requestQueue := make(chan core.Update, 100)
+	ran := make(chan error, 1)
+	go func() {
+		ran <- svc.Run(context.Background(), requestQueue, 10*time.Millisecond, BatchPolicy{Size: 3, QuietPeriod: 5 * time.Millisecond})
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				requestQueue <- core.Update{Path: "/data/a-latest"}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				svc.FetchVolumes()
+				svc.GetAppIds("/data/b-latest")
+				svc.HasArtifact("/data/a-latest")
+				svc.RestartStats()
+			}
+		}()
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := svc.Stop(ctx); err != nil {
+				t.Errorf("failed to stop: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := <-ran; err != nil {
+		t.Errorf("expected Run to return without an error, got %v", err)
+	}
+	if len(requestQueue) != 0 {
+		t.Errorf("expected every update to be processed, %d remain", len(requestQueue))
+	}
+	if err := svc.Run(context.Background(), requestQueue, time.Hour, BatchPolicy{}); err == nil {
+		t.Errorf("expected running a second time to fail")
+	}
+}
+
+// TestArtifactsService_AuditRestarts tests that each restart is recorded in
+// the audit log along with its deployment and the paths it was requested for.
+func TestArtifactsService_AuditRestarts(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	audit, err := core.OpenAuditLog(path.Join(dir, "audit.log"), 0, 0, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to open the audit log: %v", err)
+	}
+	defer audit.Close()
+	svc.SetAuditLog(audit)
+
+	requestQueue := make(chan core.Update, 10)
+	go svc.Run(context.Background(), requestQueue, time.Hour, BatchPolicy{Size: 10, QuietPeriod: 50 * time.Millisecond, MaxWait: 5 * time.Second})
+	defer svc.Stop(context.Background())
+	requestQueue <- core.Update{Path: "/data/a-latest"}
+	requestQueue <- core.Update{Path: "/data/b-latest"}
+	collectRestarts(restarts, 500*time.Millisecond)
+
+	entries, err := audit.Query(core.AuditFilter{App: "/myapp"})
+	if err != nil {
+		t.Fatalf("unable to query the audit log: %v", err)
+	}
+	expected := []core.AuditRestartEntry{{App: "/myapp", Deployment: "1"}}
+	if len(entries) != 1 || !reflect.DeepEqual(entries[0].Restarts, expected) ||
+		!reflect.DeepEqual(entries[0].Paths, []string{"/data/a-latest", "/data/b-latest"}) {
+		t.Errorf("expected the restart of /myapp for both paths, got %+v", entries)
+	}
+	if entries, _ = audit.Query(core.AuditFilter{Dst: "b-latest"}); len(entries) != 2 {
+		t.Errorf("expected both applications to be restarted for b-latest, got %+v", entries)
+	}
+}
+
+// TestArtifactsService_SetFetchInterval tests that the volumes are fetched
+// with the interval set while Run is fetching them.
+func TestArtifactsService_SetFetchInterval(t *testing.T) {
+	svc := NewArtifactsService(newFakeOrchestrator(), log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go svc.Run(ctx, make(chan core.Update), time.Hour, BatchPolicy{Size: 100, QuietPeriod: time.Hour, MaxWait: time.Hour})
+	<-svc.fetched
+	first, _ := svc.FetchStatus()
+
+	svc.SetFetchInterval(10 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if lastFetch, _ := svc.FetchStatus(); lastFetch.After(first) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the volumes to be fetched again within the new interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
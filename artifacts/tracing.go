@@ -0,0 +1,72 @@
+package artifacts
+
+import (
+	"context"
+
+	"apex/artifact-manager/core"
+)
+
+// SetTracer sets the tracer the time updates wait on the request queue and in
+// a batch, the batches and the restarts are traced with.
+func (as *ArtifactsService) SetTracer(tracer *core.Tracer) {
+	as.mutex.Lock()
+	as.tracer = tracer
+	as.mutex.Unlock()
+	as.scheduler.setTracer(tracer)
+}
+
+// currentTracer returns the tracer, which may be nil.
+func (as *ArtifactsService) currentTracer() *core.Tracer {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	return as.tracer
+}
+
+// traceReceived records the time update waited on the request queue in the
+// trace of its upload and returns the span of the time it waits in its batch,
+// which is ended once the batch is restarted. The span is nil if the upload
+// wasn't traced.
+func (as *ArtifactsService) traceReceived(update core.Update) *core.Span {
+	tracer := as.currentTracer()
+	upload, err := core.ParseTraceparent(update.TraceContext)
+	if tracer == nil || err != nil {
+		return nil
+	}
+	ctx := core.ContextWithSpanContext(context.Background(), upload)
+	if !update.Queued.IsZero() {
+		_, queued := tracer.StartAt(ctx, "queue", update.Queued)
+		queued.SetAttribute("path", update.Path)
+		queued.End()
+	}
+	_, batched := tracer.Start(ctx, "batch")
+	batched.SetAttribute("path", update.Path)
+	return batched
+}
+
+// traceLinks returns the spans of the uploads that made updates.
+func traceLinks(updates []core.Update) []core.SpanContext {
+	links := make([]core.SpanContext, 0)
+	for _, update := range updates {
+		if upload, err := core.ParseTraceparent(update.TraceContext); err == nil && !containsSpan(links, upload) {
+			links = append(links, upload)
+		}
+	}
+	return links
+}
+
+// appLinks returns the spans of the uploads appID is restarted for.
+func (as *ArtifactsService) appLinks(appID string) []core.SpanContext {
+	as.mutex.Lock()
+	defer as.mutex.Unlock()
+	return traceLinks(as.causes[appID])
+}
+
+// containsSpan returns true if links contains sc.
+func containsSpan(links []core.SpanContext, sc core.SpanContext) bool {
+	for _, link := range links {
+		if link == sc {
+			return true
+		}
+	}
+	return false
+}
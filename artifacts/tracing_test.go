@@ -0,0 +1,66 @@
+package artifacts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// TestArtifactsService_Tracing tests that the time updates wait on the queue
+// and in their batch is traced along with their uploads, and that the batch
+// and the restarts are linked to the uploads.
+func TestArtifactsService_Tracing(t *testing.T) {
+	restarts := make(chan string, 10)
+	s, svc := newRestartingMarathon(t, sharedVolumesApps, restarts)
+	defer s.Close()
+	var buf bytes.Buffer
+	tracer := core.NewTracer(core.NewStdoutExporter(&buf), core.DefaultLogger())
+	svc.SetTracer(tracer)
+
+	upload := core.SpanContext{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}
+	requestQueue := make(chan core.Update, 10)
+	go svc.Run(context.Background(), requestQueue, time.Hour, BatchPolicy{Size: 10, QuietPeriod: 50 * time.Millisecond, MaxWait: 5 * time.Second})
+	requestQueue <- core.Update{Path: "/data/a-latest", TraceContext: upload.Traceparent(), Queued: time.Now().Add(-time.Second)}
+	requestQueue <- core.Update{Path: "/data/b-latest"}
+	collectRestarts(restarts, 500*time.Millisecond)
+	svc.Stop(context.Background())
+	if err := tracer.Close(); err != nil {
+		t.Fatalf("unable to close the tracer: %v", err)
+	}
+
+	spans := make(map[string][]core.SpanData)
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var span core.SpanData
+		if err := decoder.Decode(&span); err != nil {
+			t.Fatalf("unable to decode the spans: %v", err)
+		}
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+	for _, name := range []string{"queue", "batch"} {
+		if len(spans[name]) != 1 || spans[name][0].TraceID != upload.TraceID || spans[name][0].ParentSpanID != upload.SpanID {
+			t.Errorf("expected a %s span in the trace of the upload; got %+v", name, spans[name])
+		}
+	}
+	if len(spans["queue"]) == 1 && spans["queue"][0].End.Sub(spans["queue"][0].Start) < time.Second {
+		t.Errorf("expected the queue span to start when the update was queued; got %+v", spans["queue"][0])
+	}
+	if len(spans["restart_apps"]) != 1 || len(spans["restart_apps"][0].Links) != 1 || spans["restart_apps"][0].Links[0] != upload {
+		t.Errorf("expected a restart_apps span linked to the upload; got %+v", spans["restart_apps"])
+	}
+	if len(spans["restart"]) != 2 {
+		t.Fatalf("expected a restart span for each application; got %+v", spans["restart"])
+	}
+	for _, span := range spans["restart"] {
+		if span.Attributes["app"] == "/myapp" && (len(span.Links) != 1 || span.Links[0] != upload) {
+			t.Errorf("expected the restart of /myapp to be linked to the upload; got %+v", span)
+		}
+		if span.Attributes["app"] == "/otherapp" && len(span.Links) != 0 {
+			t.Errorf("expected the restart of /otherapp not to be linked to the upload; got %+v", span)
+		}
+	}
+}
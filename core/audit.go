@@ -0,0 +1,298 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// The operations recorded in the audit log.
+const (
+	AuditUpload   = "upload"
+	AuditRollback = "rollback"
+	AuditRestart  = "restart"
+)
+
+// AuditRestartEntry is a workload that was restarted, along with the deployment
+// its restart started.
+type AuditRestartEntry struct {
+	App string `json:"app"`
+	// empty if the orchestrator does not track deployments
+	Deployment string `json:"deployment,omitempty"`
+}
+
+// AuditEntry is a single line of the audit log, recording a change made to
+// the managed files or a restart of the workloads depending on them.
+type AuditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	// the name of the token, or the identity of the client certificate, of the
+	// client that made the change, empty for the changes artifact-manager makes
+	Identity string `json:"identity,omitempty"`
+	// the address of the client that made the change
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	// the name, src and dst of an upload, as they were requested
+	Name string `json:"name,omitempty"`
+	Src  string `json:"src,omitempty"`
+	Dst  string `json:"dst,omitempty"`
+	// the SHA-256 digest of the uploaded file, prefixed with "sha256:"
+	Digest string `json:"digest,omitempty"`
+	// the updated paths, within the external directory, that applications would have mounted
+	Paths []string `json:"paths,omitempty"`
+	// the path the symlink pointed to before and after the change
+	PreviousTarget string `json:"previousTarget,omitempty"`
+	Target         string `json:"target,omitempty"`
+	// the workloads that were restarted
+	Restarts []AuditRestartEntry `json:"restarts,omitempty"`
+	// why artifact-manager made the change
+	Reason string `json:"reason,omitempty"`
+}
+
+// AuditFilter selects entries of the audit log, a filter that is not set
+// selects every entry.
+type AuditFilter struct {
+	// the dst of an upload, matched against the base name of the updated paths
+	Dst string
+	// the id of a restarted workload
+	App string
+	// the entries recorded at or after Since and before Until
+	Since time.Time
+	Until time.Time
+	// the maximum number of entries selected, the oldest ones, 0 selects
+	// them all; the next ones are selected with the time of the last entry
+	// as Since
+	Limit int
+}
+
+// matches returns true if entry is selected by the filter.
+func (f AuditFilter) matches(entry AuditEntry) bool {
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !entry.Time.Before(f.Until) {
+		return false
+	}
+	if f.Dst != "" {
+		found := path.Clean(entry.Dst) == path.Clean(f.Dst)
+		for _, updated := range entry.Paths {
+			found = found || path.Base(updated) == path.Base(f.Dst)
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.App != "" {
+		found := false
+		for _, restart := range entry.Restarts {
+			found = found || restart.App == f.App
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// AuditLog is an append-only file of JSON lines recording who changed what
+// and which workloads were restarted because of it.
+//
+// Once the file grows past its maximum size it is rotated: it is renamed with
+// the suffix ".1", the previous ".1" becomes ".2" and so on, and only the
+// given number of rotated files are kept.
+type AuditLog struct {
+	name       string
+	maxSize    int64
+	maxBackups int
+	logger     *Logger
+	mutex      *sync.Mutex
+	file       *os.File
+	size       int64
+	// returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// OpenAuditLog opens, or creates, the audit log named name, which is rotated
+// once it grows past maxSize bytes, keeping maxBackups rotated files. The
+// problems it works around are logged with logger.
+func OpenAuditLog(name string, maxSize int64, maxBackups int, logger *Logger) (*AuditLog, error) {
+	a := AuditLog{
+		name:       name,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		logger:     logger,
+		mutex:      &sync.Mutex{},
+		now:        time.Now,
+	}
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Record appends entry to the audit log, its time is set to now if it has none.
+func (a *AuditLog) Record(entry AuditEntry) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if entry.Time.IsZero() {
+		entry.Time = a.now()
+	}
+	entry.Time = entry.Time.UTC()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("unable to encode audit entry: %v", err)
+	}
+	data = append(data, '\n')
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.maxSize {
+		if err = a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("unable to write to audit log %s: %v", a.name, err)
+	}
+	err = a.file.Sync()
+	if err != nil {
+		return fmt.Errorf("unable to sync audit log %s: %v", a.name, err)
+	}
+	return nil
+}
+
+// Query returns the entries selected by filter, oldest first, from the audit
+// log and the rotated files that are kept.
+//
+// The files are opened while holding the mutex, so they can't be rotated in
+// between, and read without it, so entries can be recorded meanwhile.
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditEntry, error) {
+	a.mutex.Lock()
+	files := make([]*os.File, 0, a.maxBackups+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i := a.maxBackups; i >= 0; i-- {
+		name := a.name
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", a.name, i)
+		}
+		f, err := os.Open(name)
+		if os.IsNotExist(err) && i > 0 {
+			continue
+		}
+		if err != nil {
+			a.mutex.Unlock()
+			return nil, fmt.Errorf("unable to open audit log %s: %v", name, err)
+		}
+		files = append(files, f)
+	}
+	// only what has been written so far is read from the audit log, not an
+	// entry that is being appended
+	size := a.size
+	a.mutex.Unlock()
+
+	entries := make([]AuditEntry, 0)
+	for i, f := range files {
+		var r io.Reader = f
+		if i == len(files)-1 {
+			r = io.LimitReader(f, size)
+		}
+		err := a.readAuditLog(f.Name(), r, filter, &entries)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Limit > 0 && len(entries) >= filter.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// Close closes the audit log file.
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.file.Close()
+}
+
+// open opens the audit log file for appending.
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open audit log %s: %v", a.name, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("unable to open audit log %s: %v", a.name, err)
+	}
+	a.file = f
+	a.size = info.Size()
+	return nil
+}
+
+// rotate renames the audit log file and the rotated files kept, removing the
+// oldest, and opens a new audit log file.
+func (a *AuditLog) rotate() error {
+	err := a.file.Close()
+	if err != nil {
+		return fmt.Errorf("unable to close audit log %s: %v", a.name, err)
+	}
+	if a.maxBackups <= 0 {
+		err = os.Remove(a.name)
+	} else {
+		for i := a.maxBackups - 1; i >= 1; i-- {
+			err = os.Rename(fmt.Sprintf("%s.%d", a.name, i), fmt.Sprintf("%s.%d", a.name, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				break
+			}
+			err = nil
+		}
+		if err == nil {
+			err = os.Rename(a.name, a.name+".1")
+		}
+	}
+	if err != nil {
+		a.logger.Warnf("problem rotating audit log %s, appending to it: %v", a.name, err)
+	}
+	return a.open()
+}
+
+// readAuditLog appends the entries of the audit log named name, read from r,
+// selected by filter to entries, until the filter's limit is reached.
+func (a *AuditLog) readAuditLog(name string, r io.Reader, filter AuditFilter, entries *[]AuditEntry) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// a partially written line is expected if the application
+			// stopped while appending to the audit log
+			a.logger.Warnf("skipping unreadable line %d of audit log %s: %v", line, name, err)
+			continue
+		}
+		if !filter.matches(entry) {
+			continue
+		}
+		*entries = append(*entries, entry)
+		if filter.Limit > 0 && len(*entries) >= filter.Limit {
+			return nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read audit log %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// TestAuditLog_Query tests that the recorded entries are read back, oldest
+// first, and selected by the filter.
+func TestAuditLog_Query(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	audit, err := OpenAuditLog(path.Join(dir, "audit.log"), 0, 0, DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to open the audit log: %v", err)
+	}
+	defer audit.Close()
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	audit.now = func() time.Time { return now }
+
+	entries := []AuditEntry{
+		{Operation: AuditUpload, Identity: "ci", Name: "a-2.tgz", Src: "a-2", Dst: "a-latest", Paths: []string{"/data/a-latest"}},
+		{Operation: AuditUpload, Identity: "ci", Name: "b-2.tgz", Src: "b-2", Dst: "b-latest", Paths: []string{"/data/b-latest"}},
+		{Operation: AuditRestart, Paths: []string{"/data/a-latest"}, Restarts: []AuditRestartEntry{{App: "/myapp", Deployment: "1"}}},
+		{Operation: AuditRollback, Paths: []string{"/data/a-latest"}, Target: "/data/a-1", Reason: "/myapp is unhealthy"},
+	}
+	for _, entry := range entries {
+		if err = audit.Record(entry); err != nil {
+			t.Fatalf("unable to record %+v: %v", entry, err)
+		}
+		now = now.Add(time.Minute)
+	}
+
+	filters := []struct {
+		filter     AuditFilter
+		operations []string
+	}{
+		{AuditFilter{}, []string{AuditUpload, AuditUpload, AuditRestart, AuditRollback}},
+		{AuditFilter{Dst: "a-latest"}, []string{AuditUpload, AuditRestart, AuditRollback}},
+		{AuditFilter{App: "/myapp"}, []string{AuditRestart}},
+		{AuditFilter{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, []string{AuditUpload, AuditRestart}},
+		{AuditFilter{Limit: 2}, []string{AuditUpload, AuditUpload}},
+		{AuditFilter{Since: start.Add(time.Minute), Limit: 2}, []string{AuditUpload, AuditRestart}},
+	}
+	for _, f := range filters {
+		found, err := audit.Query(f.filter)
+		if err != nil {
+			t.Fatalf("unable to query the audit log: %v", err)
+		}
+		operations := make([]string, 0, len(found))
+		for _, entry := range found {
+			operations = append(operations, entry.Operation)
+		}
+		if fmt.Sprint(operations) != fmt.Sprint(f.operations) {
+			t.Errorf("expected %+v to select %v, got %v", f.filter, f.operations, operations)
+		}
+	}
+
+	found, _ := audit.Query(AuditFilter{App: "/myapp"})
+	if len(found) != 1 || !found[0].Time.Equal(start.Add(2*time.Minute)) || found[0].Restarts[0].Deployment != "1" {
+		t.Errorf("expected the restart of /myapp to be read back, got %+v", found)
+	}
+}
+
+// TestAuditLog_Rotate tests that the audit log is rotated once it grows past
+// its maximum size, that only the given number of rotated files are kept and
+// that the entries of the rotated files are still queried.
+func TestAuditLog_Rotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	name := path.Join(dir, "audit.log")
+
+	// each entry is about 75 bytes, so the log is rotated every other entry
+	audit, err := OpenAuditLog(name, 160, 2, DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to open the audit log: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		if err = audit.Record(AuditEntry{Operation: AuditUpload, Name: fmt.Sprintf("file-%d", i)}); err != nil {
+			t.Fatalf("unable to record entry %d: %v", i, err)
+		}
+	}
+	audit.Close()
+
+	for _, rotated := range []string{name + ".1", name + ".2"} {
+		if _, err = os.Stat(rotated); err != nil {
+			t.Errorf("expected %s to be kept: %v", rotated, err)
+		}
+	}
+	if _, err = os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected only 2 rotated files to be kept")
+	}
+
+	// reopening appends to the existing audit log
+	audit, err = OpenAuditLog(name, 160, 2, DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to reopen the audit log: %v", err)
+	}
+	defer audit.Close()
+	entries, err := audit.Query(AuditFilter{})
+	if err != nil {
+		t.Fatalf("unable to query the audit log: %v", err)
+	}
+	if len(entries) != 6 || entries[0].Name != "file-2" || entries[5].Name != "file-7" {
+		t.Errorf("expected the last 6 entries, oldest first, got %+v", entries)
+	}
+	entries, err = audit.Query(AuditFilter{Limit: 3})
+	if err != nil {
+		t.Fatalf("unable to query the audit log: %v", err)
+	}
+	if len(entries) != 3 || entries[0].Name != "file-2" || entries[2].Name != "file-4" {
+		t.Errorf("expected the oldest 3 entries, across the rotated files, got %+v", entries)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"path"
 	"strconv"
 	"strings"
 	"time"
@@ -13,144 +14,639 @@ import (
 type Config struct {
 	// address to listen on
 	Addr string
+	// the file mutations and restarts are recorded in, the audit log is disabled if empty
+	AuditFile string
+	// the number of rotated audit logs kept
+	AuditMaxBackups int
+	// the size, in megabytes, after which the audit log is rotated
+	AuditMaxSize int
+	// the YAML or TOML file the settings are read from, see Parse
+	ConfigFile string
 	// enable debug logging
 	Debug bool
 	// the directory used for managing files
 	Dir string
+	// the factor the size of an uploaded archive is multiplied by to estimate
+	// the space its extraction needs
+	DiskExtractRatio int
+	// the space, in megabytes, uploads have to leave free in dir
+	DiskReserve int
+	// the label a docker container has to have set to "true" to be restarted
+	DockerLabel string
+	// the unix socket of the Docker Engine API
+	DockerSocket string
 	// a prefix used for all app specific environment variables
 	EnvVarPrefix string
-        // if the application is run inside a container, the external directory would be the location on
-        // the host.
-        ExternalDir string
+	// if the application is run inside a container, the external directory would be the location on
+	// the host.
+	ExternalDir string
 	// the name of the host the application is running on
 	Hostname string
+	// how long an idle keep-alive connection is kept open
+	HTTPIdleTimeout time.Duration
+	// the longest time reading a request, including its body, may take
+	HTTPReadTimeout time.Duration
+	// the longest time handling a request and writing its response may take
+	HTTPWriteTimeout time.Duration
+	// the name of the journal, within Dir, of updates whose restarts have not completed
+	JournalFile string
+	// the certificate authorities trusted when connecting to the Kubernetes API server
+	KubernetesCAFile string
+	// the Kubernetes namespace that is watched, every namespace if empty
+	KubernetesNamespace string
+	// the file the bearer token used with the Kubernetes API server is read from
+	KubernetesTokenFile string
+	// the url of the Kubernetes API server
+	KubernetesURL string
+	// the format of the log entries, "json", "logfmt" or "text"
+	LogFormat string
+	// the lowest level of the entries logged, "debug", "info", "warn" or "error"
+	LogLevel string
+	// the certificate authorities trusted when connecting to Marathon with https
+	MarathonCAFile string
+	// the client certificate presented when connecting to Marathon with https
+	MarathonCertFile string
+	// the Marathon clusters read from MarathonClustersFile, or a single unnamed
+	// cluster using the other Marathon options
+	MarathonClusters []MarathonCluster
+	// the JSON file the Marathon clusters are read from, see LoadMarathonClusters
+	MarathonClustersFile string
+	// the DC/OS service account credentials used to log in to Marathon
+	MarathonDCOSCredentialsFile string
 	// enable debugging by the go-marathon library
 	MarathonDebug bool
 	// Marathon hosts to interact with, can be one or more "host:port" separated by commas
 	MarathonHosts string
+	// the key of MarathonCertFile
+	MarathonKeyFile string
+	// the password used with http basic auth when connecting to Marathon
+	MarathonPassword string
 	// the period in-between querying marathon
 	MarathonQueryInterval time.Duration
+	// the scheme used to connect to Marathon, "http" or "https"
+	MarathonScheme string
+	// the user name used with http basic auth when connecting to Marathon, no auth is used if empty
+	MarathonUsername string
+	// the address of the Nomad HTTP API
+	NomadAddr string
+	// the namespace of the Nomad jobs, "*" for every namespace
+	NomadNamespace string
+	// the ACL token used with the Nomad HTTP API
+	NomadToken string
+	// the orchestrator running the applications to restart, "marathon", "kubernetes", "nomad" or "docker"
+	Orchestrator string
 	// port to listen on
 	Port int
+	// the longest time since the volumes were last fetched successfully for
+	// the application to be ready, 0 disables the check
+	ReadyMaxFetchAge time.Duration
+	// the percentage of the request queue that may be full for the application to be ready
+	ReadyMaxQueuePercent int
+	// the free space, in megabytes, dir needs for the application to be ready
+	ReadyMinFreeSpace int
+	// the number of updated paths that triggers restarting applications
+	RestartBatchSize int
+	// the minimum time between two restarts of the same application
+	RestartCooldown time.Duration
+	// the maximum number of restart deployments in progress at once
+	RestartMaxInFlight int
+	// the maximum number of restarts started per minute
+	RestartMaxPerMinute int
+	// the longest time an updated path waits before applications are restarted
+	RestartMaxWait time.Duration
+	// the time without any updates after which applications are restarted
+	RestartQuietPeriod time.Duration
+	// the number of applications of a batch restarted before the rest of it
+	RolloutCanarySize int
+	// how long restarted applications may take to become healthy before the remaining restarts are halted
+	RolloutHealthTimeout time.Duration
+	// restore the previous release of an update when the restarts are halted
+	RolloutRollback bool
+	// how long restarted applications have to stay healthy before restarting more
+	RolloutSoakTime time.Duration
+	// how long to wait for uploads in progress and restarts to finish when shutting down
+	ShutdownTimeout time.Duration
+	// the certificate the server uses TLS with, TLS is not used if empty
+	TLSCertFile string
+	// whether clients are asked for a certificate, "optional" or "require", none are if empty
+	TLSClientAuth string
+	// the certificate authorities client certificates are verified with
+	TLSClientCAFile string
+	// the key of TLSCertFile
+	TLSKeyFile string
+	// the minimum TLS version accepted, "1.0", "1.1", "1.2" or "1.3"
+	TLSMinVersion string
+	// the JSON file of the bearer tokens requests are authorized with, every request is allowed if empty
+	TokensFile string
+	// where the spans of the uploads and restarts are exported to, "otlp" or
+	// "stdout", tracing is disabled if empty
+	TraceExporter string
+	// the base url of the OpenTelemetry collector the spans are sent to with OTLP over HTTP
+	TraceOTLPEndpoint string
+	// the name of the service the spans are exported as
+	TraceServiceName string
+	// the command-line flags of the settings
+	flags *flag.FlagSet
 }
 
 // NewConfig creates and returns a new Config.
 func NewConfig(envVarPrefix string) *Config {
 	c := Config{
-		Addr:                  "",
-		Debug:                 false,
-		Dir:                   "/tmp",
-		EnvVarPrefix:          envVarPrefix,
-                ExternalDir:           "/tmp",
-		MarathonDebug:         false,
-		MarathonHosts:         "localhost:8080",
-		MarathonQueryInterval: 10 * time.Second,
-		Port: 8900,
+		Addr:                        "",
+		AuditFile:                   "",
+		AuditMaxBackups:             5,
+		AuditMaxSize:                100,
+		ConfigFile:                  "",
+		Debug:                       false,
+		Dir:                         "/tmp",
+		DiskExtractRatio:            3,
+		DiskReserve:                 100,
+		DockerLabel:                 "",
+		DockerSocket:                "/var/run/docker.sock",
+		EnvVarPrefix:                envVarPrefix,
+		ExternalDir:                 "/tmp",
+		HTTPIdleTimeout:             2 * time.Minute,
+		HTTPReadTimeout:             10 * time.Minute,
+		HTTPWriteTimeout:            10 * time.Minute,
+		JournalFile:                 ".artifact-manager.journal",
+		KubernetesCAFile:            "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt",
+		KubernetesNamespace:         "",
+		KubernetesTokenFile:         "/var/run/secrets/kubernetes.io/serviceaccount/token",
+		KubernetesURL:               "https://kubernetes.default.svc",
+		LogFormat:                   "json",
+		LogLevel:                    "info",
+		MarathonCAFile:              "",
+		MarathonCertFile:            "",
+		MarathonClustersFile:        "",
+		MarathonDCOSCredentialsFile: "",
+		MarathonDebug:               false,
+		MarathonHosts:               "localhost:8080",
+		MarathonKeyFile:             "",
+		MarathonPassword:            "",
+		MarathonQueryInterval:       10 * time.Second,
+		MarathonScheme:              "http",
+		MarathonUsername:            "",
+		NomadAddr:                   "http://localhost:4646",
+		NomadNamespace:              "",
+		NomadToken:                  "",
+		Orchestrator:                "marathon",
+		Port:                        8900,
+		ReadyMaxFetchAge:            5 * time.Minute,
+		ReadyMaxQueuePercent:        90,
+		ReadyMinFreeSpace:           100,
+		RestartBatchSize:            5,
+		RestartCooldown:             0,
+		RestartMaxInFlight:          0,
+		RestartMaxPerMinute:         0,
+		RestartMaxWait:              30 * time.Second,
+		RestartQuietPeriod:          5 * time.Second,
+		RolloutCanarySize:           0,
+		RolloutHealthTimeout:        5 * time.Minute,
+		RolloutRollback:             false,
+		RolloutSoakTime:             0,
+		ShutdownTimeout:             30 * time.Second,
+		TLSCertFile:                 "",
+		TLSClientAuth:               "",
+		TLSClientCAFile:             "",
+		TLSKeyFile:                  "",
+		TLSMinVersion:               "1.2",
+		TokensFile:                  "",
+		TraceExporter:               "",
+		TraceOTLPEndpoint:           "http://localhost:4318",
+		TraceServiceName:            "artifact-manager",
 	}
-	if flag.Lookup("addr") == nil {
-		flag.StringVar(&c.Addr, "addr", c.Addr, "address to listen on")
+	// the flags are defined on a flag set of their own, so that the
+	// application can be embedded without touching the global flags
+	c.flags = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	for _, s := range c.settings() {
+		s.define(c.flags)
 	}
-	if flag.Lookup("debug") == nil {
-		flag.BoolVar(&c.Debug, "debug", c.Debug, "enable debug logging")
-	}
-	if flag.Lookup("dir") == nil {
-		flag.StringVar(&c.Dir, "dir", c.Dir, "directory where files will be managed")
+	c.flags.Usage = c.Usage
+	return &c
+}
+
+// FlagSet returns the command-line flags of the settings, which are parsed by
+// Parse.
+func (c *Config) FlagSet() *flag.FlagSet {
+	return c.flags
+}
+
+// setting is a setting of the application, it is set with the command-line
+// flag name, the environment variable named after the flag or the key name
+// in the config file.
+type setting struct {
+	name  string
+	usage string
+	// the field of Config the setting is stored in, a *string, *int, *bool or
+	// *time.Duration
+	value interface{}
+	// an environment variable that is set, even if it's empty, overrides the setting
+	allowEmpty bool
+	// the setting is read again by Reload
+	reloadable bool
+}
+
+// settings returns the settings of the application, which are stored in the
+// fields of c.
+func (c *Config) settings() []setting {
+	return []setting{
+		{name: "addr", value: &c.Addr, usage: "address to listen on"},
+		{name: "audit-file", value: &c.AuditFile, usage: "file uploads, rollbacks and restarts are recorded in as json lines, empty disables the audit log"},
+		{name: "audit-max-backups", value: &c.AuditMaxBackups, usage: "number of rotated audit logs kept"},
+		{name: "audit-max-size", value: &c.AuditMaxSize, usage: "size in megabytes after which the audit log is rotated"},
+		{name: "config-file", value: &c.ConfigFile, usage: "yaml or toml file settings are read from, flags and environment variables take precedence over it"},
+		{name: "debug", value: &c.Debug, usage: "enable debug logging"},
+		{name: "dir", value: &c.Dir, usage: "directory where files will be managed"},
+		{name: "disk-extract-ratio", value: &c.DiskExtractRatio, usage: "factor the size of an uploaded archive is multiplied by to estimate the space its extraction needs"},
+		{name: "disk-reserve", value: &c.DiskReserve, usage: "space in megabytes uploads have to leave free in dir, uploads that don't fit are refused with 507"},
+		{name: "docker-label", value: &c.DockerLabel, usage: "label a docker container has to have set to \"true\" to be restarted, empty restarts every container"},
+		{name: "docker-socket", value: &c.DockerSocket, usage: "unix socket of the docker engine api"},
+		{name: "external-dir", value: &c.ExternalDir, usage: "if running in a container, this is the directory on the host that maps to `dir` inside the container"},
+		{name: "http-idle-timeout", value: &c.HTTPIdleTimeout, usage: "time an idle keep-alive connection is kept open, 0 uses http-read-timeout"},
+		{name: "http-read-timeout", value: &c.HTTPReadTimeout, usage: "longest time reading a request, including the file uploaded, may take, 0 disables the timeout"},
+		{name: "http-write-timeout", value: &c.HTTPWriteTimeout, usage: "longest time handling a request, including extracting the file uploaded, and writing its response may take, 0 disables the timeout"},
+		{name: "journal-file", value: &c.JournalFile, allowEmpty: true, usage: "name of the journal, within the managed directory, of updates whose restarts have not completed, empty disables the journal"},
+		{name: "kubernetes-ca-file", value: &c.KubernetesCAFile, allowEmpty: true, usage: "certificate authorities trusted when connecting to the kubernetes api server, empty uses the system's"},
+		{name: "kubernetes-namespace", value: &c.KubernetesNamespace, usage: "kubernetes namespace whose workloads are restarted, empty watches every namespace"},
+		{name: "kubernetes-token-file", value: &c.KubernetesTokenFile, allowEmpty: true, usage: "file the bearer token used with the kubernetes api server is read from, empty sends no token"},
+		{name: "kubernetes-url", value: &c.KubernetesURL, usage: "url of the kubernetes api server"},
+		{name: "log-format", value: &c.LogFormat, usage: "format of the log entries, \"json\", \"logfmt\" or \"text\""},
+		{name: "log-level", value: &c.LogLevel, reloadable: true, usage: "lowest level of the entries logged, \"debug\", \"info\", \"warn\" or \"error\", debug if debug is set, reloaded on sighup"},
+		{name: "marathon-ca-file", value: &c.MarathonCAFile, usage: "certificate authorities trusted when connecting to marathon with https, empty uses the system's"},
+		{name: "marathon-cert-file", value: &c.MarathonCertFile, usage: "client certificate presented when connecting to marathon with https, requires marathon-key-file"},
+		{name: "marathon-clusters-file", value: &c.MarathonClustersFile, usage: "json file of the named marathon clusters to restart applications in, replaces marathon-hosts"},
+		{name: "marathon-dcos-credentials-file", value: &c.MarathonDCOSCredentialsFile, usage: "json file of the dc/os service account credentials used to log in to marathon"},
+		{name: "marathon-debug", value: &c.MarathonDebug, usage: "enable go-marathon library debug logging"},
+		{name: "marathon-hosts", value: &c.MarathonHosts, usage: "comma-delimited list of marathon hosts, \"host:port\""},
+		{name: "marathon-key-file", value: &c.MarathonKeyFile, usage: "key of marathon-cert-file"},
+		{name: "marathon-password", value: &c.MarathonPassword, usage: "password used with http basic auth when connecting to marathon"},
+		{name: "marathon-query-interval", value: &c.MarathonQueryInterval, reloadable: true, usage: "time to wait between queries to marathon, reloaded on sighup"},
+		{name: "marathon-scheme", value: &c.MarathonScheme, usage: "scheme used to connect to marathon, \"http\" or \"https\""},
+		{name: "marathon-username", value: &c.MarathonUsername, usage: "user name used with http basic auth when connecting to marathon, empty disables basic auth"},
+		{name: "nomad-addr", value: &c.NomadAddr, usage: "address of the nomad http api"},
+		{name: "nomad-namespace", value: &c.NomadNamespace, usage: "namespace of the nomad jobs to restart, \"*\" for every namespace, empty uses the default namespace"},
+		{name: "nomad-token", value: &c.NomadToken, usage: "acl token used with the nomad http api"},
+		{name: "orchestrator", value: &c.Orchestrator, usage: "orchestrator running the applications to restart, \"marathon\", \"kubernetes\", \"nomad\" or \"docker\""},
+		{name: "port", value: &c.Port, usage: "port to listen on"},
+		{name: "ready-max-fetch-age", value: &c.ReadyMaxFetchAge, usage: "longest time since the volumes were last fetched for the application to be ready, 0 disables the check"},
+		{name: "ready-max-queue-percent", value: &c.ReadyMaxQueuePercent, usage: "percentage of the request queue that may be full for the application to be ready"},
+		{name: "ready-min-free-space", value: &c.ReadyMinFreeSpace, usage: "free space in megabytes dir needs for the application to be ready"},
+		{name: "restart-batch-size", value: &c.RestartBatchSize, usage: "number of updated paths that triggers restarting applications"},
+		{name: "restart-cooldown", value: &c.RestartCooldown, usage: "minimum time between two restarts of the same application, 0 disables the cooldown"},
+		{name: "restart-max-in-flight", value: &c.RestartMaxInFlight, usage: "maximum number of restart deployments in progress at once, 0 is unlimited"},
+		{name: "restart-max-per-minute", value: &c.RestartMaxPerMinute, usage: "maximum number of restarts started per minute, 0 is unlimited"},
+		{name: "restart-max-wait", value: &c.RestartMaxWait, usage: "longest time an update waits before applications are restarted"},
+		{name: "restart-quiet-period", value: &c.RestartQuietPeriod, usage: "time without updates after which applications are restarted"},
+		{name: "rollout-canary-size", value: &c.RolloutCanarySize, usage: "number of applications of a batch restarted, and soaked, before the rest of it, 0 disables canaries"},
+		{name: "rollout-health-timeout", value: &c.RolloutHealthTimeout, usage: "time restarted applications may take to become healthy before the remaining restarts are halted"},
+		{name: "rollout-rollback", value: &c.RolloutRollback, usage: "re-point symlinks to their previous release when restarts are halted"},
+		{name: "rollout-soak-time", value: &c.RolloutSoakTime, usage: "time restarted applications have to stay healthy before more are restarted, 0 disables health gating"},
+		{name: "shutdown-timeout", value: &c.ShutdownTimeout, usage: "time to wait for uploads in progress and restarts to finish when shutting down"},
+		{name: "tls-cert-file", value: &c.TLSCertFile, usage: "certificate the server uses tls with, read again when it changes, empty disables tls"},
+		{name: "tls-client-auth", value: &c.TLSClientAuth, usage: "whether clients are asked for a certificate verified with tls-client-ca-file, \"optional\" or \"require\", empty disables client certificates"},
+		{name: "tls-client-ca-file", value: &c.TLSClientCAFile, usage: "certificate authorities client certificates are verified with"},
+		{name: "tls-key-file", value: &c.TLSKeyFile, usage: "key of tls-cert-file"},
+		{name: "tls-min-version", value: &c.TLSMinVersion, usage: "minimum tls version accepted, \"1.0\", \"1.1\", \"1.2\" or \"1.3\""},
+		{name: "tokens-file", value: &c.TokensFile, reloadable: true, usage: "json file of the hashed bearer tokens requests are authorized with, empty allows every request, reloaded on sighup"},
+		{name: "trace-exporter", value: &c.TraceExporter, usage: "where the spans of uploads and restarts are exported to, \"otlp\" or \"stdout\", empty disables tracing"},
+		{name: "trace-otlp-endpoint", value: &c.TraceOTLPEndpoint, usage: "base url of the opentelemetry collector spans are sent to with otlp over http"},
+		{name: "trace-service-name", value: &c.TraceServiceName, usage: "name of the service the spans are exported as"},
 	}
-	if flag.Lookup("external-dir") == nil {
-		flag.StringVar(&c.ExternalDir, "external-dir", c.ExternalDir, "if running in a container, this is the directory on the host that maps to `dir` inside the container")
+}
+
+// lookupSetting returns the setting named name.
+func (c *Config) lookupSetting(name string) (setting, bool) {
+	for _, s := range c.settings() {
+		if s.name == name {
+			return s, true
+		}
 	}
-	if flag.Lookup("marathon-debug") == nil {
-		flag.BoolVar(&c.MarathonDebug, "marathon-debug", c.MarathonDebug, "enable go-marathon library debug logging")
+	return setting{}, false
+}
+
+// envVar returns the name of the environment variable overriding s.
+func (c *Config) envVar(s setting) string {
+	return c.EnvVarPrefix + strings.ToUpper(strings.Replace(s.name, "-", "_", -1))
+}
+
+// define defines the command-line flag of s on flags, its default is the
+// current value of s.
+func (s setting) define(flags *flag.FlagSet) {
+	switch value := s.value.(type) {
+	case *string:
+		flags.StringVar(value, s.name, *value, s.usage)
+	case *int:
+		flags.IntVar(value, s.name, *value, s.usage)
+	case *bool:
+		flags.BoolVar(value, s.name, *value, s.usage)
+	case *time.Duration:
+		flags.DurationVar(value, s.name, *value, s.usage)
 	}
-	if flag.Lookup("marathon-hosts") == nil {
-		flag.StringVar(&c.MarathonHosts, "marathon-hosts", c.MarathonHosts, "comma-delimited list of marathon hosts, \"host:port\"")
+}
+
+// set parses val and stores it in the field of s.
+func (s setting) set(val string) error {
+	switch value := s.value.(type) {
+	case *string:
+		*value = val
+	case *int:
+		num, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("%s=%v is not a valid number", s.name, val)
+		}
+		*value = num
+	case *bool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("%s=%v is not a valid boolean, true or false", s.name, val)
+		}
+		*value = b
+	case *time.Duration:
+		d, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("%s=%v is not a valid duration: %v", s.name, val, err)
+		}
+		*value = d
 	}
-	if flag.Lookup("marathon-query-interval") == nil {
-		flag.DurationVar(&c.MarathonQueryInterval, "marathon-query-interval", c.MarathonQueryInterval, "time to wait between queries to marathon")
+	return nil
+}
+
+// setEnv parses val, the value of the environment variable of s, and stores
+// it in the field of s. Unlike in the config file, a boolean is true if val
+// starts with t or T and false otherwise.
+func (s setting) setEnv(val string) error {
+	if value, ok := s.value.(*bool); ok {
+		*value = strings.HasPrefix(strings.ToLower(val), "t")
+		return nil
 	}
-	if flag.Lookup("port") == nil {
-		flag.IntVar(&c.Port, "port", c.Port, "port to listen on")
+	return s.set(val)
+}
+
+// String returns the value of s the way set parses it.
+func (s setting) String() string {
+	switch value := s.value.(type) {
+	case *string:
+		return *value
+	case *int:
+		return strconv.Itoa(*value)
+	case *bool:
+		return strconv.FormatBool(*value)
+	case *time.Duration:
+		return value.String()
 	}
-	flag.Usage = c.Usage
-	return &c
+	return ""
+}
+
+// setFlags returns the names of the command-line flags that were set.
+func (c *Config) setFlags() map[string]bool {
+	names := make(map[string]bool)
+	c.flags.Visit(func(f *flag.Flag) {
+		names[f.Name] = true
+	})
+	return names
 }
 
-// Parse parses the command-line flags and checks for environment variable overrides.
-func (c *Config) Parse() error {
-	flag.Parse()
+// Parse parses the command-line flags in args, without the name of the
+// program, reads the config file and checks for environment variable
+// overrides, then validates the settings. Every setting is taken from the
+// first of the environment, the command line, the config file and the
+// defaults it is set in. flag.ErrHelp is returned if -help was requested.
+func (c *Config) Parse(args []string) error {
+	if err := c.flags.Parse(args); err != nil {
+		return err
+	}
+	set := c.setFlags()
 
-	key := c.EnvVarPrefix + "ADDR"
+	// the config file has to be known before the settings in it are read
+	key := c.EnvVarPrefix + "CONFIG_FILE"
 	val := os.Getenv(key)
 	if val != "" {
-		c.Addr = os.Getenv(key)
+		c.ConfigFile = val
+	}
+	if c.ConfigFile != "" {
+		values, err := c.readConfigFile()
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			if set[value.setting.name] {
+				continue
+			}
+			if err = value.setting.set(value.value); err != nil {
+				return fmt.Errorf("%s:%d: %v", c.ConfigFile, value.line, err)
+			}
+			set[value.setting.name] = true
+		}
 	}
 
-	key = c.EnvVarPrefix + "DEBUG"
-	val = os.Getenv(key)
-	if strings.HasPrefix(strings.ToLower(val), "t") {
-		c.Debug = true
+	for _, s := range c.settings() {
+		key = c.envVar(s)
+		val, ok := os.LookupEnv(key)
+		if !ok || (val == "" && !s.allowEmpty) {
+			continue
+		}
+		if err := s.setEnv(val); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		set[s.name] = true
 	}
 
-	key = c.EnvVarPrefix + "DIR"
-	val = os.Getenv(key)
-	if val != "" {
-		c.Dir = os.Getenv(key)
+	// if no value is specified, default to being equal to `dir`
+	if !set["external-dir"] {
+		c.ExternalDir = c.Dir
+	}
+	return c.Validate()
+}
+
+// readConfigFile reads the values of the settings in the config file, every
+// key in it has to be a setting.
+func (c *Config) readConfigFile() ([]configValue, error) {
+	values, err := parseConfigFile(c.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	for i, value := range values {
+		s, ok := c.lookupSetting(value.key)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: %s is not a setting", c.ConfigFile, value.line, value.key)
+		}
+		if s.name == "config-file" {
+			return nil, fmt.Errorf("%s:%d: config-file can't be set in the config file", c.ConfigFile, value.line)
+		}
+		values[i].setting = s
 	}
+	return values, nil
+}
+
+// Validate checks the settings, and derives MarathonClusters from them. It is
+// called by Parse.
+func (c *Config) Validate() error {
 	_, err := os.Stat(c.Dir)
 	if os.IsNotExist(err) {
 		return fmt.Errorf("directory=%s does not exist", c.Dir)
 	}
 
-	key = c.EnvVarPrefix + "EXTERNAL_DIR"
-	val = os.Getenv(key)
-	if val != "" {
-		c.ExternalDir = os.Getenv(key)
-	} else {
-                // if no value is specified, default to being equal to `dir`
-                c.ExternalDir = c.Dir
-        }
+	switch c.LogFormat {
+	case "json", "logfmt", "text":
+	default:
+		return fmt.Errorf("log-format=%s is not one of json, logfmt or text", c.LogFormat)
+	}
 
-	key = c.EnvVarPrefix + "MARATHON_DEBUG"
-	val = os.Getenv(key)
-	if strings.HasPrefix(strings.ToLower(val), "t") {
-		c.MarathonDebug = true
+	if c.RestartBatchSize <= 0 {
+		return fmt.Errorf("restart-batch-size=%d is not a positive number", c.RestartBatchSize)
 	}
 
-	key = c.EnvVarPrefix + "MARATHON_HOSTS"
-	val = os.Getenv(key)
-	if val != "" {
-		c.MarathonHosts = os.Getenv(key)
+	// a wave that never becomes healthy would hold up every later restart
+	if c.RolloutHealthTimeout <= 0 {
+		return fmt.Errorf("rollout-health-timeout=%s is not a positive duration", c.RolloutHealthTimeout)
 	}
 
-	key = c.EnvVarPrefix + "MARATHON_QUERY_INTERVAL"
-	val = os.Getenv(key)
-	if val != "" {
-		d, err := time.ParseDuration(val)
+	// the free space needed by an upload is computed unsigned
+	if c.DiskExtractRatio < 0 {
+		return fmt.Errorf("disk-extract-ratio=%d can't be negative", c.DiskExtractRatio)
+	}
+	if c.DiskReserve < 0 {
+		return fmt.Errorf("disk-reserve=%d can't be negative", c.DiskReserve)
+	}
+
+	if err = c.validateReloadable(); err != nil {
+		return err
+	}
+
+	if c.MarathonClustersFile != "" {
+		c.MarathonClusters, err = LoadMarathonClusters(c.MarathonClustersFile, c.MarathonQueryInterval)
 		if err != nil {
-			return fmt.Errorf("marathon-query-interval=%v is not a valid duration: %v", val, err)
+			return err
+		}
+	} else {
+		cluster := MarathonCluster{
+			Hosts:               c.MarathonHosts,
+			Scheme:              c.MarathonScheme,
+			CAFile:              c.MarathonCAFile,
+			CertFile:            c.MarathonCertFile,
+			KeyFile:             c.MarathonKeyFile,
+			Username:            c.MarathonUsername,
+			Password:            c.MarathonPassword,
+			DCOSCredentialsFile: c.MarathonDCOSCredentialsFile,
+			QueryInterval:       c.MarathonQueryInterval,
 		}
-		c.MarathonQueryInterval = d
+		if err = cluster.Validate(); err != nil {
+			return err
+		}
+		c.MarathonClusters = []MarathonCluster{cluster}
 	}
 
-	key = c.EnvVarPrefix + "PORT"
-	val = os.Getenv(key)
-	if val != "" {
-		num, err := strconv.Atoi(val)
+	switch c.Orchestrator {
+	case "marathon", "kubernetes", "nomad", "docker":
+	default:
+		return fmt.Errorf("orchestrator=%s is not one of \"marathon\", \"kubernetes\", \"nomad\" or \"docker\"", c.Orchestrator)
+	}
+
+	if c.TLSCertFile != "" && c.TLSKeyFile == "" {
+		return fmt.Errorf("tls-key-file is required with tls-cert-file")
+	}
+
+	switch c.TraceExporter {
+	case "", "otlp", "stdout":
+	default:
+		return fmt.Errorf("trace-exporter=%s is not one of otlp or stdout", c.TraceExporter)
+	}
+	return nil
+}
+
+// validateReloadable checks the settings read again by Reload.
+func (c *Config) validateReloadable() error {
+	if c.Debug {
+		c.LogLevel = "debug"
+	}
+	if _, err := ParseLevel(c.LogLevel); err != nil {
+		return fmt.Errorf("log-level=%v", err)
+	}
+	if c.MarathonQueryInterval <= 0 {
+		return fmt.Errorf("marathon-query-interval=%s is not a positive duration", c.MarathonQueryInterval)
+	}
+	return nil
+}
+
+// Reload reads the reloadable settings, such as log-level, again from the
+// config file and the environment, the command-line flags still take
+// precedence over the config file. It returns the names of the settings that
+// changed. None of them change if the config file can't be read or one of
+// them isn't valid, the other settings only change with a restart.
+func (c *Config) Reload() ([]string, error) {
+	set := c.setFlags()
+	file := make(map[string]configValue)
+	if c.ConfigFile != "" {
+		values, err := c.readConfigFile()
 		if err != nil {
-			return fmt.Errorf("port=%v is not a valid number", val)
+			return nil, err
+		}
+		for _, value := range values {
+			file[value.setting.name] = value
 		}
-		c.Port = num
 	}
-	return nil
+
+	// the settings are read into a copy, which is only kept if it's valid
+	next := *c
+	nextSettings := next.settings()
+	for _, s := range nextSettings {
+		if !s.reloadable {
+			continue
+		}
+		// the setting is read from scratch, as it may no longer be in the file
+		f := c.flags.Lookup(s.name)
+		value, inFile := file[s.name]
+		switch {
+		case f != nil && set[s.name]:
+			s.set(f.Value.String())
+		case inFile:
+			if err := s.set(value.value); err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", c.ConfigFile, value.line, err)
+			}
+		case f != nil:
+			s.set(f.DefValue)
+		}
+		key := c.envVar(s)
+		val, ok := os.LookupEnv(key)
+		if !ok || (val == "" && !s.allowEmpty) {
+			continue
+		}
+		if err := s.setEnv(val); err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	if err := next.validateReloadable(); err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0)
+	for i, s := range c.settings() {
+		if s.reloadable && s.String() != nextSettings[i].String() {
+			s.set(nextSettings[i].String())
+			changed = append(changed, s.name)
+		}
+	}
+	return changed, nil
 }
 
-// Usage outputs how to use the application.
+// Usage outputs how to use the application to the output of the flag set.
 func (c *Config) Usage() {
-	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
-	flag.PrintDefaults()
-	fmt.Fprintln(os.Stderr)
-	fmt.Fprintln(os.Stderr, "Note: environment variables can be defined to override any command-line flag.")
-	fmt.Fprintf(os.Stderr, "The variables are equivalent to the command-line flag names, except that they should be upper-case, hypens replaced by underscores and prefixed with \"%s\" (excluding double quotes)\n", c.EnvVarPrefix)
+	out := c.flags.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", c.flags.Name())
+	c.flags.PrintDefaults()
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Note: environment variables can be defined to override any command-line flag.")
+	fmt.Fprintf(out, "The variables are equivalent to the command-line flag names, except that they should be upper-case, hypens replaced by underscores and prefixed with \"%s\" (excluding double quotes)\n", c.EnvVarPrefix)
+	fmt.Fprintln(out, "The settings can also be read from the yaml or toml config-file, with the flag names as keys, which the command-line flags take precedence over.")
+}
+
+// JournalPath returns the path of the journal, or an empty string if the
+// journal is disabled.
+func (c *Config) JournalPath() string {
+	if c.JournalFile == "" {
+		return ""
+	}
+	return path.Join(c.Dir, path.Base(c.JournalFile))
 }
 
 // ServeAddr returns the address the server should listen on.
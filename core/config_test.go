@@ -0,0 +1,210 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes data to the config file named name in dir, and
+// returns its path.
+func writeConfigFile(t *testing.T, dir, name, data string) string {
+	configFile := path.Join(dir, name)
+	if err := ioutil.WriteFile(configFile, []byte(data), 0644); err != nil {
+		t.Fatalf("unable to write %s: %v", configFile, err)
+	}
+	return configFile
+}
+
+// TestConfig_Parse tests that the config file overrides the defaults and is
+// overridden by the environment.
+func TestConfig_Parse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := writeConfigFile(t, dir, "config.yaml", `
+dir: `+dir+`
+port: 8901
+journal-file: ".journal"
+marathon:
+  query_interval: 30s
+restart:
+  batch_size: 10
+`)
+	os.Setenv("AM_CONFIG_TEST_CONFIG_FILE", configFile)
+	os.Setenv("AM_CONFIG_TEST_RESTART_BATCH_SIZE", "20")
+	os.Setenv("AM_CONFIG_TEST_JOURNAL_FILE", "")
+	defer os.Unsetenv("AM_CONFIG_TEST_CONFIG_FILE")
+	defer os.Unsetenv("AM_CONFIG_TEST_RESTART_BATCH_SIZE")
+	defer os.Unsetenv("AM_CONFIG_TEST_JOURNAL_FILE")
+
+	c := NewConfig("AM_CONFIG_TEST_")
+	if err = c.Parse(nil); err != nil {
+		t.Fatalf("failed to parse the config: %v", err)
+	}
+	if c.Dir != dir || c.ExternalDir != dir {
+		t.Errorf("expected dir and external-dir to be %s; got %s and %s", dir, c.Dir, c.ExternalDir)
+	}
+	if c.Port != 8901 || c.MarathonQueryInterval != 30*time.Second {
+		t.Errorf("expected port and marathon-query-interval to be read from the file; got %d and %s", c.Port, c.MarathonQueryInterval)
+	}
+	if c.RestartBatchSize != 20 {
+		t.Errorf("expected restart-batch-size to be overridden by the environment; got %d", c.RestartBatchSize)
+	}
+	if c.JournalFile != "" {
+		t.Errorf("expected journal-file to be emptied by the environment; got %s", c.JournalFile)
+	}
+	if c.LogLevel != "info" {
+		t.Errorf("expected log-level to keep its default; got %s", c.LogLevel)
+	}
+}
+
+// TestConfig_ParseFlags tests that the command-line flags override the config
+// file, and that they only set the config they were parsed by.
+func TestConfig_ParseFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := writeConfigFile(t, dir, "config.toml", "port = 8901\n")
+
+	c := NewConfig("AM_CONFIG_TEST_")
+	if err = c.Parse([]string{"-config-file", configFile, "-port", "9000"}); err != nil {
+		t.Fatalf("failed to parse the config: %v", err)
+	}
+	other := NewConfig("AM_CONFIG_TEST_")
+	if err = other.Parse([]string{"-config-file=" + configFile}); err != nil {
+		t.Fatalf("failed to parse the other config: %v", err)
+	}
+	if c.Port != 9000 || other.Port != 8901 {
+		t.Errorf("expected the ports to be 9000 and 8901; got %d and %d", c.Port, other.Port)
+	}
+
+	invalid := NewConfig("AM_CONFIG_TEST_")
+	invalid.FlagSet().SetOutput(ioutil.Discard)
+	if err = invalid.Parse([]string{"-prot", "9000"}); err == nil {
+		t.Errorf("expected an error parsing an unknown flag")
+	}
+}
+
+// TestConfig_ParseInvalid tests that invalid settings are reported along
+// with where they were set.
+func TestConfig_ParseInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		file     string
+		expected string
+	}{
+		{"unknown", "prot: 8901\n", "config.yaml:1: prot is not a setting"},
+		{"number", "dir: /tmp\nport: http\n", "config.yaml:2: port=http is not a valid number"},
+		{"duration", "marathon-query-interval: 10\n", "config.yaml:1: marathon-query-interval=10 is not a valid duration"},
+		{"boolean", "rollout-rollback: yes please\n", "config.yaml:1: rollout-rollback=yes please is not a valid boolean"},
+		{"config-file", "config-file: other.yaml\n", "config.yaml:1: config-file can't be set in the config file"},
+		{"level", "log-level: loud\n", "log-level="},
+		{"restart-batch-size", "restart-batch-size: 0\n", "restart-batch-size=0 is not a positive number"},
+		{"rollout-health-timeout", "rollout-health-timeout: 0s\n", "rollout-health-timeout=0s is not a positive duration"},
+		{"disk-extract-ratio", "disk-extract-ratio: -1\n", "disk-extract-ratio=-1 can't be negative"},
+		{"disk-reserve", "disk-reserve: -100\n", "disk-reserve=-100 can't be negative"},
+	}
+	for _, test := range tests {
+		configFile := writeConfigFile(t, dir, "config.yaml", test.file)
+		os.Setenv("AM_CONFIG_TEST_CONFIG_FILE", configFile)
+		c := NewConfig("AM_CONFIG_TEST_")
+		err = c.Parse(nil)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q; got %v", test.name, test.expected, err)
+		}
+	}
+	os.Unsetenv("AM_CONFIG_TEST_CONFIG_FILE")
+}
+
+// TestConfig_ParseEnvBoolean tests that a boolean set in the environment is
+// true if it starts with t, whatever its case, and false otherwise.
+func TestConfig_ParseEnvBoolean(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := writeConfigFile(t, dir, "config.yaml", "rollout-rollback: true\n")
+	os.Setenv("AM_CONFIG_TEST_CONFIG_FILE", configFile)
+	defer os.Unsetenv("AM_CONFIG_TEST_CONFIG_FILE")
+	defer os.Unsetenv("AM_CONFIG_TEST_ROLLOUT_ROLLBACK")
+
+	tests := []struct {
+		env      string
+		expected bool
+	}{
+		{"true", true},
+		{"True", true},
+		{"t", true},
+		{"TRUE", true},
+		{"false", false},
+		{"1", false},
+		{"yes please", false},
+	}
+	for _, test := range tests {
+		os.Setenv("AM_CONFIG_TEST_ROLLOUT_ROLLBACK", test.env)
+		c := NewConfig("AM_CONFIG_TEST_")
+		if err = c.Parse(nil); err != nil {
+			t.Errorf("%s: failed to parse the config: %v", test.env, err)
+			continue
+		}
+		if c.RolloutRollback != test.expected {
+			t.Errorf("%s: expected rollout-rollback to be %t; got %t", test.env, test.expected, c.RolloutRollback)
+		}
+	}
+}
+
+// TestConfig_Reload tests that only the reloadable settings are read again,
+// and that none change if one of them isn't valid.
+func TestConfig_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := writeConfigFile(t, dir, "config.toml", "port = 8901\nlog-level = \"warn\"\n")
+
+	c := NewConfig("AM_CONFIG_TEST_")
+	c.ConfigFile = configFile
+	if err = c.Parse(nil); err != nil {
+		t.Fatalf("failed to parse the config: %v", err)
+	}
+
+	writeConfigFile(t, dir, "config.toml", "port = 8902\nmarathon-query-interval = \"1m\"\n")
+	changed, err := c.Reload()
+	if err != nil {
+		t.Fatalf("failed to reload the config: %v", err)
+	}
+	if !reflect.DeepEqual(changed, []string{"log-level", "marathon-query-interval"}) {
+		t.Errorf("expected log-level and marathon-query-interval to change; got %v", changed)
+	}
+	if c.LogLevel != "info" || c.MarathonQueryInterval != time.Minute {
+		t.Errorf("expected log-level to be reset and marathon-query-interval to be read; got %s and %s", c.LogLevel, c.MarathonQueryInterval)
+	}
+	if c.Port != 8901 {
+		t.Errorf("expected port to only change with a restart; got %d", c.Port)
+	}
+
+	writeConfigFile(t, dir, "config.toml", "log-level = \"error\"\nmarathon-query-interval = \"-1s\"\n")
+	if _, err = c.Reload(); err == nil {
+		t.Errorf("expected an error reloading a negative marathon-query-interval")
+	}
+	if c.LogLevel != "info" || c.MarathonQueryInterval != time.Minute {
+		t.Errorf("expected the settings to be left unchanged; got %s and %s", c.LogLevel, c.MarathonQueryInterval)
+	}
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// configValue is the value of a setting read from a config file.
+type configValue struct {
+	// the key of the value, the name of the setting it is stored in
+	key   string
+	value string
+	// the line of the config file the value is on
+	line int
+	// the setting named key, set by Config.readConfigFile
+	setting setting
+}
+
+// parseConfigFile reads the values in the YAML, with a .yaml or .yml
+// extension, or TOML, with a .toml extension, config file at name.
+//
+// Only the subset of either format needed to set flags is supported, keys
+// with a string, number or boolean value, which may be nested in maps or
+// tables. The keys are the names of the flags, underscores may be used
+// instead of hyphens and the keys of nested maps or tables are joined with
+// hyphens, so that these set marathon-query-interval:
+//
+//	marathon:
+//	  query_interval: 30s
+//
+//	[marathon]
+//	query-interval = "30s"
+func parseConfigFile(name string) ([]configValue, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the config file: %v", err)
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".yaml", ".yml":
+		return parseYAML(name, string(data))
+	case ".toml":
+		return parseTOML(name, string(data))
+	default:
+		return nil, fmt.Errorf("config-file=%s is not a .yaml, .yml or .toml file", name)
+	}
+}
+
+// parseYAML parses the YAML config file at name, whose content is data.
+func parseYAML(name, data string) ([]configValue, error) {
+	// the maps the current line is nested in
+	type section struct {
+		prefix string
+		// the indentation of the key of the map and of its entries, which is
+		// only known once the first one is read
+		indent      int
+		entryIndent int
+	}
+	var sections []section
+	values := make([]configValue, 0)
+	for i, line := range strings.Split(data, "\n") {
+		text := strings.TrimRight(stripComment(line, ':'), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("%s:%d: tabs can't be used for indentation", name, i+1)
+		}
+		indent := len(text) - len(trimmed)
+		for len(sections) > 0 && indent <= sections[len(sections)-1].indent {
+			sections = sections[:len(sections)-1]
+		}
+		prefix := ""
+		if len(sections) > 0 {
+			current := &sections[len(sections)-1]
+			if current.entryIndent < 0 {
+				current.entryIndent = indent
+			}
+			if indent != current.entryIndent {
+				return nil, fmt.Errorf("%s:%d: the indentation doesn't match that of the lines before", name, i+1)
+			}
+			prefix = current.prefix
+		} else if indent != 0 {
+			return nil, fmt.Errorf("%s:%d: the indentation doesn't match that of the lines before", name, i+1)
+		}
+
+		colon := strings.Index(trimmed, ":")
+		if colon < 0 || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("%s:%d: expected \"key: value\", lists are not supported", name, i+1)
+		}
+		key := configKey(prefix + trimmed[:colon])
+		raw := strings.TrimSpace(trimmed[colon+1:])
+		if raw == "" {
+			sections = append(sections, section{prefix: key + "-", indent: indent, entryIndent: -1})
+			continue
+		}
+		if raw == "~" || raw == "null" {
+			continue
+		}
+		value, err := unquoteConfigValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: the value of %s %v", name, i+1, key, err)
+		}
+		values = append(values, configValue{key: key, value: value, line: i + 1})
+	}
+	return values, nil
+}
+
+// parseTOML parses the TOML config file at name, whose content is data.
+func parseTOML(name, data string) ([]configValue, error) {
+	prefix := ""
+	values := make([]configValue, 0)
+	for i, line := range strings.Split(data, "\n") {
+		text := strings.TrimSpace(stripComment(line, '='))
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "[") {
+			if strings.HasPrefix(text, "[[") || !strings.HasSuffix(text, "]") {
+				return nil, fmt.Errorf("%s:%d: expected \"[table]\", arrays of tables are not supported", name, i+1)
+			}
+			prefix = configKey(strings.TrimSpace(text[1:len(text)-1])) + "-"
+			continue
+		}
+
+		equals := strings.Index(text, "=")
+		if equals < 0 {
+			return nil, fmt.Errorf("%s:%d: expected \"key = value\"", name, i+1)
+		}
+		key := configKey(prefix + strings.TrimSpace(text[:equals]))
+		raw := strings.TrimSpace(text[equals+1:])
+		if strings.HasPrefix(raw, `"""`) || strings.HasPrefix(raw, "'''") {
+			return nil, fmt.Errorf("%s:%d: the value of %s is a multi-line string, which is not supported", name, i+1, key)
+		}
+		value, err := unquoteConfigValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: the value of %s %v", name, i+1, key, err)
+		}
+		values = append(values, configValue{key: key, value: value, line: i + 1})
+	}
+	return values, nil
+}
+
+// configKey returns the name of the setting key refers to.
+func configKey(key string) string {
+	key = strings.TrimSpace(key)
+	key = strings.Replace(key, "_", "-", -1)
+	key = strings.Replace(key, ".", "-", -1)
+	key = strings.Replace(key, " ", "", -1)
+	return strings.ToLower(key)
+}
+
+// unquoteConfigValue returns the string, number or boolean raw as a string.
+// Double-quoted strings may contain escape sequences, single-quoted strings
+// don't, except for YAML's two single quotes standing for one.
+func unquoteConfigValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		value, err := strconv.Unquote(raw)
+		if err != nil {
+			return "", fmt.Errorf("is not a valid double-quoted string")
+		}
+		return value, nil
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return "", fmt.Errorf("is not a valid single-quoted string")
+		}
+		return strings.Replace(raw[1:len(raw)-1], "''", "'", -1), nil
+	case strings.HasPrefix(raw, "[") || strings.HasPrefix(raw, "{"):
+		return "", fmt.Errorf("is a list or a map, which are not supported")
+	default:
+		return raw, nil
+	}
+}
+
+// stripComment removes the comment, starting with a #, from line, whose key
+// ends at the first separator. A value is only quoted if it starts with a
+// quote, so a # within the quotes doesn't start a comment, while one after an
+// apostrophe within an unquoted value does.
+func stripComment(line string, separator byte) string {
+	hash := strings.IndexByte(line, '#')
+	sep := strings.IndexByte(line, separator)
+	if hash < 0 {
+		return line
+	}
+	if sep < 0 || hash < sep {
+		return line[:hash]
+	}
+
+	// the value holds the # as it comes after the separator
+	value := strings.TrimLeft(line[sep+1:], " \t")
+	offset := len(line) - len(value)
+	if value[0] != '"' && value[0] != '\'' {
+		return line[:offset+strings.IndexByte(value, '#')]
+	}
+	quote := value[0]
+	for i := 1; i < len(value); i++ {
+		switch c := value[i]; {
+		case quote == '"' && c == '\\':
+			// the escaped character can't end the string
+			i++
+		case quote == '\'' && c == quote && i+1 < len(value) && value[i+1] == quote:
+			// two single quotes stand for one
+			i++
+		case c == quote:
+			if end := strings.IndexByte(value[i+1:], '#'); end >= 0 {
+				return line[:offset+i+1+end]
+			}
+			return line
+		}
+	}
+	// the value isn't terminated, which unquoteConfigValue reports
+	return line
+}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestParseConfigFile tests that YAML and TOML config files are read into the
+// same values.
+func TestParseConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"config.yaml": `---
+# the settings of the artifact manager
+port: 8901
+log_level: "warn" # quoted
+debug: false
+marathon:
+  hosts: m1:8080,m2:8080
+  query-interval: 30s
+tls-client-auth: 'it''s #1'
+audit-file: ~
+note: it's fine # an apostrophe doesn't quote
+`,
+		"config.toml": `# the settings of the artifact manager
+port = 8901
+log_level = "warn" # quoted
+debug = false
+note = "it's fine" # quoted
+
+[marathon]
+hosts = "m1:8080,m2:8080"
+query-interval = "30s"
+
+[tls]
+client_auth = 'it''s #1'
+`,
+	}
+	expected := map[string]string{
+		"port":                    "8901",
+		"log-level":               "warn",
+		"debug":                   "false",
+		"marathon-hosts":          "m1:8080,m2:8080",
+		"marathon-query-interval": "30s",
+		"note":                    "it's fine",
+	}
+	for name, data := range files {
+		configFile := path.Join(dir, name)
+		if err = ioutil.WriteFile(configFile, []byte(data), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", configFile, err)
+		}
+		values, err := parseConfigFile(configFile)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", name, err)
+		}
+		parsed := make(map[string]string)
+		for _, value := range values {
+			parsed[value.key] = value.value
+		}
+		// toml has no escape for single quotes in literal strings
+		if strings.HasSuffix(name, ".yaml") && parsed["tls-client-auth"] != "it's #1" {
+			t.Errorf("%s: expected tls-client-auth to be unquoted; got %q", name, parsed["tls-client-auth"])
+		}
+		delete(parsed, "tls-client-auth")
+		if !reflect.DeepEqual(parsed, expected) {
+			t.Errorf("%s: expected %v; got %v", name, expected, parsed)
+		}
+	}
+}
+
+// TestParseConfigFile_Invalid tests that the line of what can't be parsed is
+// reported.
+func TestParseConfigFile_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "configfile")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{"list.yaml", "port: 8901\nmarathon-hosts:\n  - m1:8080\n", "list.yaml:3:"},
+		{"flow.yaml", "marathon-hosts: [m1, m2]\n", "flow.yaml:1:"},
+		{"indent.yaml", "marathon:\n  hosts: m1\n    scheme: https\n", "indent.yaml:3:"},
+		{"tabs.yaml", "marathon:\n\thosts: m1\n", "tabs.yaml:2:"},
+		{"quote.yaml", "log-level: \"warn\n", "quote.yaml:1:"},
+		{"array.toml", "[[clusters]]\n", "array.toml:1:"},
+		{"key.toml", "port = 8901\nlog-level\n", "key.toml:2:"},
+		{"multiline.toml", "log-level = \"\"\"warn\"\"\"\n", "multiline.toml:1:"},
+		{"config.json", "{}", "is not a .yaml, .yml or .toml file"},
+	}
+	for _, test := range tests {
+		configFile := path.Join(dir, test.name)
+		if err = ioutil.WriteFile(configFile, []byte(test.data), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", configFile, err)
+		}
+		_, err := parseConfigFile(configFile)
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q; got %v", test.name, test.expected, err)
+		}
+	}
+}
@@ -1,33 +1,48 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/mholt/archiver"
 	filetype "gopkg.in/h2non/filetype.v1"
 )
 
+// ErrNoSpace is returned, wrapped, when a file couldn't be written because
+// the disk is full.
+var ErrNoSpace = errors.New("no space left on device")
+
 // SaveFile writes the contents from reader to a new file named fileName.
 //
 // The expectedLength is used to verify the entire contents were successfully written.
+// The file is removed if it couldn't be written entirely, an error wrapping
+// ErrNoSpace is returned if the disk is full.
 func SaveFile(fileName string, reader io.Reader, expectedLength int64) error {
 	// create a file to copy the request contents into
 	f, err := os.Create(fileName)
 	if err != nil {
-		return fmt.Errorf("unable to create file to write content into: %v", err)
+		return fmt.Errorf("unable to create file to write content into: %w", noSpace(err))
 	}
-	defer f.Close()
 
 	// copy the request body into the file
 	written, err := io.Copy(f, reader)
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
 	if err != nil {
-		return fmt.Errorf("failed to write content to %s: %v", f.Name(), err)
+		os.Remove(fileName)
+		return fmt.Errorf("failed to write content to %s: %w", fileName, noSpace(err))
 	}
 	if written != expectedLength {
-		return fmt.Errorf("failed to write entire content to %s, wrote=%d bytes, expected=%d bytes", f.Name(), written, expectedLength)
+		os.Remove(fileName)
+		return fmt.Errorf("failed to write entire content to %s, wrote=%d bytes, expected=%d bytes", fileName, written, expectedLength)
 	}
 
 	return nil
@@ -35,7 +50,8 @@ func SaveFile(fileName string, reader io.Reader, expectedLength int64) error {
 
 // ExtractFile file into a directory provided by the extractIntoDir argument.
 //
-// If the file is not an archive, nothing will happen.
+// If the file is not an archive, nothing will happen. An error wrapping
+// ErrNoSpace is returned if the disk filled up.
 func ExtractFile(file, extractIntoDir string) error {
 	f, err := os.Open(file)
 	if err != nil {
@@ -45,12 +61,36 @@ func ExtractFile(file, extractIntoDir string) error {
 	if isArchive(f) {
 		err = extract(file, extractIntoDir)
 		if err != nil {
-			return err
+			return noSpace(err)
 		}
 	}
 	return nil
 }
 
+// IsArchiveName returns true if name has the extension of an archive that
+// ExtractFile can extract.
+func IsArchiveName(name string) bool {
+	for _, archiverImpl := range archiver.SupportedFormats {
+		if archiverImpl.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// noSpace returns err wrapped with ErrNoSpace if it was caused by the disk
+// being full. The archiver only keeps the message of the errors it returns,
+// so the message is checked as well.
+func noSpace(err error) error {
+	if errors.Is(err, ErrNoSpace) {
+		return err
+	}
+	if errors.Is(err, syscall.ENOSPC) || strings.Contains(err.Error(), ErrNoSpace.Error()) {
+		return fmt.Errorf("%w: %v", ErrNoSpace, err)
+	}
+	return err
+}
+
 // Symlink creates a symlink named dst pointing to src.
 func Symlink(src, dst string) error {
 	if _, err := os.Lstat(dst); err == nil {
@@ -59,13 +99,48 @@ func Symlink(src, dst string) error {
 	return os.Symlink(src, dst)
 }
 
+// SymlinkTarget returns the path the symlink named name points to, or an
+// empty string if name is not a symlink.
+func SymlinkTarget(name string) string {
+	target, err := os.Readlink(name)
+	if err != nil {
+		return ""
+	}
+	return target
+}
+
 // RenameWithTimestamp renames a file by appending the existing name with a timestmap.
-func RenameWithTimestamp(name string) error {
+//
+// The new name is returned, or an empty string if the file does not exist.
+func RenameWithTimestamp(name string) (string, error) {
 	if _, err := os.Stat(name); err == nil || os.IsExist(err) {
 		newPath := fmt.Sprintf("%s-%d", name, time.Now().UnixNano()/int64(time.Millisecond))
-		return os.Rename(name, newPath)
+		return newPath, os.Rename(name, newPath)
 	}
-	return nil
+	return "", nil
+}
+
+// RestoreRenamed undoes RenameWithTimestamp, it removes whatever was created
+// as name since and renames renamed back to name. Only name is removed if
+// renamed is empty, as nothing was renamed.
+func RestoreRenamed(name, renamed string) error {
+	if err := os.RemoveAll(name); err != nil {
+		return err
+	}
+	if renamed == "" {
+		return nil
+	}
+	return os.Rename(renamed, name)
+}
+
+// FreeSpace returns the number of bytes available to unprivileged users on
+// the file system dir is on.
+func FreeSpace(dir string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("unable to get the free space of %s: %v", dir, err)
+	}
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
 }
 
 func isArchive(reader io.Reader) bool {
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestSaveFile_Incomplete tests that a file that isn't written entirely is removed.
+func TestSaveFile_Incomplete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := path.Join(dir, "notes.txt")
+	if err = SaveFile(name, strings.NewReader("notes"), 10); err == nil {
+		t.Fatalf("expected saving fewer bytes than expected to fail")
+	}
+	if _, err = os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed: %v", name, err)
+	}
+}
+
+// TestNoSpace tests that the errors caused by a full disk wrap ErrNoSpace.
+func TestNoSpace(t *testing.T) {
+	tests := []struct {
+		err     error
+		noSpace bool
+	}{
+		{&os.PathError{Op: "write", Path: "/tmp/x", Err: syscall.ENOSPC}, true},
+		{fmt.Errorf("x/file: write /tmp/x/file: no space left on device"), true},
+		{&os.PathError{Op: "write", Path: "/tmp/x", Err: syscall.EACCES}, false},
+	}
+	for _, test := range tests {
+		if noSpace := errors.Is(noSpace(test.err), ErrNoSpace); noSpace != test.noSpace {
+			t.Errorf("expected %v to be a full disk: %v; got %v", test.err, test.noSpace, noSpace)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+)
+
+// journalEntry is a single line of the journal, either an update that was
+// added or the acknowledgement of one.
+type journalEntry struct {
+	ID     uint64  `json:"id"`
+	Ack    bool    `json:"ack,omitempty"`
+	Update *Update `json:"update,omitempty"`
+}
+
+// journalCompactAfter is the number of acknowledgements after which the
+// journal is rewritten with only the pending updates.
+const journalCompactAfter = 1000
+
+// Journal is an append-only file of the updates placed onto the request
+// queue, it allows the updates that haven't been acknowledged to be
+// replayed after the application restarts.
+type Journal struct {
+	name    string
+	file    *os.File
+	logger  *Logger
+	mutex   *sync.Mutex
+	lastID  uint64
+	pending map[uint64]Update
+	// the number of acknowledgements written since the journal was last
+	// compacted, and the number after which it is compacted again
+	acks         int
+	compactAfter int
+}
+
+// OpenJournal opens, or creates, the journal named name, the problems it
+// works around are logged with logger.
+//
+// The updates found in an existing journal that were not acknowledged are
+// kept, the journal is then rewritten to contain only those updates. If it
+// can't be rewritten, a warning is logged and the existing file is appended
+// to instead.
+func OpenJournal(name string, logger *Logger) (*Journal, error) {
+	j := Journal{
+		name:         name,
+		logger:       logger,
+		mutex:        &sync.Mutex{},
+		pending:      make(map[uint64]Update),
+		compactAfter: journalCompactAfter,
+	}
+	err := j.load()
+	if err != nil {
+		return nil, err
+	}
+	j.file, err = os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open journal %s: %v", name, err)
+	}
+	err = j.compact()
+	if err != nil {
+		logger.Warnf("problem compacting the journal %s: %v", name, err)
+	}
+	return &j, nil
+}
+
+// Name returns the base name of the journal file.
+func (j *Journal) Name() string {
+	return path.Base(j.name)
+}
+
+// Append writes update to the journal and returns it with its ID set.
+func (j *Journal) Append(update Update) (Update, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	update.ID = j.lastID + 1
+	err := j.write(journalEntry{ID: update.ID, Update: &update})
+	if err != nil {
+		return update, err
+	}
+	j.lastID = update.ID
+	j.pending[update.ID] = update
+	return update, nil
+}
+
+// Ack records that the updates identified by ids have been handled, so they
+// are not replayed. Once enough updates have been acknowledged, the journal
+// is compacted so it doesn't keep growing.
+func (j *Journal) Ack(ids ...uint64) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	for _, id := range ids {
+		if _, ok := j.pending[id]; !ok {
+			continue
+		}
+		err := j.write(journalEntry{ID: id, Ack: true})
+		if err != nil {
+			return err
+		}
+		delete(j.pending, id)
+		j.acks++
+	}
+	if j.acks < j.compactAfter {
+		return nil
+	}
+	return j.compact()
+}
+
+// Pending returns the updates that have not been acknowledged, in the order
+// they were appended.
+//
+// If several updates are for the same path, only the last one is returned
+// and the others are acknowledged, since restarting for the last one also
+// covers the earlier ones.
+func (j *Journal) Pending() []Update {
+	j.mutex.Lock()
+	latest := make(map[string]uint64)
+	for id := uint64(1); id <= j.lastID; id++ {
+		if update, ok := j.pending[id]; ok {
+			latest[update.Path] = id
+		}
+	}
+	updates := make([]Update, 0, len(latest))
+	superseded := make([]uint64, 0)
+	for id := uint64(1); id <= j.lastID; id++ {
+		update, ok := j.pending[id]
+		if !ok {
+			continue
+		}
+		if latest[update.Path] != id {
+			superseded = append(superseded, id)
+			continue
+		}
+		updates = append(updates, update)
+	}
+	j.mutex.Unlock()
+
+	if err := j.Ack(superseded...); err != nil {
+		j.logger.Warnf("problem acknowledging superseded updates in the journal %s: %v", j.name, err)
+	}
+	return updates
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.file.Close()
+}
+
+// load reads the entries of an existing journal.
+func (j *Journal) load() error {
+	f, err := os.Open(j.name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to open journal %s: %v", j.name, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var entry journalEntry
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			// a partially written line is expected if the application
+			// stopped while appending to the journal
+			j.logger.Warnf("skipping unreadable line %d of journal %s: %v", line, j.name, err)
+			continue
+		}
+		if entry.ID > j.lastID {
+			j.lastID = entry.ID
+		}
+		if entry.Ack {
+			delete(j.pending, entry.ID)
+		} else if entry.Update != nil {
+			update := *entry.Update
+			update.ID = entry.ID
+			j.pending[entry.ID] = update
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("unable to read journal %s: %v", j.name, err)
+	}
+	return nil
+}
+
+// compact rewrites the journal with only the pending updates and opens it
+// for appending. If the journal can't be rewritten, it keeps appending to
+// the file it was appending to.
+func (j *Journal) compact() error {
+	tmpName := j.name + ".tmp"
+	f, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create journal %s: %v", tmpName, err)
+	}
+	for id := uint64(1); id <= j.lastID; id++ {
+		if update, ok := j.pending[id]; ok {
+			err = writeJournalEntry(f, journalEntry{ID: id, Update: &update})
+			if err != nil {
+				f.Close()
+				return fmt.Errorf("unable to write journal %s: %v", tmpName, err)
+			}
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return fmt.Errorf("unable to write journal %s: %v", tmpName, err)
+	}
+	err = os.Rename(tmpName, j.name)
+	if err != nil {
+		return fmt.Errorf("unable to replace journal %s: %v", j.name, err)
+	}
+
+	file, err := os.OpenFile(j.name, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to open journal %s: %v", j.name, err)
+	}
+	j.file.Close()
+	j.file = file
+	j.acks = 0
+	return nil
+}
+
+// write appends entry to the journal file and flushes it to disk.
+func (j *Journal) write(entry journalEntry) error {
+	err := writeJournalEntry(j.file, entry)
+	if err != nil {
+		return fmt.Errorf("unable to write to journal %s: %v", j.name, err)
+	}
+	return nil
+}
+
+// writeJournalEntry appends entry to f and flushes it to disk.
+func writeJournalEntry(f *os.File, entry journalEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("unable to encode journal entry: %v", err)
+	}
+	data = append(data, '\n')
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	return f.Sync()
+}
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func openTestJournal(t *testing.T) (string, *Journal) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %v", err)
+	}
+	name := path.Join(dir, ".journal")
+	j, err := OpenJournal(name, DefaultLogger())
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("unable to open journal: %v", err)
+	}
+	return name, j
+}
+
+// TestJournal_Replay tests that updates that were not acknowledged are
+// pending once the journal is opened again.
+func TestJournal_Replay(t *testing.T) {
+	name, j := openTestJournal(t)
+	defer os.RemoveAll(path.Dir(name))
+
+	first, err := j.Append(Update{Path: "/data/a"})
+	if err != nil {
+		t.Fatalf("unable to append: %v", err)
+	}
+	second, err := j.Append(Update{Path: "/data/b", Symlink: "/tmp/b", PreviousTarget: "/data/b-1"})
+	if err != nil {
+		t.Fatalf("unable to append: %v", err)
+	}
+	if first.ID == 0 || second.ID <= first.ID {
+		t.Fatalf("expected increasing ids, got %d and %d", first.ID, second.ID)
+	}
+	if err = j.Ack(first.ID); err != nil {
+		t.Fatalf("unable to ack: %v", err)
+	}
+	j.Close()
+
+	j, err = OpenJournal(name, DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to reopen journal: %v", err)
+	}
+	defer j.Close()
+
+	pending := j.Pending()
+	if len(pending) != 1 || pending[0] != second {
+		t.Fatalf("expected only %+v to be pending, got %+v", second, pending)
+	}
+
+	// new updates continue after the replayed ones
+	third, err := j.Append(Update{Path: "/data/c"})
+	if err != nil {
+		t.Fatalf("unable to append: %v", err)
+	}
+	if third.ID <= second.ID {
+		t.Errorf("expected the id %d to be greater than %d", third.ID, second.ID)
+	}
+}
+
+// TestJournal_PendingDeduplicates tests that only the last pending update of
+// a path is returned and the earlier ones are acknowledged.
+func TestJournal_PendingDeduplicates(t *testing.T) {
+	name, j := openTestJournal(t)
+	defer os.RemoveAll(path.Dir(name))
+	defer j.Close()
+
+	j.Append(Update{Path: "/data/a"})
+	j.Append(Update{Path: "/data/b"})
+	last, _ := j.Append(Update{Path: "/data/a"})
+
+	pending := j.Pending()
+	if len(pending) != 2 || pending[0].Path != "/data/b" || pending[1] != last {
+		t.Fatalf("expected /data/b and the last /data/a to be pending, got %+v", pending)
+	}
+	if again := j.Pending(); len(again) != 2 {
+		t.Errorf("expected 2 pending updates, got %+v", again)
+	}
+}
+
+// TestJournal_PartialLine tests that a line left partially written is skipped.
+func TestJournal_PartialLine(t *testing.T) {
+	name, j := openTestJournal(t)
+	defer os.RemoveAll(path.Dir(name))
+
+	update, _ := j.Append(Update{Path: "/data/a"})
+	j.Close()
+
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("unable to open journal file: %v", err)
+	}
+	f.WriteString(`{"id": 2, "update": {"pa`)
+	f.Close()
+
+	j, err = OpenJournal(name, DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to reopen journal: %v", err)
+	}
+	defer j.Close()
+	if pending := j.Pending(); len(pending) != 1 || pending[0] != update {
+		t.Errorf("expected %+v to be pending, got %+v", update, pending)
+	}
+}
+
+// TestJournal_CompactFails tests that a journal that can't be compacted when
+// it is opened is still opened, and the existing file appended to.
+func TestJournal_CompactFails(t *testing.T) {
+	name, j := openTestJournal(t)
+	defer os.RemoveAll(path.Dir(name))
+
+	first, _ := j.Append(Update{Path: "/data/a"})
+	j.Close()
+	if err := os.Mkdir(name+".tmp", 0755); err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+
+	var buf bytes.Buffer
+	logger, _ := NewLogger(&buf, "text", LevelWarn)
+	j, err := OpenJournal(name, logger)
+	if err != nil {
+		t.Fatalf("expected the journal to be opened, got: %v", err)
+	}
+	if !strings.Contains(buf.String(), "problem compacting the journal") {
+		t.Errorf("expected the failed compaction to be logged, got %q", buf.String())
+	}
+	second, err := j.Append(Update{Path: "/data/b"})
+	if err != nil {
+		t.Fatalf("unable to append: %v", err)
+	}
+	j.Close()
+
+	j, err = OpenJournal(name, logger)
+	if err != nil {
+		t.Fatalf("unable to reopen journal: %v", err)
+	}
+	defer j.Close()
+	if pending := j.Pending(); len(pending) != 2 || pending[0] != first || pending[1] != second {
+		t.Errorf("expected %+v and %+v to be pending, got %+v", first, second, pending)
+	}
+}
+
+// TestJournal_Compacts tests that the journal is compacted as updates are
+// acknowledged, so its file doesn't keep growing.
+func TestJournal_Compacts(t *testing.T) {
+	name, j := openTestJournal(t)
+	defer os.RemoveAll(path.Dir(name))
+	j.compactAfter = 10
+
+	kept, err := j.Append(Update{Path: "/data/kept"})
+	if err != nil {
+		t.Fatalf("unable to append: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		update, err := j.Append(Update{Path: "/data/a", Symlink: "/tmp/a", PreviousTarget: "/data/a-1"})
+		if err != nil {
+			t.Fatalf("unable to append: %v", err)
+		}
+		if err = j.Ack(update.ID); err != nil {
+			t.Fatalf("unable to ack: %v", err)
+		}
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatalf("unable to stat the journal: %v", err)
+	}
+	// the pending update, along with at most 10 updates and their acknowledgements
+	if info.Size() > 2048 {
+		t.Errorf("expected the journal to be compacted, it is %d bytes", info.Size())
+	}
+	j.Close()
+
+	j, err = OpenJournal(name, DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to reopen journal: %v", err)
+	}
+	defer j.Close()
+	if pending := j.Pending(); len(pending) != 1 || pending[0] != kept {
+		t.Errorf("expected only %+v to be pending, got %+v", kept, pending)
+	}
+}
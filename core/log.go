@@ -1,8 +1,253 @@
 package core
 
-import "log"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-// Log logs a message using the given format and values.
+// Level is the severity of a log entry, entries below the level of a Logger
+// are discarded.
+type Level int32
+
+// The levels of the log entries.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String returns the name of the level.
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named name, one of debug, info, warn or error.
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("%s is not one of debug, info, warn or error", name)
+}
+
+// Logger writes leveled log entries, each made of a message and the fields
+// of the Logger, as a single line of JSON, logfmt or plain text.
+type Logger struct {
+	out    io.Writer
+	format string
+	// shared by the loggers derived with With
+	mutex *sync.Mutex
+	level *int32
+	// the key, value pairs added to each entry
+	fields []interface{}
+	// returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// NewLogger creates a Logger writing entries of at least level to out, in
+// format, which is "json", "logfmt" or "text".
+func NewLogger(out io.Writer, format string, level Level) (*Logger, error) {
+	switch format {
+	case "json", "logfmt", "text":
+	default:
+		return nil, fmt.Errorf("log format %s is not one of json, logfmt or text", format)
+	}
+	l := Logger{
+		out:    out,
+		format: format,
+		mutex:  &sync.Mutex{},
+		level:  new(int32),
+		fields: make([]interface{}, 0),
+		now:    time.Now,
+	}
+	l.SetLevel(level)
+	return &l, nil
+}
+
+// With returns a Logger adding the given key, value pairs to each entry, it
+// shares its output and level with l.
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	derived := *l
+	derived.fields = append(append(make([]interface{}, 0, len(l.fields)+len(keyvals)), l.fields...), keyvals...)
+	return &derived
+}
+
+// SetLevel sets the level of the logger and those derived from it.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+// Level returns the level of the logger.
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+// Debugf logs a message at the debug level.
+func (l *Logger) Debugf(format string, values ...interface{}) {
+	l.log(LevelDebug, format, values...)
+}
+
+// Infof logs a message at the info level.
+func (l *Logger) Infof(format string, values ...interface{}) {
+	l.log(LevelInfo, format, values...)
+}
+
+// Warnf logs a message at the warn level.
+func (l *Logger) Warnf(format string, values ...interface{}) {
+	l.log(LevelWarn, format, values...)
+}
+
+// Errorf logs a message at the error level.
+func (l *Logger) Errorf(format string, values ...interface{}) {
+	l.log(LevelError, format, values...)
+}
+
+// Writer returns a writer logging each line written to it at level, it lets
+// a *log.Logger, created without a prefix or flags, write to l.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &levelWriter{logger: l, level: level}
+}
+
+func (l *Logger) log(level Level, format string, values ...interface{}) {
+	if level < l.Level() {
+		return
+	}
+	msg := strings.TrimRight(fmt.Sprintf(format, values...), "\n")
+
+	var buf bytes.Buffer
+	switch l.format {
+	case "json":
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, l.now().UTC().Format(time.RFC3339Nano))
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(&buf, fmt.Sprint(l.fields[i]))
+			buf.WriteByte(':')
+			writeJSON(&buf, fieldValue(l.fields[i+1]))
+		}
+		buf.WriteByte('}')
+	case "logfmt":
+		buf.WriteString("time=" + l.now().UTC().Format(time.RFC3339Nano))
+		buf.WriteString(" level=" + level.String())
+		buf.WriteString(" msg=" + logfmtValue(msg))
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			buf.WriteString(fmt.Sprintf(" %v=%s", l.fields[i], logfmtValue(fmt.Sprint(fieldValue(l.fields[i+1])))))
+		}
+	default:
+		buf.WriteString(l.now().Format("2006/01/02 15:04:05 "))
+		buf.WriteString(strings.ToUpper(level.String()) + " " + msg)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			buf.WriteString(fmt.Sprintf(" %v=%s", l.fields[i], logfmtValue(fmt.Sprint(fieldValue(l.fields[i+1])))))
+		}
+	}
+	buf.WriteByte('\n')
+
+	l.mutex.Lock()
+	l.out.Write(buf.Bytes())
+	l.mutex.Unlock()
+}
+
+// fieldValue returns the value of a field as it is logged, errors are logged
+// as their message.
+func fieldValue(value interface{}) interface{} {
+	if err, ok := value.(error); ok {
+		return err.Error()
+	}
+	return value
+}
+
+// writeJSON writes value encoded as JSON, or as a JSON string of its default
+// format if it can't be encoded.
+func writeJSON(buf *bytes.Buffer, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
+
+// logfmtValue quotes value if it is empty or contains spaces, quotes or equal signs.
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// levelWriter logs the lines written to it at its level.
+type levelWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (lw *levelWriter) Write(p []byte) (int, error) {
+	lw.logger.log(lw.level, "%s", p)
+	return len(p), nil
+}
+
+var (
+	defaultMutex  = &sync.Mutex{}
+	defaultLogger = mustLogger(NewLogger(os.Stderr, "text", LevelInfo))
+)
+
+func mustLogger(logger *Logger, err error) *Logger {
+	if err != nil {
+		panic(err)
+	}
+	return logger
+}
+
+// SetDefaultLogger sets the logger used by Log and the other package level
+// logging functions.
+func SetDefaultLogger(logger *Logger) {
+	defaultMutex.Lock()
+	defaultLogger = logger
+	defaultMutex.Unlock()
+}
+
+// DefaultLogger returns the logger used by Log and the other package level
+// logging functions.
+func DefaultLogger() *Logger {
+	defaultMutex.Lock()
+	defer defaultMutex.Unlock()
+	return defaultLogger
+}
+
+// Log logs a message at the info level using the given format and values.
 func Log(format string, values ...interface{}) {
-	log.Printf(format, values...)
+	DefaultLogger().Infof(format, values...)
+}
+
+// LogDebug logs a message at the debug level using the given format and values.
+func LogDebug(format string, values ...interface{}) {
+	DefaultLogger().Debugf(format, values...)
+}
+
+// LogWarn logs a message at the warn level using the given format and values.
+func LogWarn(format string, values ...interface{}) {
+	DefaultLogger().Warnf(format, values...)
+}
+
+// LogError logs a message at the error level using the given format and values.
+func LogError(format string, values ...interface{}) {
+	DefaultLogger().Errorf(format, values...)
 }
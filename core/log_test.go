@@ -0,0 +1,81 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+	"time"
+)
+
+// TestLogger tests that entries are written in each format with the fields of
+// the logger and that entries below its level are discarded.
+func TestLogger(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		format   string
+		expected string
+	}{
+		{"json", `{"time":"2020-01-02T03:04:05Z","level":"warn","msg":"upload \"a\" failed","request_id":"abc","err":"disk full"}` + "\n"},
+		{"logfmt", `time=2020-01-02T03:04:05Z level=warn msg="upload \"a\" failed" request_id=abc err="disk full"` + "\n"},
+		{"text", `2020/01/02 03:04:05 WARN upload "a" failed request_id=abc err="disk full"` + "\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		logger, err := NewLogger(&buf, test.format, LevelWarn)
+		if err != nil {
+			t.Fatalf("unable to create a %s logger: %v", test.format, err)
+		}
+		logger.now = func() time.Time { return now }
+		logger = logger.With("request_id", "abc", "err", errors.New("disk full"))
+		logger.Infof("discarded")
+		logger.Warnf("upload %q failed\n", "a")
+		if buf.String() != test.expected {
+			t.Errorf("expected the %s entry\n%s\ngot\n%s", test.format, test.expected, buf.String())
+		}
+	}
+
+	if _, err := NewLogger(&bytes.Buffer{}, "xml", LevelInfo); err == nil {
+		t.Errorf("expected an unknown format to be rejected")
+	}
+}
+
+// TestLogger_SetLevel tests that the level is shared with the derived loggers
+// and applied to the entries written through Writer.
+func TestLogger_SetLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := NewLogger(&buf, "logfmt", LevelInfo)
+	if err != nil {
+		t.Fatalf("unable to create the logger: %v", err)
+	}
+	derived := logger.With("app", "/web")
+	debug := log.New(derived.Writer(LevelDebug), "", 0)
+
+	debug.Printf("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("expected debug entries to be discarded, got %s", buf.String())
+	}
+	logger.SetLevel(LevelDebug)
+	if derived.Level() != LevelDebug {
+		t.Errorf("expected the derived logger to be at debug, got %s", derived.Level())
+	}
+	debug.Printf("shown")
+	if !bytes.Contains(buf.Bytes(), []byte("level=debug msg=shown app=/web\n")) {
+		t.Errorf("expected the debug entry to be written, got %s", buf.String())
+	}
+}
+
+// TestParseLevel tests that levels are parsed by name.
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "INFO", "Warn", "error"} {
+		level, err := ParseLevel(name)
+		if err != nil {
+			t.Errorf("unable to parse %s: %v", name, err)
+		} else if !bytes.EqualFold([]byte(level.String()), []byte(name)) {
+			t.Errorf("expected %s to be parsed, got %s", name, level)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Errorf("expected an unknown level to be rejected")
+	}
+}
@@ -0,0 +1,165 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// MarathonCluster configures one of the Marathon clusters whose applications
+// are restarted.
+type MarathonCluster struct {
+	// identifies the cluster, the ids of its applications are prefixed with it
+	Name string
+	// one or more "host:port" separated by commas, failover members of the cluster
+	Hosts string
+	// "http" or "https"
+	Scheme string
+	// the certificate authorities trusted when using https, the system's if empty
+	CAFile string
+	// the client certificate, and its key, presented when using https, none if empty
+	CertFile string
+	KeyFile  string
+	// the credentials used with http basic auth, no auth is used if Username is empty
+	Username string
+	Password string
+	// the DC/OS service account credentials used to log in, such as those
+	// created by "dcos security org service-accounts", none if empty
+	DCOSCredentialsFile string
+	// the period in-between querying the cluster
+	QueryInterval time.Duration
+	// host path prefixes used by the agents of the cluster, mapped to the
+	// prefix of the same paths as they are uploaded to the artifact manager
+	Paths map[string]string
+}
+
+// URL returns the url go-marathon connects to the cluster with, such as
+// "https://m1:8080,m2:8080". A cluster without a scheme uses "http".
+func (mc *MarathonCluster) URL() string {
+	if mc.Scheme == "" {
+		return "http://" + mc.Hosts
+	}
+	return mc.Scheme + "://" + mc.Hosts
+}
+
+// Validate checks that the scheme and the files of the cluster are usable.
+func (mc *MarathonCluster) Validate() error {
+	if mc.Scheme != "http" && mc.Scheme != "https" {
+		return fmt.Errorf("scheme=%s of %s is not \"http\" or \"https\"", mc.Scheme, mc.describe())
+	}
+	if (mc.CertFile == "") != (mc.KeyFile == "") {
+		return fmt.Errorf("%s needs both a certificate and a key file for client certificates", mc.describe())
+	}
+	if mc.Username != "" && mc.DCOSCredentialsFile != "" {
+		return fmt.Errorf("%s can't use both basic auth and dc/os credentials", mc.describe())
+	}
+	return nil
+}
+
+// describe names the cluster in error messages.
+func (mc *MarathonCluster) describe() string {
+	if mc.Name == "" {
+		return "marathon"
+	}
+	return "marathon cluster " + mc.Name
+}
+
+// TranslatePath returns hostPath, as used by the agents of the cluster, as the
+// path uploaded to the artifact manager. The longest prefix in Paths that
+// hostPath starts with is replaced, a path without any is returned as is.
+func (mc *MarathonCluster) TranslatePath(hostPath string) string {
+	longest := ""
+	for prefix := range mc.Paths {
+		if strings.HasPrefix(hostPath, prefix) && len(prefix) > len(longest) {
+			longest = prefix
+		}
+	}
+	if longest == "" {
+		return hostPath
+	}
+	return mc.Paths[longest] + strings.TrimPrefix(hostPath, longest)
+}
+
+// LoadMarathonClusters reads the Marathon clusters from the JSON file at
+// path, such as:
+//
+//	[
+//	  {"name": "east", "hosts": "m1:8080,m2:8080", "query_interval": "30s"},
+//	  {"name": "west", "hosts": "m3:8080", "username": "artifacts", "password": "secret",
+//	   "paths": {"/mnt/artifacts/": "/data/"}},
+//	  {"name": "dcos", "hosts": "master.mesos/service/marathon", "scheme": "https",
+//	   "ca_file": "/certs/dcos-ca.crt", "dcos_credentials_file": "/secrets/service-account.json"}
+//	]
+//
+// A cluster without a query_interval is queried every defaultInterval, and
+// one without a scheme uses "http". The client certificate of a cluster is
+// set with cert_file and key_file.
+func LoadMarathonClusters(path string, defaultInterval time.Duration) ([]MarathonCluster, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the marathon clusters: %v", err)
+	}
+	var entries []struct {
+		Name                string            `json:"name"`
+		Hosts               string            `json:"hosts"`
+		Scheme              string            `json:"scheme"`
+		CAFile              string            `json:"ca_file"`
+		CertFile            string            `json:"cert_file"`
+		KeyFile             string            `json:"key_file"`
+		Username            string            `json:"username"`
+		Password            string            `json:"password"`
+		DCOSCredentialsFile string            `json:"dcos_credentials_file"`
+		QueryInterval       string            `json:"query_interval"`
+		Paths               map[string]string `json:"paths"`
+	}
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse the marathon clusters in %s: %v", path, err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no marathon clusters in %s", path)
+	}
+
+	clusters := make([]MarathonCluster, 0, len(entries))
+	names := make(map[string]bool)
+	for i, entry := range entries {
+		if entry.Name == "" || strings.Contains(entry.Name, ":") {
+			return nil, fmt.Errorf("marathon cluster %d needs a name without a colon, got %q", i, entry.Name)
+		}
+		if names[entry.Name] {
+			return nil, fmt.Errorf("marathon cluster %s is defined more than once", entry.Name)
+		}
+		names[entry.Name] = true
+		if entry.Hosts == "" {
+			return nil, fmt.Errorf("marathon cluster %s has no hosts", entry.Name)
+		}
+		cluster := MarathonCluster{
+			Name:                entry.Name,
+			Hosts:               entry.Hosts,
+			Scheme:              entry.Scheme,
+			CAFile:              entry.CAFile,
+			CertFile:            entry.CertFile,
+			KeyFile:             entry.KeyFile,
+			Username:            entry.Username,
+			Password:            entry.Password,
+			DCOSCredentialsFile: entry.DCOSCredentialsFile,
+			QueryInterval:       defaultInterval,
+			Paths:               entry.Paths,
+		}
+		if cluster.Scheme == "" {
+			cluster.Scheme = "http"
+		}
+		if err = cluster.Validate(); err != nil {
+			return nil, err
+		}
+		if entry.QueryInterval != "" {
+			cluster.QueryInterval, err = time.ParseDuration(entry.QueryInterval)
+			if err != nil || cluster.QueryInterval <= 0 {
+				return nil, fmt.Errorf("query_interval=%s of marathon cluster %s is not a valid duration", entry.QueryInterval, entry.Name)
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters, nil
+}
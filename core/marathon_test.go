@@ -0,0 +1,76 @@
+package core
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeClusters(t *testing.T, dir, clusters string) string {
+	clustersPath := path.Join(dir, "clusters.json")
+	if err := ioutil.WriteFile(clustersPath, []byte(clusters), 0600); err != nil {
+		t.Fatalf("unable to write %s: %v", clustersPath, err)
+	}
+	return clustersPath
+}
+
+// TestLoadMarathonClusters tests that the clusters are read along with their
+// defaults and that invalid clusters are refused.
+func TestLoadMarathonClusters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clusters")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	clusters, err := LoadMarathonClusters(writeClusters(t, dir, `[
+		{"name": "east", "hosts": "m1:8080,m2:8080"},
+		{"name": "west", "hosts": "m3:8080", "username": "am", "password": "secret", "query_interval": "1m",
+		 "paths": {"/mnt/": "/data/", "/mnt/artifacts/": "/data/"}}
+	]`), 10*time.Second)
+	if err != nil {
+		t.Fatalf("failed to load the clusters: %v", err)
+	}
+	if len(clusters) != 2 || clusters[0].QueryInterval != 10*time.Second || clusters[1].QueryInterval != time.Minute {
+		t.Fatalf("expected 2 clusters queried every 10s and 1m, got %+v", clusters)
+	}
+	if clusters[1].Username != "am" || clusters[1].Password != "secret" {
+		t.Errorf("expected the credentials of west, got %+v", clusters[1])
+	}
+	if url := clusters[0].URL(); url != "http://m1:8080,m2:8080" {
+		t.Errorf("expected the east cluster to use http, got %s", url)
+	}
+
+	translations := map[string]string{
+		"/mnt/artifacts/a-latest": "/data/a-latest",
+		"/mnt/b-latest":           "/data/b-latest",
+		"/etc/hosts":              "/etc/hosts",
+	}
+	for hostPath, expected := range translations {
+		if translated := clusters[1].TranslatePath(hostPath); translated != expected {
+			t.Errorf("expected %s to be translated to %s, got %s", hostPath, expected, translated)
+		}
+	}
+	if translated := clusters[0].TranslatePath("/mnt/b-latest"); translated != "/mnt/b-latest" {
+		t.Errorf("expected a cluster without paths to keep them, got %s", translated)
+	}
+
+	invalid := []string{
+		`[]`,
+		`[{"hosts": "m1:8080"}]`,
+		`[{"name": "a:b", "hosts": "m1:8080"}]`,
+		`[{"name": "east"}]`,
+		`[{"name": "east", "hosts": "m1:8080"}, {"name": "east", "hosts": "m2:8080"}]`,
+		`[{"name": "east", "hosts": "m1:8080", "query_interval": "often"}]`,
+		`[{"name": "east", "hosts": "m1:8080", "scheme": "ftp"}]`,
+		`[{"name": "east", "hosts": "m1:8080", "cert_file": "/certs/am.crt"}]`,
+		`[{"name": "east", "hosts": "m1:8080", "username": "am", "dcos_credentials_file": "/secrets/am.json"}]`,
+	}
+	for _, clusters := range invalid {
+		if _, err = LoadMarathonClusters(writeClusters(t, dir, clusters), time.Second); err == nil {
+			t.Errorf("expected an error loading %s", clusters)
+		}
+	}
+}
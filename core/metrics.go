@@ -0,0 +1,337 @@
+package core
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry holds metrics and writes them in the Prometheus text exposition
+// format, see https://prometheus.io/docs/instrumenting/exposition_formats/.
+type Registry struct {
+	mutex   *sync.Mutex
+	metrics []metric
+}
+
+// metric is a metric held by a Registry.
+type metric interface {
+	// writes the samples of the metric, without its HELP and TYPE lines
+	write(w io.Writer) error
+	describe() (name, help, kind string)
+}
+
+// NewRegistry creates a new Registry without any metrics.
+func NewRegistry() *Registry {
+	r := Registry{
+		mutex:   &sync.Mutex{},
+		metrics: make([]metric, 0),
+	}
+	return &r
+}
+
+// Write writes every metric of the registry to w, in the order they were added.
+func (r *Registry) Write(w io.Writer) error {
+	r.mutex.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mutex.Unlock()
+
+	for _, m := range metrics {
+		name, help, kind := m.describe()
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, strings.Replace(help, "\n", " ", -1), name, kind)
+		if err != nil {
+			return err
+		}
+		if err = m.write(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Registry) add(m metric) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// NewCounter adds a counter, which has a value for each combination of the
+// values of its labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{samples: newSamples(name, help, "counter", labels)}
+	r.add(c)
+	return c
+}
+
+// NewGauge adds a gauge, which has a value for each combination of the values
+// of its labels.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{samples: newSamples(name, help, "gauge", labels)}
+	r.add(g)
+	return g
+}
+
+// NewGaugeFunc adds a gauge without labels whose value is returned by value
+// each time the metrics are written.
+func (r *Registry) NewGaugeFunc(name, help string, value func() float64) {
+	r.add(&funcMetric{name: name, help: help, kind: "gauge", values: func() map[string]float64 {
+		return map[string]float64{"": value()}
+	}})
+}
+
+// NewOptionalGaugeFunc adds a gauge without labels whose value is returned by
+// value each time the metrics are written, the gauge has no sample when value
+// returns false, such as when it couldn't be read.
+func (r *Registry) NewOptionalGaugeFunc(name, help string, value func() (float64, bool)) {
+	r.add(&funcMetric{name: name, help: help, kind: "gauge", values: func() map[string]float64 {
+		v, ok := value()
+		if !ok {
+			return map[string]float64{}
+		}
+		return map[string]float64{"": v}
+	}})
+}
+
+// NewCounterFunc adds a counter with a single label whose value for each
+// value of the label is returned by values each time the metrics are written.
+func (r *Registry) NewCounterFunc(name, help, label string, values func() map[string]float64) {
+	r.add(&funcMetric{name: name, help: help, kind: "counter", label: label, values: values})
+}
+
+// NewHistogram adds a histogram counting the values observed in the given
+// buckets, which are their upper bounds in increasing order, for each
+// combination of the values of its labels.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		name:       name,
+		help:       help,
+		labels:     labels,
+		buckets:    buckets,
+		mutex:      &sync.Mutex{},
+		histograms: make(map[string]*histogram),
+	}
+	r.add(h)
+	return h
+}
+
+// samples are the values of a counter or gauge keyed by their label values.
+type samples struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mutex  *sync.Mutex
+	values map[string]float64
+}
+
+func newSamples(name, help, kind string, labels []string) samples {
+	return samples{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		mutex:  &sync.Mutex{},
+		values: make(map[string]float64),
+	}
+}
+
+func (s *samples) describe() (string, string, string) {
+	return s.name, s.help, s.kind
+}
+
+func (s *samples) update(labelValues []string, update func(float64) float64) {
+	key := formatLabels(s.labels, labelValues)
+	s.mutex.Lock()
+	s.values[key] = update(s.values[key])
+	s.mutex.Unlock()
+}
+
+func (s *samples) write(w io.Writer) error {
+	s.mutex.Lock()
+	values := make(map[string]float64, len(s.values))
+	for key, value := range s.values {
+		values[key] = value
+	}
+	s.mutex.Unlock()
+	return writeSamples(w, s.name, values)
+}
+
+// Counter is a value that only goes up, such as the number of uploads.
+type Counter struct {
+	samples
+}
+
+// Inc adds one to the value of the counter for the given label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds delta, which must not be negative, to the value of the counter for
+// the given label values.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.update(labelValues, func(value float64) float64 {
+		return value + delta
+	})
+}
+
+// Gauge is a value that goes up and down, such as the number of volumes.
+type Gauge struct {
+	samples
+}
+
+// Set sets the value of the gauge for the given label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.update(labelValues, func(float64) float64 {
+		return value
+	})
+}
+
+// funcMetric is a counter or gauge whose values are read when it is written.
+type funcMetric struct {
+	name   string
+	help   string
+	kind   string
+	label  string
+	values func() map[string]float64
+}
+
+func (f *funcMetric) describe() (string, string, string) {
+	return f.name, f.help, f.kind
+}
+
+func (f *funcMetric) write(w io.Writer) error {
+	values := make(map[string]float64)
+	for labelValue, value := range f.values() {
+		if f.label == "" {
+			values[""] = value
+			continue
+		}
+		values[formatLabels([]string{f.label}, []string{labelValue})] = value
+	}
+	return writeSamples(w, f.name, values)
+}
+
+// Histogram counts the values observed, such as the durations of uploads, in
+// buckets.
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mutex   *sync.Mutex
+	// the histogram of each combination of label values, keyed by their formatted labels
+	histograms map[string]*histogram
+}
+
+// histogram is the state of a Histogram for a combination of label values.
+type histogram struct {
+	labelValues []string
+	// the number of values observed in each bucket, not cumulated
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *Histogram) describe() (string, string, string) {
+	return h.name, h.help, "histogram"
+}
+
+// Observe adds value to the histogram for the given label values.
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	hist, ok := h.histograms[key]
+	if !ok {
+		hist = &histogram{labelValues: labelValues, counts: make([]uint64, len(h.buckets))}
+		h.histograms[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.count++
+	hist.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	keys := make([]string, 0, len(h.histograms))
+	for key := range h.histograms {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		hist := h.histograms[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			le := formatLabels(labels, append(append([]string{}, hist.labelValues...), formatValue(bound)))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, le, cumulative); err != nil {
+				return err
+			}
+		}
+		le := formatLabels(labels, append(append([]string{}, hist.labelValues...), "+Inf"))
+		_, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %s\n%s_count%s %d\n",
+			h.name, le, hist.count, h.name, key, formatValue(hist.sum), h.name, key, hist.count)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSamples writes a line for each of values, keyed by their formatted
+// labels, sorted by their labels.
+func writeSamples(w io.Writer, name string, values map[string]float64) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", name, key, formatValue(values[key])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatLabels returns the labels with their values, such as {app="/web"}, or
+// an empty string if there are no labels. A missing value is empty.
+func formatLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels))
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// formatValue formats value the way Prometheus expects it.
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestRegistry_Write tests that the metrics are written in the Prometheus text
+// exposition format.
+func TestRegistry_Write(t *testing.T) {
+	registry := NewRegistry()
+	uploads := registry.NewCounter("uploads_total", "Number of uploads.", "outcome")
+	volumes := registry.NewGauge("volumes", "Number of volumes.")
+	duration := registry.NewHistogram("duration_seconds", "Time taken.", []float64{0.5, 1}, "outcome")
+	registry.NewGaugeFunc("queue_depth", "Number of updates queued.", func() float64 { return 3 })
+	registry.NewOptionalGaugeFunc("free_bytes", "Number of bytes free.", func() (float64, bool) { return 0, false })
+	registry.NewOptionalGaugeFunc("used_bytes", "Number of bytes used.", func() (float64, bool) { return 10, true })
+	registry.NewCounterFunc("restarts_total", "Number of restarts.", "app", func() map[string]float64 {
+		return map[string]float64{"/web": 2, `/a"b`: 1}
+	})
+
+	uploads.Inc("success")
+	uploads.Add(2, "success")
+	uploads.Inc("error")
+	volumes.Set(1.5)
+	duration.Observe(0.2, "success")
+	duration.Observe(0.7, "success")
+	duration.Observe(5, "success")
+
+	var buf bytes.Buffer
+	if err := registry.Write(&buf); err != nil {
+		t.Fatalf("unable to write the metrics: %v", err)
+	}
+	expected := `# HELP uploads_total Number of uploads.
+# TYPE uploads_total counter
+uploads_total{outcome="error"} 1
+uploads_total{outcome="success"} 3
+# HELP volumes Number of volumes.
+# TYPE volumes gauge
+volumes 1.5
+# HELP duration_seconds Time taken.
+# TYPE duration_seconds histogram
+duration_seconds_bucket{outcome="success",le="0.5"} 1
+duration_seconds_bucket{outcome="success",le="1"} 2
+duration_seconds_bucket{outcome="success",le="+Inf"} 3
+duration_seconds_sum{outcome="success"} 5.9
+duration_seconds_count{outcome="success"} 3
+# HELP queue_depth Number of updates queued.
+# TYPE queue_depth gauge
+queue_depth 3
+# HELP free_bytes Number of bytes free.
+# TYPE free_bytes gauge
+# HELP used_bytes Number of bytes used.
+# TYPE used_bytes gauge
+used_bytes 10
+# HELP restarts_total Number of restarts.
+# TYPE restarts_total counter
+restarts_total{app="/a\"b"} 1
+restarts_total{app="/web"} 2
+`
+	if buf.String() != expected {
+		t.Errorf("expected the metrics\n%s\ngot\n%s", expected, buf.String())
+	}
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestOTLPExporter tests that the spans are sent to the collector in the OTLP
+// JSON encoding and that a rejected export fails.
+func TestOTLPExporter(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var request otlpRequest
+		if err := json.Unmarshal(body, &request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- request
+	}))
+	defer s.Close()
+
+	start := time.Unix(1, 500)
+	exporter := NewOTLPExporter(s.URL+"/", "artifact-manager")
+	err := exporter.ExportSpans([]SpanData{{
+		Name:         "restart",
+		TraceID:      "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:       "00f067aa0ba902b7",
+		ParentSpanID: "b7ad6b7169203331",
+		Links:        []SpanContext{{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "b9c7c989f97918e1"}},
+		Start:        start,
+		End:          start.Add(time.Second),
+		Attributes:   map[string]interface{}{"app": "/web", "apps": 2},
+		Error:        "deployment failed",
+	}})
+	if err != nil {
+		t.Fatalf("unable to export the spans: %v", err)
+	}
+
+	request := <-requests
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("expected a single span; got %+v", request)
+	}
+	resource := request.ResourceSpans[0].Resource.Attributes
+	if len(resource) != 1 || resource[0].Key != "service.name" || *resource[0].Value.StringValue != "artifact-manager" {
+		t.Errorf("expected the service name in the resource; got %+v", resource)
+	}
+	span := request.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if span.StartTimeUnixNano != "1000000500" || span.EndTimeUnixNano != "2000000500" {
+		t.Errorf("expected the times in nanoseconds; got %s and %s", span.StartTimeUnixNano, span.EndTimeUnixNano)
+	}
+	if span.ParentSpanID != "b7ad6b7169203331" || len(span.Links) != 1 || span.Links[0].SpanID != "b9c7c989f97918e1" {
+		t.Errorf("expected the parent and link to be sent; got %+v", span)
+	}
+	if len(span.Attributes) != 2 || span.Attributes[0].Key != "app" || *span.Attributes[1].Value.IntValue != "2" {
+		t.Errorf("expected the attributes sorted by key; got %+v", span.Attributes)
+	}
+	if span.Status.Code != otlpStatusError || span.Status.Message != "deployment failed" {
+		t.Errorf("expected an error status; got %+v", span.Status)
+	}
+
+	if err = NewOTLPExporter(s.URL+"/missing", "artifact-manager").ExportSpans([]SpanData{{Name: "restart"}}); err == nil {
+		t.Errorf("expected a rejected export to fail")
+	}
+}
@@ -0,0 +1,315 @@
+package core
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// traceExportInterval is how often the ended spans are exported.
+const traceExportInterval = time.Second
+
+// traceBatchSize is the number of ended spans that are exported right away.
+const traceBatchSize = 512
+
+// traceparent matches a W3C trace context traceparent header, see
+// https://www.w3.org/TR/trace-context/#traceparent-header.
+var traceparent = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+// SpanContext identifies a span and the trace it belongs to.
+type SpanContext struct {
+	// the hex encoded 16 byte id of the trace
+	TraceID string `json:"traceId"`
+	// the hex encoded 8 byte id of the span
+	SpanID string `json:"spanId"`
+}
+
+// IsValid returns true if the trace and span ids are set.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// Traceparent returns the span context as a W3C traceparent header, or an
+// empty string if it isn't valid.
+func (sc SpanContext) Traceparent() string {
+	if !sc.IsValid() {
+		return ""
+	}
+	return "00-" + sc.TraceID + "-" + sc.SpanID + "-01"
+}
+
+// ParseTraceparent returns the span context of a W3C traceparent header.
+func ParseTraceparent(header string) (SpanContext, error) {
+	match := traceparent.FindStringSubmatch(header)
+	if match == nil || match[1] == "00000000000000000000000000000000" || match[2] == "0000000000000000" {
+		return SpanContext{}, fmt.Errorf("%q is not a valid traceparent", header)
+	}
+	return SpanContext{TraceID: match[1], SpanID: match[2]}, nil
+}
+
+// spanContextKey is the key of the current span context in a context.
+type spanContextKey struct{}
+
+// ContextWithSpanContext returns a copy of ctx in which sc is the parent of
+// the spans started with it.
+func ContextWithSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, sc)
+}
+
+// SpanContextFromContext returns the span context set in ctx, which isn't
+// valid if none was set.
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	sc, _ := ctx.Value(spanContextKey{}).(SpanContext)
+	return sc
+}
+
+// SpanData is a span that has ended, as it is exported.
+type SpanData struct {
+	Name         string `json:"name"`
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId,omitempty"`
+	// the spans, usually of other traces, the span is related to, such as the
+	// uploads a batch of restarts was caused by
+	Links      []SpanContext          `json:"links,omitempty"`
+	Start      time.Time              `json:"start"`
+	End        time.Time              `json:"end"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+	// the error the span failed with, empty if it succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// SpanExporter exports the spans that have ended.
+type SpanExporter interface {
+	ExportSpans(spans []SpanData) error
+}
+
+// Tracer starts spans and exports them with its SpanExporter once they have
+// ended, in batches. A nil *Tracer starts nil spans, which record nothing.
+type Tracer struct {
+	exporter SpanExporter
+	logger   *Logger
+	mutex    *sync.Mutex
+	// the ended spans that haven't been exported yet
+	ended []SpanData
+	// signals the export loop that a batch is ready
+	ready chan struct{}
+	stop  chan struct{}
+	done  chan struct{}
+	// returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// NewTracer creates a Tracer exporting the ended spans with exporter, it
+// exports them until Close is called. The spans that couldn't be exported
+// are logged with logger.
+func NewTracer(exporter SpanExporter, logger *Logger) *Tracer {
+	t := Tracer{
+		exporter: exporter,
+		logger:   logger,
+		mutex:    &sync.Mutex{},
+		ended:    make([]SpanData, 0),
+		ready:    make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		now:      time.Now,
+	}
+	go t.run()
+	return &t
+}
+
+// Start starts a span named name, the child of the span context in ctx if
+// any, and returns a copy of ctx in which the span is the parent of the spans
+// started with it.
+func (t *Tracer) Start(ctx context.Context, name string, links ...SpanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	return t.StartAt(ctx, name, t.now(), links...)
+}
+
+// StartAt starts a span like Start, but as if it had started at start, such
+// as the time spent waiting on a queue.
+func (t *Tracer) StartAt(ctx context.Context, name string, start time.Time, links ...SpanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+	parent := SpanContextFromContext(ctx)
+	data := SpanData{
+		Name:       name,
+		TraceID:    parent.TraceID,
+		SpanID:     t.randomID(8),
+		Start:      start,
+		Attributes: make(map[string]interface{}),
+	}
+	if parent.IsValid() {
+		data.ParentSpanID = parent.SpanID
+	} else {
+		data.TraceID = t.randomID(16)
+	}
+	for _, link := range links {
+		if link.IsValid() {
+			data.Links = append(data.Links, link)
+		}
+	}
+	span := &Span{tracer: t, mutex: &sync.Mutex{}, data: data}
+	return ContextWithSpanContext(ctx, span.Context()), span
+}
+
+// Flush exports the spans that have ended so far.
+func (t *Tracer) Flush() error {
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	ended := t.ended
+	t.ended = make([]SpanData, 0)
+	t.mutex.Unlock()
+	if len(ended) == 0 {
+		return nil
+	}
+	return t.exporter.ExportSpans(ended)
+}
+
+// Close stops exporting spans periodically and exports the spans that have
+// ended so far.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	close(t.stop)
+	<-t.done
+	return t.Flush()
+}
+
+// run exports the ended spans every traceExportInterval, or as soon as there
+// are traceBatchSize of them, until Close is called.
+func (t *Tracer) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+		case <-t.ready:
+		}
+		if err := t.Flush(); err != nil {
+			t.logger.Warnf("problem exporting spans: %v", err)
+		}
+	}
+}
+
+// end queues data to be exported.
+func (t *Tracer) end(data SpanData) {
+	t.mutex.Lock()
+	t.ended = append(t.ended, data)
+	full := len(t.ended) >= traceBatchSize
+	t.mutex.Unlock()
+	if full {
+		select {
+		case t.ready <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Span is an operation being traced. A nil *Span records nothing.
+type Span struct {
+	tracer *Tracer
+	mutex  *sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// Context returns the span context of the span, which isn't valid if the
+// span is nil.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return SpanContext{TraceID: s.data.TraceID, SpanID: s.data.SpanID}
+}
+
+// SetAttribute sets the attribute key of the span to value, it has no effect
+// once the span has ended.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if !s.ended {
+		s.data.Attributes[key] = value
+	}
+	s.mutex.Unlock()
+}
+
+// SetError marks the span as failed with err, a nil err is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mutex.Lock()
+	if !s.ended {
+		s.data.Error = err.Error()
+	}
+	s.mutex.Unlock()
+}
+
+// End ends the span, only the first call has an effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = s.tracer.now()
+	data := s.data
+	s.mutex.Unlock()
+	s.tracer.end(data)
+}
+
+// randomID returns n random bytes, hex encoded.
+func (t *Tracer) randomID(n int) string {
+	id := make([]byte, n)
+	if _, err := rand.Read(id); err != nil {
+		t.logger.Warnf("problem generating a trace id: %v", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// StdoutExporter writes each span as a line of JSON, it is meant for
+// debugging and tests.
+type StdoutExporter struct {
+	out   io.Writer
+	mutex *sync.Mutex
+}
+
+// NewStdoutExporter creates a StdoutExporter writing to out, usually os.Stdout.
+func NewStdoutExporter(out io.Writer) *StdoutExporter {
+	return &StdoutExporter{out: out, mutex: &sync.Mutex{}}
+}
+
+// ExportSpans writes spans to the output of the exporter.
+func (e *StdoutExporter) ExportSpans(spans []SpanData) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	encoder := json.NewEncoder(e.out)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// TestTracer tests that spans are children of the span context of their
+// context, keep their links and are exported once ended and flushed.
+func TestTracer(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewTracer(NewStdoutExporter(&buf), DefaultLogger())
+
+	remote, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatalf("unable to parse the traceparent: %v", err)
+	}
+	ctx, upload := tracer.Start(ContextWithSpanContext(context.Background(), remote), "upload")
+	_, save := tracer.Start(ctx, "save")
+	save.SetError(errors.New("disk full"))
+	save.End()
+	upload.SetAttribute("path", "/data/a-latest")
+	upload.End()
+	upload.SetAttribute("ignored", true)
+	_, restart := tracer.Start(context.Background(), "restart", upload.Context(), SpanContext{})
+	restart.End()
+	if err = tracer.Close(); err != nil {
+		t.Fatalf("unable to close the tracer: %v", err)
+	}
+
+	spans := make(map[string]SpanData)
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var span SpanData
+		if err = decoder.Decode(&span); err != nil {
+			t.Fatalf("unable to decode the spans: %v", err)
+		}
+		spans[span.Name] = span
+	}
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans to be exported; got %v", spans)
+	}
+	if spans["upload"].TraceID != remote.TraceID || spans["upload"].ParentSpanID != remote.SpanID {
+		t.Errorf("expected the upload to continue the remote trace; got %+v", spans["upload"])
+	}
+	if spans["save"].TraceID != remote.TraceID || spans["save"].ParentSpanID != spans["upload"].SpanID || spans["save"].Error != "disk full" {
+		t.Errorf("expected the failed save to be a child of the upload; got %+v", spans["save"])
+	}
+	if spans["upload"].Attributes["path"] != "/data/a-latest" || spans["upload"].Attributes["ignored"] != nil {
+		t.Errorf("expected only the attributes set before the end; got %v", spans["upload"].Attributes)
+	}
+	if spans["restart"].TraceID == remote.TraceID || spans["restart"].ParentSpanID != "" {
+		t.Errorf("expected the restart to start a new trace; got %+v", spans["restart"])
+	}
+	if len(spans["restart"].Links) != 1 || spans["restart"].Links[0] != upload.Context() {
+		t.Errorf("expected the restart to be linked to the upload; got %v", spans["restart"].Links)
+	}
+}
+
+// TestTracer_Nil tests that a nil tracer starts spans recording nothing.
+func TestTracer_Nil(t *testing.T) {
+	var tracer *Tracer
+	ctx, span := tracer.Start(context.Background(), "upload")
+	span.SetAttribute("path", "/data")
+	span.SetError(errors.New("failed"))
+	span.End()
+	if span.Context().IsValid() || SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("expected the span of a nil tracer to be invalid")
+	}
+	if err := tracer.Close(); err != nil {
+		t.Errorf("expected closing a nil tracer to succeed: %v", err)
+	}
+}
+
+// TestParseTraceparent tests that only valid traceparent headers are parsed.
+func TestParseTraceparent(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(header)
+	if err != nil {
+		t.Fatalf("unable to parse %s: %v", header, err)
+	}
+	if sc.Traceparent() != header {
+		t.Errorf("expected %s; got %s", header, sc.Traceparent())
+	}
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+	} {
+		if _, err = ParseTraceparent(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
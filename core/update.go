@@ -0,0 +1,26 @@
+package core
+
+import "time"
+
+// Update describes a path that was changed by an upload, it is placed onto
+// the request queue so the applications depending on the path get restarted.
+type Update struct {
+	// identifies the update within the journal, 0 if it was not journaled
+	ID uint64 `json:"-"`
+	// the path, within the external directory, that applications would have mounted
+	Path string `json:"path"`
+	// the symlink that was created or re-pointed, within the managed directory,
+	// empty if no symlink was created
+	Symlink string `json:"symlink,omitempty"`
+	// the path, within the external directory, the symlink pointed to before the
+	// upload, empty if there was no previous release
+	PreviousTarget string `json:"previousTarget,omitempty"`
+	// identifies the upload that made the update in the logs, empty if unknown
+	RequestID string `json:"requestId,omitempty"`
+	// the W3C traceparent of the span of the upload that made the update, so
+	// the restarts it causes can be linked to it, empty if it wasn't traced
+	TraceContext string `json:"traceContext,omitempty"`
+	// when the update started waiting to be placed onto the request queue,
+	// zero if it was replayed from the journal
+	Queued time.Time `json:"-"`
+}
@@ -0,0 +1,84 @@
+package http
+
+import (
+	"sync"
+
+	"apex/artifact-manager/core"
+)
+
+// admission reserves room on the request queue before an upload is handled,
+// so an upload that has been admitted is guaranteed to fit onto the queue.
+type admission struct {
+	mutex *sync.Mutex
+	queue chan<- core.Update
+	// the number of updates allowed on the queue, including reservations
+	maxSize int
+	// the number of reservations that have neither been committed nor released
+	reserved int
+}
+
+// newAdmission creates an admission for queue allowing at most maxSize updates,
+// limited to the capacity of the queue so committing never blocks.
+func newAdmission(queue chan<- core.Update, maxSize int) *admission {
+	if maxSize > cap(queue) {
+		maxSize = cap(queue)
+	}
+	a := admission{
+		mutex:   &sync.Mutex{},
+		queue:   queue,
+		maxSize: maxSize,
+	}
+	return &a
+}
+
+// reserve reserves room for one update on the queue, false is returned if
+// the queue and the outstanding reservations have reached the maximum size.
+func (a *admission) reserve() (*reservation, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.queue)+a.reserved >= a.maxSize {
+		return &reservation{done: true}, false
+	}
+	a.reserved++
+	return &reservation{admission: a}, true
+}
+
+// size returns the number of updates on the queue and reserved for it.
+func (a *admission) size() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return len(a.queue) + a.reserved
+}
+
+// reservation is room reserved on the queue for a single update.
+type reservation struct {
+	admission *admission
+	done      bool
+}
+
+// commit places update onto the queue using the reserved room.
+func (r *reservation) commit(update core.Update) {
+	if r.done {
+		return
+	}
+	r.done = true
+	a := r.admission
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	// the reservation guarantees there is room, so this doesn't block
+	a.queue <- update
+	a.reserved--
+}
+
+// release gives the reserved room back, it does nothing once the
+// reservation has been committed or released.
+func (r *reservation) release() {
+	if r.done {
+		return
+	}
+	r.done = true
+	a := r.admission
+	a.mutex.Lock()
+	a.reserved--
+	a.mutex.Unlock()
+}
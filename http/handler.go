@@ -1,10 +1,15 @@
 package http
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io"
 	gohttp "net/http"
 	"path"
+	"strconv"
+	"time"
 
 	"apex/artifact-manager/core"
 )
@@ -13,29 +18,102 @@ import (
 type Handler struct {
 	// application configuraiton
 	config *core.Config
-	// logger for logging debug messages
-	debug *log.Logger
-	// the location of the uploaded file (symlink destination or actual file)
-	// will be placed onto the channel
-	requestQueue chan<- string
+	// an update describing the location of the uploaded file (symlink destination
+	// or actual file) will be placed onto the channel
+	requestQueue chan<- core.Update
 	// the max size of the request queue
 	maxQueueSize int
+	// reserves room on the request queue for each upload
+	admission *admission
+	// the journal updates are written to before being placed onto the request queue, may be nil
+	journal *core.Journal
+	// the tokens requests are authorized with, every request is allowed if nil
+	tokens *Tokens
+	// the audit log uploads are recorded in, may be nil
+	audit *core.AuditLog
+	// the metrics served by MetricsHandler and those of the uploads, may be nil
+	registry *core.Registry
+	metrics  *handlerMetrics
+	// the tracer the stages of each upload are traced with, may be nil
+	tracer *core.Tracer
+	// the status of the service restarting the applications checked for
+	// readiness, may be nil
+	status ServiceStatus
+	// the logger the requests are logged with, core.DefaultLogger if nil
+	logger *core.Logger
 }
 
 // NewHandler creates a new Handler.
-func NewHandler(config *core.Config, requestQueue chan<- string, maxQueueSize int, debug *log.Logger) *Handler {
+//
+// The debug messages of each request are logged by the logger set by
+// SetLogger along with the id of the request.
+func NewHandler(config *core.Config, requestQueue chan<- core.Update, maxQueueSize int) *Handler {
 	h := Handler{
 		config:       config,
-		debug:        debug,
 		requestQueue: requestQueue,
 		maxQueueSize: maxQueueSize,
+		admission:    newAdmission(requestQueue, maxQueueSize),
 	}
 	return &h
 }
 
+// SetJournal sets the journal each update is written to before it is placed
+// onto the request queue.
+func (h *Handler) SetJournal(journal *core.Journal) {
+	h.journal = journal
+}
+
+// SetTokens sets the bearer tokens every request has to be authorized by.
+func (h *Handler) SetTokens(tokens *Tokens) {
+	h.tokens = tokens
+}
+
+// SetAuditLog sets the audit log each upload is recorded in, which is served
+// by AuditHandler.
+func (h *Handler) SetAuditLog(audit *core.AuditLog) {
+	h.audit = audit
+}
+
+// authorize checks that the request may perform operation on the given names
+// when tokens are set. It returns the identity of the client, the name of its
+// token or the identity of its client certificate, and whether it may. If it
+// may not, the request is answered with 401 or 403 and the reason.
+func (h *Handler) authorize(w gohttp.ResponseWriter, r *gohttp.Request, operation string, names ...string) (string, bool) {
+	if h.tokens == nil {
+		return clientIdentity(r), true
+	}
+	tokenName, status, err := h.tokens.Authorize(r, operation, names...)
+	if err != nil {
+		h.requestLogger(r).Warnf("refused %s request to %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+		if status == gohttp.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="artifact-manager"`)
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, err.Error())
+		return tokenName, false
+	}
+	h.requestLogger(r).Debugf("Authorized %s to %s %v", tokenName, operation, names)
+	return tokenName, true
+}
+
 // UploadHandler handles file upload requests
 func (h *Handler) UploadHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
-	core.Log("received %s request to %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	r, logger := h.withRequestID(w, r)
+	logger.Infof("received %s request to %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	recorder := &statusRecorder{ResponseWriter: w, status: gohttp.StatusOK}
+	w = recorder
+	r, span := h.startSpan(r, "upload")
+	defer func() {
+		endSpan(span, recorder.status)
+	}()
+	if h.metrics != nil {
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		defer func() {
+			h.metrics.observeUpload(recorder.status, body.count, time.Since(start))
+		}()
+	}
 	// only accept POST
 	if r.Method != gohttp.MethodPost {
 		w.WriteHeader(gohttp.StatusMethodNotAllowed)
@@ -44,7 +122,7 @@ func (h *Handler) UploadHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
 	}
 	// check to ensure content is being provided
 	if r.ContentLength <= 0 {
-		core.Log("invalid request, no content provided")
+		logger.Infof("invalid request, no content provided")
 		w.WriteHeader(gohttp.StatusBadRequest)
 		fmt.Fprintf(w, "invalid request, no content provided")
 		return
@@ -55,25 +133,56 @@ func (h *Handler) UploadHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
 	src := queryParams.Get("src")
 	dst := queryParams.Get("dst")
 	if name == "" {
-		core.Log("invalid request, name parameter must be provided in the URL")
+		logger.Infof("invalid request, name parameter must be provided in the URL")
 		w.WriteHeader(gohttp.StatusBadRequest)
 		fmt.Fprintf(w, "name parameter must be provided in the URL")
 		return
 	}
+	// the token has to be allowed to write every path the upload changes
+	names := []string{path.Base(name)}
+	if src != "" && dst != "" {
+		names = append(names, path.Clean(src), path.Clean(dst))
+	}
+	identity, ok := h.authorize(w, r, OperationUpload, names...)
+	if !ok {
+		return
+	}
+	if identity != "" {
+		logger.Infof("upload of %s by %s", path.Base(name), identity)
+	}
+	auditEntry := core.AuditEntry{
+		Operation:  core.AuditUpload,
+		Identity:   identity,
+		RemoteAddr: r.RemoteAddr,
+		Name:       name,
+		Src:        src,
+		Dst:        dst,
+	}
 
-	// check if the queue is full, if so reject the request
-	if len(h.requestQueue) >= h.maxQueueSize {
-		core.Log("server has too many requests (%d) to fulfill", len(h.requestQueue))
+	// reserve room on the queue before anything is written, so a request rejected
+	// because the queue is full leaves the filesystem untouched
+	reservation, ok := h.admission.reserve()
+	if !ok {
+		size := h.admission.size()
+		logger.Warnf("server has too many requests (%d) to fulfill", size)
 		w.WriteHeader(gohttp.StatusServiceUnavailable)
-		fmt.Fprintf(w, "server has too many requests (%d) to fulfill", len(h.requestQueue))
+		fmt.Fprintf(w, "server has too many requests (%d) to fulfill", size)
 		return
 	}
+	// gives the room back unless the update was placed onto the queue
+	defer reservation.release()
 
 	defer r.Body.Close()
 
 	// in case the name included a path, ensure we jut have the name of the file, and
 	// add the directory to it
 	name = path.Base(name)
+	if h.journal != nil && name == h.journal.Name() {
+		logger.Infof("invalid request, name %s is reserved for the journal", name)
+		w.WriteHeader(gohttp.StatusBadRequest)
+		fmt.Fprintf(w, "name %s is reserved", name)
+		return
+	}
 	name = path.Join(h.config.Dir, name)
 
 	// src and dst are optional, if they're provided a symlink we'll be created
@@ -87,11 +196,23 @@ func (h *Handler) UploadHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
 		dst = path.Join(h.config.Dir, dst)
 	}
 
-	// save the file
-	err = core.SaveFile(name, r.Body, r.ContentLength)
+	// refuse the upload before anything is written if it won't fit
+	if err = h.checkStorage(name, r.ContentLength, createSymlink); err != nil {
+		logger.Warnf("refused upload: %v", err)
+		w.WriteHeader(gohttp.StatusInsufficientStorage)
+		fmt.Fprint(w, err.Error())
+		return
+	}
+
+	// save the file, hashing it on the way for the audit log
+	digest := sha256.New()
+	stage := h.startStage(r, "save")
+	err = core.SaveFile(name, io.TeeReader(r.Body, digest), r.ContentLength)
+	stage.SetError(err)
+	stage.End()
 	if err != nil {
-		core.Log("problem saving file to %s: %v", name, err)
-		w.WriteHeader(gohttp.StatusInternalServerError)
+		logger.Errorf("problem saving file to %s: %v", name, err)
+		w.WriteHeader(storageStatus(err))
 		fmt.Fprintf(w, "problem saving file to %s: %v\n", name, err)
 		return
 	}
@@ -102,59 +223,180 @@ func (h *Handler) UploadHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
 	// mounted into their containers. If a symlink is being created for the file, then the
 	// `dst` parameter is used as the name and `ExternalDir` is still used as the path. Again,
 	// the idea being this would match the `hostPath` defined in a Marathon app.
-	requestMsg := path.Join(h.config.ExternalDir, path.Base(name))
+	requestMsg := core.Update{
+		Path:         path.Join(h.config.ExternalDir, path.Base(name)),
+		RequestID:    requestID(r),
+		TraceContext: span.Context().Traceparent(),
+	}
 	if createSymlink {
-		requestMsg = path.Join(h.config.ExternalDir, path.Base(dst))
+		requestMsg.Path = path.Join(h.config.ExternalDir, path.Base(dst))
+		requestMsg.Symlink = dst
+		// remember what the symlink pointed to, so the previous release can be restored
+		previousTarget := core.SymlinkTarget(dst)
 
 		// if the 'src' already exists and is not the same as 'name', move it
+		var renamed string
 		if internalSrc != "" && internalSrc != name {
-			h.debug.Printf("Given src %s might exist, renaming if necessary", internalSrc)
-			err = core.RenameWithTimestamp(internalSrc)
+			logger.Debugf("Given src %s might exist, renaming if necessary", internalSrc)
+			renamed, err = core.RenameWithTimestamp(internalSrc)
 			if err != nil {
-				core.Log("problem renaming existing source path %s: %v", internalSrc, err)
+				logger.Errorf("problem renaming existing source path %s: %v", internalSrc, err)
 				w.WriteHeader(gohttp.StatusInternalServerError)
 				fmt.Fprintf(w, "problem renaming existing source path %s: %v", internalSrc, err)
 				return
 			}
+			// the previous release now lives under the new name
+			if previousTarget == src {
+				previousTarget = ""
+				if renamed != "" {
+					previousTarget = path.Join(h.config.ExternalDir, path.Base(renamed))
+				}
+			}
 		}
+		requestMsg.PreviousTarget = previousTarget
+		auditEntry.PreviousTarget = previousTarget
+		auditEntry.Target = src
 
 		// extract the file (if its an archive, otherwise this won't do anything)
-		h.debug.Printf("Extracting %s (if it's an archive) into %s", name, h.config.Dir)
+		logger.Debugf("Extracting %s (if it's an archive) into %s", name, h.config.Dir)
+		extractStart := time.Now()
+		stage = h.startStage(r, "extract")
 		err = core.ExtractFile(name, h.config.Dir)
+		stage.SetError(err)
+		stage.End()
+		h.metrics.observeExtract(time.Since(extractStart))
 		if err != nil {
-			core.Log("problem extracting file %s into %s: %v\n", name, h.config.Dir, err)
-			w.WriteHeader(gohttp.StatusInternalServerError)
+			logger.Errorf("problem extracting file %s into %s: %v", name, h.config.Dir, err)
+			// don't leave a partial release behind
+			rollbackExtraction(logger, name, internalSrc, renamed)
+			w.WriteHeader(storageStatus(err))
 			fmt.Fprintf(w, "problem extracting file %s into %s: %v\n", name, h.config.Dir, err)
 			return
 		}
 
 		// create symlink
-		h.debug.Printf("Creating symlink from %s to %s", src, dst)
+		logger.Debugf("Creating symlink from %s to %s", src, dst)
+		stage = h.startStage(r, "symlink")
 		err = core.Symlink(src, dst)
+		stage.SetError(err)
+		stage.End()
 		if err != nil {
-			core.Log("problem creating symlink from %s to %s: %v", src, dst, err)
+			logger.Errorf("problem creating symlink from %s to %s: %v", src, dst, err)
 			w.WriteHeader(gohttp.StatusInternalServerError)
 			fmt.Fprintf(w, "problem creating symlink from %s to %s: %v", src, dst, err)
 			return
 		}
 	}
 
-	// check if the queue is full, if so reject the request
-	if len(h.requestQueue) >= h.maxQueueSize {
-		w.WriteHeader(gohttp.StatusServiceUnavailable)
-		fmt.Fprintf(w, "server has too many requests (%d) to fulfill", len(h.requestQueue))
-		return
+	// the update waits for the applications depending on it to be restarted
+	// from here on, journaling it included
+	span.SetAttribute("path", requestMsg.Path)
+	requestMsg.Queued = time.Now()
+
+	// journal the update so the restart isn't lost if the application stops
+	// before the update has been processed
+	if h.journal != nil {
+		stage = h.startStage(r, "journal")
+		requestMsg, err = h.journal.Append(requestMsg)
+		stage.SetError(err)
+		stage.End()
+		if err != nil {
+			logger.Errorf("problem journaling update of %s: %v", requestMsg.Path, err)
+			w.WriteHeader(gohttp.StatusInternalServerError)
+			fmt.Fprintf(w, "problem journaling update of %s: %v", requestMsg.Path, err)
+			return
+		}
 	}
 
-	h.debug.Printf("Adding %s to request queue", requestMsg)
-	h.requestQueue <- requestMsg
+	logger.Debugf("Adding %s to request queue", requestMsg.Path)
+	reservation.commit(requestMsg)
+
+	// the upload has been made by now, failing to record it doesn't undo it
+	if h.audit != nil {
+		auditEntry.Digest = "sha256:" + hex.EncodeToString(digest.Sum(nil))
+		auditEntry.Paths = []string{requestMsg.Path}
+		if err = h.audit.Record(auditEntry); err != nil {
+			logger.Errorf("problem recording the upload of %s in the audit log: %v", name, err)
+		}
+	}
 
 	w.WriteHeader(gohttp.StatusCreated)
 }
 
-// ListenAndServe starts the server
-func (h *Handler) ListenAndServe() error {
-	gohttp.HandleFunc("/", h.UploadHandler)
+// auditLimit is the number of entries of the audit log answered at most when
+// a request doesn't set the limit parameter.
+const auditLimit = 1000
+
+// AuditHandler handles requests for the entries of the audit log, which are
+// answered with a JSON list of the entries, oldest first. The entries can be
+// filtered with the dst, app, since and until parameters, the times are in
+// RFC 3339 format, and at most limit of them are answered, auditLimit by
+// default.
+func (h *Handler) AuditHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
+	r, logger := h.withRequestID(w, r)
+	logger.Infof("received %s request to %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	if r.Method != gohttp.MethodGet {
+		w.WriteHeader(gohttp.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "only %s is allowed", gohttp.MethodGet)
+		return
+	}
+	if _, ok := h.authorize(w, r, OperationRead); !ok {
+		return
+	}
+	if h.audit == nil {
+		w.WriteHeader(gohttp.StatusNotFound)
+		fmt.Fprint(w, "the audit log is disabled")
+		return
+	}
+
+	queryParams := r.URL.Query()
+	filter := core.AuditFilter{
+		Dst:   queryParams.Get("dst"),
+		App:   queryParams.Get("app"),
+		Limit: auditLimit,
+	}
+	if val := queryParams.Get("limit"); val != "" {
+		limit, err := strconv.Atoi(val)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(gohttp.StatusBadRequest)
+			fmt.Fprintf(w, "limit=%s is not a positive number", val)
+			return
+		}
+		filter.Limit = limit
+	}
+	for param, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		val := queryParams.Get(param)
+		if val == "" {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339, val)
+		if err != nil {
+			w.WriteHeader(gohttp.StatusBadRequest)
+			fmt.Fprintf(w, "%s=%s is not an RFC 3339 time", param, val)
+			return
+		}
+		*t = parsed
+	}
+
+	entries, err := h.audit.Query(filter)
+	if err != nil {
+		logger.Errorf("problem reading the audit log: %v", err)
+		w.WriteHeader(gohttp.StatusInternalServerError)
+		fmt.Fprintf(w, "problem reading the audit log: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
 
-	return gohttp.ListenAndServe(h.config.ServeAddr(), nil)
+// ServeMux returns a new ServeMux routing requests to the handlers of h.
+func (h *Handler) ServeMux() *gohttp.ServeMux {
+	mux := gohttp.NewServeMux()
+	mux.HandleFunc("/", h.UploadHandler)
+	mux.HandleFunc("/audit", h.AuditHandler)
+	mux.HandleFunc("/metrics", h.MetricsHandler)
+	mux.HandleFunc("/admin/log-level", h.LogLevelHandler)
+	mux.HandleFunc("/healthz", h.HealthzHandler)
+	mux.HandleFunc("/readyz", h.ReadyzHandler)
+	return mux
 }
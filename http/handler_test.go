@@ -2,13 +2,17 @@ package http
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	gohttp "net/http"
 	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
+	"sync"
 	"testing"
 
 	"apex/artifact-manager/core"
@@ -26,8 +30,8 @@ func TestUploadHandler_WithoutUrlParams(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// handler is some http handler function we wrote that we want to test
-	requestQueue := make(chan string, 10)
-	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 10, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 10)
 	h.UploadHandler(rec, req)
 
 	if rec.Code != gohttp.StatusBadRequest {
@@ -38,7 +42,7 @@ func TestUploadHandler_WithoutUrlParams(t *testing.T) {
 		} else {
 			msg = fmt.Sprintf("%s: response=%s", msg, string(resp))
 		}
-		t.Errorf(msg)
+		t.Error(msg)
 	}
 	if len(requestQueue) != 0 {
 		t.Errorf("expected requestQueue channel to be empty; got %d", len(requestQueue))
@@ -57,8 +61,8 @@ func TestUploadHandler_WithNameUrlParam(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// handler is some http handler function we wrote that we want to test
-	requestQueue := make(chan string, 10)
-	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 10, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 10)
 	pathToFile := path.Join(h.config.Dir, "Makefile")
 	defer os.Remove(pathToFile)
 	h.UploadHandler(rec, req)
@@ -71,7 +75,7 @@ func TestUploadHandler_WithNameUrlParam(t *testing.T) {
 		} else {
 			msg = fmt.Sprintf("%s: response=%s", msg, string(resp))
 		}
-		t.Errorf(msg)
+		t.Error(msg)
 	} else {
 		// ensure the file was created
 		if _, err = os.Stat(pathToFile); os.IsNotExist(err) {
@@ -83,7 +87,7 @@ func TestUploadHandler_WithNameUrlParam(t *testing.T) {
 		t.Errorf("expected requestQueue channel to have 1 message; got %d", len(requestQueue))
 	} else {
 		result := <-requestQueue
-		if result != pathToFile {
+		if result.Path != pathToFile {
 			t.Errorf("expected message on requestQueue to be %s; got %v", pathToFile, result)
 		}
 	}
@@ -101,14 +105,13 @@ func TestUploadHandler_WithNameSrcDstUrlParams(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// handler is some http handler function we wrote that we want to test
-	requestQueue := make(chan string, 10)
-        config := core.NewConfig("AM_TEST_")
-        config.ExternalDir = config.ExternalDir
-	h := NewHandler(config, requestQueue, 10, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	requestQueue := make(chan core.Update, 10)
+	config := core.NewConfig("AM_TEST_")
+	h := NewHandler(config, requestQueue, 10)
 	pathToFile := path.Join(h.config.Dir, "Makefile")
 	symlinkSrc := path.Join(h.config.Dir, "Makefile")
 	symlinkDst := path.Join(h.config.Dir, "myfile")
-        expectedRequestMsg := path.Join(h.config.ExternalDir, "myfile")
+	expectedRequestMsg := path.Join(h.config.ExternalDir, "myfile")
 	defer func() {
 		os.RemoveAll(symlinkDst)
 		os.RemoveAll(symlinkSrc)
@@ -124,7 +127,7 @@ func TestUploadHandler_WithNameSrcDstUrlParams(t *testing.T) {
 		} else {
 			msg = fmt.Sprintf("%s: response=%s", msg, string(resp))
 		}
-		t.Errorf(msg)
+		t.Error(msg)
 		return
 	}
 
@@ -149,7 +152,7 @@ func TestUploadHandler_WithNameSrcDstUrlParams(t *testing.T) {
 		t.Errorf("expected requestQueue channel to have 1 message; got %d", len(requestQueue))
 	} else {
 		result := <-requestQueue
-		if result != expectedRequestMsg {
+		if result.Path != expectedRequestMsg {
 			t.Errorf("expected message on requestQueue to be %s; got %v", pathToFile, expectedRequestMsg)
 		}
 	}
@@ -168,8 +171,8 @@ func TestUploadHandler_WithArchiveNoSymlink(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// handler is some http handler function we wrote that we want to test
-	requestQueue := make(chan string, 10)
-	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 10, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 10)
 	pathToFile := path.Join(h.config.Dir, "x.tgz")
 	defer func() {
 		os.Remove(pathToFile)
@@ -184,7 +187,7 @@ func TestUploadHandler_WithArchiveNoSymlink(t *testing.T) {
 		} else {
 			msg = fmt.Sprintf("%s: response=%s", msg, string(resp))
 		}
-		t.Errorf(msg)
+		t.Error(msg)
 	}
 
 	// ensure the file was created
@@ -196,7 +199,7 @@ func TestUploadHandler_WithArchiveNoSymlink(t *testing.T) {
 		t.Errorf("expected requestQueue channel to have 1 message; got %d", len(requestQueue))
 	} else {
 		result := <-requestQueue
-		if result != pathToFile {
+		if result.Path != pathToFile {
 			t.Errorf("expected message on requestQueue to be %s; got %v", pathToFile, pathToFile)
 		}
 	}
@@ -215,8 +218,8 @@ func TestUploadHandler_WithArchiveAndSymlink(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// handler is some http handler function we wrote that we want to test
-	requestQueue := make(chan string, 10)
-	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 10, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 10)
 	pathToFile := path.Join(h.config.Dir, "x.tgz")
 	symlinkSrc := path.Join(h.config.Dir, "sample")
 	symlinkDst := path.Join(h.config.Dir, "x-latest")
@@ -235,7 +238,7 @@ func TestUploadHandler_WithArchiveAndSymlink(t *testing.T) {
 		} else {
 			msg = fmt.Sprintf("%s: response=%s", msg, string(resp))
 		}
-		t.Errorf(msg)
+		t.Error(msg)
 	}
 
 	// ensure the file was created
@@ -265,7 +268,7 @@ func TestUploadHandler_WithArchiveAndSymlink(t *testing.T) {
 		t.Errorf("expected requestQueue channel to have 1 message; got %d", len(requestQueue))
 	} else {
 		result := <-requestQueue
-		if result != symlinkDst {
+		if result.Path != symlinkDst {
 			t.Errorf("expected message on requestQueue to be %s; got %v", pathToFile, symlinkDst)
 		}
 	}
@@ -283,11 +286,11 @@ func TestUploadHandler_ExceedRequestLImit(t *testing.T) {
 	rec := httptest.NewRecorder()
 
 	// handler is some http handler function we wrote that we want to test
-	requestQueue := make(chan string, 1)
+	requestQueue := make(chan core.Update, 1)
 	// simulate a request having already been put onto the queue
-	requestQueue <- "this is a test"
+	requestQueue <- core.Update{Path: "this is a test"}
 
-	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 1, log.New(ioutil.Discard, log.Prefix(), log.Flags()))
+	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 1)
 	pathToFile := path.Join(h.config.Dir, "Makefile")
 	defer os.Remove(pathToFile)
 	h.UploadHandler(rec, req)
@@ -300,7 +303,7 @@ func TestUploadHandler_ExceedRequestLImit(t *testing.T) {
 		} else {
 			msg = fmt.Sprintf("%s: response=%s", msg, string(resp))
 		}
-		t.Errorf(msg)
+		t.Error(msg)
 	}
 
 	// ensure the file was not created
@@ -309,6 +312,205 @@ func TestUploadHandler_ExceedRequestLImit(t *testing.T) {
 	}
 }
 
+// TestUploadHandler_ReplacingArchiveAndSymlink tests that uploading an archive
+// a second time records where the symlink pointed to before.
+func TestUploadHandler_ReplacingArchiveAndSymlink(t *testing.T) {
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 10)
+	pathToFile := path.Join(h.config.Dir, "x.tgz")
+	symlinkSrc := path.Join(h.config.Dir, "sample")
+	symlinkDst := path.Join(h.config.Dir, "x-latest")
+	defer func() {
+		os.RemoveAll(symlinkDst)
+		os.RemoveAll(symlinkSrc)
+		os.Remove(pathToFile)
+	}()
+
+	for i := 0; i < 2; i++ {
+		req, err := createRequest("../_samples/x.tgz", "http://localhost/?name=x.tgz&src=sample&dst=x-latest")
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		rec := httptest.NewRecorder()
+		h.UploadHandler(rec, req)
+		if rec.Code != gohttp.StatusCreated {
+			t.Fatalf("expected status %d; got %d: %s", gohttp.StatusCreated, rec.Code, rec.Body.String())
+		}
+	}
+
+	first := <-requestQueue
+	if first.Symlink != symlinkDst || first.PreviousTarget != "" {
+		t.Errorf("expected the first upload to create %s without a previous target; got %+v", symlinkDst, first)
+	}
+
+	second := <-requestQueue
+	if !strings.HasPrefix(second.PreviousTarget, symlinkSrc+"-") {
+		t.Errorf("expected the previous target to be the renamed %s; got %s", symlinkSrc, second.PreviousTarget)
+	}
+	defer os.RemoveAll(second.PreviousTarget)
+	if _, err := os.Stat(second.PreviousTarget); err != nil {
+		t.Errorf("expected the previous release %s to exist: %v", second.PreviousTarget, err)
+	}
+}
+
+// TestUploadHandler_Journal tests that the update is journaled before it is
+// placed onto the request queue, and that the journal can't be overwritten.
+func TestUploadHandler_Journal(t *testing.T) {
+	config := core.NewConfig("AM_TEST_")
+	journal, err := core.OpenJournal(path.Join(config.Dir, ".am-test.journal"), core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("could not open journal: %v", err)
+	}
+	defer os.Remove(path.Join(config.Dir, ".am-test.journal"))
+	defer journal.Close()
+
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(config, requestQueue, 10)
+	h.SetJournal(journal)
+	pathToFile := path.Join(h.config.Dir, "Makefile")
+	defer os.Remove(pathToFile)
+
+	req, err := createRequest("../Makefile", "http://localhost/?name=.am-test.journal")
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.UploadHandler(rec, req)
+	if rec.Code != gohttp.StatusBadRequest {
+		t.Errorf("expected status %d when overwriting the journal; got %d", gohttp.StatusBadRequest, rec.Code)
+	}
+
+	req, err = createRequest("../Makefile", "http://localhost/?name=Makefile")
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	h.UploadHandler(rec, req)
+	if rec.Code != gohttp.StatusCreated {
+		t.Fatalf("expected status %d; got %d: %s", gohttp.StatusCreated, rec.Code, rec.Body.String())
+	}
+
+	result := <-requestQueue
+	if result.ID == 0 {
+		t.Errorf("expected the update to have a journal id")
+	}
+	if pending := journal.Pending(); len(pending) != 1 || pending[0] != result {
+		t.Errorf("expected %+v to be pending in the journal; got %+v", result, pending)
+	}
+}
+
+// TestUploadHandler_QueueReserved tests that an upload is rejected, without
+// writing anything, while the room left on the queue is reserved by another
+// upload that is still being handled.
+func TestUploadHandler_QueueReserved(t *testing.T) {
+	requestQueue := make(chan core.Update, 1)
+	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 1)
+	pathToFile := path.Join(h.config.Dir, "reserved-Makefile")
+	defer os.Remove(pathToFile)
+
+	// simulate an upload in progress
+	inProgress, ok := h.admission.reserve()
+	if !ok {
+		t.Fatalf("expected to reserve room on an empty queue")
+	}
+
+	req, err := createRequest("../Makefile", "http://localhost/?name=reserved-Makefile")
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.UploadHandler(rec, req)
+	if rec.Code != gohttp.StatusServiceUnavailable {
+		t.Fatalf("expected status %d; got %d: %s", gohttp.StatusServiceUnavailable, rec.Code, rec.Body.String())
+	}
+	if _, err = os.Stat(pathToFile); !os.IsNotExist(err) {
+		t.Errorf("file %s should not have been created", pathToFile)
+	}
+
+	// once the other upload gives up its room, the upload is accepted
+	inProgress.release()
+	req, err = createRequest("../Makefile", "http://localhost/?name=reserved-Makefile")
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	h.UploadHandler(rec, req)
+	if rec.Code != gohttp.StatusCreated {
+		t.Fatalf("expected status %d; got %d: %s", gohttp.StatusCreated, rec.Code, rec.Body.String())
+	}
+	if len(requestQueue) != 1 {
+		t.Errorf("expected requestQueue channel to have 1 message; got %d", len(requestQueue))
+	}
+	if size := h.admission.size(); size != 1 {
+		t.Errorf("expected only the queued update to take up room; got %d", size)
+	}
+}
+
+// TestUploadHandler_FailureReleasesReservation tests that an upload which
+// fails gives back the room it reserved on the queue.
+func TestUploadHandler_FailureReleasesReservation(t *testing.T) {
+	requestQueue := make(chan core.Update, 1)
+	config := core.NewConfig("AM_TEST_")
+	config.Dir = "/does/not/exist"
+	h := NewHandler(config, requestQueue, 1)
+
+	req, err := createRequest("../Makefile", "http://localhost/?name=Makefile")
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.UploadHandler(rec, req)
+	if rec.Code != gohttp.StatusInternalServerError {
+		t.Fatalf("expected status %d; got %d: %s", gohttp.StatusInternalServerError, rec.Code, rec.Body.String())
+	}
+	if size := h.admission.size(); size != 0 {
+		t.Errorf("expected the reservation to be released; got %d", size)
+	}
+}
+
+// TestUploadHandler_Concurrent tests that concurrent uploads never place more
+// updates onto the queue than it allows, it is meant to be run with the race
+// detector.
+func TestUploadHandler_Concurrent(t *testing.T) {
+	requestQueue := make(chan core.Update, 5)
+	h := NewHandler(core.NewConfig("AM_TEST_"), requestQueue, 5)
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("concurrent-%d", i)
+		defer os.Remove(path.Join(h.config.Dir, name))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := createRequest("../Makefile", "http://localhost/?name="+name)
+			if err != nil {
+				t.Errorf("could not create request: %v", err)
+				return
+			}
+			rec := httptest.NewRecorder()
+			h.UploadHandler(rec, req)
+			codes <- rec.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case gohttp.StatusCreated:
+			created++
+		case gohttp.StatusServiceUnavailable:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if created != 5 || len(requestQueue) != 5 {
+		t.Errorf("expected 5 uploads to be queued; got %d created and %d queued", created, len(requestQueue))
+	}
+}
+
 func createRequest(file, url string) (*gohttp.Request, error) {
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -322,3 +524,135 @@ func createRequest(file, url string) (*gohttp.Request, error) {
 		reader,
 	)
 }
+
+// TestUploadHandler_Tokens tests that uploads need a bearer token allowed to
+// upload every path they change.
+func TestUploadHandler_Tokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokensFile := path.Join(dir, "tokens.json")
+	writeTokens(t, tokensFile, "Makefile*")
+	tokens, err := OpenTokens(tokensFile, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("failed to open the tokens: %v", err)
+	}
+
+	requestQueue := make(chan core.Update, 10)
+	config := core.NewConfig("AM_TEST_")
+	config.Dir = dir
+	config.ExternalDir = dir
+	h := NewHandler(config, requestQueue, 10)
+	h.SetTokens(tokens)
+
+	tests := []struct {
+		url    string
+		header string
+		status int
+	}{
+		{"http://localhost/?name=Makefile", "", gohttp.StatusUnauthorized},
+		{"http://localhost/?name=Makefile", "Bearer wrong", gohttp.StatusUnauthorized},
+		{"http://localhost/?name=Makefile&src=Makefile-src&dst=other-latest", "Bearer ci-secret", gohttp.StatusForbidden},
+		{"http://localhost/?name=Makefile", "Bearer ci-secret", gohttp.StatusCreated},
+	}
+	for _, test := range tests {
+		req, err := createRequest("../Makefile", test.url)
+		if err != nil {
+			t.Fatalf("could not create request: %v", err)
+		}
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rec := httptest.NewRecorder()
+		h.UploadHandler(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("expected %s with %q to get %d; got %d: %s", test.url, test.header, test.status, rec.Code, rec.Body.String())
+		}
+		if rec.Code == gohttp.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("expected a WWW-Authenticate header with %d", rec.Code)
+		}
+	}
+	if len(requestQueue) != 1 {
+		t.Errorf("expected only the authorized upload to be queued; got %d", len(requestQueue))
+	}
+}
+
+// TestAuditHandler tests that uploads are recorded in the audit log with the
+// identity of their client and the digest of the file, and served filtered.
+func TestAuditHandler(t *testing.T) {
+	config := core.NewConfig("AM_TEST_")
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config.Dir = dir
+	config.ExternalDir = dir
+	audit, err := core.OpenAuditLog(path.Join(dir, "audit.log"), 0, 0, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to open the audit log: %v", err)
+	}
+	defer audit.Close()
+
+	tokensFile := path.Join(dir, "tokens.json")
+	writeTokens(t, tokensFile, "*")
+	tokens, err := OpenTokens(tokensFile, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("failed to open the tokens: %v", err)
+	}
+	h := NewHandler(config, make(chan core.Update, 10), 10)
+	h.SetTokens(tokens)
+	h.SetAuditLog(audit)
+
+	for _, dst := range []string{"notes-latest", "other-latest"} {
+		req := httptest.NewRequest(gohttp.MethodPost, "http://localhost/?name=notes-1.txt&src=notes-1.txt&dst="+dst, strings.NewReader("notes"))
+		req.Header.Set("Authorization", "Bearer ci-secret")
+		rec := httptest.NewRecorder()
+		h.UploadHandler(rec, req)
+		if rec.Code != gohttp.StatusCreated {
+			t.Fatalf("expected status %d; got %d: %s", gohttp.StatusCreated, rec.Code, rec.Body.String())
+		}
+	}
+
+	query := func(url, secret string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(gohttp.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer "+secret)
+		rec := httptest.NewRecorder()
+		h.AuditHandler(rec, req)
+		return rec
+	}
+	if rec := query("http://localhost/audit", "ci-secret"); rec.Code != gohttp.StatusForbidden {
+		t.Errorf("expected a token that may not read to be forbidden, got %d", rec.Code)
+	}
+	if rec := query("http://localhost/audit?since=yesterday", "ops-secret"); rec.Code != gohttp.StatusBadRequest {
+		t.Errorf("expected an invalid time to be refused, got %d", rec.Code)
+	}
+	if rec := query("http://localhost/audit?limit=0", "ops-secret"); rec.Code != gohttp.StatusBadRequest {
+		t.Errorf("expected an invalid limit to be refused, got %d", rec.Code)
+	}
+	rec := query("http://localhost/audit?limit=1", "ops-secret")
+	var page []core.AuditEntry
+	if err = json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatalf("unable to parse the entries %s: %v", rec.Body.String(), err)
+	}
+	if len(page) != 1 || page[0].Dst != "notes-latest" {
+		t.Errorf("expected only the first upload, got %+v", page)
+	}
+
+	rec = query("http://localhost/audit?dst=notes-latest", "ops-secret")
+	if rec.Code != gohttp.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", gohttp.StatusOK, rec.Code, rec.Body.String())
+	}
+	var entries []core.AuditEntry
+	if err = json.Unmarshal(rec.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("unable to parse the entries %s: %v", rec.Body.String(), err)
+	}
+	sum := sha256.Sum256([]byte("notes"))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	if len(entries) != 1 || entries[0].Identity != "ci" || entries[0].Digest != digest ||
+		entries[0].Target != path.Join(dir, "notes-1.txt") || entries[0].Dst != "notes-latest" {
+		t.Errorf("expected the upload to notes-latest by ci, got %+v", entries)
+	}
+}
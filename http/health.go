@@ -0,0 +1,186 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	gohttp "net/http"
+	"os"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// readyPingTimeout is how long the orchestrator may take to answer a ping
+// before it is considered unreachable.
+const readyPingTimeout = 5 * time.Second
+
+// ServiceStatus reports the status of the dependencies of the service
+// restarting the applications, it is implemented by *artifacts.ArtifactsService.
+type ServiceStatus interface {
+	// FetchStatus returns when the volumes were last fetched successfully and
+	// the error the last fetch failed with.
+	FetchStatus() (time.Time, error)
+	// PingOrchestrator checks that the orchestrator is reachable.
+	PingOrchestrator() (string, error)
+}
+
+// SetServiceStatus sets the status of the service restarting the
+// applications that is checked by ReadyzHandler.
+func (h *Handler) SetServiceStatus(status ServiceStatus) {
+	h.status = status
+}
+
+// readinessCheck is the outcome of one of the checks of ReadyzHandler.
+type readinessCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+}
+
+// readiness is the body of the responses of ReadyzHandler.
+type readiness struct {
+	Ready  bool             `json:"ready"`
+	Checks []readinessCheck `json:"checks"`
+}
+
+// HealthzHandler answers liveness probes, it answers every GET with 200 as
+// long as the application is serving requests.
+func (h *Handler) HealthzHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
+	if r.Method != gohttp.MethodGet && r.Method != gohttp.MethodHead {
+		w.WriteHeader(gohttp.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "only %s is allowed", gohttp.MethodGet)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, `{"status":"ok"}`)
+}
+
+// ReadyzHandler answers readiness probes with the outcome of each check as
+// JSON, with 200 if every check passed and 503 otherwise. It checks that dir
+// is writable and has enough free space, that the volumes were fetched
+// recently, that the orchestrator is reachable and that the request queue
+// has room.
+func (h *Handler) ReadyzHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
+	r, logger := h.withRequestID(w, r)
+	if r.Method != gohttp.MethodGet && r.Method != gohttp.MethodHead {
+		w.WriteHeader(gohttp.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "only %s is allowed", gohttp.MethodGet)
+		return
+	}
+
+	result := readiness{Ready: true, Checks: []readinessCheck{h.checkDirWritable(), h.checkFreeSpace()}}
+	if h.status != nil {
+		result.Checks = append(result.Checks, h.checkVolumes(), h.checkOrchestrator())
+	}
+	result.Checks = append(result.Checks, h.checkQueue())
+	for _, check := range result.Checks {
+		if !check.OK {
+			result.Ready = false
+			logger.Debugf("not ready, the %s check failed: %s", check.Name, check.Detail)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Ready {
+		w.WriteHeader(gohttp.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+// checkDirWritable checks that a file can be written to dir.
+func (h *Handler) checkDirWritable() readinessCheck {
+	check := readinessCheck{Name: "dir"}
+	file, err := ioutil.TempFile(h.config.Dir, ".readyz-")
+	if err != nil {
+		check.Detail = fmt.Sprintf("%s is not writable: %v", h.config.Dir, err)
+		return check
+	}
+	_, err = file.WriteString("ready")
+	closeErr := file.Close()
+	os.Remove(file.Name())
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		check.Detail = fmt.Sprintf("%s is not writable: %v", h.config.Dir, err)
+		return check
+	}
+	check.OK = true
+	check.Detail = fmt.Sprintf("%s is writable", h.config.Dir)
+	return check
+}
+
+// checkFreeSpace checks that dir has at least ReadyMinFreeSpace megabytes free.
+func (h *Handler) checkFreeSpace() readinessCheck {
+	check := readinessCheck{Name: "disk"}
+	free, err := core.FreeSpace(h.config.Dir)
+	if err != nil {
+		check.Detail = fmt.Sprintf("unable to read the free space of %s: %v", h.config.Dir, err)
+		return check
+	}
+	check.OK = free >= uint64(h.config.ReadyMinFreeSpace)*1024*1024
+	check.Detail = fmt.Sprintf("%d MB free in %s, at least %d MB needed", free/1024/1024, h.config.Dir, h.config.ReadyMinFreeSpace)
+	return check
+}
+
+// checkVolumes checks that the last fetch of the volumes succeeded and that
+// it isn't older than ReadyMaxFetchAge.
+func (h *Handler) checkVolumes() readinessCheck {
+	check := readinessCheck{Name: "volumes"}
+	lastFetch, err := h.status.FetchStatus()
+	switch {
+	case lastFetch.IsZero() && err != nil:
+		check.Detail = fmt.Sprintf("the volumes have never been fetched: %v", err)
+	case lastFetch.IsZero():
+		check.Detail = "the volumes have not been fetched yet"
+	case err != nil:
+		check.Detail = fmt.Sprintf("the last fetch of the volumes failed, they were fetched %s ago: %v", time.Since(lastFetch).Round(time.Second), err)
+	case h.config.ReadyMaxFetchAge > 0 && time.Since(lastFetch) > h.config.ReadyMaxFetchAge:
+		check.Detail = fmt.Sprintf("the volumes were fetched %s ago, more than %s", time.Since(lastFetch).Round(time.Second), h.config.ReadyMaxFetchAge)
+	default:
+		check.OK = true
+		check.Detail = fmt.Sprintf("the volumes were fetched %s ago", time.Since(lastFetch).Round(time.Second))
+	}
+	return check
+}
+
+// checkOrchestrator checks that the orchestrator answers a ping within
+// readyPingTimeout.
+func (h *Handler) checkOrchestrator() readinessCheck {
+	check := readinessCheck{Name: "orchestrator"}
+	type pingResult struct {
+		detail string
+		err    error
+	}
+	// the ping is left running if it takes too long, its result is dropped
+	results := make(chan pingResult, 1)
+	go func() {
+		detail, err := h.status.PingOrchestrator()
+		results <- pingResult{detail, err}
+	}()
+	select {
+	case result := <-results:
+		if result.err != nil {
+			check.Detail = fmt.Sprintf("the orchestrator is not reachable: %v", result.err)
+			return check
+		}
+		check.OK = true
+		check.Detail = result.detail
+	case <-time.After(readyPingTimeout):
+		check.Detail = fmt.Sprintf("the orchestrator did not answer within %s", readyPingTimeout)
+	}
+	return check
+}
+
+// checkQueue checks that no more than ReadyMaxQueuePercent of the request
+// queue is full.
+func (h *Handler) checkQueue() readinessCheck {
+	size, maxSize := h.admission.size(), h.admission.maxSize
+	check := readinessCheck{
+		Name:   "queue",
+		OK:     maxSize <= 0 || size*100 <= maxSize*h.config.ReadyMaxQueuePercent,
+		Detail: fmt.Sprintf("%d of %d updates queued, at most %d%% allowed", size, maxSize, h.config.ReadyMaxQueuePercent),
+	}
+	return check
+}
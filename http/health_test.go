@@ -0,0 +1,102 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// fakeStatus is a ServiceStatus reporting fixed values.
+type fakeStatus struct {
+	lastFetch time.Time
+	fetchErr  error
+	pingErr   error
+}
+
+func (s fakeStatus) FetchStatus() (time.Time, error) {
+	return s.lastFetch, s.fetchErr
+}
+
+func (s fakeStatus) PingOrchestrator() (string, error) {
+	return "leader master-1:8080", s.pingErr
+}
+
+// TestHealthzHandler tests that liveness probes are answered with 200.
+func TestHealthzHandler(t *testing.T) {
+	h := NewHandler(core.NewConfig("AM_TEST_"), make(chan core.Update, 10), 10)
+	rec := httptest.NewRecorder()
+	h.HealthzHandler(rec, httptest.NewRequest(gohttp.MethodGet, "http://localhost/healthz", nil))
+	if rec.Code != gohttp.StatusOK || rec.Body.String() != `{"status":"ok"}` {
+		t.Errorf("expected status %d; got %d: %s", gohttp.StatusOK, rec.Code, rec.Body.String())
+	}
+}
+
+// TestReadyzHandler tests that the application is only ready once every
+// check passes and that the failed checks are reported.
+func TestReadyzHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "readyz")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		dir     string
+		minFree int
+		status  ServiceStatus
+		queued  int
+		failed  string
+	}{
+		{"ready", dir, 0, fakeStatus{lastFetch: time.Now()}, 0, ""},
+		{"without status", dir, 0, nil, 0, ""},
+		{"dir", path.Join(dir, "missing"), 0, fakeStatus{lastFetch: time.Now()}, 0, "dir,disk"},
+		{"disk", dir, 1 << 30, fakeStatus{lastFetch: time.Now()}, 0, "disk"},
+		{"never fetched", dir, 0, fakeStatus{}, 0, "volumes"},
+		{"failed fetch", dir, 0, fakeStatus{lastFetch: time.Now(), fetchErr: errors.New("connection refused")}, 0, "volumes"},
+		{"stale", dir, 0, fakeStatus{lastFetch: time.Now().Add(-time.Hour)}, 0, "volumes"},
+		{"unreachable", dir, 0, fakeStatus{lastFetch: time.Now(), pingErr: errors.New("connection refused")}, 0, "orchestrator"},
+		{"queue", dir, 0, fakeStatus{lastFetch: time.Now()}, 10, "queue"},
+	}
+	for _, test := range tests {
+		config := core.NewConfig("AM_TEST_")
+		config.Dir = test.dir
+		config.ReadyMinFreeSpace = test.minFree
+		requestQueue := make(chan core.Update, 10)
+		for i := 0; i < test.queued; i++ {
+			requestQueue <- core.Update{}
+		}
+		h := NewHandler(config, requestQueue, 10)
+		if test.status != nil {
+			h.SetServiceStatus(test.status)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ReadyzHandler(rec, httptest.NewRequest(gohttp.MethodGet, "http://localhost/readyz", nil))
+		var result readiness
+		if err = json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%s: unable to decode %s: %v", test.name, rec.Body.String(), err)
+		}
+		failed := make([]string, 0)
+		for _, check := range result.Checks {
+			if !check.OK {
+				failed = append(failed, check.Name)
+			}
+		}
+		switch {
+		case test.failed == "" && (rec.Code != gohttp.StatusOK || !result.Ready || len(failed) > 0):
+			t.Errorf("%s: expected to be ready; got %d: %s", test.name, rec.Code, rec.Body.String())
+		case test.failed != "" && (rec.Code != gohttp.StatusServiceUnavailable || result.Ready || strings.Join(failed, ",") != test.failed):
+			t.Errorf("%s: expected the %s checks to fail; got %d: %s", test.name, test.failed, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	gohttp "net/http"
+	"regexp"
+
+	"apex/artifact-manager/core"
+)
+
+// requestIDHeader is the header the id of a request is read from, if the
+// client sent one, and returned in.
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID matches the request ids accepted from clients.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestIDKey is the key of the request id in the context of a request.
+type requestIDKey struct{}
+
+// withRequestID returns r along with a logger adding its request id to every
+// entry. The request id is the one sent by the client in the X-Request-ID
+// header, or a new one if it sent none or an invalid one, and is returned in
+// the X-Request-ID header of w.
+func (h *Handler) withRequestID(w gohttp.ResponseWriter, r *gohttp.Request) (*gohttp.Request, *core.Logger) {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newRequestID(h.log())
+	}
+	w.Header().Set(requestIDHeader, id)
+	r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+	return r, h.requestLogger(r)
+}
+
+// requestID returns the id set by withRequestID, or an empty string.
+func requestID(r *gohttp.Request) string {
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+// SetLogger sets the logger the requests are logged with, and whose level is
+// served by LogLevelHandler, core.DefaultLogger is used by default.
+func (h *Handler) SetLogger(logger *core.Logger) {
+	h.logger = logger
+}
+
+// log returns the logger set by SetLogger, or core.DefaultLogger.
+func (h *Handler) log() *core.Logger {
+	if h.logger == nil {
+		return core.DefaultLogger()
+	}
+	return h.logger
+}
+
+// requestLogger returns a logger adding the request id of r to every entry.
+func (h *Handler) requestLogger(r *gohttp.Request) *core.Logger {
+	id := requestID(r)
+	if id == "" {
+		return h.log()
+	}
+	return h.log().With("request_id", id)
+}
+
+// newRequestID returns a random request id, a problem generating it is
+// logged with logger.
+func newRequestID(logger *core.Logger) string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		logger.Warnf("problem generating a request id: %v", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// logLevel is the body of the requests and responses of LogLevelHandler.
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+// LogLevelHandler handles requests for the level of the logger set by
+// SetLogger, or the default logger. A GET
+// is answered with the level, a PUT sets it to the level in its JSON body,
+// such as {"level": "debug"}, and answers with the new level.
+func (h *Handler) LogLevelHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
+	r, logger := h.withRequestID(w, r)
+	logger.Infof("received %s request to %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+	if r.Method != gohttp.MethodGet && r.Method != gohttp.MethodPut {
+		w.WriteHeader(gohttp.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "only %s and %s are allowed", gohttp.MethodGet, gohttp.MethodPut)
+		return
+	}
+	operation := OperationRead
+	if r.Method == gohttp.MethodPut {
+		operation = OperationAdmin
+	}
+	identity, ok := h.authorize(w, r, operation)
+	if !ok {
+		return
+	}
+
+	if r.Method == gohttp.MethodPut {
+		var body logLevel
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(gohttp.StatusBadRequest)
+			fmt.Fprintf(w, "invalid request, unable to parse the body: %v", err)
+			return
+		}
+		level, err := core.ParseLevel(body.Level)
+		if err != nil {
+			w.WriteHeader(gohttp.StatusBadRequest)
+			fmt.Fprintf(w, "invalid request, %v", err)
+			return
+		}
+		h.log().SetLevel(level)
+		logger.Warnf("log level set to %s by %s", level, identity)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(logLevel{Level: h.log().Level().String()})
+}
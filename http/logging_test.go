@@ -0,0 +1,119 @@
+package http
+
+import (
+	"io/ioutil"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"apex/artifact-manager/core"
+)
+
+// TestUploadHandler_RequestID tests that the request id sent by the client is
+// returned and carried by the update, and that one is generated otherwise.
+func TestUploadHandler_RequestID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "requestid")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := core.NewConfig("AM_TEST_")
+	config.Dir = dir
+	config.ExternalDir = dir
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(config, requestQueue, 10)
+
+	tests := []struct {
+		header   string
+		expected string
+	}{
+		{"deploy-42", "deploy-42"},
+		{"", ""},
+		{"not valid", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(gohttp.MethodPost, "http://localhost/?name=notes.txt", strings.NewReader("notes"))
+		if test.header != "" {
+			req.Header.Set(requestIDHeader, test.header)
+		}
+		rec := httptest.NewRecorder()
+		h.UploadHandler(rec, req)
+		if rec.Code != gohttp.StatusCreated {
+			t.Fatalf("expected status %d; got %d: %s", gohttp.StatusCreated, rec.Code, rec.Body.String())
+		}
+		id := rec.Header().Get(requestIDHeader)
+		if test.expected != "" && id != test.expected {
+			t.Errorf("expected the request id %s; got %s", test.expected, id)
+		}
+		if !validRequestID.MatchString(id) || id == test.header && test.expected == "" {
+			t.Errorf("expected a request id to be generated for %q; got %q", test.header, id)
+		}
+		update := <-requestQueue
+		if update.RequestID != id {
+			t.Errorf("expected the update to carry the request id %s; got %s", id, update.RequestID)
+		}
+	}
+}
+
+// TestLogLevelHandler tests that the level of the logger of the handler is
+// read with the read operation and only changed with the admin operation.
+func TestLogLevelHandler(t *testing.T) {
+	logger, err := core.NewLogger(ioutil.Discard, "text", core.LevelInfo)
+	if err != nil {
+		t.Fatalf("unable to create the logger: %v", err)
+	}
+	defaultLevel := core.DefaultLogger().Level()
+
+	dir, err := ioutil.TempDir("", "loglevel")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokensFile := path.Join(dir, "tokens.json")
+	writeTokens(t, tokensFile, "*")
+	tokens, err := OpenTokens(tokensFile, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("failed to open the tokens: %v", err)
+	}
+	h := NewHandler(core.NewConfig("AM_TEST_"), make(chan core.Update, 10), 10)
+	h.SetTokens(tokens)
+	h.SetLogger(logger)
+
+	tests := []struct {
+		method string
+		body   string
+		header string
+		status int
+		level  string
+	}{
+		{gohttp.MethodGet, "", "", gohttp.StatusUnauthorized, ""},
+		{gohttp.MethodPut, `{"level":"debug"}`, "Bearer ci-secret", gohttp.StatusForbidden, ""},
+		{gohttp.MethodPut, `{"level":"verbose"}`, "Bearer ops-secret", gohttp.StatusBadRequest, ""},
+		{gohttp.MethodPut, `{"level":"debug"}`, "Bearer ops-secret", gohttp.StatusOK, `{"level":"debug"}`},
+		{gohttp.MethodGet, "", "Bearer ops-secret", gohttp.StatusOK, `{"level":"debug"}`},
+		{gohttp.MethodDelete, "", "Bearer ops-secret", gohttp.StatusMethodNotAllowed, ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "http://localhost/admin/log-level", strings.NewReader(test.body))
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rec := httptest.NewRecorder()
+		h.LogLevelHandler(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("expected %s %s with %q to get %d; got %d: %s", test.method, test.body, test.header, test.status, rec.Code, rec.Body.String())
+		}
+		if test.level != "" && strings.TrimSpace(rec.Body.String()) != test.level {
+			t.Errorf("expected %s; got %s", test.level, rec.Body.String())
+		}
+	}
+	if logger.Level() != core.LevelDebug {
+		t.Errorf("expected the level to be debug; got %s", logger.Level())
+	}
+	if core.DefaultLogger().Level() != defaultLevel {
+		t.Errorf("expected the default logger to stay at %s; got %s", defaultLevel, core.DefaultLogger().Level())
+	}
+}
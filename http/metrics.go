@@ -0,0 +1,144 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	gohttp "net/http"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// durationBuckets are the buckets, in seconds, of the upload and extraction durations.
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// handlerMetrics are the metrics of the uploads handled by a Handler, a nil
+// *handlerMetrics records nothing.
+type handlerMetrics struct {
+	uploads         *core.Counter
+	uploadBytes     *core.Counter
+	uploadDuration  *core.Histogram
+	extractDuration *core.Histogram
+}
+
+// SetMetrics adds the metrics of the uploads, the request queue and the free
+// space of the managed directory to registry, which is served by MetricsHandler.
+func (h *Handler) SetMetrics(registry *core.Registry) {
+	h.registry = registry
+	h.metrics = &handlerMetrics{
+		uploads: registry.NewCounter("artifact_manager_uploads_total",
+			"Number of uploads by outcome.", "outcome"),
+		uploadBytes: registry.NewCounter("artifact_manager_upload_bytes_total",
+			"Number of bytes received by uploads by outcome.", "outcome"),
+		uploadDuration: registry.NewHistogram("artifact_manager_upload_duration_seconds",
+			"Time taken to handle uploads by outcome.", durationBuckets, "outcome"),
+		extractDuration: registry.NewHistogram("artifact_manager_extract_duration_seconds",
+			"Time taken to extract uploaded archives.", durationBuckets),
+	}
+	registry.NewGaugeFunc("artifact_manager_queue_depth",
+		"Number of updates on the request queue, or reserved for it by uploads in progress.",
+		func() float64 { return float64(h.admission.size()) })
+	registry.NewGaugeFunc("artifact_manager_queue_capacity",
+		"Maximum number of updates on the request queue.",
+		func() float64 { return float64(h.admission.maxSize) })
+	// the free space is left out when it can't be read, rather than reported
+	// as a full disk
+	registry.NewOptionalGaugeFunc("artifact_manager_dir_free_bytes",
+		"Number of bytes available in the managed directory.",
+		func() (float64, bool) {
+			free, err := core.FreeSpace(h.config.Dir)
+			if err != nil {
+				h.log().Warnf("problem reading the free space for the metrics: %v", err)
+				return 0, false
+			}
+			return float64(free), true
+		})
+}
+
+// observeUpload records an upload answered with status after reading size
+// bytes of its body.
+func (m *handlerMetrics) observeUpload(status int, size int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	outcome := uploadOutcome(status)
+	m.uploads.Inc(outcome)
+	m.uploadBytes.Add(float64(size), outcome)
+	m.uploadDuration.Observe(duration.Seconds(), outcome)
+}
+
+// observeExtract records the extraction of an upload.
+func (m *handlerMetrics) observeExtract(duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.extractDuration.Observe(duration.Seconds())
+}
+
+// uploadOutcome returns the outcome of an upload answered with status.
+func uploadOutcome(status int) string {
+	switch {
+	case status < 300:
+		return "success"
+	case status == gohttp.StatusUnauthorized || status == gohttp.StatusForbidden:
+		return "unauthorized"
+	case status == gohttp.StatusServiceUnavailable:
+		return "unavailable"
+	case status == gohttp.StatusInsufficientStorage:
+		return "insufficient_storage"
+	case status < 500:
+		return "invalid"
+	}
+	return "error"
+}
+
+// MetricsHandler handles requests for the metrics, in the Prometheus text
+// exposition format.
+func (h *Handler) MetricsHandler(w gohttp.ResponseWriter, r *gohttp.Request) {
+	r, logger := h.withRequestID(w, r)
+	if r.Method != gohttp.MethodGet {
+		w.WriteHeader(gohttp.StatusMethodNotAllowed)
+		fmt.Fprintf(w, "only %s is allowed", gohttp.MethodGet)
+		return
+	}
+	if _, ok := h.authorize(w, r, OperationRead); !ok {
+		return
+	}
+	if h.registry == nil {
+		w.WriteHeader(gohttp.StatusNotFound)
+		fmt.Fprint(w, "metrics are disabled")
+		return
+	}
+	var buf bytes.Buffer
+	if err := h.registry.Write(&buf); err != nil {
+		logger.Warnf("problem writing the metrics: %v", err)
+		w.WriteHeader(gohttp.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// statusRecorder remembers the status a response was written with.
+type statusRecorder struct {
+	gohttp.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.count += int64(n)
+	return n, err
+}
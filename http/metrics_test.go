@@ -0,0 +1,66 @@
+package http
+
+import (
+	"io/ioutil"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"apex/artifact-manager/core"
+)
+
+// TestMetricsHandler tests that the uploads are counted by outcome and that
+// the queue depth and the free space are reported.
+func TestMetricsHandler(t *testing.T) {
+	config := core.NewConfig("AM_TEST_")
+	dir, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config.Dir = dir
+	config.ExternalDir = dir
+
+	h := NewHandler(config, make(chan core.Update, 10), 10)
+	h.SetMetrics(core.NewRegistry())
+	for _, url := range []string{"http://localhost/?name=notes.txt", "http://localhost/?name=other.txt", "http://localhost/"} {
+		req := httptest.NewRequest(gohttp.MethodPost, url, strings.NewReader("notes"))
+		h.UploadHandler(httptest.NewRecorder(), req)
+	}
+	if _, err = os.Stat(path.Join(dir, "notes.txt")); err != nil {
+		t.Fatalf("expected the upload to be saved: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.MetricsHandler(rec, httptest.NewRequest(gohttp.MethodGet, "http://localhost/metrics", nil))
+	if rec.Code != gohttp.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", gohttp.StatusOK, rec.Code, rec.Body.String())
+	}
+	for _, line := range []string{
+		`artifact_manager_uploads_total{outcome="success"} 2`,
+		`artifact_manager_uploads_total{outcome="invalid"} 1`,
+		`artifact_manager_upload_bytes_total{outcome="success"} 10`,
+		`artifact_manager_upload_duration_seconds_count{outcome="success"} 2`,
+		`artifact_manager_queue_depth 2`,
+		`artifact_manager_queue_capacity 10`,
+		`# TYPE artifact_manager_dir_free_bytes gauge`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("expected the metrics to contain %s, got\n%s", line, rec.Body.String())
+		}
+	}
+	if !strings.Contains(rec.Body.String(), "\nartifact_manager_dir_free_bytes ") {
+		t.Errorf("expected the free space of the managed directory, got\n%s", rec.Body.String())
+	}
+
+	// the free space isn't reported as 0 when it can't be read
+	config.Dir = path.Join(dir, "missing")
+	rec = httptest.NewRecorder()
+	h.MetricsHandler(rec, httptest.NewRequest(gohttp.MethodGet, "http://localhost/metrics", nil))
+	if strings.Contains(rec.Body.String(), "\nartifact_manager_dir_free_bytes ") {
+		t.Errorf("expected no free space for a missing directory, got\n%s", rec.Body.String())
+	}
+}
@@ -0,0 +1,59 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	gohttp "net/http"
+	"os"
+	"path"
+
+	"apex/artifact-manager/core"
+)
+
+// checkStorage returns an error if the managed directory doesn't have room
+// for an upload of size bytes named name, and for its extraction if extract
+// is set and name is an archive, while leaving DiskReserve megabytes free. The
+// upload is allowed if the free space can't be read.
+func (h *Handler) checkStorage(name string, size int64, extract bool) error {
+	free, err := core.FreeSpace(h.config.Dir)
+	if err != nil {
+		h.log().Warnf("problem checking the space available for an upload: %v", err)
+		return nil
+	}
+	needed := uint64(size)
+	if extract && core.IsArchiveName(name) {
+		needed += uint64(size) * uint64(h.config.DiskExtractRatio)
+	}
+	reserve := uint64(h.config.DiskReserve) * 1024 * 1024
+	if needed+reserve > free {
+		return fmt.Errorf("insufficient storage, %s needs %d bytes and %d MB have to be left free, %d bytes are available in %s",
+			path.Base(name), needed, h.config.DiskReserve, free, h.config.Dir)
+	}
+	return nil
+}
+
+// storageStatus returns the status a request that failed with err is
+// answered with, 507 if the disk is full and 500 otherwise.
+func storageStatus(err error) int {
+	if errors.Is(err, core.ErrNoSpace) {
+		return gohttp.StatusInsufficientStorage
+	}
+	return gohttp.StatusInternalServerError
+}
+
+// rollbackExtraction removes the archive name and whatever its extraction
+// created as internalSrc, then restores the previous release internalSrc was
+// renamed to, if any. The symlink isn't changed until the extraction succeeded,
+// so it points to the previous release again.
+func rollbackExtraction(logger *core.Logger, name, internalSrc, renamed string) {
+	if err := core.RestoreRenamed(internalSrc, renamed); err != nil {
+		logger.Errorf("problem restoring the previous release of %s from %s: %v", internalSrc, renamed, err)
+	} else if renamed != "" {
+		logger.Warnf("restored the previous release of %s from %s", internalSrc, renamed)
+	}
+	if name != internalSrc {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logger.Errorf("problem removing %s: %v", name, err)
+		}
+	}
+}
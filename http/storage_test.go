@@ -0,0 +1,116 @@
+package http
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"syscall"
+	"testing"
+
+	"apex/artifact-manager/core"
+)
+
+// TestUploadHandler_InsufficientStorage tests that an upload that won't fit,
+// along with the reserve, is refused before anything is written.
+func TestUploadHandler_InsufficientStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := core.NewConfig("AM_TEST_")
+	config.Dir = dir
+	config.ExternalDir = dir
+	config.DiskReserve = 1 << 30
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(config, requestQueue, 10)
+
+	req, err := createRequest("../_samples/x.tgz", "http://localhost/?name=x.tgz&src=x&dst=x-latest")
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	rec := httptest.NewRecorder()
+	h.UploadHandler(rec, req)
+	if rec.Code != gohttp.StatusInsufficientStorage {
+		t.Errorf("expected status %d; got %d: %s", gohttp.StatusInsufficientStorage, rec.Code, rec.Body.String())
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected nothing to be written; got %d files", len(files))
+	}
+	if len(requestQueue) != 0 {
+		t.Errorf("expected nothing to be queued; got %d updates", len(requestQueue))
+	}
+}
+
+// TestUploadHandler_ExtractionRollback tests that a failed extraction is
+// cleaned up and the previous release is restored.
+func TestUploadHandler_ExtractionRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := core.NewConfig("AM_TEST_")
+	config.Dir = dir
+	config.ExternalDir = dir
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(config, requestQueue, 10)
+
+	// the previous release
+	if err = os.Mkdir(path.Join(dir, "x"), 0755); err != nil {
+		t.Fatalf("unable to create the previous release: %v", err)
+	}
+	if err = ioutil.WriteFile(path.Join(dir, "x", "previous"), []byte("previous"), 0644); err != nil {
+		t.Fatalf("unable to create the previous release: %v", err)
+	}
+	if err = os.Symlink(path.Join(dir, "x"), path.Join(dir, "x-latest")); err != nil {
+		t.Fatalf("unable to create the symlink: %v", err)
+	}
+
+	// the gzip magic number followed by garbage
+	corrupt := append([]byte{0x1f, 0x8b, 0x08}, bytes.Repeat([]byte("corrupt"), 100)...)
+	req := httptest.NewRequest(gohttp.MethodPost, "http://localhost/?name=x.tgz&src=x&dst=x-latest", bytes.NewReader(corrupt))
+	rec := httptest.NewRecorder()
+	h.UploadHandler(rec, req)
+	if rec.Code != gohttp.StatusInternalServerError {
+		t.Fatalf("expected status %d; got %d: %s", gohttp.StatusInternalServerError, rec.Code, rec.Body.String())
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	if fmt.Sprint(names) != "[x x-latest]" {
+		t.Errorf("expected only the previous release and the symlink to be left; got %v", names)
+	}
+	if _, err = os.Stat(path.Join(dir, "x", "previous")); err != nil {
+		t.Errorf("expected the previous release to be restored: %v", err)
+	}
+	if target := core.SymlinkTarget(path.Join(dir, "x-latest")); target != path.Join(dir, "x") {
+		t.Errorf("expected the symlink to point to the previous release; got %s", target)
+	}
+	if len(requestQueue) != 0 {
+		t.Errorf("expected nothing to be queued; got %d updates", len(requestQueue))
+	}
+}
+
+// TestStorageStatus tests that a full disk is answered with 507.
+func TestStorageStatus(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("%w: write x.tgz: %v", core.ErrNoSpace, syscall.ENOSPC), gohttp.StatusInsufficientStorage},
+		{fmt.Errorf("permission denied"), gohttp.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if status := storageStatus(test.err); status != test.status {
+			t.Errorf("expected %v to be answered with %d; got %d", test.err, test.status, status)
+		}
+	}
+}
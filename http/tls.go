@@ -0,0 +1,185 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	gohttp "net/http"
+	"os"
+	"sync"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// tlsVersions are the values of the tls-min-version option.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// NewTLSConfig returns the TLS configuration the server uses, or nil if
+// config has no certificate and the server is not using TLS. The certificate
+// is read again once it changes and the outcome is logged with logger.
+func NewTLSConfig(config *core.Config, logger *core.Logger) (*tls.Config, error) {
+	if config.TLSCertFile == "" {
+		return nil, nil
+	}
+	minVersion, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("tls-min-version=%s is not one of 1.0, 1.1, 1.2 or 1.3", config.TLSMinVersion)
+	}
+	reloader, err := newCertificateReloader(config.TLSCertFile, config.TLSKeyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: reloader.getCertificate,
+	}
+
+	switch config.TLSClientAuth {
+	case "":
+		return tlsConfig, nil
+	case "optional":
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("tls-client-auth=%s is not \"optional\" or \"require\"", config.TLSClientAuth)
+	}
+	if config.TLSClientCAFile == "" {
+		return nil, fmt.Errorf("tls-client-ca-file is required to verify client certificates")
+	}
+	data, err := ioutil.ReadFile(config.TLSClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the client certificate authorities: %v", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", config.TLSClientCAFile)
+	}
+	return tlsConfig, nil
+}
+
+// certificateReloader serves the certificate in a pair of files, which are
+// read again once they change, so a renewed certificate is used without
+// restarting. If the changed files can't be read, the certificate last read
+// keeps being served.
+type certificateReloader struct {
+	certFile string
+	keyFile  string
+	logger   *core.Logger
+	mutex    *sync.Mutex
+	// the certificate last read, and when its files were modified then
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	// when the files were last checked for changes
+	checked time.Time
+	// how often the files are checked for changes
+	checkInterval time.Duration
+	// returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// newCertificateReloader reads the certificate in certFile and its key in
+// keyFile, the reloads are logged with logger.
+func newCertificateReloader(certFile, keyFile string, logger *core.Logger) (*certificateReloader, error) {
+	cr := certificateReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		logger:        logger,
+		mutex:         &sync.Mutex{},
+		checkInterval: time.Second,
+		now:           time.Now,
+	}
+	err := cr.load()
+	if err != nil {
+		return nil, err
+	}
+	cr.checked = cr.now()
+	return &cr, nil
+}
+
+// load reads the certificate and its key.
+func (cr *certificateReloader) load() error {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return fmt.Errorf("unable to read the tls certificate: %v", err)
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to read the tls key: %v", err)
+	}
+	certificate, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to read the tls certificate: %v", err)
+	}
+	cr.certificate = &certificate
+	cr.certModTime = certInfo.ModTime()
+	cr.keyModTime = keyInfo.ModTime()
+	return nil
+}
+
+// getCertificate returns the certificate, reading it again if its files
+// changed, it is used as the GetCertificate of the tls.Config.
+func (cr *certificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	now := cr.now()
+	if now.Sub(cr.checked) < cr.checkInterval {
+		return cr.certificate, nil
+	}
+	cr.checked = now
+
+	certInfo, certErr := os.Stat(cr.certFile)
+	keyInfo, keyErr := os.Stat(cr.keyFile)
+	if certErr != nil || keyErr != nil {
+		cr.logger.Warnf("problem checking the tls certificate, keeping the certificate last read: %v %v", certErr, keyErr)
+		return cr.certificate, nil
+	}
+	if certInfo.ModTime().Equal(cr.certModTime) && keyInfo.ModTime().Equal(cr.keyModTime) {
+		return cr.certificate, nil
+	}
+	// the certificate and key may be replaced one after the other, a pair
+	// that doesn't match is read again once both have been replaced
+	if err := cr.load(); err != nil {
+		cr.logger.Warnf("problem reloading the tls certificate, keeping the certificate last read: %v", err)
+		return cr.certificate, nil
+	}
+	cr.logger.Infof("reloaded the tls certificate in %s", cr.certFile)
+	return cr.certificate, nil
+}
+
+// clientIdentities returns the names a client certificate identifies its
+// client by: the common name of its subject and its subject alternative names.
+func clientIdentities(certificate *x509.Certificate) []string {
+	identities := make([]string, 0)
+	if certificate.Subject.CommonName != "" {
+		identities = append(identities, certificate.Subject.CommonName)
+	}
+	for _, uri := range certificate.URIs {
+		identities = append(identities, uri.String())
+	}
+	identities = append(identities, certificate.DNSNames...)
+	identities = append(identities, certificate.EmailAddresses...)
+	return identities
+}
+
+// clientIdentity returns the identity of the verified client certificate r
+// was sent with, its common name or first subject alternative name, or an
+// empty string if it has none.
+func clientIdentity(r *gohttp.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+	identities := clientIdentities(r.TLS.VerifiedChains[0][0])
+	if len(identities) == 0 {
+		return ""
+	}
+	return identities[0]
+}
@@ -0,0 +1,251 @@
+package http
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	gohttp "net/http"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// testCA issues certificates for the tests.
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	serial      int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{}
+	ca.certificate, ca.key = ca.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	return ca
+}
+
+// issue creates a certificate from template, signed by the ca or self-signed
+// if the ca has no certificate yet.
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate a key: %v", err)
+	}
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, parentKey := template, key
+	if ca.certificate != nil {
+		parent, parentKey = ca.certificate, ca.key
+	}
+	data, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("unable to create a certificate: %v", err)
+	}
+	certificate, err := x509.ParseCertificate(data)
+	if err != nil {
+		t.Fatalf("unable to parse the certificate: %v", err)
+	}
+	return certificate, key
+}
+
+// writePEM writes certificate and key as PEM files in dir and returns their paths.
+func writePEM(t *testing.T, dir, name string, certificate *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	certFile := path.Join(dir, name+".crt")
+	keyFile := path.Join(dir, name+".key")
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("unable to marshal the key of %s: %v", name, err)
+	}
+	err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data}), 0600)
+	}
+	if err != nil {
+		t.Fatalf("unable to write %s: %v", name, err)
+	}
+	return certFile, keyFile
+}
+
+// TestHandler_MutualTLS tests that uploads are served over TLS and that the
+// client certificate identifies the client to the tokens.
+func TestHandler_MutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	caFile, _ := writePEM(t, dir, "ca", ca.certificate, ca.key)
+	serverCertificate, serverKey := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "artifact-manager"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	deployer, _ := url.Parse("spiffe://example.org/deployer")
+	clientCertificate, clientKey := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "deployer"},
+		URIs:        []*url.URL{deployer},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	strangerCertificate, strangerKey := ca.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "stranger"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	config := core.NewConfig("AM_TEST_")
+	config.Dir = dir
+	config.ExternalDir = dir
+	config.TLSCertFile, config.TLSKeyFile = writePEM(t, dir, "server", serverCertificate, serverKey)
+	config.TLSClientAuth = "optional"
+	config.TLSClientCAFile = caFile
+	config.TLSMinVersion = "1.3"
+	tlsConfig, err := NewTLSConfig(config, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to create the tls config: %v", err)
+	}
+
+	tokensFile := path.Join(dir, "tokens.json")
+	tokens := `[{"name": "deployer", "client": "spiffe://example.org/deployer", "operations": ["upload"], "paths": ["*"]}]`
+	if err = ioutil.WriteFile(tokensFile, []byte(tokens), 0600); err != nil {
+		t.Fatalf("unable to write %s: %v", tokensFile, err)
+	}
+	h := NewHandler(config, make(chan core.Update, 10), 10)
+	tokenStore, err := OpenTokens(tokensFile, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("failed to open the tokens: %v", err)
+	}
+	h.SetTokens(tokenStore)
+
+	// httptest would serve its own certificate to clients that don't send
+	// a server name, so the server is started on a tls listener instead
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	server := &gohttp.Server{Handler: gohttp.HandlerFunc(h.UploadHandler)}
+	go server.Serve(tls.NewListener(listener, tlsConfig))
+	defer server.Close()
+	serverURL := "https://" + listener.Addr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	upload := func(certificate *x509.Certificate, key *ecdsa.PrivateKey, maxVersion uint16) (int, error) {
+		clientConfig := &tls.Config{RootCAs: roots, MaxVersion: maxVersion}
+		if certificate != nil {
+			clientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{certificate.Raw}, PrivateKey: key}}
+		}
+		client := &gohttp.Client{Transport: &gohttp.Transport{TLSClientConfig: clientConfig}}
+		res, err := client.Post(serverURL+"/?name=notes.txt", "text/plain", bytes.NewReader([]byte("notes")))
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+		return res.StatusCode, nil
+	}
+
+	if status, err := upload(clientCertificate, clientKey, 0); err != nil || status != gohttp.StatusCreated {
+		t.Errorf("expected the deployer to upload, got %d: %v", status, err)
+	}
+	if status, err := upload(strangerCertificate, strangerKey, 0); err != nil || status != gohttp.StatusUnauthorized {
+		t.Errorf("expected a client certificate without a token to be unauthorized, got %d: %v", status, err)
+	}
+	if status, err := upload(nil, nil, 0); err != nil || status != gohttp.StatusUnauthorized {
+		t.Errorf("expected a client without a certificate to be unauthorized, got %d: %v", status, err)
+	}
+	if _, err := upload(clientCertificate, clientKey, tls.VersionTLS12); err == nil {
+		t.Errorf("expected tls 1.2 to be refused")
+	}
+}
+
+// TestCertificateReloader tests that a changed certificate is read again, and
+// that a certificate that can't be read leaves the previous one in place.
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t)
+	first, firstKey := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "first"}})
+	certFile, keyFile := writePEM(t, dir, "server", first, firstKey)
+	reloader, err := newCertificateReloader(certFile, keyFile, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("unable to read the certificate: %v", err)
+	}
+	now := time.Now()
+	reloader.now = func() time.Time { return now }
+	served := func() string {
+		certificate, err := reloader.getCertificate(nil)
+		if err != nil {
+			t.Fatalf("unable to get the certificate: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			t.Fatalf("unable to parse the certificate: %v", err)
+		}
+		return leaf.Subject.CommonName
+	}
+
+	second, secondKey := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "second"}})
+	writePEM(t, dir, "server", second, secondKey)
+	os.Chtimes(certFile, now.Add(time.Minute), now.Add(time.Minute))
+	os.Chtimes(keyFile, now.Add(time.Minute), now.Add(time.Minute))
+	if name := served(); name != "first" {
+		t.Errorf("expected the certificate not to be checked again within a second, got %s", name)
+	}
+	now = now.Add(time.Second)
+	if name := served(); name != "second" {
+		t.Errorf("expected the renewed certificate, got %s", name)
+	}
+
+	// a certificate whose key hasn't been replaced yet
+	third, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "third"}})
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: third.Raw}), 0600)
+	os.Chtimes(certFile, now.Add(2*time.Minute), now.Add(2*time.Minute))
+	now = now.Add(time.Second)
+	if name := served(); name != "second" {
+		t.Errorf("expected the certificate last read to be kept, got %s", name)
+	}
+}
+
+// TestNewTLSConfig tests that invalid TLS options are refused.
+func TestNewTLSConfig(t *testing.T) {
+	config := core.NewConfig("AM_TEST_")
+	if tlsConfig, err := NewTLSConfig(config, core.DefaultLogger()); err != nil || tlsConfig != nil {
+		t.Errorf("expected no tls without a certificate, got %v, %v", tlsConfig, err)
+	}
+
+	config.TLSCertFile, config.TLSKeyFile = "server.crt", "server.key"
+	for _, change := range []func(){
+		func() { config.TLSMinVersion = "1.4" },
+		func() { config.TLSClientAuth = "sometimes" },
+		func() { config.TLSClientAuth = "require" },
+	} {
+		config.TLSMinVersion, config.TLSClientAuth = "1.2", ""
+		change()
+		if _, err := NewTLSConfig(config, core.DefaultLogger()); err == nil {
+			t.Errorf("expected an error with %+v", fmt.Sprint(config.TLSMinVersion, config.TLSClientAuth))
+		}
+	}
+}
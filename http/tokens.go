@@ -0,0 +1,281 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	gohttp "net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// The operations a token may be allowed to perform.
+const (
+	OperationUpload = "upload"
+	OperationRead   = "read"
+	OperationAdmin  = "admin"
+)
+
+// token is an API token, or a client certificate, read from the tokens file.
+type token struct {
+	// identifies the token in logs and responses, the token itself is never logged
+	Name string `json:"name"`
+	// the hex encoded SHA-256 hash of the token, optionally prefixed with "sha256:"
+	Hash string `json:"hash"`
+	// the common name or a subject alternative name of a client certificate,
+	// set instead of Hash to authorize clients by their certificate
+	Client string `json:"client"`
+	// the operations the token may perform
+	Operations []string `json:"operations"`
+	// the glob patterns, see path.Match, of the names the token may use, such
+	// as the name, src and dst of an upload
+	Paths []string `json:"paths"`
+}
+
+// allows returns true if the token may perform operation.
+func (t *token) allows(operation string) bool {
+	for _, allowed := range t.Operations {
+		if allowed == operation || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// matches returns true if name matches one of the paths of the token.
+func (t *token) matches(name string) bool {
+	for _, pattern := range t.Paths {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens authenticates requests with the bearer tokens in a file and
+// authorizes the operations they perform.
+//
+// The file is a JSON list of tokens, which are stored as their SHA-256 hash,
+// and of the clients authorized by their verified client certificate:
+//
+//	[
+//	  {"name": "ci", "hash": "sha256:9f86d0...", "operations": ["upload", "read"], "paths": ["myapp-*"]},
+//	  {"name": "ops", "hash": "sha256:60303a...", "operations": ["*"], "paths": ["*"]},
+//	  {"name": "deployer", "client": "spiffe://example.org/deployer", "operations": ["upload"], "paths": ["*"]}
+//	]
+//
+// The file is read again once it changes, a file that can't be read leaves
+// the tokens last read in place. The /healthz and /readyz probes are never
+// authenticated, so the orchestrators can call them without a token.
+type Tokens struct {
+	path   string
+	logger *core.Logger
+	mutex  *sync.Mutex
+	// the tokens keyed by their hash
+	tokens map[string]*token
+	// the client certificate tokens keyed by their client
+	clients map[string]*token
+	// when the file was last checked for changes, and its state then
+	checked time.Time
+	modTime time.Time
+	size    int64
+	// how often the file is checked for changes
+	checkInterval time.Duration
+	// returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// OpenTokens reads the tokens from the file at path, the file is read again
+// once it changes and the outcome is logged with logger.
+func OpenTokens(path string, logger *core.Logger) (*Tokens, error) {
+	t := Tokens{
+		path:          path,
+		logger:        logger,
+		mutex:         &sync.Mutex{},
+		checkInterval: time.Second,
+		now:           time.Now,
+	}
+	err := t.load(path)
+	if err != nil {
+		return nil, err
+	}
+	t.checked = t.now()
+	return &t, nil
+}
+
+// HashToken returns the hash a token is stored as in the tokens file.
+func HashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// load reads the tokens file at path, the tokens, and the path they are read
+// from, are only replaced if it is valid.
+func (t *Tokens) load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("unable to read the tokens: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("unable to read the tokens: %v", err)
+	}
+	var list []*token
+	if err = json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("unable to parse the tokens in %s: %v", path, err)
+	}
+
+	tokens := make(map[string]*token, len(list))
+	clients := make(map[string]*token)
+	for i, tok := range list {
+		if tok.Name == "" {
+			return fmt.Errorf("token %d in %s has no name", i, path)
+		}
+		if tok.Client != "" {
+			if tok.Hash != "" {
+				return fmt.Errorf("token %s in %s has both a hash and a client", tok.Name, path)
+			}
+			if _, ok := clients[tok.Client]; ok {
+				return fmt.Errorf("token %s in %s has the same client as another token", tok.Name, path)
+			}
+			if err = validateToken(tok); err != nil {
+				return fmt.Errorf("token %s in %s %v", tok.Name, path, err)
+			}
+			clients[tok.Client] = tok
+			continue
+		}
+		hash := strings.ToLower(strings.TrimPrefix(tok.Hash, "sha256:"))
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != sha256.Size {
+			return fmt.Errorf("the hash of token %s in %s is not a hex encoded sha-256 hash", tok.Name, path)
+		}
+		if _, ok := tokens[hash]; ok {
+			return fmt.Errorf("token %s in %s has the same hash as another token", tok.Name, path)
+		}
+		if err = validateToken(tok); err != nil {
+			return fmt.Errorf("token %s in %s %v", tok.Name, path, err)
+		}
+		tokens[hash] = tok
+	}
+
+	t.mutex.Lock()
+	t.path = path
+	t.tokens = tokens
+	t.clients = clients
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+	t.mutex.Unlock()
+	return nil
+}
+
+// validateToken checks the operations and paths of tok.
+func validateToken(tok *token) error {
+	for _, operation := range tok.Operations {
+		switch operation {
+		case OperationUpload, OperationRead, OperationAdmin, "*":
+		default:
+			return fmt.Errorf("has an unknown operation %s", operation)
+		}
+	}
+	for _, pattern := range tok.Paths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("has an invalid path %s: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// reloadIfChanged reads the tokens file again if it changed since it was
+// last read, it is checked at most once per check interval.
+func (t *Tokens) reloadIfChanged() {
+	t.mutex.Lock()
+	now := t.now()
+	if now.Sub(t.checked) < t.checkInterval {
+		t.mutex.Unlock()
+		return
+	}
+	t.checked = now
+	path, modTime, size := t.path, t.modTime, t.size
+	t.mutex.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.logger.Warnf("problem checking the tokens in %s, keeping the tokens last read: %v", path, err)
+		return
+	}
+	if info.ModTime().Equal(modTime) && info.Size() == size {
+		return
+	}
+	if err = t.load(path); err != nil {
+		t.logger.Warnf("problem reloading the tokens, keeping the tokens last read: %v", err)
+		return
+	}
+	t.logger.Infof("reloaded the tokens in %s", path)
+}
+
+// Reload reads the tokens from the file at path, which replaces the file they
+// were read from if it's valid. The tokens last read are kept otherwise.
+func (t *Tokens) Reload(path string) error {
+	return t.load(path)
+}
+
+// Authorize checks that r is sent with a verified client certificate, or a
+// bearer token, that may perform operation on every one of the names, which
+// are matched against the paths of the token. A client certificate that is
+// not in the tokens file doesn't authorize anything on its own.
+//
+// It returns the name of the token, or an error and the status, 401 or 403,
+// the request should be answered with.
+func (t *Tokens) Authorize(r *gohttp.Request, operation string, names ...string) (string, int, error) {
+	t.reloadIfChanged()
+
+	tok := t.clientToken(r)
+	if tok == nil {
+		header := r.Header.Get("Authorization")
+		if header == "" {
+			return "", gohttp.StatusUnauthorized, fmt.Errorf("a bearer token is required in the Authorization header")
+		}
+		if !strings.HasPrefix(header, "Bearer ") {
+			return "", gohttp.StatusUnauthorized, fmt.Errorf("the Authorization header must be a bearer token")
+		}
+		hash := strings.TrimPrefix(HashToken(strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))), "sha256:")
+		t.mutex.Lock()
+		tok = t.tokens[hash]
+		t.mutex.Unlock()
+		if tok == nil {
+			return "", gohttp.StatusUnauthorized, fmt.Errorf("the bearer token is not valid")
+		}
+	}
+
+	if !tok.allows(operation) {
+		return tok.Name, gohttp.StatusForbidden, fmt.Errorf("token %s may not %s", tok.Name, operation)
+	}
+	for _, name := range names {
+		if !tok.matches(name) {
+			return tok.Name, gohttp.StatusForbidden, fmt.Errorf("token %s may not %s %s", tok.Name, operation, name)
+		}
+	}
+	return tok.Name, gohttp.StatusOK, nil
+}
+
+// clientToken returns the token of the verified client certificate of r, or
+// nil if it has none or it isn't in the tokens file.
+func (t *Tokens) clientToken(r *gohttp.Request) *token {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, identity := range clientIdentities(r.TLS.VerifiedChains[0][0]) {
+		if tok, ok := t.clients[identity]; ok {
+			return tok
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package http
+
+import (
+	"fmt"
+	"io/ioutil"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"apex/artifact-manager/core"
+)
+
+// writeTokens writes a tokens file allowing the "ci" secret to upload the
+// paths matching pattern, and the "ops" secret to do anything.
+func writeTokens(t *testing.T, tokensFile, pattern string) {
+	data := fmt.Sprintf(`[
+		{"name": "ci", "hash": "%s", "operations": ["upload"], "paths": ["%s"]},
+		{"name": "ops", "hash": "%s", "operations": ["*"], "paths": ["*"]}
+	]`, HashToken("ci-secret"), pattern, HashToken("ops-secret"))
+	if err := ioutil.WriteFile(tokensFile, []byte(data), 0600); err != nil {
+		t.Fatalf("unable to write %s: %v", tokensFile, err)
+	}
+}
+
+// TestTokens_Authorize tests that tokens are only allowed their operations on
+// the paths matching their patterns.
+func TestTokens_Authorize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokensFile := path.Join(dir, "tokens.json")
+	writeTokens(t, tokensFile, "myapp-*")
+	tokens, err := OpenTokens(tokensFile, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("failed to open the tokens: %v", err)
+	}
+
+	tests := []struct {
+		header    string
+		operation string
+		names     []string
+		status    int
+	}{
+		{"", OperationUpload, []string{"myapp-1.tgz"}, 401},
+		{"Basic Y2k6c2VjcmV0", OperationUpload, []string{"myapp-1.tgz"}, 401},
+		{"Bearer wrong", OperationUpload, []string{"myapp-1.tgz"}, 401},
+		{"Bearer ci-secret", OperationUpload, []string{"myapp-1.tgz", "myapp-latest"}, 200},
+		{"Bearer ci-secret", OperationUpload, []string{"myapp-1.tgz", "otherapp-latest"}, 403},
+		{"Bearer ci-secret", OperationAdmin, nil, 403},
+		{"Bearer ops-secret", OperationAdmin, nil, 200},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(gohttp.MethodPost, "/", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		_, status, err := tokens.Authorize(req, test.operation, test.names...)
+		if status != test.status || (err == nil) != (status == 200) {
+			t.Errorf("expected %q to %s %v to get %d, got %d: %v", test.header, test.operation, test.names, test.status, status, err)
+		}
+	}
+}
+
+// TestTokens_Reload tests that a changed tokens file is read again, and that
+// an invalid one leaves the tokens last read in place.
+func TestTokens_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokensFile := path.Join(dir, "tokens.json")
+	writeTokens(t, tokensFile, "myapp-*")
+	tokens, err := OpenTokens(tokensFile, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("failed to open the tokens: %v", err)
+	}
+	now := time.Now()
+	tokens.now = func() time.Time { return now }
+	req := httptest.NewRequest(gohttp.MethodPost, "/", nil)
+	req.Header.Set("Authorization", "Bearer ci-secret")
+
+	writeTokens(t, tokensFile, "otherapp-*")
+	os.Chtimes(tokensFile, now.Add(time.Minute), now.Add(time.Minute))
+	if _, status, _ := tokens.Authorize(req, OperationUpload, "otherapp-latest"); status != 403 {
+		t.Errorf("expected the tokens not to be checked again within a second, got %d", status)
+	}
+	now = now.Add(time.Second)
+	if _, status, err := tokens.Authorize(req, OperationUpload, "otherapp-latest"); status != 200 {
+		t.Errorf("expected the changed tokens to be read, got %d: %v", status, err)
+	}
+
+	ioutil.WriteFile(tokensFile, []byte("not json"), 0600)
+	os.Chtimes(tokensFile, now.Add(2*time.Minute), now.Add(2*time.Minute))
+	now = now.Add(time.Second)
+	if _, status, err := tokens.Authorize(req, OperationUpload, "otherapp-latest"); status != 200 {
+		t.Errorf("expected the tokens last read to be kept, got %d: %v", status, err)
+	}
+
+	invalid := []string{
+		`[{"hash": "` + HashToken("a") + `"}]`,
+		`[{"name": "a", "hash": "plain"}]`,
+		`[{"name": "a", "hash": "` + HashToken("a") + `", "operations": ["rollback"]}]`,
+		`[{"name": "a", "hash": "` + HashToken("a") + `", "paths": ["["]}]`,
+		`[{"name": "a", "hash": "` + HashToken("a") + `"}, {"name": "b", "hash": "` + HashToken("a") + `"}]`,
+	}
+	for _, tokens := range invalid {
+		ioutil.WriteFile(tokensFile, []byte(tokens), 0600)
+		if _, err = OpenTokens(tokensFile, core.DefaultLogger()); err == nil {
+			t.Errorf("expected an error opening %s", tokens)
+		}
+	}
+}
+
+// TestTokens_ReloadPath tests that the tokens are read from the file they are
+// reloaded from, as long as it is valid.
+func TestTokens_ReloadPath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tokens")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokensFile := path.Join(dir, "tokens.json")
+	writeTokens(t, tokensFile, "myapp-*")
+	tokens, err := OpenTokens(tokensFile, core.DefaultLogger())
+	if err != nil {
+		t.Fatalf("failed to open the tokens: %v", err)
+	}
+	req := httptest.NewRequest(gohttp.MethodPost, "/", nil)
+	req.Header.Set("Authorization", "Bearer ci-secret")
+
+	otherFile := path.Join(dir, "other.json")
+	writeTokens(t, otherFile, "otherapp-*")
+	if err = tokens.Reload(otherFile); err != nil {
+		t.Fatalf("failed to reload the tokens: %v", err)
+	}
+	if _, status, err := tokens.Authorize(req, OperationUpload, "otherapp-latest"); status != 200 {
+		t.Errorf("expected the tokens in %s to be read, got %d: %v", otherFile, status, err)
+	}
+
+	if err = tokens.Reload(path.Join(dir, "missing.json")); err == nil {
+		t.Errorf("expected an error reloading a missing file")
+	}
+	if _, status, err := tokens.Authorize(req, OperationUpload, "otherapp-latest"); status != 200 {
+		t.Errorf("expected the tokens last read to be kept, got %d: %v", status, err)
+	}
+}
@@ -0,0 +1,48 @@
+package http
+
+import (
+	"fmt"
+	gohttp "net/http"
+
+	"apex/artifact-manager/core"
+)
+
+// traceparentHeader is the W3C trace context header the trace of a request is
+// continued from, if the client sent one.
+const traceparentHeader = "traceparent"
+
+// SetTracer sets the tracer the stages of each upload are traced with.
+func (h *Handler) SetTracer(tracer *core.Tracer) {
+	h.tracer = tracer
+}
+
+// startSpan starts the span of handling r, the child of the span in the
+// traceparent header of r if the client sent a valid one, and returns r with
+// the span in its context.
+func (h *Handler) startSpan(r *gohttp.Request, name string) (*gohttp.Request, *core.Span) {
+	ctx := r.Context()
+	if parent, err := core.ParseTraceparent(r.Header.Get(traceparentHeader)); err == nil {
+		ctx = core.ContextWithSpanContext(ctx, parent)
+	}
+	ctx, span := h.tracer.Start(ctx, name)
+	span.SetAttribute("request_id", requestID(r))
+	span.SetAttribute("http.method", r.Method)
+	return r.WithContext(ctx), span
+}
+
+// startStage starts the span of a stage of handling r, the child of the span
+// started by startSpan.
+func (h *Handler) startStage(r *gohttp.Request, name string) *core.Span {
+	_, span := h.tracer.Start(r.Context(), name)
+	return span
+}
+
+// endSpan ends the span of a request answered with status, which failed if
+// status is an error.
+func endSpan(span *core.Span, status int) {
+	span.SetAttribute("http.status_code", status)
+	if status >= 400 {
+		span.SetError(fmt.Errorf("answered with status %d", status))
+	}
+	span.End()
+}
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"apex/artifact-manager/core"
+)
+
+// TestUploadHandler_Tracing tests that the stages of an upload are traced as
+// children of the trace the client sent and that the update carries the span
+// of the upload.
+func TestUploadHandler_Tracing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := core.NewConfig("AM_TEST_")
+	config.Dir = dir
+	config.ExternalDir = dir
+	var buf bytes.Buffer
+	tracer := core.NewTracer(core.NewStdoutExporter(&buf), core.DefaultLogger())
+	requestQueue := make(chan core.Update, 10)
+	h := NewHandler(config, requestQueue, 10)
+	h.SetTracer(tracer)
+
+	req, err := createRequest("../_samples/x.tgz", "http://localhost/?name=x.tgz&src=x&dst=x-latest")
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	h.UploadHandler(rec, req)
+	if rec.Code != gohttp.StatusCreated {
+		t.Fatalf("expected status %d; got %d: %s", gohttp.StatusCreated, rec.Code, rec.Body.String())
+	}
+	if err = tracer.Close(); err != nil {
+		t.Fatalf("unable to close the tracer: %v", err)
+	}
+
+	spans := make(map[string]core.SpanData)
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var span core.SpanData
+		if err = decoder.Decode(&span); err != nil {
+			t.Fatalf("unable to decode the spans: %v", err)
+		}
+		spans[span.Name] = span
+	}
+	upload := spans["upload"]
+	if upload.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || upload.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("expected the upload to continue the trace of the client; got %+v", upload)
+	}
+	if upload.Attributes["http.status_code"] != float64(gohttp.StatusCreated) || upload.Attributes["request_id"] != rec.Header().Get(requestIDHeader) {
+		t.Errorf("expected the status and request id of the upload; got %v", upload.Attributes)
+	}
+	for _, stage := range []string{"save", "extract", "symlink"} {
+		if spans[stage].TraceID != upload.TraceID || spans[stage].ParentSpanID != upload.SpanID {
+			t.Errorf("expected a %s span as a child of the upload; got %+v", stage, spans[stage])
+		}
+	}
+	update := <-requestQueue
+	if update.TraceContext != (core.SpanContext{TraceID: upload.TraceID, SpanID: upload.SpanID}).Traceparent() {
+		t.Errorf("expected the update to carry the span of the upload; got %s", update.TraceContext)
+	}
+	if update.Queued.IsZero() {
+		t.Errorf("expected the update to carry the time it was queued")
+	}
+}
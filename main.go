@@ -1,62 +1,82 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
+	"flag"
 	"log"
 	"os"
-	"time"
+	"os/signal"
+	"syscall"
 
-	"apex/artifact-manager/artifacts"
 	"apex/artifact-manager/core"
-	"apex/artifact-manager/http"
+	"apex/artifact-manager/server"
 )
 
 func main() {
-	// TODO: add metrics, maybe record trace events
-	// TODO: Create go routine worker pool
-	// note: default < command line < env var
+	// note: default < config file < command line < env var
 
 	config := core.NewConfig("AM_")
-	err := config.Parse()
+	err := config.Parse(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
 	if err != nil {
-		core.Log("problem with application configuration. %v", err)
+		core.LogError("problem with application configuration. %v", err)
 		os.Exit(1)
 	}
 
-	// setup a logger for recording debug/verbose messages
-	debugWriter := ioutil.Discard
-	if config.Debug {
-		debugWriter = os.Stdout
+	// every message is logged as a leveled entry, including those of the log
+	// package, and the debug messages are only logged at the debug level
+	level, _ := core.ParseLevel(config.LogLevel)
+	logger, err := core.NewLogger(os.Stderr, config.LogFormat, level)
+	if err != nil {
+		core.LogError("problem creating the logger. %v", err)
+		os.Exit(1)
 	}
-	debugLogger := log.New(debugWriter, "DEBUG ", log.Flags())
+	core.SetDefaultLogger(logger)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(core.LevelInfo))
 
-	goMarathonDebugWriter := ioutil.Discard
-	if config.MarathonDebug {
-		goMarathonDebugWriter = os.Stdout
+	srv, err := server.New(config, server.WithLogger(logger))
+	if err != nil {
+		core.LogError("problem creating the server. %v", err)
+		os.Exit(1)
 	}
-
-	// create marathon client and artifacts service
-	marathonClient, err := artifacts.NewMarathonClient(nil, goMarathonDebugWriter, config.MarathonHosts)
+	err = srv.Start(context.Background())
 	if err != nil {
-		core.Log("problem creating marathon client. %v", err)
+		core.LogError("problem starting the server. %v", err)
 		os.Exit(1)
 	}
+	core.Log("Serving requests at %s", srv.Addr())
 
-	artifactsService := artifacts.NewArtifactsService(marathonClient, debugLogger)
-	go func() {
-		artifactsService.StartFetching(config.MarathonQueryInterval)
-	}()
-
-	requestQueue := make(chan string, 100)
-
-	go func() {
-		artifactsService.StartApplicationRestartProcessing(requestQueue, 5, 5*time.Second)
-	}()
-
-	// setup http server
-	core.Log("Serving requests at %s", config.ServeAddr())
+	// SIGHUP reloads the settings that can change without a restart
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if err = srv.Reload(); err != nil {
+					core.LogError("problem reloading the configuration, keeping the settings last read. %v", err)
+				}
+				continue
+			}
+			core.Log("received %s, shutting down", sig)
+			break wait
+		case err = <-srv.Failed():
+			core.LogError("server failed: %v", err)
+			break wait
+		}
+	}
 
-	handler := http.NewHandler(config, requestQueue, 100, debugLogger)
-	err = handler.ListenAndServe()
-	core.Log("server failed: %v", err)
+	// stop accepting requests and let the uploads in progress finish before
+	// flushing the restarts of everything that was uploaded
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	err = srv.Shutdown(shutdownCtx)
+	if err != nil {
+		core.LogWarn("problem shutting down: %v", err)
+	}
+	core.Log("shut down")
 }
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	gohttp "net/http"
+	"os"
+	"time"
+
+	"apex/artifact-manager/artifacts"
+	"apex/artifact-manager/core"
+)
+
+// orchestrator is an Orchestrator created from the configuration, along with
+// the interval the volumes are fetched from it with.
+type orchestrator struct {
+	artifacts.Orchestrator
+	fetchInterval time.Duration
+	// whether fetchInterval is marathon-query-interval, rather than the
+	// interval of the clusters in marathon-clusters-file
+	queryInterval bool
+	// runs the background work of the orchestrator, such as watching
+	// Kubernetes, until ctx is done, may be nil
+	run func(ctx context.Context)
+}
+
+// newOrchestrator creates the orchestrator selected by config, logging with
+// logger and writing its debug messages to debug.
+func newOrchestrator(config *core.Config, logger *core.Logger, debug *log.Logger) (*orchestrator, error) {
+	o := orchestrator{fetchInterval: config.MarathonQueryInterval, queryInterval: true}
+	switch config.Orchestrator {
+	case "kubernetes":
+		httpClient, err := artifacts.NewKubernetesHTTPClient(config.KubernetesCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("problem creating kubernetes client. %v", err)
+		}
+		kubernetes := artifacts.NewKubernetesOrchestrator(config.KubernetesURL, httpClient, debug)
+		kubernetes.SetTokenFile(config.KubernetesTokenFile)
+		kubernetes.SetNamespace(config.KubernetesNamespace)
+		kubernetes.SetLogger(logger)
+		o.Orchestrator = kubernetes
+		o.run = kubernetes.Run
+	case "nomad":
+		// blocking queries wait for minutes, so the client has no timeout
+		nomad := artifacts.NewNomadOrchestrator(config.NomadAddr, &gohttp.Client{}, debug)
+		nomad.SetToken(config.NomadToken)
+		nomad.SetNamespace(config.NomadNamespace)
+		nomad.SetPathPrefix(config.ExternalDir)
+		nomad.SetLogger(logger)
+		o.Orchestrator = nomad
+		o.run = nomad.Run
+	case "docker":
+		docker := artifacts.NewDockerOrchestrator(config.DockerSocket, debug)
+		docker.SetLabel(config.DockerLabel)
+		o.Orchestrator = docker
+	default:
+		var goMarathonDebugWriter io.Writer
+		if config.MarathonDebug {
+			goMarathonDebugWriter = os.Stdout
+		}
+		if len(config.MarathonClusters) == 0 {
+			return nil, fmt.Errorf("no marathon clusters are configured, the config has to be validated")
+		}
+		if len(config.MarathonClusters) == 1 && config.MarathonClusters[0].Name == "" {
+			marathon, err := artifacts.NewMarathonClusterOrchestrator(config.MarathonClusters[0], goMarathonDebugWriter, debug)
+			if err != nil {
+				return nil, fmt.Errorf("problem creating marathon client. %v", err)
+			}
+			marathon.SetLogger(logger)
+			o.Orchestrator = marathon
+			break
+		}
+
+		// the volumes are fetched from the clusters as often as the most
+		// frequently queried cluster is
+		clusters := artifacts.NewClustersOrchestrator(debug)
+		clusters.SetLogger(logger)
+		for i, cluster := range config.MarathonClusters {
+			marathon, err := artifacts.NewMarathonClusterOrchestrator(cluster, goMarathonDebugWriter, debug)
+			if err != nil {
+				return nil, fmt.Errorf("problem creating marathon client. %v", err)
+			}
+			marathon.SetLogger(logger)
+			err = clusters.AddCluster(cluster.Name, marathon, cluster.QueryInterval, cluster.TranslatePath)
+			if err != nil {
+				return nil, fmt.Errorf("problem adding marathon cluster. %v", err)
+			}
+			if i == 0 || cluster.QueryInterval < o.fetchInterval {
+				o.fetchInterval = cluster.QueryInterval
+			}
+		}
+		o.Orchestrator = clusters
+		o.queryInterval = false
+		o.run = clusters.Run
+	}
+	return &o, nil
+}
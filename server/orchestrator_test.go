@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"apex/artifact-manager/artifacts"
+	"apex/artifact-manager/core"
+)
+
+// TestNewOrchestrator tests that the orchestrator selected by the
+// configuration is created, and fetched from as often as configured.
+func TestNewOrchestrator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "orchestrator")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	clustersFile := path.Join(dir, "clusters.json")
+	err = ioutil.WriteFile(clustersFile, []byte(`[
+		{"name": "east", "hosts": "east:8080", "query_interval": "20s"},
+		{"name": "west", "hosts": "west:8080", "query_interval": "5s"}
+	]`), 0644)
+	if err != nil {
+		t.Fatalf("unable to write %s: %v", clustersFile, err)
+	}
+	clusters, err := core.LoadMarathonClusters(clustersFile, 10*time.Second)
+	if err != nil {
+		t.Fatalf("failed to load the clusters: %v", err)
+	}
+
+	tests := []struct {
+		orchestrator  string
+		clusters      []core.MarathonCluster
+		expected      artifacts.Orchestrator
+		fetchInterval time.Duration
+		queryInterval bool
+		run           bool
+	}{
+		{"marathon", []core.MarathonCluster{{Hosts: "localhost:8080", Scheme: "http", QueryInterval: 10 * time.Second}}, &artifacts.MarathonOrchestrator{}, 10 * time.Second, true, false},
+		{"marathon", clusters, &artifacts.ClustersOrchestrator{}, 5 * time.Second, false, true},
+		{"kubernetes", nil, &artifacts.KubernetesOrchestrator{}, 10 * time.Second, true, true},
+		{"nomad", nil, &artifacts.NomadOrchestrator{}, 10 * time.Second, true, true},
+		{"docker", nil, &artifacts.DockerOrchestrator{}, 10 * time.Second, true, false},
+	}
+	for _, test := range tests {
+		config := core.NewConfig("AM_SERVER_TEST_")
+		config.Orchestrator = test.orchestrator
+		config.MarathonClusters = test.clusters
+		config.KubernetesCAFile = ""
+		o, err := newOrchestrator(config, core.DefaultLogger(), log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			t.Errorf("%s: failed to create the orchestrator: %v", test.orchestrator, err)
+			continue
+		}
+		if typeName(o.Orchestrator) != typeName(test.expected) {
+			t.Errorf("%s: expected a %s; got a %s", test.orchestrator, typeName(test.expected), typeName(o.Orchestrator))
+		}
+		if o.fetchInterval != test.fetchInterval || o.queryInterval != test.queryInterval || (o.run != nil) != test.run {
+			t.Errorf("%s: expected to fetch every %s, following marathon-query-interval %v, with background work %v; got %s, %v and %v",
+				test.orchestrator, test.fetchInterval, test.queryInterval, test.run, o.fetchInterval, o.queryInterval, o.run != nil)
+		}
+	}
+
+	// an unvalidated configuration has no marathon clusters
+	if _, err = newOrchestrator(core.NewConfig("AM_SERVER_TEST_"), core.DefaultLogger(), log.New(ioutil.Discard, "", 0)); err == nil {
+		t.Errorf("expected an error creating marathon without clusters")
+	}
+}
+
+// typeName returns the name of the type of value.
+func typeName(value interface{}) string {
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,453 @@
+// Package server runs the artifact manager, it is used by the artifact-manager
+// command and can be embedded in other programs.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	gohttp "net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"apex/artifact-manager/artifacts"
+	"apex/artifact-manager/core"
+	"apex/artifact-manager/http"
+)
+
+// defaultQueueSize is the number of updates the request queue holds unless
+// WithQueueSize is used.
+const defaultQueueSize = 100
+
+// Server serves the HTTP API of the artifact manager and restarts the
+// applications depending on the files uploaded to it. Its ServeMux,
+// http.Server, ArtifactsService and request queue are its own, so that more
+// than one Server can run in a process.
+type Server struct {
+	config *core.Config
+	// the logger the requests and restarts are logged with, its level is set
+	// by log-level
+	logger *core.Logger
+	// writes the debug messages of the orchestrator and the ArtifactsService
+	// to logger
+	debug *log.Logger
+	// the orchestrator restarting the applications, and the interval the
+	// volumes are fetched from it with
+	orchestrator  artifacts.Orchestrator
+	fetchInterval time.Duration
+	// whether fetchInterval follows marathon-query-interval when it's reloaded
+	reloadInterval bool
+	// runs the background work of the orchestrator, may be nil
+	runOrchestrator func(ctx context.Context)
+	queueSize       int
+	// the listener requests are served on, created by Start if nil
+	listener net.Listener
+	metrics  *core.Registry
+	tracer   *core.Tracer
+	// whether the tracer was created by New, and is closed by Shutdown
+	ownTracer    bool
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	idleTimeout  time.Duration
+
+	// the journal and audit log, may be nil
+	journal *core.Journal
+	audit   *core.AuditLog
+	// the tokens requests are authorized with, may be nil
+	tokens       *http.Tokens
+	requestQueue chan core.Update
+	service      *artifacts.ArtifactsService
+	handler      *http.Handler
+	httpServer   *gohttp.Server
+
+	mutex *sync.Mutex
+	// cancels the context of the background work, nil until Start is called
+	cancel context.CancelFunc
+	// closed once the background work has stopped
+	done chan struct{}
+	// receives the error serving requests failed with
+	failed    chan error
+	closeOnce *sync.Once
+}
+
+// Option configures a Server created by New.
+type Option func(*Server)
+
+// WithLogger sets the logger the requests, the fetching of the volumes and
+// the restarts are logged with, and whose level is set when log-level is
+// reloaded. A logger of the Server's own, writing to stderr in log-format, is
+// used by default.
+func WithLogger(logger *core.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithOrchestrator sets the orchestrator restarting the applications, in
+// place of the one selected by the configuration, and the interval the
+// volumes are fetched from it with. Its background work, if any, has to be
+// run by the caller.
+func WithOrchestrator(orchestrator artifacts.Orchestrator, fetchInterval time.Duration) Option {
+	return func(s *Server) {
+		s.orchestrator = orchestrator
+		s.fetchInterval = fetchInterval
+	}
+}
+
+// WithQueueSize sets the number of updates the request queue holds, 100 by
+// default.
+func WithQueueSize(size int) Option {
+	return func(s *Server) {
+		s.queueSize = size
+	}
+}
+
+// WithListener sets the listener requests are served on, in place of
+// listening on the address of the configuration.
+func WithListener(listener net.Listener) Option {
+	return func(s *Server) {
+		s.listener = listener
+	}
+}
+
+// WithMetrics sets the registry the metrics are registered with, a registry
+// of the Server's own is used by default.
+func WithMetrics(registry *core.Registry) Option {
+	return func(s *Server) {
+		s.metrics = registry
+	}
+}
+
+// WithTracer sets the tracer the uploads and restarts are traced with, in
+// place of the one selected by the configuration. It isn't closed by
+// Shutdown.
+func WithTracer(tracer *core.Tracer) Option {
+	return func(s *Server) {
+		s.tracer = tracer
+	}
+}
+
+// WithReadTimeout sets the longest time reading a request may take,
+// http-read-timeout by default.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.readTimeout = timeout
+	}
+}
+
+// WithWriteTimeout sets the longest time handling a request and writing its
+// response may take, http-write-timeout by default.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.writeTimeout = timeout
+	}
+}
+
+// WithIdleTimeout sets how long an idle keep-alive connection is kept open,
+// http-idle-timeout by default.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.idleTimeout = timeout
+	}
+}
+
+// New creates a Server from config, which has to be parsed, or validated,
+// first. The journal and audit log are opened, but nothing is served until
+// Start is called.
+func New(config *core.Config, options ...Option) (*Server, error) {
+	s := Server{
+		config:       config,
+		queueSize:    defaultQueueSize,
+		readTimeout:  config.HTTPReadTimeout,
+		writeTimeout: config.HTTPWriteTimeout,
+		idleTimeout:  config.HTTPIdleTimeout,
+		mutex:        &sync.Mutex{},
+		done:         make(chan struct{}),
+		failed:       make(chan error, 1),
+		closeOnce:    &sync.Once{},
+	}
+	for _, option := range options {
+		option(&s)
+	}
+	if s.logger == nil {
+		level, _ := core.ParseLevel(config.LogLevel)
+		logger, err := core.NewLogger(os.Stderr, config.LogFormat, level)
+		if err != nil {
+			return nil, fmt.Errorf("problem creating the logger. %v", err)
+		}
+		s.logger = logger
+	}
+	s.debug = log.New(s.logger.Writer(core.LevelDebug), "", 0)
+	if s.orchestrator == nil {
+		o, err := newOrchestrator(config, s.logger, s.debug)
+		if err != nil {
+			return nil, err
+		}
+		s.orchestrator = o.Orchestrator
+		s.fetchInterval = o.fetchInterval
+		s.reloadInterval = o.queryInterval
+		s.runOrchestrator = o.run
+	}
+	if s.metrics == nil {
+		s.metrics = core.NewRegistry()
+	}
+
+	s.service = artifacts.NewArtifactsService(s.orchestrator, s.debug)
+	s.service.SetLogger(s.logger)
+	s.service.SetMetrics(s.metrics)
+	s.service.SetRestartLimits(artifacts.RestartLimits{
+		MaxInFlight:  config.RestartMaxInFlight,
+		MaxPerMinute: config.RestartMaxPerMinute,
+		Cooldown:     config.RestartCooldown,
+	})
+	s.service.SetRolloutPolicy(artifacts.RolloutPolicy{
+		CanarySize:    config.RolloutCanarySize,
+		SoakTime:      config.RolloutSoakTime,
+		HealthTimeout: config.RolloutHealthTimeout,
+		Rollback:      config.RolloutRollback,
+	})
+	s.requestQueue = make(chan core.Update, s.queueSize)
+	s.handler = http.NewHandler(config, s.requestQueue, s.queueSize)
+	s.handler.SetLogger(s.logger)
+	s.handler.SetMetrics(s.metrics)
+	s.handler.SetServiceStatus(s.service)
+
+	// updates are journaled so restarts that haven't happened survive a restart
+	var err error
+	if config.JournalPath() != "" {
+		s.journal, err = core.OpenJournal(config.JournalPath(), s.logger)
+		if err != nil {
+			return nil, fmt.Errorf("problem opening journal. %v", err)
+		}
+		s.service.SetJournal(s.journal)
+		s.handler.SetJournal(s.journal)
+	}
+
+	// uploads, rollbacks and restarts are recorded for later inspection
+	if config.AuditFile != "" {
+		s.audit, err = core.OpenAuditLog(config.AuditFile, int64(config.AuditMaxSize)*1024*1024, config.AuditMaxBackups, s.logger)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("problem opening audit log. %v", err)
+		}
+		s.service.SetAuditLog(s.audit)
+		s.handler.SetAuditLog(s.audit)
+	}
+
+	if config.TokensFile != "" {
+		s.tokens, err = http.OpenTokens(config.TokensFile, s.logger)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("problem reading tokens. %v", err)
+		}
+		s.handler.SetTokens(s.tokens)
+	} else {
+		s.logger.Warnf("no tokens-file is set, every request is allowed")
+	}
+
+	// the stages of the uploads and the restarts they cause are traced
+	if s.tracer == nil {
+		switch config.TraceExporter {
+		case "otlp":
+			s.tracer = core.NewTracer(core.NewOTLPExporter(config.TraceOTLPEndpoint, config.TraceServiceName), s.logger)
+		case "stdout":
+			s.tracer = core.NewTracer(core.NewStdoutExporter(os.Stdout), s.logger)
+		}
+		s.ownTracer = s.tracer != nil
+	}
+	if s.tracer != nil {
+		s.service.SetTracer(s.tracer)
+		s.handler.SetTracer(s.tracer)
+	}
+
+	s.httpServer = &gohttp.Server{
+		Handler:      s.handler.ServeMux(),
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+		IdleTimeout:  s.idleTimeout,
+	}
+	return &s, nil
+}
+
+// Start starts fetching the volumes, restarting the applications depending on
+// the updates and serving requests, over TLS if a certificate is configured.
+// It returns once requests are being served. The volumes are no longer
+// fetched once ctx is done, but requests are served until Shutdown is
+// called. Start can only be called once.
+func (s *Server) Start(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.cancel != nil {
+		return fmt.Errorf("the server is already started")
+	}
+
+	listener := s.listener
+	if listener == nil {
+		var err error
+		listener, err = net.Listen("tcp", s.config.ServeAddr())
+		if err != nil {
+			return err
+		}
+	}
+	tlsConfig, err := http.NewTLSConfig(s.config, s.logger)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	s.listener = listener
+
+	ctx, s.cancel = context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	if s.runOrchestrator != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runOrchestrator(ctx)
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.service.Run(ctx, s.requestQueue, s.fetchInterval, artifacts.BatchPolicy{
+			Size:        s.config.RestartBatchSize,
+			QuietPeriod: s.config.RestartQuietPeriod,
+			MaxWait:     s.config.RestartMaxWait,
+		})
+	}()
+	go func() {
+		wg.Wait()
+		close(s.done)
+	}()
+
+	go func() {
+		err := s.httpServer.Serve(listener)
+		if err != gohttp.ErrServerClosed {
+			s.failed <- err
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address requests are served on, nil until Start is called.
+func (s *Server) Addr() net.Addr {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Failed returns a channel receiving the error serving requests failed with,
+// nothing is received if Shutdown stopped serving them.
+func (s *Server) Failed() <-chan error {
+	return s.failed
+}
+
+// Shutdown stops accepting requests and waits for those in progress to
+// finish, then stops the ArtifactsService, which restarts the applications
+// depending on everything uploaded so far, and closes the journal, the audit
+// log and the tracer created by New. It gives up waiting once ctx is done, in
+// which case an error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	var problems []string
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		s.httpServer.Close()
+		problems = append(problems, fmt.Sprintf("gave up waiting for requests in progress to finish: %v", err))
+	}
+	if err := s.service.Stop(ctx); err != nil {
+		problems = append(problems, fmt.Sprintf("problem stopping the artifacts service: %v", err))
+	}
+
+	s.mutex.Lock()
+	cancel := s.cancel
+	s.mutex.Unlock()
+	if cancel != nil {
+		cancel()
+		select {
+		case <-s.done:
+		case <-ctx.Done():
+			problems = append(problems, fmt.Sprintf("gave up waiting for the orchestrator to stop: %v", ctx.Err()))
+		}
+	}
+
+	if err := s.close(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// close exports the spans of the tracer created by New, and closes it along
+// with the journal and the audit log. Only the first call has any effect.
+func (s *Server) close() error {
+	var problems []string
+	s.closeOnce.Do(func() {
+		if s.ownTracer {
+			if err := s.tracer.Close(); err != nil {
+				problems = append(problems, fmt.Sprintf("problem exporting spans: %v", err))
+			}
+		}
+		if s.audit != nil {
+			if err := s.audit.Close(); err != nil {
+				problems = append(problems, fmt.Sprintf("problem closing the audit log: %v", err))
+			}
+		}
+		if s.journal != nil {
+			if err := s.journal.Close(); err != nil {
+				problems = append(problems, fmt.Sprintf("problem closing the journal: %v", err))
+			}
+		}
+	})
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// Reload reads the reloadable settings of the configuration again, see
+// core.Config.Reload, and applies those that changed. The settings are left
+// unchanged if any of them isn't valid.
+func (s *Server) Reload() error {
+	changed, err := s.config.Reload()
+	if err != nil {
+		return err
+	}
+	for _, name := range changed {
+		switch name {
+		case "log-level":
+			level, _ := core.ParseLevel(s.config.LogLevel)
+			s.logger.SetLevel(level)
+		case "marathon-query-interval":
+			if !s.reloadInterval {
+				s.logger.Warnf("the interval the volumes are fetched with only changes with a restart")
+				continue
+			}
+			s.service.SetFetchInterval(s.config.MarathonQueryInterval)
+		case "tokens-file":
+			if s.tokens == nil || s.config.TokensFile == "" {
+				s.logger.Warnf("tokens-file can only be set or unset with a restart")
+				continue
+			}
+		}
+		s.logger.Infof("reloaded %s", name)
+	}
+
+	// the tokens are read again even if the file didn't change
+	if s.tokens != nil && s.config.TokensFile != "" {
+		if err = s.tokens.Reload(s.config.TokensFile); err != nil {
+			return fmt.Errorf("problem reloading the tokens, keeping the tokens last read. %v", err)
+		}
+		s.logger.Infof("reloaded the tokens in %s", s.config.TokensFile)
+	}
+	return nil
+}
@@ -0,0 +1,357 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	gohttp "net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"apex/artifact-manager/artifacts"
+	"apex/artifact-manager/core"
+	"apex/artifact-manager/http"
+)
+
+// fakeOrchestrator is an Orchestrator running a single workload, which
+// mounts paths, that records its restarts.
+type fakeOrchestrator struct {
+	mutex    *sync.Mutex
+	paths    []string
+	restarts []string
+}
+
+func newFakeOrchestrator(paths ...string) *fakeOrchestrator {
+	return &fakeOrchestrator{mutex: &sync.Mutex{}, paths: paths}
+}
+
+func (f *fakeOrchestrator) Workloads() ([]artifacts.Workload, error) {
+	return []artifacts.Workload{{ID: "/web", Paths: f.paths}}, nil
+}
+
+func (f *fakeOrchestrator) Restart(id string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.restarts = append(f.restarts, id)
+	return "", nil
+}
+
+func (f *fakeOrchestrator) restarted() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string{}, f.restarts...)
+}
+
+// newTestConfig returns a configuration managing dir and listening on a
+// random port of the loopback interface.
+func newTestConfig(dir string) *core.Config {
+	config := core.NewConfig("AM_SERVER_TEST_")
+	config.Addr = "127.0.0.1"
+	config.Port = 0
+	config.Dir = dir
+	config.ExternalDir = dir
+	return config
+}
+
+// upload uploads notes.txt to the server at addr with token, if any, and
+// returns the status it was answered with.
+func upload(t *testing.T, addr, token string) int {
+	req, err := gohttp.NewRequest(gohttp.MethodPost, "http://"+addr+"/?name=notes.txt", strings.NewReader("notes"))
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := gohttp.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("upload failed: %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// TestServer_Embedded tests that two servers run side by side, each serving
+// requests on its own ServeMux and restarting the applications of its own
+// orchestrator.
+func TestServer_Embedded(t *testing.T) {
+	servers := make([]*Server, 0, 2)
+	orchestrators := make([]*fakeOrchestrator, 0, 2)
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "server")
+		if err != nil {
+			t.Fatalf("unable to create temp dir: %v", err)
+		}
+		defer os.RemoveAll(dir)
+		orchestrator := newFakeOrchestrator(path.Join(dir, "notes.txt"))
+		s, err := New(newTestConfig(dir), WithOrchestrator(orchestrator, time.Hour), WithQueueSize(10))
+		if err != nil {
+			t.Fatalf("failed to create server %d: %v", i, err)
+		}
+		if err = s.Start(context.Background()); err != nil {
+			t.Fatalf("failed to start server %d: %v", i, err)
+		}
+		servers = append(servers, s)
+		orchestrators = append(orchestrators, orchestrator)
+	}
+	if servers[0].Addr().String() == servers[1].Addr().String() {
+		t.Fatalf("expected the servers to listen on different addresses; got %s", servers[0].Addr())
+	}
+
+	for i, s := range servers {
+		if status := upload(t, s.Addr().String(), ""); status != gohttp.StatusCreated {
+			t.Errorf("expected the upload to server %d to be answered with %d; got %d", i, gohttp.StatusCreated, status)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := s.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Errorf("failed to shut down server %d: %v", i, err)
+		}
+		if restarted := orchestrators[i].restarted(); !reflect.DeepEqual(restarted, []string{"/web"}) {
+			t.Errorf("expected server %d to restart /web once while shutting down; got %v", i, restarted)
+		}
+	}
+
+	// nothing is registered on the default ServeMux
+	_, pattern := gohttp.DefaultServeMux.Handler(httptest.NewRequest(gohttp.MethodGet, "/healthz", nil))
+	if pattern != "" {
+		t.Errorf("expected nothing to be registered on the default ServeMux; got %s", pattern)
+	}
+}
+
+// TestServer_ShutdownWaitsForUploads tests that shutting down lets an upload
+// in progress finish, and restarts the applications depending on it, while
+// new connections are refused.
+func TestServer_ShutdownWaitsForUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	orchestrator := newFakeOrchestrator(path.Join(dir, "shutdown-upload"))
+	s, err := New(newTestConfig(dir), WithOrchestrator(orchestrator, time.Hour), WithQueueSize(10))
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err = s.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	addr := s.Addr().String()
+
+	// start an upload whose body arrives slowly
+	body, bodyWriter := io.Pipe()
+	content := []byte("some content")
+	req, err := gohttp.NewRequest(gohttp.MethodPost, "http://"+addr+"/?name=shutdown-upload", body)
+	if err != nil {
+		t.Fatalf("could not create request: %v", err)
+	}
+	req.ContentLength = int64(len(content))
+	responses := make(chan *gohttp.Response, 1)
+	go func() {
+		resp, err := gohttp.DefaultClient.Do(req)
+		if err != nil {
+			t.Errorf("upload failed: %v", err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+	bodyWriter.Write(content[:4])
+	time.Sleep(50 * time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if _, err = net.Dial("tcp", addr); err == nil {
+		t.Errorf("expected new connections to be refused while shutting down")
+	}
+
+	bodyWriter.Write(content[4:])
+	bodyWriter.Close()
+
+	resp, ok := <-responses
+	if !ok {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != gohttp.StatusCreated {
+		t.Errorf("expected status %d; got %d", gohttp.StatusCreated, resp.StatusCode)
+	}
+	if err = <-shutdown; err != nil {
+		t.Errorf("failed to shut down: %v", err)
+	}
+	if restarted := orchestrator.restarted(); !reflect.DeepEqual(restarted, []string{"/web"}) {
+		t.Errorf("expected /web to be restarted for the upload while shutting down; got %v", restarted)
+	}
+}
+
+// TestServer_Options tests that the options override the configuration.
+func TestServer_Options(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	config := newTestConfig(dir)
+	config.JournalFile = ""
+
+	s, err := New(config, WithOrchestrator(newFakeOrchestrator(), time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create the server: %v", err)
+	}
+	if s.httpServer.ReadTimeout != config.HTTPReadTimeout || s.httpServer.WriteTimeout != config.HTTPWriteTimeout || s.httpServer.IdleTimeout != config.HTTPIdleTimeout {
+		t.Errorf("expected the timeouts of the configuration; got %s, %s and %s", s.httpServer.ReadTimeout, s.httpServer.WriteTimeout, s.httpServer.IdleTimeout)
+	}
+	if cap(s.requestQueue) != defaultQueueSize || s.Addr() != nil {
+		t.Errorf("expected a queue of %d updates and no address before starting; got %d and %v", defaultQueueSize, cap(s.requestQueue), s.Addr())
+	}
+
+	s, err = New(config, WithOrchestrator(newFakeOrchestrator(), time.Hour),
+		WithReadTimeout(time.Second), WithWriteTimeout(2*time.Second), WithIdleTimeout(3*time.Second),
+		WithQueueSize(5))
+	if err != nil {
+		t.Fatalf("failed to create the server: %v", err)
+	}
+	if s.httpServer.ReadTimeout != time.Second || s.httpServer.WriteTimeout != 2*time.Second || s.httpServer.IdleTimeout != 3*time.Second {
+		t.Errorf("expected the timeouts of the options; got %s, %s and %s", s.httpServer.ReadTimeout, s.httpServer.WriteTimeout, s.httpServer.IdleTimeout)
+	}
+	if cap(s.requestQueue) != 5 {
+		t.Errorf("expected a queue of 5 updates; got %d", cap(s.requestQueue))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Start(ctx); err != nil {
+		t.Fatalf("failed to start the server: %v", err)
+	}
+	if err = s.Start(ctx); err == nil {
+		t.Errorf("expected an error starting the server twice")
+	}
+	if err = s.Shutdown(ctx); err != nil {
+		t.Errorf("failed to shut down: %v", err)
+	}
+	if err = s.Shutdown(ctx); err != nil {
+		t.Errorf("failed to shut down a second time: %v", err)
+	}
+}
+
+// TestServer_Reload tests that the tokens are read from the tokens-file of
+// the reloaded configuration.
+func TestServer_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"old", "new"} {
+		data := fmt.Sprintf(`[{"name": "%s", "hash": "%s", "operations": ["*"], "paths": ["*"]}]`, name, http.HashToken(name+"-secret"))
+		if err = ioutil.WriteFile(path.Join(dir, name+".json"), []byte(data), 0600); err != nil {
+			t.Fatalf("unable to write the tokens: %v", err)
+		}
+	}
+	configFile := path.Join(dir, "config.yaml")
+	writeConfig := func(tokensFile string) {
+		data := fmt.Sprintf("tokens-file: %s\njournal-file: \"\"\n", path.Join(dir, tokensFile))
+		if err := ioutil.WriteFile(configFile, []byte(data), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", configFile, err)
+		}
+	}
+	writeConfig("old.json")
+
+	config := newTestConfig(dir)
+	if err = config.Parse([]string{"-config-file", configFile, "-dir", dir, "-addr", "127.0.0.1", "-port", "0"}); err != nil {
+		t.Fatalf("failed to parse the config: %v", err)
+	}
+	s, err := New(config, WithOrchestrator(newFakeOrchestrator(), time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create the server: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = s.Start(ctx); err != nil {
+		t.Fatalf("failed to start the server: %v", err)
+	}
+	defer s.Shutdown(ctx)
+
+	if status := upload(t, s.Addr().String(), "new-secret"); status != gohttp.StatusUnauthorized {
+		t.Errorf("expected the new token to be refused before reloading; got %d", status)
+	}
+	writeConfig("new.json")
+	if err = s.Reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if status := upload(t, s.Addr().String(), "new-secret"); status != gohttp.StatusCreated {
+		t.Errorf("expected the new token to be allowed once reloaded; got %d", status)
+	}
+
+	writeConfig("missing.json")
+	if err = s.Reload(); err == nil {
+		t.Errorf("expected an error reloading missing tokens")
+	}
+	if status := upload(t, s.Addr().String(), "new-secret"); status != gohttp.StatusCreated {
+		t.Errorf("expected the tokens last read to be kept; got %d", status)
+	}
+}
+
+// TestServer_ReloadLogLevel tests that reloading log-level sets the level of
+// the logger of the server, and leaves the default logger alone.
+func TestServer_ReloadLogLevel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := path.Join(dir, "config.yaml")
+	writeConfig := func(level string) {
+		data := fmt.Sprintf("log-level: %s\njournal-file: \"\"\n", level)
+		if err := ioutil.WriteFile(configFile, []byte(data), 0644); err != nil {
+			t.Fatalf("unable to write %s: %v", configFile, err)
+		}
+	}
+	writeConfig("info")
+
+	config := newTestConfig(dir)
+	if err = config.Parse([]string{"-config-file", configFile, "-dir", dir, "-addr", "127.0.0.1", "-port", "0"}); err != nil {
+		t.Fatalf("failed to parse the config: %v", err)
+	}
+	s, err := New(config, WithOrchestrator(newFakeOrchestrator(), time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create the server: %v", err)
+	}
+	if s.logger == core.DefaultLogger() || s.logger.Level() != core.LevelInfo {
+		t.Errorf("expected a logger of the server's own at the info level; got the default logger %t at %s", s.logger == core.DefaultLogger(), s.logger.Level())
+	}
+
+	logger, err := core.NewLogger(ioutil.Discard, "text", core.LevelInfo)
+	if err != nil {
+		t.Fatalf("failed to create the logger: %v", err)
+	}
+	s, err = New(config, WithOrchestrator(newFakeOrchestrator(), time.Hour), WithLogger(logger))
+	if err != nil {
+		t.Fatalf("failed to create the server: %v", err)
+	}
+	defaultLevel := core.DefaultLogger().Level()
+	writeConfig("error")
+	if err = s.Reload(); err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+	if logger.Level() != core.LevelError {
+		t.Errorf("expected the logger of the server to be set to error; got %s", logger.Level())
+	}
+	if core.DefaultLogger().Level() != defaultLevel {
+		t.Errorf("expected the default logger to stay at %s; got %s", defaultLevel, core.DefaultLogger().Level())
+	}
+}